@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/andrewchambers/sftpplease/extraio"
+	"github.com/andrewchambers/sftpplease/sftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// The first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// Serve a single sftp session on stdin and stdout, as run by
+// inetd or a systemd socket with Accept=yes.
+func serveStdin(newOpts func(string) *sftp.Options, fs vfs.VFS) {
+	// FileConn makes the socket non blocking, so stdin
+	// must not be used directly after this succeeds.
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		_ = os.Stdin.Close()
+		sftp.Serve(newOpts(conn.RemoteAddr().String()), fs, conn)
+		return
+	}
+	// Failing, FileConn may still have made stdin non blocking,
+	// so reading it would fail rather than wait for data.
+	_ = syscall.SetNonblock(int(os.Stdin.Fd()), false)
+	sftp.Serve(newOpts("stdin"), fs, &extraio.MergedReadWriteCloser{
+		WC: os.Stdout,
+		RC: os.Stdin,
+	})
+}
+
+// Serve sftp on the sockets passed by systemd socket activation,
+// accepting connections on listening sockets until they fail.
+func serveSystemd(newOpts func(string) *sftp.Options, fs vfs.VFS) error {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return fmt.Errorf("no sockets passed by systemd (LISTEN_PID not set to our pid)")
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return fmt.Errorf("no sockets passed by systemd (LISTEN_FDS not set)")
+	}
+
+	srv := &sftp.Server{
+		FS: fs,
+		ConnOptions: func(conn io.ReadWriteCloser) *sftp.Options {
+			return newOpts(conn.(net.Conn).RemoteAddr().String())
+		},
+	}
+	var wg sync.WaitGroup
+	for fd := listenFdsStart; fd < listenFdsStart+nfds; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+
+		if l, err := net.FileListener(f); err == nil {
+			_ = f.Close()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := srv.Serve(l)
+				log.Printf("accepting connection failed: %s", err)
+			}()
+			continue
+		}
+
+		conn, err := net.FileConn(f)
+		if err != nil {
+			return fmt.Errorf("passed file descriptor %d is not a socket: %s", fd, err)
+		}
+		_ = f.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = srv.ServeConn(conn)
+		}()
+	}
+
+	wg.Wait()
+	// Wait for the sessions still being served.
+	return srv.Shutdown(context.Background())
+}
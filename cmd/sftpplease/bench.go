@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/extraio"
+	"github.com/andrewchambers/sftpplease/sftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// The most the sftp client reads or writes in one request.
+const benchRequestSize = 32 * 1024
+
+type benchOptions struct {
+	// Where the files transferred are made, removed once done.
+	Dir      string
+	Files    int
+	FileSize int64
+	// Requests in flight at once, shared by all the files.
+	Parallel int
+}
+
+// Upload and download files through an sftp session serving fs over
+// a pipe, reporting the throughput and allocations of each, to measure
+// the server and file system without ssh or the network.
+func benchMain(fs vfs.VFS, opts *sftp.Options, bo benchOptions, out io.Writer) error {
+	if bo.Files < 1 || bo.FileSize < 1 || bo.Parallel < 1 {
+		return fmt.Errorf("-bench-files, -bench-file-size and -bench-parallel must be positive")
+	}
+	defer fs.Close()
+
+	serverR, clientW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	clientR, serverW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		sftp.Serve(opts, fs, &extraio.MergedReadWriteCloser{RC: serverR, WC: serverW})
+	}()
+
+	c, err := sftp.NewClient(&extraio.MergedReadWriteCloser{RC: clientR, WC: clientW})
+	if err != nil {
+		return err
+	}
+	// The session ends once the client disconnects.
+	defer func() {
+		_ = c.Close()
+		<-served
+	}()
+
+	err = c.Mkdir(bo.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", bo.Dir, err)
+	}
+	var names []string
+	for i := 0; i < bo.Files; i++ {
+		names = append(names, path.Join(bo.Dir, strconv.Itoa(i)))
+	}
+	defer func() {
+		for _, name := range names {
+			_ = c.Remove(name)
+		}
+		_ = c.Remove(bo.Dir)
+	}()
+
+	err = benchTransfer(c, names, bo, "upload", out)
+	if err != nil {
+		return err
+	}
+	return benchTransfer(c, names, bo, "download", out)
+}
+
+// Transfer every file in requests split between bo.Parallel workers,
+// then report the results to out.
+func benchTransfer(c *sftp.Client, names []string, bo benchOptions, op string, out io.Writer) error {
+	flags := os.O_RDONLY
+	if op == "upload" {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	var files []vfs.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, name := range names {
+		f, err := c.OpenFile(name, flags, 0644)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	perFile := (bo.FileSize + benchRequestSize - 1) / benchRequestSize
+	requests := perFile * int64(len(files))
+	var next int64
+	var lock sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < bo.Parallel; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			buf := make([]byte, benchRequestSize)
+			_, _ = rand.New(rand.NewSource(seed)).Read(buf)
+			for {
+				req := atomic.AddInt64(&next, 1) - 1
+				if req >= requests {
+					return
+				}
+				f := files[req/perFile]
+				off := (req % perFile) * benchRequestSize
+				n := bo.FileSize - off
+				if n > benchRequestSize {
+					n = benchRequestSize
+				}
+				var err error
+				if op == "upload" {
+					_, err = f.WriteAt(buf[:n], off)
+				} else {
+					_, err = f.ReadAt(buf[:n], off)
+				}
+				if err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("%s of %s failed: %w", op, f.Name(), err)
+					}
+					lock.Unlock()
+					atomic.StoreInt64(&next, requests)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	if firstErr != nil {
+		return firstErr
+	}
+
+	total := bo.FileSize * int64(len(files))
+	_, err := fmt.Fprintf(out, "%-9s %d files, %.1f MiB in %s, %.1f MiB/s, %d requests, %.1f allocations and %.0f bytes allocated per request\n",
+		op+":", len(files), float64(total)/(1<<20), elapsed.Round(time.Millisecond),
+		float64(total)/(1<<20)/elapsed.Seconds(), requests,
+		float64(after.Mallocs-before.Mallocs)/float64(requests),
+		float64(after.TotalAlloc-before.TotalAlloc)/float64(requests))
+	return err
+}
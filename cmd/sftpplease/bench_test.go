@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/sftp"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestBench(t *testing.T) {
+	fs := mem.New()
+	var out bytes.Buffer
+	opts := &sftp.Options{Logger: sftp.LogFunc(func(string, ...interface{}) {})}
+	err := benchMain(fs, opts, benchOptions{Dir: "/bench", Files: 2, FileSize: 100001, Parallel: 3}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "upload:   2 files") || !strings.HasPrefix(lines[1], "download: 2 files") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	if !strings.Contains(lines[0], " 8 requests") {
+		t.Fatalf("expected 8 requests of 32KiB:\n%s", out.String())
+	}
+	if _, err := fs.Stat("/bench"); err == nil {
+		t.Fatal("expected the files transferred to be removed")
+	}
+}
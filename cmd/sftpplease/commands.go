@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/andrewchambers/sftpplease/cmd/sftpplease/rsync"
+	"github.com/andrewchambers/sftpplease/cmd/sftpplease/scp"
+)
+
+// Check the command requested over ssh is in the allowed list, and
+// that its arguments are ones the command is known to accept.
+func validateCommand(args []string, allowed []string) error {
+	name := path.Base(args[0])
+
+	isAllowed := false
+	for _, a := range allowed {
+		if a == name {
+			isAllowed = true
+		}
+	}
+	if !isAllowed {
+		return fmt.Errorf("command not allowed: %s", name)
+	}
+
+	for _, arg := range args[1:] {
+		for _, c := range arg {
+			if c < ' ' || c == 0x7f {
+				return fmt.Errorf("%s: argument contains control characters: %q", name, arg)
+			}
+		}
+	}
+
+	switch name {
+	case "sftp-server":
+		return validateSftpServerArgs(args[1:])
+	case "scp":
+		return validateScpArgs(args[1:])
+	case "rsync":
+		_, err := rsync.ParseArgs(args[1:])
+		return err
+	}
+	return nil
+}
+
+// Flags of the OpenSSH sftp-server an sshd subsystem line may pass,
+// mapped to whether they take a value. They only affect logging and
+// help, so they are accepted and ignored.
+var sftpServerFlags = map[string]bool{
+	"-e": false,
+	"-h": false,
+	"-f": true,
+	"-l": true,
+}
+
+// Flags of the OpenSSH sftp-server that restrict or change what clients
+// may do. Ignoring them would quietly serve a session the operator did
+// not intend, so they are refused in favour of the sftpplease flags.
+var sftpServerRefusedFlags = map[string]string{
+	"-R": "-read-only",
+	"-P": "-deny",
+	"-p": "-deny",
+	"-u": "-umask",
+	"-d": "-home",
+}
+
+func validateSftpServerArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		if instead, ok := sftpServerRefusedFlags[args[i]]; ok {
+			return fmt.Errorf("sftp-server: flag %s is not supported, use the sftpplease flag %s instead", args[i], instead)
+		}
+		hasValue, ok := sftpServerFlags[args[i]]
+		if !ok {
+			return fmt.Errorf("sftp-server: unexpected argument: %q", args[i])
+		}
+		if hasValue {
+			i++
+			if i == len(args) {
+				return fmt.Errorf("sftp-server: flag %s needs a value", args[i-1])
+			}
+		}
+	}
+	return nil
+}
+
+// The flags scp clients pass to the remote scp.
+func validateScpArgs(args []string) error {
+	a, err := scp.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	return a.Validate()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCommand(t *testing.T) {
+	allowed := []string{"sftp-server", "scp", "rsync"}
+	for _, tc := range []struct {
+		args []string
+		// A substring of the error expected, empty for none.
+		err string
+	}{
+		{[]string{"sftp-server"}, ""},
+		{[]string{"/usr/lib/openssh/sftp-server"}, ""},
+		{[]string{"internal-sftp"}, "command not allowed"},
+		{[]string{"sh", "-c", "id"}, "command not allowed"},
+		{[]string{"rsync", "--server", "--sender", "-logDtpre.iLsfxC", ".", "dir/"}, ""},
+		{[]string{"rsync", "--server", "-logDtpre.iLsfxC", ".", "dir/"}, "uploads are not supported"},
+		{[]string{"rsync", "--server", "--sender", "-rz", ".", "dir/"}, "option -z is not supported"},
+		{[]string{"sftp-server", "-e", "-l", "VERBOSE", "-f", "AUTH"}, ""},
+		{[]string{"sftp-server", "-h"}, ""},
+		{[]string{"sftp-server", "-l"}, "needs a value"},
+		{[]string{"sftp-server", "-R"}, "use the sftpplease flag -read-only"},
+		{[]string{"sftp-server", "-P", "remove"}, "use the sftpplease flag -deny"},
+		{[]string{"sftp-server", "-p", "open,close"}, "use the sftpplease flag -deny"},
+		{[]string{"sftp-server", "-u", "077"}, "use the sftpplease flag -umask"},
+		{[]string{"sftp-server", "-d", "/home/%u"}, "use the sftpplease flag -home"},
+		{[]string{"sftp-server", "-x"}, "unexpected argument"},
+		{[]string{"sftp-server", "-l", "bad\nvalue"}, "control characters"},
+		{[]string{"scp", "-t", "/dir"}, ""},
+		{[]string{"scp", "-r", "-f", "a", "b"}, ""},
+		{[]string{"scp", "-t", "a", "b"}, "one target path"},
+		{[]string{"scp", "-z", "-t", "/dir"}, "unexpected flag"},
+		{[]string{"scp", "/dir"}, "exactly one of -f or -t"},
+	} {
+		err := validateCommand(tc.args, allowed)
+
+		if tc.err == "" && err != nil {
+			t.Fatalf("%q: %s", tc.args, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Fatalf("%q: expected an error containing %q, got %v", tc.args, tc.err, err)
+		}
+	}
+
+	err := validateCommand([]string{"rsync", "--server", "--sender", "-r", ".", "dir"}, []string{"sftp-server", "scp"})
+	if err == nil || !strings.Contains(err.Error(), "command not allowed") {
+		t.Fatalf("expected rsync to be refused unless allowed, got %v", err)
+	}
+}
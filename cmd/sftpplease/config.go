@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Load a TOML config file. Top level keys are named after the
+// command line flags, and set any flag not given on the command line.
+// Options in a [users.NAME] table override the top level options
+// when serving that user:
+//
+//	vfs = "dropbox:TOKEN"
+//	read-only = true
+//	max-files = 32
+//	log-file = "/var/log/sftpplease.log"
+//
+//	[users.alice]
+//	vfs = "local"
+//	read-only = false
+func loadConfig(fpath string, fset *flag.FlagSet) error {
+	cfg := make(map[string]interface{})
+	_, err := toml.DecodeFile(fpath, &cfg)
+	if err != nil {
+		return fmt.Errorf("error loading config %s: %s", fpath, err)
+	}
+
+	explicit := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	users, ok := cfg["users"]
+	delete(cfg, "users")
+
+	err = applyConfig(cfg, fset, explicit)
+	if err != nil {
+		return fmt.Errorf("error loading config %s: %s", fpath, err)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	userTables, ok := users.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("error loading config %s: 'users' must be a table", fpath)
+	}
+
+	userName, err := currentUser(fset.Lookup("user-env").Value.String())
+	if err != nil {
+		return err
+	}
+
+	userCfg, ok := userTables[userName]
+	if !ok {
+		return nil
+	}
+
+	userTable, ok := userCfg.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("error loading config %s: 'users.%s' must be a table", fpath, userName)
+	}
+
+	if _, ok := userTable["user-env"]; ok {
+		return fmt.Errorf("error loading config %s: users.%s: 'user-env' must be set at the top level", fpath, userName)
+	}
+
+	err = applyConfig(userTable, fset, explicit)
+	if err != nil {
+		return fmt.Errorf("error loading config %s: users.%s: %s", fpath, userName, err)
+	}
+
+	return nil
+}
+
+func applyConfig(cfg map[string]interface{}, fset *flag.FlagSet, explicit map[string]bool) error {
+	for k, v := range cfg {
+		if k == "config" || fset.Lookup(k) == nil {
+			return fmt.Errorf("unknown option '%s'", k)
+		}
+		if explicit[k] {
+			continue
+		}
+		switch v.(type) {
+		case string, bool, int64, float64:
+		default:
+			return fmt.Errorf("bad value for option '%s'", k)
+		}
+		if _, isMode := fset.Lookup(k).Value.(*modeFlag); isMode {
+			if _, isString := v.(string); !isString {
+				return fmt.Errorf("option '%s' must be an octal string, e.g. \"0644\"", k)
+			}
+		}
+		err := fset.Set(k, fmt.Sprint(v))
+		if err != nil {
+			return fmt.Errorf("bad value for option '%s': %s", k, err)
+		}
+	}
+	return nil
+}
+
+// The user being served, the user sshd is running us as unless
+// the environment variable userEnv is given and set. Only an
+// explicitly given userEnv is trusted, ssh clients can set
+// environment variables sshd accepts.
+func currentUser(userEnv string) (string, error) {
+	if userEnv != "" {
+		if name := os.Getenv(userEnv); name != "" {
+			return name, nil
+		}
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("error looking up current user: %s", err)
+	}
+	return u.Username, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os/user"
+	"testing"
+)
+
+func TestCurrentUser(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Setenv("SFTPPLEASE_USER", "mallory")
+	t.Setenv("SFTPPLEASE_TEST_USER", "alice")
+
+	for _, tc := range []struct {
+		userEnv string
+		expect  string
+	}{
+		// The environment, including the old default variable,
+		// is ignored unless asked for.
+		{"", u.Username},
+		{"SFTPPLEASE_TEST_USER", "alice"},
+		{"SFTPPLEASE_TEST_UNSET", u.Username},
+	} {
+		name, err := currentUser(tc.userEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != tc.expect {
+			t.Fatalf("user env %q: expected %q, got %q", tc.userEnv, tc.expect, name)
+		}
+	}
+}
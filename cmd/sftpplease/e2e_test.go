@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/extraio"
+	"github.com/andrewchambers/sftpplease/sftp"
+)
+
+// End to end tests run this test binary as sftpplease, serving a
+// temporary local directory, and drive it with the Go client and the
+// OpenSSH sftp and scp clients when they are installed.
+
+func TestMain(m *testing.M) {
+	if os.Getenv("SFTPPLEASE_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type e2e struct {
+	t *testing.T
+	// Scratch space for the clients, the directory served is root.
+	dir  string
+	root string
+	bin  string
+}
+
+func newE2E(t *testing.T) *e2e {
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &e2e{t: t, dir: dir, root: filepath.Join(dir, "root"), bin: bin}
+	if err := os.Mkdir(e.root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func (e *e2e) Close() {
+	_ = os.RemoveAll(e.dir)
+}
+
+// A command running sftpplease on the directory served.
+func (e *e2e) server(args ...string) *exec.Cmd {
+	cmd := exec.Command(e.bin, append([]string{"-vfs", "local:" + e.root}, args...)...)
+	cmd.Env = append(os.Environ(), "SFTPPLEASE_TEST_MAIN=1")
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// Write an executable script to the scratch directory.
+func (e *e2e) script(name string, body string) string {
+	p := filepath.Join(e.dir, name)
+	body = fmt.Sprintf("#!/bin/sh\nexport SFTPPLEASE_TEST_MAIN=1\n%s\n", body)
+	if err := ioutil.WriteFile(p, []byte(body), 0755); err != nil {
+		e.t.Fatal(err)
+	}
+	return p
+}
+
+// A script serving sftp on stdin, for sftp -D.
+func (e *e2e) sftpServer() string {
+	return e.script("sftp-server", fmt.Sprintf("exec '%s' -vfs 'local:%s' -serve stdin", e.bin, e.root))
+}
+
+// A script standing in for ssh, for scp -S. It runs the remote command
+// like the forced command of an authorized key, and subsystem requests
+// for sftp as sftp-server.
+func (e *e2e) ssh() string {
+	return e.script("ssh", fmt.Sprintf(`for cmd; do :; done
+if [ "$cmd" = sftp ]; then
+	cmd=sftp-server
+fi
+SSH_ORIGINAL_COMMAND="$cmd" exec '%s' -vfs 'local:%s'`, e.bin, e.root))
+}
+
+// Run a client in the scratch directory, returning its output.
+func (e *e2e) run(name string, args ...string) string {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = e.dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		e.t.Fatalf("%s %s: %s\n%s", name, strings.Join(args, " "), err, stderr.String())
+	}
+	return string(out)
+}
+
+// Create a tree of files to copy under the scratch directory, with
+// sizes around the lengths of sftp reads and writes.
+func (e *e2e) makeTree(name string) string {
+	rng := rand.New(rand.NewSource(1))
+	files := map[string]int{
+		"empty":           0,
+		"small.txt":       13,
+		"a b.dat":         32 * 1024,
+		"sub/big":         1024*1024 + 7,
+		"sub/deeper/odd":  255*1024 + 1,
+		"sub/empty/.keep": 0,
+	}
+	top := filepath.Join(e.dir, name)
+	for p, size := range files {
+		p = filepath.Join(top, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			e.t.Fatal(err)
+		}
+		data := make([]byte, size)
+		_, _ = rng.Read(data)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			e.t.Fatal(err)
+		}
+	}
+	return top
+}
+
+// Fail unless the trees at a and b hold the same files and directories
+// with the same contents.
+func compareTrees(t *testing.T, a string, b string) {
+	listA, listB := listTree(t, a), listTree(t, b)
+	if strings.Join(listA, "\n") != strings.Join(listB, "\n") {
+		t.Fatalf("%s holds:\n%s\nbut %s holds:\n%s", a, strings.Join(listA, "\n"), b, strings.Join(listB, "\n"))
+	}
+	for _, p := range listA {
+		if strings.HasSuffix(p, "/") {
+			continue
+		}
+		dataA, err := ioutil.ReadFile(filepath.Join(a, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataB, err := ioutil.ReadFile(filepath.Join(b, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dataA, dataB) {
+			t.Fatalf("%s differs between %s and %s", p, a, b)
+		}
+	}
+}
+
+// The sorted relative paths under top, directories ending in a slash.
+func listTree(t *testing.T, top string) []string {
+	var paths []string
+	err := filepath.Walk(top, func(p string, st os.FileInfo, err error) error {
+		if err != nil || p == top {
+			return err
+		}
+		rel, err := filepath.Rel(top, p)
+		if err != nil {
+			return err
+		}
+		if st.IsDir() {
+			rel += "/"
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestE2EClient(t *testing.T) {
+	e := newE2E(t)
+	defer e.Close()
+
+	cmd := e.server("-serve", "stdin")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	c, err := sftp.NewClient(&extraio.MergedReadWriteCloser{WC: stdin, RC: stdout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := make([]byte, 3*1024*1024+11)
+	_, _ = rand.New(rand.NewSource(1)).Read(data)
+	if err := c.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.OpenFile("/dir/a", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(e.root, "dir/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Fatal("uploaded file differs")
+	}
+
+	if err := c.Rename("/dir/a", "/dir/b"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = c.Open("/dir/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := ioutil.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Fatal("downloaded file differs")
+	}
+
+	d, err := c.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := d.Readdir(-1)
+	_ = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "b" || entries[0].Size() != int64(len(data)) {
+		t.Fatalf("unexpected listing %v", entries)
+	}
+}
+
+func TestE2ESftp(t *testing.T) {
+	if _, err := exec.LookPath("sftp"); err != nil {
+		t.Skip("sftp not installed")
+	}
+	e := newE2E(t)
+	defer e.Close()
+	src := e.makeTree("src")
+
+	batch := filepath.Join(e.dir, "batch")
+	err := ioutil.WriteFile(batch, []byte(strings.Join([]string{
+		"put -r src up",
+		"get -r up down",
+		"put src/small.txt up/copy.txt",
+		"rename up/copy.txt up/renamed.txt",
+		"ls -1 up",
+		"rm up/renamed.txt",
+	}, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := e.run("sftp", "-q", "-b", batch, "-D", e.sftpServer())
+
+	compareTrees(t, src, filepath.Join(e.root, "up"))
+	compareTrees(t, src, filepath.Join(e.dir, "down"))
+
+	var listing []string
+	for _, line := range strings.Split(out, "\n") {
+		// Progress and the commands run are also output.
+		if strings.HasPrefix(line, "up/") {
+			listing = append(listing, line)
+		}
+	}
+	expected := []string{"up/a b.dat", "up/empty", "up/renamed.txt", "up/small.txt", "up/sub"}
+	if strings.Join(listing, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("listed:\n%s\nexpected:\n%s", strings.Join(listing, "\n"), strings.Join(expected, "\n"))
+	}
+	if _, err := os.Stat(filepath.Join(e.root, "up/renamed.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected the renamed file to be removed")
+	}
+}
+
+func TestE2EScp(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not installed")
+	}
+	for _, mode := range []struct {
+		name string
+		args []string
+	}{
+		{"scp protocol", []string{"-O"}},
+		{"sftp protocol", nil},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			e := newE2E(t)
+			defer e.Close()
+			src := e.makeTree("src")
+			scp := func(args ...string) {
+				e.run("scp", append(append([]string{"-q", "-S", e.ssh()}, mode.args...), args...)...)
+			}
+
+			scp("-r", "src", "e2e:/up")
+			compareTrees(t, src, filepath.Join(e.root, "up"))
+			scp("-r", "e2e:/up", "down")
+			compareTrees(t, src, filepath.Join(e.dir, "down"))
+
+			scp("src/a b.dat", "e2e:/single")
+			scp("e2e:/single", "single")
+			for _, p := range []string{filepath.Join(e.root, "single"), filepath.Join(e.dir, "single")} {
+				data, err := ioutil.ReadFile(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := ioutil.ReadFile(filepath.Join(src, "a b.dat"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, expected) {
+					t.Fatalf("%s differs", p)
+				}
+			}
+		})
+	}
+}
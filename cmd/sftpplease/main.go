@@ -1,21 +1,42 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 
+	"github.com/andrewchambers/sftpplease/cmd/sftpplease/rsync"
 	"github.com/andrewchambers/sftpplease/cmd/sftpplease/scp"
 	"github.com/andrewchambers/sftpplease/extraio"
 	"github.com/andrewchambers/sftpplease/sftp"
+	"github.com/andrewchambers/sftpplease/version"
 	"github.com/andrewchambers/sftpplease/vfs"
 	"github.com/anmitsu/go-shlex"
 
 	_ "github.com/andrewchambers/sftpplease/extradbx/dbxfs"
 	_ "github.com/andrewchambers/sftpplease/vfs/local"
+	_ "github.com/andrewchambers/sftpplease/vfs/megafs"
+	_ "github.com/andrewchambers/sftpplease/vfs/mem"
+	_ "github.com/andrewchambers/sftpplease/vfs/onedrive"
+	_ "github.com/andrewchambers/sftpplease/vfs/pluginfs"
+	_ "github.com/andrewchambers/sftpplease/vfs/rclonefs"
+	_ "github.com/andrewchambers/sftpplease/vfs/s3fs"
+	_ "github.com/andrewchambers/sftpplease/vfs/sftpfs"
+	_ "github.com/andrewchambers/sftpplease/vfs/smbfs"
+	_ "github.com/andrewchambers/sftpplease/vfs/sqlitefs"
+	_ "github.com/andrewchambers/sftpplease/vfs/storjfs"
+	_ "github.com/andrewchambers/sftpplease/vfs/tarfs"
+	_ "github.com/andrewchambers/sftpplease/vfs/webdav"
 )
 
 func parseVFS(s string) (string, string) {
@@ -26,31 +47,221 @@ func parseVFS(s string) (string, string) {
 	return s[0:idx], s[idx+1:]
 }
 
+// Read the passphrase of an encrypted file system from passphraseFile,
+// or the environment if it is not set.
+func encryptPassphrase(passphraseFile string) ([]byte, error) {
+	if passphraseFile == "" {
+		passphrase := os.Getenv("SFTPPLEASE_ENCRYPT_PASSPHRASE")
+		if passphrase == "" {
+			return nil, fmt.Errorf("encrypted vfs needs -encrypt-passphrase-file or SFTPPLEASE_ENCRYPT_PASSPHRASE")
+		}
+		return []byte(passphrase), nil
+	}
+	passphrase, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(passphrase, "\r\n"), nil
+}
+
+// A flag.Value for permission bits, written in octal.
+type modeFlag os.FileMode
+
+func (m *modeFlag) String() string {
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *modeFlag) Set(s string) error {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0o"), 8, 32)
+	if err != nil {
+		return err
+	}
+	if v&^0777 != 0 {
+		return fmt.Errorf("mode %s has bits other than permissions set", s)
+	}
+	*m = modeFlag(v)
+	return nil
+}
+
+// Identify this ssh session for audit records by
+// user, client address and process id.
+func sessionID(userEnv string) string {
+	userName, err := currentUser(userEnv)
+	if err != nil {
+		userName = "?"
+	}
+	client := "?"
+	// SSH_CONNECTION is "client_ip client_port server_ip server_port".
+	if conn := strings.Fields(os.Getenv("SSH_CONNECTION")); len(conn) >= 2 {
+		client = net.JoinHostPort(conn[0], conn[1])
+	}
+	return fmt.Sprintf("%s@%s[%d]", userName, client, os.Getpid())
+}
+
+// Split a comma separated flag value, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Where -scp-stats reports go, 'log' for the log
+// or 'fd:N' for a descriptor inherited from the parent.
+func statsWriter(dest string) (io.Writer, error) {
+	if dest == "log" {
+		return log.Writer(), nil
+	}
+	if !strings.HasPrefix(dest, "fd:") {
+		return nil, fmt.Errorf("unknown destination '%s', expected 'log' or 'fd:N'", dest)
+	}
+	fd, err := strconv.Atoi(dest[len("fd:"):])
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("bad file descriptor in '%s'", dest)
+	}
+	if fd <= 2 {
+		return nil, fmt.Errorf("fd %d is used by the ssh session", fd)
+	}
+	return os.NewFile(uintptr(fd), "scp-stats"), nil
+}
+
+// Build an sftp policy allowing everything but the
+// comma separated operations in deny.
+func parseDeny(deny string) (*sftp.Policy, error) {
+	policy := sftp.AllowAllPolicy()
+	for _, op := range splitList(deny) {
+		switch op {
+		case "read":
+			policy.AllowRead = false
+		case "write":
+			policy.AllowWrite = false
+		case "delete":
+			policy.AllowDelete = false
+		case "rename":
+			policy.AllowRename = false
+		case "mkdir":
+			policy.AllowMkdir = false
+		case "setstat":
+			policy.AllowSetstat = false
+		default:
+			return nil, fmt.Errorf("unknown operation in -deny: '%s'", op)
+		}
+	}
+	return policy, nil
+}
+
 func main() {
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	Debug := flag.Bool("debug", false, "enable debug logging")
+	TraceFile := flag.String("trace-file", "", "append a JSON record of every sftp packet sent and received to this file, for debugging clients")
+	TracePayloads := flag.Bool("trace-payloads", false, "also record the contents of each packet in -trace-file, so the packets a client sent can be replayed")
 	ReadOnly := flag.Bool("read-only", false, "only allow read access to the virtual file system")
+	WriteOnce := flag.Bool("write-once", false, "allow new files to be uploaded, but never changed, replaced or removed")
 	MaxFiles := flag.Int("max-files", 64, "maximum number of files allowed to be open concurrently")
-	VFS := flag.String("vfs", "", "File system implementation. Valid values are 'local' and 'dropbox:TOKEN' ")
+	MaxFilesTotal := flag.Int("max-files-total", 0, "maximum number of files open at once in all the sftp sessions of one server, 0 for no limit")
+	HomeDir := flag.String("home", "/", "directory sftp clients start in and ~ expands to")
+	IdleTimeout := flag.Duration("idle-timeout", 0, "shut down sftp sessions that are idle for this long, for example '30m', 0 to disable")
+	MaxSessionDuration := flag.Duration("max-session-duration", 0, "end sftp sessions after this long, for example '8h', 0 for no limit")
+	BwLimit := flag.Uint("bw-limit", 0, "limit the bandwidth of sftp and scp file transfers, shared by all sessions, specified in Kbit/s")
+	MaxFileSize := flag.Int64("max-file-size", 0, "maximum size in bytes of uploaded files, 0 for no limit")
+	AllowNames := flag.String("allow-names", "", "comma separated glob or 're:' regexp patterns, only matching paths may be written to")
+	DenyNames := flag.String("deny-names", "", "comma separated glob or 're:' regexp patterns, matching paths may not be written to, e.g. '*.exe'")
+	FilterReads := flag.Bool("filter-reads", false, "also apply -allow-names and -deny-names to opening, stat and listing files")
+	Hide := flag.String("hide", "", "comma separated glob or 're:' regexp patterns of paths to hide from clients, e.g. '.*'")
+	Deny := flag.String("deny", "", "comma separated sftp operations to deny, any of 'read,write,delete,rename,mkdir,setstat'")
+	FileMode := modeFlag(0644)
+	flag.Var(&FileMode, "file-mode", "octal mode for new files when the sftp client does not supply one")
+	DirMode := modeFlag(0755)
+	flag.Var(&DirMode, "dir-mode", "octal mode for new directories when the sftp client does not supply one")
+	Umask := modeFlag(0)
+	flag.Var(&Umask, "umask", "octal permission bits cleared from the mode of new files and directories created over sftp")
+	WriteCoalesceSize := flag.Int("write-coalesce-size", 0, "merge sequential sftp writes into writes of up to this many bytes, 0 to disable")
+	MaxPacketLength := flag.Uint("max-packet-length", 0, "longest sftp request packet accepted in bytes, 0 for the default of 1MiB")
+	MaxReadLength := flag.Uint("max-read-length", 0, "most data returned by one sftp read in bytes, longer reads return less, 0 for 1KiB less than -max-packet-length")
+	MaxWriteLength := flag.Uint("max-write-length", 0, "most data accepted by one sftp write in bytes, 0 for 1KiB less than -max-packet-length")
+	ReaddirBatchSize := flag.Int("readdir-batch-size", 0, "most directory entries sent in one sftp directory listing response, 0 for the default of 64")
+	ReadPipelineDepth := flag.Int("read-pipeline-depth", 0, "run up to this many sftp reads of one file at once, for file systems that read ranges in parallel, 0 to read one at a time")
+	VFS := flag.String("vfs", "", "File system implementation. Valid values are 'local', 'local:DIR', 'mem', 'webdav:URL', 'onedrive:TOKEN', 'sftp:[USER@]HOST[:DIR]', 'smb://USER@SERVER/SHARE', 'rclone:REMOTE:PATH', 's3:BUCKET[/PREFIX][?OPTIONS]', 'plugin:PROGRAM', 'tar:ARCHIVE', 'sqlite:DB', 'storj:ACCESS', 'mega:EMAIL' and 'dropbox:TOKEN', prefix with 'encrypt+' to encrypt stored data")
+	EncryptPassphraseFile := flag.String("encrypt-passphrase-file", "", "file holding the passphrase for 'encrypt+' file systems, defaults to $SFTPPLEASE_ENCRYPT_PASSPHRASE")
+	EncryptNames := flag.Bool("encrypt-names", false, "also encrypt file names when first setting up an 'encrypt+' file system")
+	MaxOpsPerSecond := flag.Float64("max-ops-per-second", 0, "limit the average rate of calls to the file system provider, 0 for no limit")
+	MaxConcurrentOps := flag.Int("max-concurrent-ops", 0, "limit the calls to the file system provider in progress at once, 0 for no limit")
+	ReadCacheDir := flag.String("read-cache-dir", "", "keep copies of downloaded files in this local directory so repeated downloads are served locally")
+	ReadCacheSize := flag.Int64("read-cache-size", 1<<30, "maximum size in bytes of the -read-cache-dir cache, 0 for no limit")
+	StatCacheTTL := flag.Duration("stat-cache-ttl", 0, "remember file information for this long to answer repeated stat requests, for example '10s', 0 to disable")
+	Root := flag.String("root", "", "confine clients to this directory of the virtual file system")
+	TrashDir := flag.String("trash-dir", "", "move removed files into this directory instead of deleting them, for example '/.trash'")
+	TrashRetention := flag.Duration("trash-retention", 0, "delete files kept in -trash-dir for longer than this, for example '720h', 0 to keep them forever")
+	LogFile := flag.String("log-file", "", "append log messages to this file instead of stderr")
+	LogFormat := flag.String("log-format", "text", "sftp log format, 'text' or 'json' for one record per sftp operation")
+	Config := flag.String("config", "", "load options from a TOML config file, command line flags take precedence")
+	MetricsListen := flag.String("metrics-listen", "", "serve Prometheus metrics of sftp operations at /metrics on this address, for example 'localhost:9100', most useful with -serve")
+	AuditFile := flag.String("audit-file", "", "append a JSON record of every sftp operation that modifies files, and every file received by scp, to this file")
+	ScpSymlinks := flag.String("scp-symlinks", "follow", "how 'scp -r' treats symlinks in sent directories, 'follow' to send what they point to or 'skip' to leave them out, links themselves can't be sent or recreated")
+	ScpInclude := flag.String("scp-include", "", "comma separated glob or 're:' regexp patterns, scp only sends and receives matching files")
+	ScpExclude := flag.String("scp-exclude", "", "comma separated glob or 're:' regexp patterns of files and directories scp does not send or receive")
+	ScpStats := flag.String("scp-stats", "", "report scp transfer progress and statistics, 'log' to the log or 'fd:N' to an open file descriptor")
+	AllowCommands := flag.String("allow-commands", "sftp-server,scp", "comma separated commands ssh clients may run, of sftp-server, scp and rsync, which only serves downloads")
+	Serve := flag.String("serve", "", "serve sftp without ssh, 'stdin' for a connection on stdin from inetd, or 'systemd' for socket activation")
+	BenchDir := flag.String("bench-dir", "/sftpplease-bench", "directory 'sftpplease bench' creates to transfer files in, removed once done")
+	BenchFiles := flag.Int("bench-files", 4, "number of files 'sftpplease bench' uploads and downloads at once")
+	BenchFileSize := flag.Int64("bench-file-size", 64<<20, "size in bytes of the files 'sftpplease bench' transfers")
+	BenchParallel := flag.Int("bench-parallel", 16, "sftp requests 'sftpplease bench' keeps in flight at once")
+	UserEnv := flag.String("user-env", "", "environment variable selecting the config file [users.NAME] section instead of the login user, only set it if clients can't set the variable")
 
-	flag.Parse()
+	PrintVersion := flag.Bool("version", false, "print the version and exit")
 
-	originalCommand := os.Getenv("SSH_ORIGINAL_COMMAND")
+	// 'sftpplease mount [flags] DIR' mounts the vfs instead of serving it,
+	// 'sftpplease bench [flags]' measures transfers through an sftp session.
+	args := os.Args[1:]
+	mount := len(args) > 0 && args[0] == "mount"
+	bench := len(args) > 0 && args[0] == "bench"
+	if mount || bench {
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
 
-	cmdArgs, err := shlex.Split(originalCommand, true)
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "error parsing ssh command: %s", err)
-		os.Exit(1)
+	if *PrintVersion {
+		fmt.Println(version.String())
+		return
 	}
 
-	if len(cmdArgs) == 0 {
-		_, _ = fmt.Fprintf(os.Stderr, "expected a command, got none!\n")
-		os.Exit(1)
+	log.SetPrefix(version.String() + " ")
+
+	if *Config != "" {
+		err := loadConfig(*Config, flag.CommandLine)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *LogFile != "" {
+		logFile, err := os.OpenFile(*LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error opening log file: %s\n", err)
+			os.Exit(1)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	for _, limit := range []*uint{MaxPacketLength, MaxReadLength, MaxWriteLength} {
+		if *limit > math.MaxUint32 {
+			_, _ = fmt.Fprintf(os.Stderr, "sftp packet and data lengths must be less than 4GiB\n")
+			os.Exit(1)
+		}
 	}
 
 	vfsName, vfsOpts := parseVFS(*VFS)
+	encrypt := strings.HasPrefix(vfsName, "encrypt+")
+	vfsName = strings.TrimPrefix(vfsName, "encrypt+")
 
 	fs, err := vfs.Open(vfsName, vfsOpts)
 	if err != nil {
@@ -58,27 +269,282 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *MaxOpsPerSecond > 0 || *MaxConcurrentOps > 0 {
+		fs = &vfs.ThrottleVFS{Fs: fs, OpsPerSecond: *MaxOpsPerSecond, MaxConcurrent: *MaxConcurrentOps}
+	}
+
+	if *ReadCacheDir != "" {
+		err := os.MkdirAll(*ReadCacheDir, 0700)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error creating read cache: %s\n", err)
+			os.Exit(1)
+		}
+		fs = &vfs.ReadCacheVFS{Fs: fs, Dir: *ReadCacheDir, MaxSize: *ReadCacheSize}
+	}
+
+	if encrypt {
+		passphrase, err := encryptPassphrase(*EncryptPassphraseFile)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fs, err = vfs.NewEncryptVFS(fs, passphrase, *EncryptNames)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error opening encrypted vfs: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *StatCacheTTL > 0 {
+		fs = &vfs.StatCacheVFS{Fs: fs, TTL: *StatCacheTTL}
+	}
+
+	if *Root != "" {
+		fs = &vfs.ChrootVFS{Fs: fs, Root: *Root}
+	}
+
+	if *TrashDir != "" {
+		fs = &vfs.TrashVFS{Fs: fs, Dir: *TrashDir, Retention: *TrashRetention}
+	}
+
+	if *MaxFileSize > 0 {
+		fs = &vfs.MaxFileSizeVFS{Fs: fs, MaxSize: *MaxFileSize}
+	}
+
+	if *AllowNames != "" || *DenyNames != "" {
+		allow, err := vfs.ParseNamePatterns(splitList(*AllowNames))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-allow-names: %s\n", err)
+			os.Exit(1)
+		}
+		deny, err := vfs.ParseNamePatterns(splitList(*DenyNames))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-deny-names: %s\n", err)
+			os.Exit(1)
+		}
+		fs = &vfs.FilterVFS{Fs: fs, Allow: allow, Deny: deny, Reads: *FilterReads}
+	}
+
+	if *Hide != "" {
+		patterns, err := vfs.ParseNamePatterns(splitList(*Hide))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-hide: %s\n", err)
+			os.Exit(1)
+		}
+		fs = &vfs.HiddenVFS{Fs: fs, Patterns: patterns}
+	}
+
+	if *WriteOnce {
+		fs = &vfs.WriteOnceVFS{Fs: fs}
+	}
+
 	if *ReadOnly {
 		fs = &vfs.ReadOnlyVFS{Fs: fs}
 	}
 
-	if path.Base(cmdArgs[0]) == "sftp-server" {
-		opts := &sftp.Options{
-			Debug:    *Debug,
-			MaxFiles: *MaxFiles,
-			LogFunc:  log.Printf,
+	if mount {
+		err := mountMain(fs, flag.Args(), *ReadOnly)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	policy, err := parseDeny(*Deny)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	var logger sftp.Logger
+	switch *LogFormat {
+	case "text":
+		logger = sftp.LogFunc(log.Printf)
+	case "json":
+		logger = sftp.NewJSONLogger(log.Writer())
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown log format: '%s'\n", *LogFormat)
+		os.Exit(1)
+	}
+
+	scp.MaxFiles = *MaxFiles
+
+	scp.Include, err = vfs.ParseNamePatterns(splitList(*ScpInclude))
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "-scp-include: %s\n", err)
+		os.Exit(1)
+	}
+	scp.Exclude, err = vfs.ParseNamePatterns(splitList(*ScpExclude))
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "-scp-exclude: %s\n", err)
+		os.Exit(1)
+	}
+
+	switch *ScpSymlinks {
+	case "follow":
+		scp.FollowSymlinks = true
+	case "skip":
+		scp.FollowSymlinks = false
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown scp symlink handling: '%s'\n", *ScpSymlinks)
+		os.Exit(1)
+	}
+
+	if *ScpStats != "" {
+		w, err := statsWriter(*ScpStats)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-scp-stats: %s\n", err)
+			os.Exit(1)
+		}
+		scp.StatsLog = log.New(w, log.Prefix(), log.Flags())
+	}
+
+	var auditLog sftp.AuditLog
+	if *AuditFile != "" {
+		auditFile, err := os.OpenFile(*AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error opening audit file: %s\n", err)
+			os.Exit(1)
+		}
+		defer auditFile.Close()
+		auditLog = sftp.NewJSONAuditLog(auditFile)
+	}
+
+	var tracer *sftp.Tracer
+	if *TraceFile != "" {
+		traceFile, err := os.OpenFile(*TraceFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error opening trace file: %s\n", err)
+			os.Exit(1)
+		}
+		defer traceFile.Close()
+		tracer = sftp.NewTracer(traceFile, *TracePayloads)
+	}
+
+	var metrics sftp.Metrics
+	if *MetricsListen != "" {
+		l, err := net.Listen("tcp", *MetricsListen)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error listening for metrics requests: %s\n", err)
+			os.Exit(1)
+		}
+		m := sftp.NewPrometheusMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		go func() {
+			err := http.Serve(l, mux)
+			log.Printf("serving metrics failed: %s", err)
+		}()
+		metrics = m
+	}
+
+	// One limit for every session, whatever its protocol.
+	var rateLimiter *extraio.RateLimiter
+	if *BwLimit > 0 {
+		rateLimiter = extraio.NewRateLimiter(int64(*BwLimit) * 1024 / 8)
+		scp.RateLimiter = rateLimiter
+		rsync.RateLimiter = rateLimiter
+	}
+
+	var handleLimit *sftp.HandleLimit
+	if *MaxFilesTotal > 0 {
+		handleLimit = sftp.NewHandleLimit(*MaxFilesTotal)
+	}
+
+	newSftpOptions := func(id string) *sftp.Options {
+		return &sftp.Options{
+			Debug:              *Debug,
+			Tracer:             tracer,
+			MaxFiles:           *MaxFiles,
+			HomeDir:            *HomeDir,
+			Policy:             policy,
+			DefaultFileMode:    os.FileMode(FileMode),
+			DefaultDirMode:     os.FileMode(DirMode),
+			Umask:              os.FileMode(Umask),
+			WriteCoalesceSize:  *WriteCoalesceSize,
+			ReadPipelineDepth:  *ReadPipelineDepth,
+			ReaddirBatchSize:   *ReaddirBatchSize,
+			MaxPacketLength:    uint32(*MaxPacketLength),
+			MaxReadLength:      uint32(*MaxReadLength),
+			MaxWriteLength:     uint32(*MaxWriteLength),
+			IdleTimeout:        *IdleTimeout,
+			MaxSessionDuration: *MaxSessionDuration,
+			SharedRateLimiter:  rateLimiter,
+			SharedHandleLimit:  handleLimit,
+			Logger:             logger,
+			AuditLog:           auditLog,
+			Metrics:            metrics,
+			SessionID:          id,
 		}
+	}
 
-		sftp.Serve(opts, fs, &extraio.MergedReadWriteCloser{
+	if bench {
+		err := benchMain(fs, newSftpOptions("bench"), benchOptions{
+			Dir:      *BenchDir,
+			Files:    *BenchFiles,
+			FileSize: *BenchFileSize,
+			Parallel: *BenchParallel,
+		}, os.Stdout)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch *Serve {
+	case "":
+	case "stdin":
+		serveStdin(newSftpOptions, fs)
+		return
+	case "systemd":
+		err := serveSystemd(newSftpOptions, fs)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown -serve mode: '%s'\n", *Serve)
+		os.Exit(1)
+	}
+
+	originalCommand := os.Getenv("SSH_ORIGINAL_COMMAND")
+
+	cmdArgs, err := shlex.Split(originalCommand, true)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error parsing ssh command: %s", err)
+		os.Exit(1)
+	}
+
+	if len(cmdArgs) == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "expected a command, got none!\n")
+		os.Exit(1)
+	}
+
+	err = validateCommand(cmdArgs, splitList(*AllowCommands))
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	if path.Base(cmdArgs[0]) == "sftp-server" {
+		sftp.Serve(newSftpOptions(sessionID(*UserEnv)), fs, &extraio.MergedReadWriteCloser{
 			WC: os.Stdout,
 			RC: os.Stdin,
 		})
 	} else if path.Base(cmdArgs[0]) == "scp" {
+		scp.Logger = logger
+		scp.AuditLog = auditLog
+		scp.SessionID = sessionID(*UserEnv)
 		if len(cmdArgs) == 1 {
 			scp.Main([]string{}, fs)
 		} else {
 			scp.Main(cmdArgs[1:], fs)
 		}
+	} else if path.Base(cmdArgs[0]) == "rsync" {
+		rsync.Main(cmdArgs[1:], fs)
 	} else {
 		_, _ = fmt.Fprintf(os.Stderr, "unsupported command: %s", originalCommand)
 		os.Exit(1)
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/andrewchambers/sftpplease/fusemount"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// Mount fs on the directory in args until it is unmounted with
+// fusermount -u or umount, or sftpplease is interrupted.
+func mountMain(fs vfs.VFS, args []string, readOnly bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: sftpplease mount [flags] MOUNTPOINT")
+	}
+	dir := args[0]
+	defer fs.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range sigs {
+			err := fusemount.Unmount(dir)
+			if err != nil {
+				log.Printf("unmounting %s failed: %s", dir, err)
+			}
+		}
+	}()
+
+	return fusemount.Mount(fs, dir, readOnly)
+}
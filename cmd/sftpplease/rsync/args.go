@@ -0,0 +1,127 @@
+package rsync
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The arguments rsync clients pass to "rsync --server --sender".
+type Args struct {
+	Recursive  bool // -r
+	Dirs       bool // -d
+	CopyLinks  bool // -L
+	Owner      bool // -o
+	Group      bool // -g
+	NumericIds bool // --numeric-ids
+	BwLimit    uint // --bwlimit, in KiB/s
+	Paths      []string
+}
+
+var errUnsupported = errors.New("not supported")
+
+// Short options clients pass to the server that don't change what the
+// sender does, either because they only matter to the receiving client,
+// or because every file is sent with them anyway, like -t and -p. With
+// -l, symlinks are still skipped, file systems can't read them.
+const ignoredFlags = "vqntpDlWSIuxbkKOJiE"
+
+// Long options that only matter to the receiving client.
+var ignoredLongOptions = []string{
+	"--timeout=",
+	"--contimeout=",
+	"--modify-window=",
+	"--size-only",
+	"--ignore-existing",
+	"--existing",
+	"--ignore-non-existing",
+	"--max-size=",
+	"--min-size=",
+	"--safe-links",
+	"--no-implied-dirs",
+	"--log-format=",
+	"--out-format=",
+}
+
+// Parse the arguments as they follow "rsync" in the command clients run.
+// The options come first, then "." in place of the server's directory,
+// then the paths to send. Options changing the protocol or what the
+// sender must do, like -z, -c, -H or -R, are refused.
+func ParseArgs(args []string) (*Args, error) {
+	a := &Args{}
+	server, sender := false, false
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			break
+		}
+		if strings.HasPrefix(arg, "--") {
+			switch {
+			case arg == "--server":
+				server = true
+			case arg == "--sender":
+				sender = true
+			case arg == "--numeric-ids":
+				a.NumericIds = true
+			case strings.HasPrefix(arg, "--bwlimit="):
+				limit, err := strconv.ParseUint(strings.TrimPrefix(arg, "--bwlimit="), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("rsync: bad bandwidth limit: %q", arg)
+				}
+				a.BwLimit = uint(limit)
+			case ignoredLongOption(arg):
+			default:
+				return nil, fmt.Errorf("rsync: option %s is %w", arg, errUnsupported)
+			}
+			continue
+		}
+	flags:
+		for j := 1; j < len(arg); j++ {
+			c := arg[j]
+			switch {
+			case c == 'r':
+				a.Recursive = true
+			case c == 'd':
+				a.Dirs = true
+			case c == 'L':
+				a.CopyLinks = true
+			case c == 'o':
+				a.Owner = true
+			case c == 'g':
+				a.Group = true
+			case c == 'e':
+				// The rest is the client's capabilities,
+				// for protocol versions after ours.
+				break flags
+			case strings.IndexByte(ignoredFlags, c) != -1:
+			default:
+				return nil, fmt.Errorf("rsync: option -%c is %w", c, errUnsupported)
+			}
+		}
+	}
+	if !server {
+		return nil, fmt.Errorf("rsync: only 'rsync --server' may be run")
+	}
+	if !sender {
+		return nil, fmt.Errorf("rsync: uploads are %w, use sftp or scp instead", errUnsupported)
+	}
+	if i == len(args) || args[i] != "." {
+		return nil, fmt.Errorf("rsync: missing '.' argument")
+	}
+	a.Paths = args[i+1:]
+	if len(a.Paths) == 0 {
+		return nil, fmt.Errorf("rsync: no paths to send")
+	}
+	return a, nil
+}
+
+func ignoredLongOption(arg string) bool {
+	for _, opt := range ignoredLongOptions {
+		if arg == opt || (strings.HasSuffix(opt, "=") && strings.HasPrefix(arg, opt)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package rsync
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		expect *Args
+		// A substring of the error expected, empty for none.
+		err string
+	}{
+		{
+			args:   []string{"--server", "--sender", "-vlogDtpre.iLsfxCIvu", ".", "src/"},
+			expect: &Args{Recursive: true, Owner: true, Group: true, Paths: []string{"src/"}},
+		},
+		{
+			args:   []string{"--server", "--sender", "-dL", "--numeric-ids", "--bwlimit=100", "--timeout=30", ".", "a", "b"},
+			expect: &Args{Dirs: true, CopyLinks: true, NumericIds: true, BwLimit: 100, Paths: []string{"a", "b"}},
+		},
+		{args: []string{"--server", "-vlogDtpre.iLsfxCIvu", ".", "dst/"}, err: "uploads are not supported"},
+		{args: []string{"--sender", "-r", ".", "a"}, err: "only 'rsync --server'"},
+		{args: []string{"--server", "--sender", "-rz", ".", "a"}, err: "option -z is not supported"},
+		{args: []string{"--server", "--sender", "-c", ".", "a"}, err: "option -c is not supported"},
+		{args: []string{"--server", "--sender", "--delete-excluded", ".", "a"}, err: "option --delete-excluded is not supported"},
+		{args: []string{"--server", "--sender", "--bwlimit=x", ".", "a"}, err: "bad bandwidth limit"},
+		{args: []string{"--server", "--sender", "-r", "a"}, err: "missing '.'"},
+		{args: []string{"--server", "--sender", "-r", "."}, err: "no paths"},
+	} {
+		a, err := ParseArgs(tc.args)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%q: expected an error containing %q, got %v", tc.args, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.args, err)
+		}
+		if !reflect.DeepEqual(a, tc.expect) {
+			t.Fatalf("%q: expected %+v, got %+v", tc.args, tc.expect, a)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package rsync
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// File list entry flags of protocol 27.
+const (
+	xmitTopDir   = 0x01
+	xmitSameMode = 0x02
+	xmitSameUid  = 0x08
+	xmitSameGid  = 0x10
+	xmitSameName = 0x20
+	xmitLongName = 0x40
+	xmitSameTime = 0x80
+)
+
+const (
+	sIFREG = 0100000
+	sIFDIR = 0040000
+)
+
+const (
+	dirScanBatchSize = 256
+	// Deeper directories are not sent, in case of link
+	// loops backends can't detect.
+	maxDirDepth = 256
+)
+
+type file struct {
+	// The name sent to the client, relative to where it puts files.
+	name string
+	// The path in the file system.
+	path   string
+	mode   uint32
+	size   int64
+	mtime  int64
+	topDir bool
+}
+
+func (f *file) isDir() bool {
+	return f.mode&sIFDIR != 0
+}
+
+func unixMode(fi os.FileInfo) uint32 {
+	m := fi.Mode()
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	if m.IsDir() {
+		return mode | sIFDIR
+	}
+	return mode | sIFREG
+}
+
+func newFile(name string, p string, fi os.FileInfo) *file {
+	f := &file{name: name, path: p, mode: unixMode(fi), mtime: fi.ModTime().Unix()}
+	if !fi.IsDir() {
+		f.size = fi.Size()
+	}
+	return f
+}
+
+// Build the file list as rsync does. A path naming a directory with a
+// trailing slash sends what it contains, otherwise the directory itself
+// is sent by its name. Directories are only sent with -r, or -d for their
+// contents without descending further. Only regular files and
+// directories are sent, symlinks are skipped unless -L follows them.
+func (s *sender) buildFileList() ([]*file, error) {
+	var files []*file
+	for _, arg := range s.args.Paths {
+		p := path.Join("/", arg)
+		fi, err := s.fs.Stat(p)
+		if err != nil {
+			if err := s.fileError("link_stat", arg, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		contents := arg == "" || strings.HasSuffix(arg, "/") || arg == "."
+		if fi.IsDir() && !s.args.Recursive && !(s.args.Dirs && contents) {
+			if err := s.info("skipping directory %s\n", arg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			continue
+		}
+		name := path.Base(p)
+		if contents || p == "/" {
+			name = "."
+		}
+		f := newFile(name, p, fi)
+		f.topDir = f.isDir()
+		files = append(files, f)
+		if f.isDir() {
+			files, err = s.addDir(files, f, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The client sorts the list the same way, and asks
+	// for files by their index in it.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	deduped := files[:0]
+	for i, f := range files {
+		if i > 0 && f.name == files[i-1].name {
+			continue
+		}
+		deduped = append(deduped, f)
+	}
+	return deduped, nil
+}
+
+func (s *sender) addDir(files []*file, dir *file, depth int) ([]*file, error) {
+	if depth >= maxDirDepth {
+		return files, s.fileError("opendir", dir.name, os.ErrInvalid)
+	}
+	d, err := s.fs.Open(dir.path)
+	if err != nil {
+		return files, s.fileError("opendir", dir.name, err)
+	}
+	defer d.Close()
+	for {
+		children, readErr := d.Readdir(dirScanBatchSize)
+		for _, fi := range children {
+			p := path.Join(dir.path, fi.Name())
+			name := fi.Name()
+			if dir.name != "." {
+				name = dir.name + "/" + name
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if !s.args.CopyLinks {
+					continue
+				}
+				var err error
+				fi, err = s.fs.Stat(p)
+				if err != nil {
+					if err := s.fileError("stat", name, err); err != nil {
+						return files, err
+					}
+					continue
+				}
+			}
+			if !fi.Mode().IsRegular() && !fi.IsDir() {
+				continue
+			}
+			f := newFile(name, p, fi)
+			files = append(files, f)
+			if f.isDir() && s.args.Recursive {
+				var err error
+				files, err = s.addDir(files, f, depth+1)
+				if err != nil {
+					return files, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return files, nil
+		}
+		if readErr != nil {
+			return files, s.fileError("readdir", dir.name, readErr)
+		}
+	}
+}
+
+// Send the file list in the format of protocol 27. Entries share
+// what they have in common with the one before, like the start of
+// their name. File systems have no owners for files, so every entry
+// has the same uid and gid as the last, which starts at 0, and the
+// lists mapping them to names are empty.
+func (s *sender) sendFileList(files []*file) {
+	c := s.c
+	var lastName string
+	var lastMode uint32
+	var lastMtime int64
+	for _, f := range files {
+		flags := byte(xmitSameUid | xmitSameGid)
+		if f.topDir {
+			flags |= xmitTopDir
+		}
+		if f.mode == lastMode {
+			flags |= xmitSameMode
+		}
+		if f.mtime == lastMtime {
+			flags |= xmitSameTime
+		}
+		l1 := 0
+		for l1 < len(f.name) && l1 < len(lastName) && l1 < 255 && f.name[l1] == lastName[l1] {
+			l1++
+		}
+		l2 := len(f.name) - l1
+		if l1 > 0 {
+			flags |= xmitSameName
+		}
+		if l2 > 255 {
+			flags |= xmitLongName
+		}
+
+		c.writeByte(flags)
+		if flags&xmitSameName != 0 {
+			c.writeByte(byte(l1))
+		}
+		if flags&xmitLongName != 0 {
+			c.writeInt(int32(l2))
+		} else {
+			c.writeByte(byte(l2))
+		}
+		_, _ = io.WriteString(c, f.name[l1:])
+		c.writeLongint(f.size)
+		if flags&xmitSameTime == 0 {
+			c.writeInt(int32(f.mtime))
+		}
+		if flags&xmitSameMode == 0 {
+			c.writeInt(int32(f.mode))
+		}
+
+		lastName, lastMode, lastMtime = f.name, f.mode, f.mtime
+	}
+	c.writeByte(0)
+
+	if !s.args.NumericIds {
+		if s.args.Owner {
+			c.writeInt(0)
+		}
+		if s.args.Group {
+			c.writeInt(0)
+		}
+	}
+	// Errors building the list, so the client doesn't
+	// delete files it thinks are gone.
+	c.writeInt(s.ioError)
+}
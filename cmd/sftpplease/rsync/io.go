@@ -0,0 +1,151 @@
+package rsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Message tags of the multiplexed stream servers send.
+const (
+	mplexBase = 7
+	msgData   = 0
+	// Errors the client reports as a partial transfer.
+	msgError = 1
+	msgInfo  = 2
+
+	// The most data sent in one message.
+	maxMessageLen = 32 * 1024
+)
+
+var errProtocol = errors.New("rsync protocol error")
+
+// The connection to the client. Once multiplexing starts, everything
+// written is sent in data messages, so errors can be sent between them.
+// Output is buffered until the next read, so the client is never left
+// waiting on data it needs to answer.
+type conn struct {
+	r   *bufio.Reader
+	w   io.Writer
+	buf []byte
+	mux bool
+	// The first write error, returned by the next flush or read.
+	err error
+
+	// Bytes read from and written to the client, for the stats
+	// the client shows.
+	read    int64
+	written int64
+}
+
+func newConn(r io.Reader, w io.Writer) *conn {
+	return &conn{r: bufio.NewReader(r), w: w}
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.buf = append(c.buf, p...)
+	if len(c.buf) >= maxMessageLen {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *conn) writeInt(v int32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	_, _ = c.Write(b[:])
+}
+
+// Write v as a 4 byte int if it fits, or -1 followed by 8 bytes.
+func (c *conn) writeLongint(v int64) {
+	if v >= 0 && v <= 0x7fffffff {
+		c.writeInt(int32(v))
+		return
+	}
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:], 0xffffffff)
+	binary.LittleEndian.PutUint64(b[4:], uint64(v))
+	_, _ = c.Write(b[:])
+}
+
+func (c *conn) writeByte(v byte) {
+	_, _ = c.Write([]byte{v})
+}
+
+func (c *conn) writeMessage(tag byte, p []byte) error {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(mplexBase+tag)<<24|uint32(len(p)))
+	_, err := c.w.Write(append(hdr[:], p...))
+	if err == nil {
+		c.written += int64(len(p))
+	}
+	return err
+}
+
+// Send buffered data, then msg as a message to show the user.
+func (c *conn) sendMessage(tag byte, msg string) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return c.writeMessage(tag, []byte(msg))
+}
+
+func (c *conn) flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	for len(c.buf) > 0 {
+		n := len(c.buf)
+		if n > maxMessageLen {
+			n = maxMessageLen
+		}
+		var err error
+		if c.mux {
+			err = c.writeMessage(msgData, c.buf[:n])
+		} else {
+			_, err = c.w.Write(c.buf[:n])
+			if err == nil {
+				c.written += int64(n)
+			}
+		}
+		if err != nil {
+			c.err = err
+			return err
+		}
+		c.buf = c.buf[n:]
+	}
+	c.buf = c.buf[:0]
+	return nil
+}
+
+func (c *conn) readFull(p []byte) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(c.r, p)
+	c.read += int64(n)
+	return err
+}
+
+func (c *conn) readInt() (int32, error) {
+	var b [4]byte
+	if err := c.readFull(b[:]); err != nil {
+		return 0, err
+	}
+	return int32(binary.LittleEndian.Uint32(b[:])), nil
+}
+
+func (c *conn) discard(n int64) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	m, err := io.CopyN(io.Discard, c.r, n)
+	c.read += m
+	return err
+}
@@ -0,0 +1,274 @@
+// Package rsync serves rsync clients downloading files from a virtual
+// file system, as "rsync --server --sender" does when clients run rsync
+// over ssh.
+//
+// Only a subset of the protocol is implemented. Files are always sent
+// whole, the block checksums clients send to have only the differences
+// sent are read and ignored, and uploads, compression and filter rules
+// are refused.
+package rsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/extraio"
+	"github.com/andrewchambers/sftpplease/vfs"
+	"golang.org/x/crypto/md4"
+)
+
+// The protocol version spoken. Later versions negotiate checksums,
+// compression and incremental file lists, 27 is the simplest version
+// current rsync clients still speak.
+const ProtocolVersion = 27
+
+// rsync exit codes.
+const (
+	ExitSyntax      = 1
+	ExitProtocol    = 2
+	ExitUnsupported = 4
+	ExitStreamIO    = 12
+	ExitPartial     = 23
+)
+
+// Literal data is sent in chunks of at most this size.
+const chunkSize = 32 * 1024
+
+// The largest block size the generator may use.
+const maxBlockLength = 1 << 29
+
+// If set, limits the rate of transfers along with any
+// limit the client sets, and may be shared with sftp and scp.
+var RateLimiter *extraio.RateLimiter
+
+// Run the rsync sender with the arguments the client passed, over
+// stdin and stdout, exiting when it is done.
+func Main(args []string, fs vfs.VFS) {
+	os.Exit(run(args, fs, os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(osArgs []string, fs vfs.VFS, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	a, err := ParseArgs(osArgs)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "%s\n", err)
+		if errors.Is(err, errUnsupported) {
+			return ExitUnsupported
+		}
+		return ExitSyntax
+	}
+
+	var limiter *extraio.RateLimiter
+	if a.BwLimit > 0 {
+		limiter = extraio.NewRateLimiter(int64(a.BwLimit) * 1024)
+	}
+	if limiter != nil || RateLimiter != nil {
+		// The process exits when the session ends.
+		stdout = extraio.LimitWriter(context.Background(), stdout, limiter, RateLimiter)
+	}
+
+	s := &sender{args: a, fs: fs, c: newConn(stdin, stdout)}
+	err = s.run()
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "rsync: %s\n", err)
+		if err == errProtocol {
+			return ExitProtocol
+		}
+		return ExitStreamIO
+	}
+	if s.ioError != 0 {
+		return ExitPartial
+	}
+	return 0
+}
+
+type sender struct {
+	args *Args
+	fs   vfs.VFS
+	c    *conn
+	seed int32
+	// Set when a file could not be sent.
+	ioError int32
+}
+
+// Report an error with a file to the client, which carries on
+// without it.
+func (s *sender) fileError(op string, name string, err error) error {
+	s.ioError |= 1
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return s.c.sendMessage(msgError, fmt.Sprintf("rsync: %s %q failed: %s\n", op, name, err))
+}
+
+func (s *sender) info(format string, args ...interface{}) error {
+	return s.c.sendMessage(msgInfo, fmt.Sprintf(format, args...))
+}
+
+func (s *sender) run() error {
+	c := s.c
+
+	c.writeInt(ProtocolVersion)
+	version, err := c.readInt()
+	if err != nil {
+		return err
+	}
+	if version < ProtocolVersion {
+		return fmt.Errorf("protocol version %d is too old, %d is needed", version, ProtocolVersion)
+	}
+	s.seed = int32(time.Now().Unix())
+	c.writeInt(s.seed)
+	if err := c.flush(); err != nil {
+		return err
+	}
+	c.mux = true
+
+	err = s.readFilterList()
+	if err != nil {
+		return err
+	}
+
+	files, err := s.buildFileList()
+	if err != nil {
+		return err
+	}
+	s.sendFileList(files)
+	if len(files) == 0 {
+		return c.flush()
+	}
+
+	err = s.sendFiles(files)
+	if err != nil {
+		return err
+	}
+
+	// Stats the client shows, from the client's point of view.
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	c.writeLongint(c.read)
+	c.writeLongint(c.written)
+	c.writeLongint(total)
+
+	goodbye, err := c.readInt()
+	if err != nil {
+		return err
+	}
+	if goodbye != -1 {
+		return errProtocol
+	}
+	return c.flush()
+}
+
+// Filter rules limit which files are sent, they are refused rather
+// than send files the client asked to leave out.
+func (s *sender) readFilterList() error {
+	n, err := s.c.readInt()
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		_ = s.c.discard(int64(n))
+		_ = s.c.sendMessage(msgError, "rsync: filter rules like --exclude are not supported by this server\n")
+		return fmt.Errorf("filter rules are not supported")
+	}
+	return nil
+}
+
+// Send the files the client asks for, until it says it is done with
+// both the first pass and the pass redoing failed files.
+func (s *sender) sendFiles(files []*file) error {
+	c := s.c
+	phase := 0
+	for {
+		ndx, err := c.readInt()
+		if err != nil {
+			return err
+		}
+		if ndx == -1 {
+			phase++
+			if phase > 1 {
+				break
+			}
+			c.writeInt(-1)
+			continue
+		}
+		if ndx < 0 || int(ndx) >= len(files) || files[ndx].isDir() {
+			return errProtocol
+		}
+		err = s.sendFile(ndx, files[ndx])
+		if err != nil {
+			return err
+		}
+	}
+	c.writeInt(-1)
+	return nil
+}
+
+// Send a file as literal data, whatever the block checksums of the
+// client's copy.
+func (s *sender) sendFile(ndx int32, f *file) error {
+	c := s.c
+
+	var head [4]int32
+	for i := range head {
+		v, err := c.readInt()
+		if err != nil {
+			return err
+		}
+		head[i] = v
+	}
+	count, blength, s2length, remainder := head[0], head[1], head[2], head[3]
+	if count < 0 || blength < 0 || blength > maxBlockLength || s2length < 0 || s2length > md4.Size || remainder < 0 || remainder > blength {
+		return errProtocol
+	}
+	err := c.discard(int64(count) * int64(4+s2length))
+	if err != nil {
+		return err
+	}
+
+	r, err := s.fs.Open(f.path)
+	if err != nil {
+		return s.fileError("send_files failed to open", f.name, err)
+	}
+	defer r.Close()
+
+	c.writeInt(ndx)
+	for _, v := range head {
+		c.writeInt(v)
+	}
+
+	h := md4.New()
+	var seed [4]byte
+	seed[0], seed[1], seed[2], seed[3] = byte(s.seed), byte(s.seed>>8), byte(s.seed>>16), byte(s.seed>>24)
+	_, _ = h.Write(seed[:])
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			c.writeInt(int32(n))
+			_, _ = c.Write(buf[:n])
+			_, _ = h.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The client can't be told the file is incomplete,
+			// so the checksum is made not to match, and it
+			// redoes the file.
+			_ = s.fileError("read", f.name, err)
+			_, _ = h.Write([]byte{0})
+			break
+		}
+	}
+	c.writeInt(0)
+	_, err = c.Write(h.Sum(nil))
+	return err
+}
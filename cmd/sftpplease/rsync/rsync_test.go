@@ -0,0 +1,376 @@
+package rsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+	"golang.org/x/crypto/md4"
+)
+
+// The receiving side of an rsync client, as it runs against a server
+// of protocol 27.
+type client struct {
+	t *testing.T
+	// What the client sends.
+	w io.Writer
+	// The raw server output, and the data in it once multiplexing
+	// starts.
+	raw  io.Reader
+	data bytes.Buffer
+	mux  bool
+	// Messages for the user.
+	msgs []string
+}
+
+func (c *client) writeInt(v int32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	_, err := c.w.Write(b[:])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) read(n int) []byte {
+	if !c.mux {
+		b := make([]byte, n)
+		_, err := io.ReadFull(c.raw, b)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return b
+	}
+	for c.data.Len() < n {
+		var hdr [4]byte
+		_, err := io.ReadFull(c.raw, hdr[:])
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		v := binary.LittleEndian.Uint32(hdr[:])
+		msg := make([]byte, v&0xffffff)
+		_, err = io.ReadFull(c.raw, msg)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if v>>24 == mplexBase+msgData {
+			c.data.Write(msg)
+		} else {
+			c.msgs = append(c.msgs, string(msg))
+		}
+	}
+	return c.data.Next(n)
+}
+
+func (c *client) readInt() int32 {
+	return int32(binary.LittleEndian.Uint32(c.read(4)))
+}
+
+func (c *client) readByte() byte {
+	return c.read(1)[0]
+}
+
+func (c *client) readLongint() int64 {
+	v := c.readInt()
+	if v != -1 {
+		return int64(v)
+	}
+	return int64(binary.LittleEndian.Uint64(c.read(8)))
+}
+
+type entry struct {
+	name  string
+	size  int64
+	mtime int32
+	mode  uint32
+}
+
+func (c *client) readFileList(owner bool) []entry {
+	var files []entry
+	var last entry
+	for {
+		flags := c.readByte()
+		if flags == 0 {
+			break
+		}
+		l1 := 0
+		if flags&xmitSameName != 0 {
+			l1 = int(c.readByte())
+		}
+		var l2 int
+		if flags&xmitLongName != 0 {
+			l2 = int(c.readInt())
+		} else {
+			l2 = int(c.readByte())
+		}
+		e := entry{name: last.name[:l1] + string(c.read(l2))}
+		e.size = c.readLongint()
+		e.mtime = last.mtime
+		if flags&xmitSameTime == 0 {
+			e.mtime = c.readInt()
+		}
+		e.mode = last.mode
+		if flags&xmitSameMode == 0 {
+			e.mode = uint32(c.readInt())
+		}
+		if owner && flags&xmitSameUid == 0 {
+			c.readInt()
+		}
+		if owner && flags&xmitSameGid == 0 {
+			c.readInt()
+		}
+		files = append(files, e)
+		last = e
+	}
+	if owner {
+		// The uid and gid lists.
+		if c.readInt() != 0 || c.readInt() != 0 {
+			c.t.Fatal("expected empty id lists")
+		}
+	}
+	if ioError := c.readInt(); ioError != 0 {
+		c.t.Logf("io error %d", ioError)
+	}
+	return files
+}
+
+// Ask for file ndx, sending count block checksums of a client copy,
+// and return the file data.
+func (c *client) receive(ndx int32, seed int32, count int32) []byte {
+	c.writeInt(ndx)
+	c.writeInt(count)
+	c.writeInt(700)
+	c.writeInt(2)
+	c.writeInt(0)
+	for i := int32(0); i < count; i++ {
+		c.writeInt(i)
+		_, _ = c.w.Write([]byte{1, 2})
+	}
+	if got := c.readInt(); got != ndx {
+		c.t.Fatalf("expected file %d, got %d", ndx, got)
+	}
+	for i, expect := range []int32{count, 700, 2, 0} {
+		if got := c.readInt(); got != expect {
+			c.t.Fatalf("sum head %d: expected %d, got %d", i, expect, got)
+		}
+	}
+	var data []byte
+	for {
+		n := c.readInt()
+		if n == 0 {
+			break
+		}
+		if n < 0 {
+			c.t.Fatalf("unexpected block match %d", n)
+		}
+		data = append(data, c.read(int(n))...)
+	}
+	h := md4.New()
+	_ = binary.Write(h, binary.LittleEndian, seed)
+	h.Write(data)
+	if sum := c.read(md4.Size); !bytes.Equal(sum, h.Sum(nil)) {
+		c.t.Fatalf("file %d: checksum mismatch", ndx)
+	}
+	return data
+}
+
+type result struct {
+	status int
+	stderr string
+}
+
+// Run the server with a client connected by pipes, which buffer
+// writes like the ssh connection does.
+func startClient(t *testing.T, fs vfs.VFS, args []string) (*client, <-chan result) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = inW.Close()
+		_ = outR.Close()
+	})
+	results := make(chan result, 1)
+	go func() {
+		var stderr bytes.Buffer
+		status := run(args, fs, inR, outW, &stderr)
+		_ = inR.Close()
+		_ = outW.Close()
+		results <- result{status, stderr.String()}
+	}()
+	return &client{t: t, w: inW, raw: outR}, results
+}
+
+func (c *client) start() int32 {
+	c.writeInt(31)
+	if v := c.readInt(); v != ProtocolVersion {
+		c.t.Fatalf("unexpected protocol version %d", v)
+	}
+	seed := c.readInt()
+	c.mux = true
+	// No filter rules.
+	c.writeInt(0)
+	return seed
+}
+
+func (c *client) finish() {
+	// The end of the first pass, and the pass redoing files.
+	c.writeInt(-1)
+	if v := c.readInt(); v != -1 {
+		c.t.Fatalf("expected the end of the first pass, got %d", v)
+	}
+	c.writeInt(-1)
+	if v := c.readInt(); v != -1 {
+		c.t.Fatalf("expected the end of the transfer, got %d", v)
+	}
+	// Stats.
+	c.readLongint()
+	c.readLongint()
+	c.readLongint()
+	c.writeInt(-1)
+}
+
+func writeFile(t *testing.T, fs *mem.Fs, p string, data string, mtime int64) {
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	err = fs.Chtimes(p, time.Unix(mtime, 0), time.Unix(mtime, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	fs := mem.New()
+	for _, dir := range []string{"/src", "/src/sub"} {
+		if err := fs.Mkdir(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := strings.Repeat("0123456789", 10000)
+	writeFile(t, fs, "/src/a", "hello", 1600000000)
+	writeFile(t, fs, "/src/sub/big", big, 1600000000)
+	writeFile(t, fs, "/src/sub.txt", "", 1500000000)
+
+	c, results := startClient(t, fs, []string{"--server", "--sender", "-vlogDtpre.iLsfxCIvu", ".", "src/"})
+	seed := c.start()
+	files := c.readFileList(true)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	// Sorted as the client sorts them.
+	if strings.Join(names, " ") != ". a sub sub.txt sub/big" {
+		t.Fatalf("unexpected file list %q", names)
+	}
+	if files[1] != (entry{"a", 5, 1600000000, 0100640}) {
+		t.Fatalf("unexpected entry %+v", files[1])
+	}
+	if files[3] != (entry{"sub.txt", 0, 1500000000, 0100640}) {
+		t.Fatalf("unexpected entry %+v", files[3])
+	}
+	if files[0].mode != 040750 || files[2].mode != 040750 {
+		t.Fatalf("unexpected directory modes %o %o", files[0].mode, files[2].mode)
+	}
+
+	if got := c.receive(1, seed, 0); string(got) != "hello" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	// Block checksums of a client copy are ignored.
+	if got := c.receive(4, seed, 3); string(got) != big {
+		t.Fatal("unexpected contents")
+	}
+	c.finish()
+
+	r := <-results
+	if r.status != 0 {
+		t.Fatalf("exit status %d: %s", r.status, r.stderr)
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	fs := mem.New()
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/a", "hello", 1600000000)
+
+	// Directories need -r, missing files are reported.
+	c, results := startClient(t, fs, []string{"--server", "--sender", "-t", ".", "dir", "missing", "a"})
+	seed := c.start()
+	files := c.readFileList(false)
+	if len(files) != 1 || files[0].name != "a" {
+		t.Fatalf("unexpected file list %v", files)
+	}
+	if got := c.receive(0, seed, 0); string(got) != "hello" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	c.finish()
+	r := <-results
+	if r.status != ExitPartial {
+		t.Fatalf("expected a partial transfer, got %d", r.status)
+	}
+	msgs := strings.Join(c.msgs, "")
+	if !strings.Contains(msgs, "skipping directory dir") || !strings.Contains(msgs, `link_stat "missing" failed`) {
+		t.Fatalf("unexpected messages %q", msgs)
+	}
+
+	// Filter rules are refused.
+	c, results = startClient(t, fs, []string{"--server", "--sender", "-r", ".", "dir"})
+	c.writeInt(31)
+	c.readInt()
+	c.readInt()
+	c.mux = true
+	c.writeInt(8)
+	_, _ = c.w.Write([]byte("- *.tmp\n"))
+	_, _ = io.Copy(io.Discard, c.raw)
+	r = <-results
+	if r.status == 0 {
+		t.Fatal("expected filter rules to be refused")
+	}
+}
+
+func TestFileListFormat(t *testing.T) {
+	fs := mem.New()
+	writeFile(t, fs, "/a", "hello", 1600000000)
+	writeFile(t, fs, "/ab", "", 1600000000)
+
+	c, results := startClient(t, fs, []string{"--server", "--sender", "-t", ".", "a", "ab"})
+	c.start()
+	expect := []byte{
+		// Same uid and gid, a name of 1 byte.
+		0x18, 1, 'a',
+		5, 0, 0, 0,
+		0x00, 0x10, 0x5e, 0x5f,
+		0xa0, 0x81, 0, 0,
+		// The same mode and time, 1 byte of the last name and 1 more.
+		0x18 | xmitSameMode | xmitSameTime | xmitSameName, 1, 1, 'b',
+		0, 0, 0, 0,
+		// The end of the list, and no errors.
+		0,
+		0, 0, 0, 0,
+	}
+	if got := c.read(len(expect)); !bytes.Equal(got, expect) {
+		t.Fatalf("unexpected file list\n%x\nexpected\n%x", got, expect)
+	}
+	c.finish()
+	if r := <-results; r.status != 0 {
+		t.Fatalf("exit status %d: %s", r.status, r.stderr)
+	}
+}
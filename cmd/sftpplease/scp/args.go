@@ -0,0 +1,110 @@
+package scp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The arguments of a remote scp command.
+type Args struct {
+	Source    bool // -f
+	Sink      bool // -t
+	Recursive bool // -r
+	TargetDir bool // -d
+	Preserve  bool // -p
+	BwLimit   uint // -l, in Kbit/s
+	Digest    bool // -H, exchange SHA-256 digests of files
+	Paths     []string
+}
+
+// The flags of OpenSSH scp, mapped to whether they take a value.
+// Clients only pass some of them to the remote scp, the others
+// are accepted so any that are passed along do no harm, and are
+// ignored like -v, -q and -E. -H is an sftpplease extension.
+var scpFlags = map[byte]bool{
+	'1': false, '2': false, '3': false, '4': false, '6': false,
+	'A': false, 'B': false, 'C': false, 'E': false, 'O': false,
+	'R': false, 'T': false, 'q': false, 'v': false,
+	'd': false, 'f': false, 'p': false, 'r': false, 't': false,
+	'H': false,
+	'F': true, 'J': true, 'P': true, 'S': true, 'X': true,
+	'c': true, 'i': true, 'l': true, 'o': true, 's': true,
+}
+
+// Parse scp arguments as OpenSSH scp does with getopt, flags may be
+// grouped like -pt and values may follow their flag directly like
+// -l100. Flags end at "--" or the first argument that isn't one.
+func ParseArgs(args []string) (*Args, error) {
+	a := &Args{}
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		for j := 1; j < len(arg); j++ {
+			c := arg[j]
+			hasValue, ok := scpFlags[c]
+			if !ok {
+				return nil, fmt.Errorf("scp: unexpected flag: -%c", c)
+			}
+			if !hasValue {
+				a.setFlag(c)
+				continue
+			}
+			value := arg[j+1:]
+			if value == "" {
+				i++
+				if i == len(args) {
+					return nil, fmt.Errorf("scp: flag -%c needs a value", c)
+				}
+				value = args[i]
+			}
+			if c == 'l' {
+				limit, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("scp: bad bandwidth limit: %q", value)
+				}
+				a.BwLimit = uint(limit)
+			}
+			break
+		}
+	}
+	a.Paths = args[i:]
+	return a, nil
+}
+
+func (a *Args) setFlag(c byte) {
+	switch c {
+	case 'f':
+		a.Source = true
+	case 't':
+		a.Sink = true
+	case 'r':
+		a.Recursive = true
+	case 'd':
+		a.TargetDir = true
+	case 'p':
+		a.Preserve = true
+	case 'H':
+		a.Digest = true
+	}
+}
+
+// Check a has one mode and the paths it needs.
+func (a *Args) Validate() error {
+	if a.Source == a.Sink {
+		return fmt.Errorf("scp: exactly one of -f or -t is required")
+	}
+	if len(a.Paths) == 0 {
+		return fmt.Errorf("scp: no paths given")
+	}
+	if a.Sink && len(a.Paths) != 1 {
+		return fmt.Errorf("scp: -t takes one target path")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package scp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected *Args
+	}{
+		{[]string{"-t", "--", "/dir"}, &Args{Sink: true, Paths: []string{"/dir"}}},
+		{[]string{"-v", "-r", "-p", "-d", "-t", "/dir"},
+			&Args{Sink: true, Recursive: true, TargetDir: true, Preserve: true, Paths: []string{"/dir"}}},
+		{[]string{"-prf", "a", "b"}, &Args{Source: true, Recursive: true, Preserve: true, Paths: []string{"a", "b"}}},
+		{[]string{"-qE", "-l", "100", "-f", "a"}, &Args{Source: true, BwLimit: 100, Paths: []string{"a"}}},
+		{[]string{"-fl100", "a"}, &Args{Source: true, BwLimit: 100, Paths: []string{"a"}}},
+		{[]string{"-f", "-o", "Foo=bar", "--", "-a"}, &Args{Source: true, Paths: []string{"-a"}}},
+	} {
+		a, err := ParseArgs(tc.args)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.args, err)
+		}
+		if !reflect.DeepEqual(a, tc.expected) {
+			t.Fatalf("%q: got %+v, expected %+v", tc.args, a, tc.expected)
+		}
+		if err := a.Validate(); err != nil {
+			t.Fatalf("%q: %s", tc.args, err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-x", "-t", "/"},
+		{"-t", "-l"},
+		{"-l", "fast", "-t", "/"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Fatalf("%q: expected an error", args)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-r", "/"},
+		{"-f", "-t", "/"},
+		{"-f"},
+		{"-t", "a", "b"},
+	} {
+		a, err := ParseArgs(args)
+		if err != nil {
+			t.Fatalf("%q: %s", args, err)
+		}
+		if err := a.Validate(); err == nil {
+			t.Fatalf("%q: expected an invalid command", args)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package scp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// With -H, an extension to the scp protocol, the source of each
+// file sends an 'H' line with the hex SHA-256 digest of the data
+// after the data and its terminating zero byte, before waiting for
+// the sink to acknowledge the file. A sink finding a different
+// digest reports an error and removes the file rather than keeping
+// corrupted data. Clients must only pass -H if they support it.
+
+var ErrDigestMismatch = errors.New("sha256 digest mismatch")
+
+// Hashes the data of a file as it is sent or received, or nil
+// when digests aren't being exchanged.
+func newDigest() hash.Hash {
+	if !verifyDigest {
+		return nil
+	}
+	return sha256.New()
+}
+
+// Wrap r so data read from it is hashed by h, if not nil.
+func hashReader(r io.Reader, h hash.Hash) io.Reader {
+	if h == nil {
+		return r
+	}
+	return io.TeeReader(r, h)
+}
+
+func sendDigest(h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+	if _, err := fmt.Fprintf(out, "H%s\n", hex.EncodeToString(h.Sum(nil))); err != nil {
+		return FatalError(err.Error())
+	}
+	return nil
+}
+
+// Read the digest line of a file received, comparing
+// it to the digest of the data h hashed.
+func checkDigest(name string, h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+	prefix, err := rd.ReadByte()
+	if err != nil {
+		return FatalError(err.Error())
+	}
+	if prefix != 'H' {
+		return protocolErr
+	}
+	line, err := readLine()
+	if err != nil {
+		return FatalError(err.Error())
+	}
+	if line != hex.EncodeToString(h.Sum(nil)) {
+		return fmt.Errorf("%s: %s", name, ErrDigestMismatch)
+	}
+	return nil
+}
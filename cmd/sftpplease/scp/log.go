@@ -0,0 +1,81 @@
+package scp
+
+import (
+	"os"
+
+	"github.com/andrewchambers/sftpplease/sftp"
+)
+
+// Exit statuses of Main.
+const (
+	// Everything was transferred.
+	ExitOK = 0
+	// Some files were not transferred, the errors
+	// were reported to the client as they happened.
+	ExitFileErrors = 1
+	// Bad arguments, or a fatal error that ended the session.
+	ExitFatal = 2
+)
+
+var (
+	// If set, receives scp errors and a record
+	// of each file sent or received.
+	Logger sftp.Logger
+	// If set, receives a record of each file
+	// received, including failures.
+	AuditLog sftp.AuditLog
+	// Identifies the session in audit records.
+	SessionID string
+)
+
+func logf(format string, args ...interface{}) {
+	if Logger != nil {
+		Logger.Logf(format, args...)
+	}
+}
+
+// Record the file t transferred in the log, and the
+// audit log if it modified the file system.
+func (t *transfer) record(err error) {
+	if Logger == nil && AuditLog == nil {
+		return
+	}
+	op := &sftp.OpRecord{
+		Op:       "scp-" + t.verb,
+		Path:     t.name,
+		Bytes:    t.n,
+		Start:    t.start,
+		Duration: t.end.Sub(t.start),
+		Err:      err,
+	}
+	if t.verb == "receive" {
+		perm := t.perm
+		op.Mode = &perm
+	}
+	if Logger != nil {
+		Logger.LogOp(op)
+	}
+	if AuditLog != nil && t.verb == "receive" {
+		AuditLog.Audit(SessionID, op)
+	}
+}
+
+// The exit status for the error a session ended with.
+func exitStatus(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case isFatal(err):
+		return ExitFatal
+	default:
+		return ExitFileErrors
+	}
+}
+
+func exit(err error) {
+	if err != nil {
+		logf("scp session %s: %s", SessionID, err)
+		_, _ = os.Stderr.WriteString(err.Error() + "\n")
+	}
+	os.Exit(exitStatus(err))
+}
@@ -0,0 +1,79 @@
+package scp
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Check a name received from the client names a single file in the
+// directory it is sent to, and can't be mistaken for another name.
+// Control and formatting characters, like bidirectional overrides
+// and zero width spaces, can disguise names in listings.
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return FatalError(name + ": invalid name")
+	}
+	if !utf8.ValidString(name) {
+		return FatalError(name + ": invalid name, not UTF-8")
+	}
+	for _, r := range name {
+		if r == '/' {
+			return FatalError(name + ": invalid name")
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return FatalError(name + ": invalid name, contains control characters")
+		}
+	}
+	return nil
+}
+
+// The path of name in dir, failing if it
+// would not be directly inside dir.
+func childPath(dir, name string) (string, error) {
+	if err := validateName(name); err != nil {
+		return "", err
+	}
+	dir = path.Clean(dir)
+	p := path.Join(dir, name)
+	if path.Dir(p) != dir {
+		return "", FatalError(name + ": invalid name")
+	}
+	return p, nil
+}
+
+// Where a file or directory named name sent to target is received.
+// Like OpenSSH scp, that is inside target if it is a directory,
+// otherwise target itself, which may not exist yet. The stat of
+// the path is returned if it exists.
+func resolveTarget(target, name string) (string, os.FileInfo, error) {
+	st, err := fs.Stat(target)
+	if err == nil && st.IsDir() {
+		p, err := childPath(target, name)
+		if err != nil {
+			return "", nil, err
+		}
+		st, err := fs.Stat(p)
+		if os.IsNotExist(err) {
+			return p, nil, nil
+		} else if err != nil {
+			return "", nil, err
+		}
+		return p, st, nil
+	} else if os.IsNotExist(err) {
+		if strings.HasSuffix(target, "/") {
+			return "", nil, errors.New(target + ": no such directory")
+		}
+		// Names are still checked, though not used.
+		if err := validateName(name); err != nil {
+			return "", nil, err
+		}
+		return target, nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	return target, st, nil
+}
@@ -1,15 +1,19 @@
 package scp
 
 import (
+	"bufio"
+	"context"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/andrewchambers/sftpplease/extraio"
 	"github.com/andrewchambers/sftpplease/vfs"
 	"golang.org/x/sys/unix"
 )
@@ -22,63 +26,104 @@ const (
 
 	MaxErrLen        = 1024
 	DirScanBatchSize = 256
+	// Deeper directories are not sent, in case of link
+	// loops backends can't detect.
+	MaxDirDepth = 256
 )
 
+// Whether symlinks in directories sent recursively are followed,
+// as OpenSSH scp does, or skipped. Links can't be recreated, the
+// scp protocol has no way to send them and file systems have no way
+// to read or create them. Skipping only works for backends that
+// report links in directory listings, and paths named by the client
+// are always followed.
+var FollowSymlinks = true
+
+// The most files, including directories being sent,
+// open at once, 0 for no limit.
+var MaxFiles = 0
+
+var ErrTooManyOpenFiles = errors.New("too many open files")
+
+// Operator filters on the paths sent and received. Files are only
+// transferred if they match one of the Include patterns, if there
+// are any, and none of the Exclude patterns. Directories are only
+// subject to Exclude, excluding them excludes all they contain.
+var (
+	Include []*vfs.NamePattern
+	Exclude []*vfs.NamePattern
+)
+
+var openFiles int
+
+// If set, limits the rate of transfers along with any
+// limit the client sets, and may be shared with sftp.
+var RateLimiter *extraio.RateLimiter
+
 var (
 	fs            vfs.VFS
-	flags         *flag.FlagSet
-	iamSource     *bool
-	iamSink       *bool
-	bwLimit       *uint
-	iamRecursive  *bool
-	targetDir     *bool
-	preserveAttrs *bool
+	iamSource     bool
+	iamSink       bool
+	iamRecursive  bool
+	targetDir     bool
+	preserveAttrs bool
+	verifyDigest  bool
 
 	protocolErr = FatalError("protocol error")
 
-	in  io.Reader = os.Stdin
-	out io.Writer = os.Stdout
+	in  io.Reader
+	out io.Writer
+
+	// Buffers in for both protocol lines and file data,
+	// which must always be read through it once created.
+	rd *bufio.Reader
 )
 
+// Run scp with the arguments the client passed, over
+// stdin and stdout, exiting when it is done.
 func Main(osArgs []string, vfs vfs.VFS) {
-	fs = vfs
-	flags := flag.NewFlagSet("rscp", flag.ExitOnError)
-
-	iamSource = flags.Bool("f", false, "Run in source mode")
-	iamSink = flags.Bool("t", false, "Run in sink mode")
-	bwLimit = flags.Uint("l", 0, "Limit the bandwidth, specified in Kbit/s")
-	iamRecursive = flags.Bool("r", false, "Copy directories recursively following any symlinks")
-	targetDir = flags.Bool("d", false, "Target should be a directory")
-	preserveAttrs = flags.Bool("p", false, "Preserve modification and access times and mode from original file")
-
-	flags.Parse(osArgs)
-	var args = flags.Args()
-
-	var validMode = (*iamSource || *iamSink) && !(*iamSource && *iamSink)
-	var validArgc = (*iamSource && len(args) > 0) || (*iamSink && len(args) == 1)
+	exit(run(osArgs, vfs, os.Stdin, os.Stdout))
+}
 
-	if !validMode || !validArgc {
+func run(osArgs []string, vfs vfs.VFS, stdin io.Reader, stdout io.Writer) error {
+	fs = vfs
+	in = stdin
+	out = stdout
+	a, err := ParseArgs(osArgs)
+	if err == nil {
+		err = a.Validate()
+	}
+	if err != nil {
 		usage()
+		return FatalError(err.Error())
 	}
+	iamSource = a.Source
+	iamSink = a.Sink
+	iamRecursive = a.Recursive
+	targetDir = a.TargetDir
+	preserveAttrs = a.Preserve
+	verifyDigest = a.Digest
+	args := a.Paths
 
-	if *bwLimit > 0 {
-		st := NewBwStats(*bwLimit * 1024)
-		in = CapReader(in, st)
-		out = CapWriter(out, st)
+	var limiter *extraio.RateLimiter
+	if a.BwLimit > 0 {
+		limiter = extraio.NewRateLimiter(int64(a.BwLimit) * 1024 / 8)
 	}
+	if limiter != nil || RateLimiter != nil {
+		// The process exits when the session ends.
+		in = extraio.LimitReader(context.Background(), in, limiter, RateLimiter)
+		out = extraio.LimitWriter(context.Background(), out, limiter, RateLimiter)
+	}
+	rd = bufio.NewReader(in)
 
-	var err error
-
-	if *iamSource {
+	startSession()
+	if iamSource {
 		err = source(args)
 	} else {
 		err = sink(args[0], false)
 	}
-
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
+	reportSession(err)
+	return err
 }
 
 func source(paths []string) error {
@@ -88,10 +133,20 @@ func source(paths []string) error {
 
 	var sendErrs []error
 	for _, path := range paths {
-		if err := send(path); isFatal(err) {
-			return err
-		} else if err != nil {
+		matches, err := expand(path)
+		if err != nil {
+			if err := teeError(err); isFatal(err) {
+				return err
+			}
 			sendErrs = append(sendErrs, err)
+			continue
+		}
+		for _, match := range matches {
+			if err := send(match, nil); isFatal(err) {
+				return err
+			} else if err != nil {
+				sendErrs = append(sendErrs, err)
+			}
 		}
 	}
 
@@ -101,11 +156,31 @@ func source(paths []string) error {
 	return nil
 }
 
+// Expand wildcards in a source path, which scp clients pass
+// through for the remote shell to expand.
+func expand(name string) ([]string, error) {
+	if !vfs.HasGlobMeta(name) {
+		return []string{name}, nil
+	}
+	matches, err := vfs.Glob(fs, name)
+	if err != nil {
+		return nil, errors.New(name + ": " + err.Error())
+	}
+	if len(matches) == 0 {
+		// Literal names may contain special characters.
+		if _, err := fs.Stat(name); err == nil {
+			return []string{name}, nil
+		}
+		return nil, errors.New(name + ": no such file or directory")
+	}
+	return matches, nil
+}
+
 func sink(path string, recur bool) error {
 	var errs []error
 	var times *FileTimes
 
-	if *targetDir {
+	if targetDir {
 		if st, err := fs.Stat(path); err != nil {
 			return teeError(FatalError(err.Error()))
 		} else if !st.IsDir() {
@@ -118,8 +193,8 @@ func sink(path string, recur bool) error {
 	}
 
 	for first := true; ; first = false {
-		prefix := []byte{0}
-		if _, err := in.Read(prefix); err != nil {
+		prefix, err := rd.ReadByte()
+		if err != nil {
 			if err == io.EOF {
 				break
 			}
@@ -130,7 +205,7 @@ func sink(path string, recur bool) error {
 			return FatalError(err.Error())
 		}
 
-		switch prefix[0] {
+		switch prefix {
 		case '\x01':
 			errs = append(errs, errors.New(line))
 
@@ -144,6 +219,12 @@ func sink(path string, recur bool) error {
 			if _, err := fmt.Fprint(out, "\x00"); err != nil {
 				return FatalError(err.Error())
 			}
+			// The directory is done, later
+			// files belong to its parent.
+			if len(errs) > 0 {
+				return AccError{errs}
+			}
+			return nil
 
 		case 'T':
 			if times == nil {
@@ -151,10 +232,8 @@ func sink(path string, recur bool) error {
 			}
 			if n, err := fmt.Sscanf(line, "%d %d %d %d",
 				&times.Mtime.Sec, &times.Mtime.Usec,
-				&times.Atime.Sec, &times.Atime.Usec); err != nil {
+				&times.Atime.Sec, &times.Atime.Usec); err != nil || n != 4 {
 
-				return teeError(FatalError(err.Error()))
-			} else if n != 4 {
 				return teeError(protocolErr)
 			}
 			if _, err := fmt.Fprint(out, "\x00"); err != nil {
@@ -180,7 +259,7 @@ func sink(path string, recur bool) error {
 		default:
 			err := protocolErr
 			if first {
-				compLine := append([]byte{prefix[0]}, line...)
+				compLine := append([]byte{prefix}, line...)
 				err = FatalError(string(compLine))
 			}
 			return teeError(err)
@@ -194,7 +273,7 @@ func sink(path string, recur bool) error {
 }
 
 func sinkDir(parent, line string, times *FileTimes) error {
-	if !*iamRecursive {
+	if !iamRecursive {
 		return teeError(FatalError("received directory without -r flag"))
 	}
 
@@ -203,7 +282,13 @@ func sinkDir(parent, line string, times *FileTimes) error {
 		return teeError(FatalError(err.Error()))
 	}
 
-	name = path.Join(parent, name)
+	name, _, err = resolveTarget(parent, name)
+	if err != nil {
+		return teeError(err)
+	}
+	if filtered(name, true) {
+		return teeError(errors.New(name + ": " + errFiltered))
+	}
 
 	resetPerm, err := prepareDir(name, perm)
 	if err != nil {
@@ -218,12 +303,8 @@ func sinkDir(parent, line string, times *FileTimes) error {
 	}
 
 	var pendErrs []error
-	if times != nil {
-		// XXX: VFS has no utimes api.
-		//t := []unix.Timeval{times.Atime, times.Mtime}
-		//if err := unix.Utimes(name, t); err != nil {
-		//	pendErrs = append(pendErrs, err)
-		//}
+	if err := setTimes(name, times); err != nil {
+		pendErrs = append(pendErrs, err)
 	}
 	if resetPerm {
 		if err := fs.Chmod(name, perm); err != nil {
@@ -249,60 +330,97 @@ func sinkFile(name, line string, times *FileTimes) error {
 		return teeError(FatalError(err.Error()))
 	}
 
-	exists := false
-	if st, err := fs.Stat(name); err == nil {
-		exists = true
-		if st.IsDir() {
-			name = path.Join(name, subj)
-		}
-	}
+	name, st, err := resolveTarget(name, subj)
 	if err != nil {
 		return teeError(err)
 	}
+	exists := st != nil
+	if exists && st.IsDir() {
+		return teeError(errors.New(name + ": is a directory"))
+	}
+	t := newTransfer("receive", name, perm, size)
+	if filtered(name, false) {
+		err := errors.New(name + ": " + errFiltered)
+		t.done(err)
+		return teeError(err)
+	}
 
-	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, perm|S_IWUSR)
+	f, err := openFile(name, os.O_WRONLY|os.O_CREATE, perm|S_IWUSR)
 	if err != nil {
+		t.done(err)
 		return teeError(err)
 	}
-	defer f.Close() /* will sync explicitly */
+	closed := false
+	defer func() {
+		if !closed {
+			f.Close()
+		}
+	}()
 
 	if _, err := fmt.Fprint(out, "\x00"); err != nil {
 		return FatalError(err.Error())
 	}
 
 	var pendErrs []error
-	if wr, err := io.Copy(f, io.LimitReader(in, size)); err != nil {
-		if _, err := io.Copy(ioutil.Discard, io.LimitReader(in, size-wr)); err != nil {
+	var dst io.Writer = f
+	sw := newSparseWriter(f)
+	if sw != nil && sw.start() == nil {
+		dst = sw
+	} else {
+		sw = nil
+	}
+	h := newDigest()
+	data := &io.LimitedReader{R: rd, N: size}
+	if _, err := io.Copy(dst, hashReader(t.reader(data), h)); err != nil {
+		// Data read but not written has been consumed, only skip
+		// what is left to keep in step with the client.
+		if _, err := io.Copy(ioutil.Discard, data); err != nil {
 			return teeError(FatalError(err.Error()))
 		}
 		pendErrs = append(pendErrs, err)
-	}
-
-	if *preserveAttrs || !exists {
-		if err := f.Chmod(perm); err != nil {
+	} else if sw != nil {
+		if err := sw.finish(); err != nil {
 			pendErrs = append(pendErrs, err)
 		}
 	}
-	if times != nil {
-		if err := unix.Utimes(name,
-			[]unix.Timeval{times.Atime, times.Mtime}); err != nil {
 
+	if preserveAttrs || !exists {
+		if err := f.Chmod(perm); err != nil {
 			pendErrs = append(pendErrs, err)
 		}
 	}
+	// Backends may only store the file when it is closed,
+	// which would replace times set before.
+	closed = true
+	if err := f.Close(); err != nil {
+		pendErrs = append(pendErrs, err)
+	} else if err := setTimes(name, times); err != nil {
+		pendErrs = append(pendErrs, err)
+	}
 
 	ackErr := ack()
 	if isFatal(ackErr) {
 		return ackErr
 	}
+	if ackErr == nil {
+		if err := checkDigest(name, h); isFatal(err) {
+			return err
+		} else if err != nil {
+			// Don't keep what is known to be corrupted.
+			_ = fs.Remove(name)
+			pendErrs = append(pendErrs, err)
+		}
+	}
 
 	var sentErr error
 	if len(pendErrs) > 0 {
 		sentErr = AccError{pendErrs}
+		t.done(sentErr)
 		if err := sendError(sentErr); err != nil {
 			return err
 		}
 	} else {
+		t.done(ackErr)
 		if _, err := fmt.Fprint(out, "\x00"); err != nil {
 			return FatalError(err.Error())
 		}
@@ -314,13 +432,30 @@ func sinkFile(name, line string, times *FileTimes) error {
 	return sentErr
 }
 
+// Set the times of name sent with -p, if any. Times are
+// silently not preserved by backends that can't set them.
+func setTimes(name string, times *FileTimes) error {
+	if times == nil {
+		return nil
+	}
+	ct, ok := fs.(vfs.Chtimeser)
+	if !ok {
+		return nil
+	}
+	err := ct.Chtimes(name, time.Unix(times.Atime.Unix()), time.Unix(times.Mtime.Unix()))
+	if errors.Is(err, vfs.ErrUnsupported) {
+		return nil
+	}
+	return err
+}
+
 func prepareDir(name string, perm os.FileMode) (bool, error) {
 	resetPerm := false
 	if st, err := fs.Stat(name); err == nil {
 		if !st.IsDir() {
 			return resetPerm, errors.New(name + ": is not a directory")
 		}
-		if *preserveAttrs {
+		if preserveAttrs {
 			if err := fs.Chmod(name, perm); err != nil {
 				return resetPerm, err
 			}
@@ -336,8 +471,10 @@ func prepareDir(name string, perm os.FileMode) (bool, error) {
 	return resetPerm, nil
 }
 
-func send(name string) error {
-	f, err := fs.Open(name)
+// Send the file or directory name, inside the directories
+// ancestors when sending directories recursively.
+func send(name string, ancestors []os.FileInfo) error {
+	f, err := openFile(name, os.O_RDONLY, 0)
 	if err != nil {
 		return teeError(err)
 	}
@@ -348,17 +485,29 @@ func send(name string) error {
 		return teeError(err)
 	}
 	name = st.Name()
+	if filtered(f.Name(), st.IsDir()) {
+		return teeError(errors.New(f.Name() + ": " + errFiltered))
+	}
 
 	if mode := st.Mode(); mode.IsDir() {
-		if *iamRecursive {
-			return sendDir(f, st)
+		if iamRecursive {
+			// Followed links can lead back to a directory being sent.
+			for _, a := range ancestors {
+				if os.SameFile(a, st) {
+					return teeError(errors.New(name + ": directory loop"))
+				}
+			}
+			if len(ancestors) >= MaxDirDepth {
+				return teeError(errors.New(name + ": too many levels of directories"))
+			}
+			return sendDir(f, st, append(ancestors, st))
 		}
 		return teeError(errors.New(name + ": is a directory"))
 	} else if !mode.IsRegular() {
 		return teeError(errors.New(name + ": not a regular file"))
 	}
 
-	if *preserveAttrs {
+	if preserveAttrs {
 		if err := sendAttr(st); err != nil {
 			return err
 		}
@@ -373,7 +522,10 @@ func send(name string) error {
 		return err
 	}
 
-	if sent, err := io.Copy(out, f); err != nil {
+	t := newTransfer("send", f.Name(), st.Mode().Perm(), st.Size())
+	h := newDigest()
+	if sent, err := io.Copy(out, hashReader(t.reader(dataReader(f, st)), h)); err != nil {
+		t.done(err)
 		patch := io.LimitReader(ConstReader(0), st.Size()-sent)
 		if _, err := io.Copy(out, patch); err != nil {
 			return FatalError(err.Error())
@@ -387,11 +539,16 @@ func send(name string) error {
 	if _, err := fmt.Fprint(out, "\x00"); err != nil {
 		return FatalError(err.Error())
 	}
-	return ack()
+	if err := sendDigest(h); err != nil {
+		return err
+	}
+	err = ack()
+	t.done(err)
+	return err
 }
 
-func sendDir(dir vfs.File, st os.FileInfo) error {
-	if *preserveAttrs {
+func sendDir(dir vfs.File, st os.FileInfo, ancestors []os.FileInfo) error {
+	if preserveAttrs {
 		if err := sendAttr(st); err != nil {
 			return err
 		}
@@ -410,7 +567,17 @@ func sendDir(dir vfs.File, st os.FileInfo) error {
 	for {
 		children, err := dir.Readdir(DirScanBatchSize)
 		for _, child := range children {
-			if err := send(path.Join(dir.Name(), child.Name())); isFatal(err) {
+			// Links can only be followed or left out.
+			if !FollowSymlinks && child.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+			childPath := path.Join(dir.Name(), child.Name())
+			// Filtered files are left out quietly, only
+			// naming them explicitly is an error.
+			if filtered(childPath, child.IsDir()) {
+				continue
+			}
+			if err := send(childPath, ancestors); isFatal(err) {
 				return err
 			} else if err != nil {
 				sendErrs = append(sendErrs, err)
@@ -438,18 +605,21 @@ func sendDir(dir vfs.File, st os.FileInfo) error {
 }
 
 func parseSubj(line string) (perm os.FileMode, size int64, name string, err error) {
-	n := 0
-	pperm := 0
-	if n, err = fmt.Sscanf(line, "%o %d %s", &pperm, &size, &name); err != nil {
-		return
-	} else if n != 3 {
+	// The name is the rest of the line, it may contain spaces.
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
 		err = protocolErr
 		return
 	}
-	perm = toStdPerm(pperm)
-	if name == ".." || strings.ContainsRune(name, '/') {
-		err = FatalError(name + ": invalid name")
+	pperm, perr := strconv.ParseUint(fields[0], 8, 32)
+	size, serr := strconv.ParseInt(fields[1], 10, 64)
+	if perr != nil || serr != nil || size < 0 {
+		err = protocolErr
+		return
 	}
+	perm = toStdPerm(int(pperm))
+	name = fields[2]
+	err = validateName(name)
 	return
 }
 
@@ -468,11 +638,11 @@ func sendAttr(st os.FileInfo) error {
 }
 
 func ack() error {
-	kind := []byte{0}
-	if _, err := in.Read(kind); err != nil {
+	kind, err := rd.ReadByte()
+	if err != nil {
 		return FatalError(err.Error())
 	}
-	if kind[0] == 0 {
+	if kind == 0 {
 		return nil
 	}
 
@@ -481,7 +651,7 @@ func ack() error {
 		return FatalError(err.Error())
 	}
 
-	switch kind[0] {
+	switch kind {
 	case 1:
 		return errors.New(l)
 	case 2:
@@ -491,6 +661,57 @@ func ack() error {
 	}
 }
 
+const errFiltered = "excluded by the server"
+
+func filtered(name string, isDir bool) bool {
+	for _, np := range Exclude {
+		if np.Match(name) {
+			return true
+		}
+	}
+	if isDir || len(Include) == 0 {
+		return false
+	}
+	for _, np := range Include {
+		if np.Match(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Open a file counted against MaxFiles until it is closed.
+func openFile(name string, flags int, perm os.FileMode) (vfs.File, error) {
+	if MaxFiles > 0 && openFiles >= MaxFiles {
+		return nil, ErrTooManyOpenFiles
+	}
+	var f vfs.File
+	var err error
+	if flags == os.O_RDONLY {
+		f, err = fs.Open(name)
+	} else {
+		f, err = fs.OpenFile(name, flags, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	openFiles++
+	return &countedFile{File: f}, nil
+}
+
+type countedFile struct {
+	vfs.File
+	closed bool
+}
+
+func (f *countedFile) Close() error {
+	if !f.closed {
+		f.closed = true
+		openFiles--
+	}
+	return f.File.Close()
+}
+
 func teeError(err error) error {
 	if err := sendError(err); err != nil {
 		return err
@@ -511,21 +732,11 @@ func sendError(err error) error {
 }
 
 func readLine() (string, error) {
-	l := make([]byte, 0, 64)
-	ch := []byte{0}
-
-	for {
-		if _, err := in.Read(ch); err != nil {
-			return "", err
-		} else {
-			if ch[0] == '\n' {
-				break
-			}
-			l = append(l, ch[0])
-		}
+	l, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
 	}
-
-	return string(l), nil
+	return l[:len(l)-1], nil
 }
 
 func toPosixPerm(perm os.FileMode) int {
@@ -553,8 +764,6 @@ func toStdPerm(posixPerm int) os.FileMode {
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: rscp -f [-pr] [-l limit] file1 ...\n"+
 		"       rscp -t [-prd] [-l limit] directory\n")
-	flag.PrintDefaults()
-	os.Exit(1)
 }
 
 type FileTimes struct {
@@ -578,11 +787,11 @@ type AccError struct {
 }
 
 func (e AccError) Error() string {
-	ve := []interface{}{}
+	msgs := make([]string, 0, len(e.Errors))
 	for _, err := range e.Errors {
-		ve = append(ve, err)
+		msgs = append(msgs, err.Error())
 	}
-	return fmt.Sprintln(ve...)
+	return strings.Join(msgs, "\n")
 }
 
 type ConstReader byte
@@ -0,0 +1,715 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/faultfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// A recorded scp session. The input is what an OpenSSH scp client
+// sends, acknowledgements included, and the output is what the
+// remote scp must send back, byte for byte.
+type transcript struct {
+	name   string
+	args   []string
+	setup  func(t *testing.T, fs *mem.Fs)
+	input  string
+	output string
+	status int
+	check  func(t *testing.T, fs *mem.Fs)
+}
+
+var transcripts = []transcript{
+	{
+		name:   "upload",
+		args:   []string{"-t", "--", "/"},
+		input:  "C0640 5 a.txt\nhello\x00",
+		output: "\x00\x00\x00",
+		check: func(t *testing.T, fs *mem.Fs) {
+			expectFile(t, fs, "/a.txt", "hello", 0640)
+		},
+	},
+	{
+		name:   "upload to file name",
+		args:   []string{"-t", "/b.txt"},
+		input:  "C0644 3 a.txt\nabc\x00",
+		output: "\x00\x00\x00",
+		check: func(t *testing.T, fs *mem.Fs) {
+			expectFile(t, fs, "/b.txt", "abc", 0644)
+			expectMissing(t, fs, "/a.txt")
+		},
+	},
+	{
+		name: "upload preserving times",
+		args: []string{"-p", "-t", "/"},
+		input: "T1600000000 0 1500000000 0\n" +
+			"C0600 2 a\nhi\x00",
+		output: "\x00\x00\x00\x00",
+		check: func(t *testing.T, fs *mem.Fs) {
+			st := expectFile(t, fs, "/a", "hi", 0600)
+			if !st.ModTime().Equal(time.Unix(1600000000, 0)) {
+				t.Fatalf("mtime not preserved: %s", st.ModTime())
+			}
+		},
+	},
+	{
+		name: "recursive upload",
+		args: []string{"-r", "-d", "-t", "/"},
+		input: "D0750 0 dir\n" +
+			"C0644 3 f\nabc\x00" +
+			"D0755 0 sub\n" +
+			"C0644 0 empty\n\x00" +
+			"E\n" +
+			"E\n" +
+			"C0644 3 after\nxyz\x00",
+		output: "\x00" + "\x00" + "\x00\x00" + "\x00" + "\x00\x00" + "\x00" + "\x00" + "\x00\x00",
+		check: func(t *testing.T, fs *mem.Fs) {
+			expectDir(t, fs, "/dir", 0750)
+			expectFile(t, fs, "/dir/f", "abc", 0644)
+			expectDir(t, fs, "/dir/sub", 0755)
+			expectFile(t, fs, "/dir/sub/empty", "", 0644)
+			// Files after a directory ends are in its parent.
+			expectFile(t, fs, "/after", "xyz", 0644)
+		},
+	},
+	{
+		name:   "recursive upload to new directory",
+		args:   []string{"-r", "-t", "/new"},
+		input:  "D0755 0 dir\n" + "C0644 1 f\nx\x00" + "E\n",
+		output: "\x00" + "\x00" + "\x00\x00" + "\x00",
+		check: func(t *testing.T, fs *mem.Fs) {
+			// Like cp -r, the directory is copied as the new name.
+			expectFile(t, fs, "/new/f", "x", 0644)
+			expectMissing(t, fs, "/new/dir")
+		},
+	},
+	{
+		name:   "upload over directory",
+		args:   []string{"-t", "/"},
+		setup:  mkdirs("/a"),
+		input:  "C0644 1 a\n",
+		output: "\x00\x01/a: is a directory\n",
+		status: ExitFileErrors,
+	},
+	{
+		name:   "download",
+		args:   []string{"-f", "/a.txt"},
+		setup:  writeFiles("/a.txt", "hello"),
+		input:  "\x00\x00\x00",
+		output: "C0644 5 a.txt\nhello\x00",
+	},
+	{
+		name:   "download wildcard",
+		args:   []string{"-f", "/*.txt"},
+		setup:  writeFiles("/a.txt", "1", "/b.txt", "22", "/c.dat", "333"),
+		input:  "\x00" + "\x00\x00" + "\x00\x00",
+		output: "C0644 1 a.txt\n1\x00" + "C0644 2 b.txt\n22\x00",
+	},
+	{
+		name: "download preserving times",
+		args: []string{"-p", "-f", "/a"},
+		setup: func(t *testing.T, fs *mem.Fs) {
+			writeFiles("/a", "x")(t, fs)
+			mtime := time.Unix(1600000000, 0)
+			if err := fs.Chtimes("/a", mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		},
+		input:  "\x00\x00\x00\x00",
+		output: "T1600000000 0 0 0\nC0644 1 a\nx\x00",
+	},
+	{
+		name:   "recursive download",
+		args:   []string{"-r", "-f", "/dir"},
+		setup:  writeFiles("/dir/a", "1", "/dir/sub/b", "22"),
+		input:  "\x00" + "\x00" + "\x00\x00" + "\x00" + "\x00\x00" + "\x00" + "\x00",
+		output: "D0755 0 dir\n" + "C0644 1 a\n1\x00" + "D0755 0 sub\n" + "C0644 2 b\n22\x00" + "E\n" + "E\n",
+	},
+	{
+		name:   "download missing file",
+		args:   []string{"-f", "/missing", "/a"},
+		setup:  writeFiles("/a", "x"),
+		input:  "\x00\x00\x00",
+		output: "\x01open /missing: file does not exist\nC0644 1 a\nx\x00",
+		status: ExitFileErrors,
+	},
+	{
+		name:   "download directory without -r",
+		args:   []string{"-f", "/dir"},
+		setup:  writeFiles("/dir/a", "1"),
+		input:  "\x00",
+		output: "\x01dir: is a directory\n",
+		status: ExitFileErrors,
+	},
+	{
+		name:   "download refused by client",
+		args:   []string{"-f", "/a"},
+		setup:  writeFiles("/a", "x"),
+		input:  "\x00\x01a: permission denied\n",
+		output: "C0644 1 a\n",
+		status: ExitFileErrors,
+	},
+	{
+		name:   "upload reported failed by client",
+		args:   []string{"-t", "/"},
+		input:  "C0644 3 a\nab\x00\x01a: read error\n",
+		output: "\x00\x00\x00",
+		status: ExitFileErrors,
+	},
+	{
+		name:   "upload into missing directory",
+		args:   []string{"-t", "/missing/a"},
+		input:  "C0644 1 a\n",
+		output: "\x00\x01open /missing: file does not exist\n",
+		status: ExitFileErrors,
+	},
+	{
+		name:   "directory without -r",
+		args:   []string{"-t", "/"},
+		input:  "D0755 0 dir\n",
+		output: "\x00\x01received directory without -r flag\n",
+		status: ExitFatal,
+		check: func(t *testing.T, fs *mem.Fs) {
+			expectMissing(t, fs, "/dir")
+		},
+	},
+	{
+		name:   "-d target not a directory",
+		args:   []string{"-d", "-t", "/a"},
+		setup:  writeFiles("/a", "x"),
+		output: "\x01/a: is not a directory\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "malformed first line",
+		args:   []string{"-t", "/"},
+		input:  "Xgarbage\n",
+		output: "\x00\x01Xgarbage\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "malformed later line",
+		args:   []string{"-t", "/"},
+		input:  "C0644 1 a\nx\x00Xgarbage\n",
+		output: "\x00\x00\x00\x01protocol error\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "malformed file line",
+		args:   []string{"-t", "/"},
+		input:  "C0644 one a\n",
+		output: "\x00\x01protocol error\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "malformed times",
+		args:   []string{"-p", "-t", "/"},
+		input:  "T1 2 3\n",
+		output: "\x00\x01protocol error\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "parent directory name",
+		args:   []string{"-r", "-t", "/dir"},
+		setup:  mkdirs("/dir"),
+		input:  "C0644 1 ..\nx\x00",
+		output: "\x00\x01..: invalid name\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "name with slash",
+		args:   []string{"-t", "/"},
+		input:  "C0644 1 a/b\nx\x00",
+		output: "\x00\x01a/b: invalid name\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "name with spaces",
+		args:   []string{"-t", "/"},
+		input:  "C0644 1 a b  c\nx\x00",
+		output: "\x00\x00\x00",
+		check: func(t *testing.T, fs *mem.Fs) {
+			expectFile(t, fs, "/a b  c", "x", 0644)
+		},
+	},
+	{
+		name:   "name with control characters",
+		args:   []string{"-t", "/"},
+		input:  "C0644 1 a\rb\nx\x00",
+		output: "\x00\x01a\rb: invalid name, contains control characters\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "name with bidirectional override",
+		args:   []string{"-r", "-t", "/"},
+		input:  "D0755 0 txt.\u202eexe\n",
+		output: "\x00\x01txt.\u202eexe: invalid name, contains control characters\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "name not UTF-8",
+		args:   []string{"-t", "/"},
+		input:  "C0644 1 \xff\nx\x00",
+		output: "\x00\x01\xff: invalid name, not UTF-8\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "dot name",
+		args:   []string{"-r", "-t", "/dir"},
+		setup:  mkdirs("/dir"),
+		input:  "D0755 0 .\n",
+		output: "\x00\x01.: invalid name\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "end without directory",
+		args:   []string{"-t", "/"},
+		input:  "E\n",
+		output: "\x00\x01protocol error\n",
+		status: ExitFatal,
+	},
+	{
+		name:   "truncated data",
+		args:   []string{"-t", "/"},
+		input:  "C0644 10 a\nabc",
+		output: "\x00\x00",
+		status: ExitFatal,
+	},
+	{
+		name:   "fatal error from client",
+		args:   []string{"-t", "/"},
+		input:  "\x02connection lost\n",
+		output: "\x00",
+		status: ExitFatal,
+	},
+	{
+		name:   "bad arguments",
+		args:   []string{"-t", "-f", "/"},
+		status: ExitFatal,
+	},
+	{
+		name:   "digest",
+		args:   []string{"-H", "-t", "/"},
+		input:  "C0644 5 a\nhello\x00H2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n",
+		output: "\x00\x00\x00",
+		check: func(t *testing.T, fs *mem.Fs) {
+			expectFile(t, fs, "/a", "hello", 0644)
+		},
+	},
+	{
+		name:   "digest mismatch",
+		args:   []string{"-H", "-t", "/"},
+		input:  "C0644 5 a\nhellO\x00H2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n",
+		output: "\x00\x00\x01/a: sha256 digest mismatch\n",
+		status: ExitFileErrors,
+		check: func(t *testing.T, fs *mem.Fs) {
+			expectMissing(t, fs, "/a")
+		},
+	},
+	{
+		name:   "download with digest",
+		args:   []string{"-H", "-f", "/a"},
+		setup:  writeFiles("/a", "hello"),
+		input:  "\x00\x00\x00",
+		output: "C0644 5 a\nhello\x00H2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n",
+	},
+}
+
+func TestTranscripts(t *testing.T) {
+	for _, tc := range transcripts {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := mem.New()
+			if tc.setup != nil {
+				tc.setup(t, fs)
+			}
+			var out bytes.Buffer
+			err := run(tc.args, fs, bytes.NewBufferString(tc.input), &out)
+			if status := exitStatus(err); status != tc.status {
+				t.Fatalf("exit status %d, expected %d: %v", status, tc.status, err)
+			}
+			if got := out.String(); got != tc.output {
+				t.Fatalf("output:\n%q\nexpected:\n%q", got, tc.output)
+			}
+			if openFiles != 0 {
+				t.Fatalf("%d files left open", openFiles)
+			}
+			if tc.check != nil {
+				tc.check(t, fs)
+			}
+		})
+	}
+}
+
+// A reader returning one of reads for each call to Read.
+type readsReader struct {
+	reads []string
+}
+
+func (r *readsReader) Read(buf []byte) (int, error) {
+	if len(r.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf, r.reads[0])
+	r.reads[0] = r.reads[0][n:]
+	if r.reads[0] == "" {
+		r.reads = r.reads[1:]
+	}
+	return n, nil
+}
+
+// Protocol lines and file data are buffered together, however the
+// client's writes arrive.
+func TestReadBoundaries(t *testing.T) {
+	input := "C0644 5 a\nhello\x00" + "C0644 3 b\nabc\x00"
+	var bytewise []string
+	for i := range input {
+		bytewise = append(bytewise, input[i:i+1])
+	}
+	for _, reads := range [][]string{
+		// A C line and its data arriving in the same read.
+		{"C0644 5 a\nhello", "\x00", "C0644 3 b\nabc", "\x00"},
+		// Data arriving with the next file's C line.
+		{"C0644 5 a\n", "hello\x00C0644 3 b\n", "abc\x00"},
+		{input},
+		bytewise,
+	} {
+		fs := mem.New()
+		var out bytes.Buffer
+		err := run([]string{"-t", "/"}, fs, &readsReader{reads: append([]string{}, reads...)}, &out)
+		if err != nil {
+			t.Fatalf("%q: %s", reads, err)
+		}
+		if got := out.String(); got != "\x00\x00\x00\x00\x00" {
+			t.Fatalf("%q: unexpected output %q", reads, got)
+		}
+		expectFile(t, fs, "/a", "hello", 0644)
+		expectFile(t, fs, "/b", "abc", 0644)
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	fs = mem.New()
+	defer func() { fs = nil }()
+	mkdirs("/dir", "/dir/sub")(t, fs.(*mem.Fs))
+	writeFiles("/dir/f", "x", "/file", "y")(t, fs.(*mem.Fs))
+
+	for _, tc := range []struct {
+		target, name string
+		expected     string
+		exists       bool
+	}{
+		{"/dir", "new", "/dir/new", false},
+		{"/dir/", "f", "/dir/f", true},
+		{"/dir", "sub", "/dir/sub", true},
+		{"/", "file", "/file", true},
+		{"/file", "other", "/file", true},
+		{"/new", "other", "/new", false},
+		{"/dir/new", "other", "/dir/new", false},
+	} {
+		p, st, err := resolveTarget(tc.target, tc.name)
+		if err != nil {
+			t.Fatalf("%s %s: %s", tc.target, tc.name, err)
+		}
+		if p != tc.expected || (st != nil) != tc.exists {
+			t.Fatalf("%s %s: got %s %v, expected %s %v", tc.target, tc.name, p, st != nil, tc.expected, tc.exists)
+		}
+	}
+
+	for _, tc := range []struct{ target, name string }{
+		{"/new/", "a"},
+		{"/missing/dir/", "a"},
+		{"/dir", ".."},
+		{"/new", "a/b"},
+	} {
+		if _, _, err := resolveTarget(tc.target, tc.name); err == nil {
+			t.Fatalf("%s %s: expected an error", tc.target, tc.name)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	defer func() {
+		Include = nil
+		Exclude = nil
+	}()
+	var err error
+	Include, err = vfs.ParseNamePatterns([]string{"*.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Exclude, err = vfs.ParseNamePatterns([]string{"secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := mem.New()
+	writeFiles("/dir/a.txt", "1", "/dir/b.dat", "2", "/dir/secret/c.txt", "3")(t, fs)
+	var out bytes.Buffer
+	input := "\x00" + "\x00" + "\x00\x00" + "\x00"
+	if err := run([]string{"-r", "-f", "/dir"}, fs, bytes.NewBufferString(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := "D0755 0 dir\n" + "C0644 1 a.txt\n1\x00" + "E\n"
+	if out.String() != expected {
+		t.Fatalf("output:\n%q\nexpected:\n%q", out.String(), expected)
+	}
+
+	out.Reset()
+	err = run([]string{"-t", "/"}, fs, bytes.NewBufferString("C0644 1 x.exe\n"), &out)
+	if exitStatus(err) != ExitFileErrors {
+		t.Fatalf("expected excluded upload to fail, got %v", err)
+	}
+	expectMissing(t, fs, "/x.exe")
+}
+
+func writeFiles(pathsAndData ...string) func(t *testing.T, fs *mem.Fs) {
+	return func(t *testing.T, fs *mem.Fs) {
+		t.Helper()
+		for i := 0; i < len(pathsAndData); i += 2 {
+			p := pathsAndData[i]
+			for dir := ""; ; {
+				j := strings.IndexByte(p[len(dir)+1:], '/')
+				if j < 0 {
+					break
+				}
+				dir = p[:len(dir)+1+j]
+				if err := fs.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+					t.Fatal(err)
+				}
+			}
+			f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte(pathsAndData[i+1])); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func mkdirs(dirs ...string) func(t *testing.T, fs *mem.Fs) {
+	return func(t *testing.T, fs *mem.Fs) {
+		t.Helper()
+		for _, dir := range dirs {
+			if err := fs.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func expectFile(t *testing.T, fs *mem.Fs, p, data string, perm os.FileMode) os.FileInfo {
+	t.Helper()
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != data {
+		t.Fatalf("%s: got %q, expected %q", p, got, data)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != perm {
+		t.Fatalf("%s: mode %s, expected %s", p, st.Mode(), perm)
+	}
+	return st
+}
+
+func expectDir(t *testing.T, fs *mem.Fs, p string, perm os.FileMode) {
+	t.Helper()
+	st, err := fs.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != os.ModeDir|perm {
+		t.Fatalf("%s: mode %s, expected %s", p, st.Mode(), os.ModeDir|perm)
+	}
+}
+
+func expectMissing(t *testing.T, fs *mem.Fs, p string) {
+	t.Helper()
+	if _, err := fs.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("%s: expected not to exist, got %v", p, err)
+	}
+}
+
+// Transcripts of sessions where the file system fails.
+func TestFaults(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fault  faultfs.Fault
+		args   []string
+		setup  func(t *testing.T, fs *mem.Fs)
+		input  string
+		output string
+		status int
+	}{
+		{
+			name:   "download read error",
+			fault:  faultfs.Fault{Op: "read", Err: errors.New("read failed")},
+			args:   []string{"-f", "/a", "/b"},
+			setup:  writeFiles("/a", "hello", "/b", "x"),
+			input:  "\x00\x00\x00\x00\x00",
+			output: "C0644 5 a\n" + "\x00\x00\x00\x00\x00" + "\x01read failed\n" + "C0644 1 b\n" + "\x00\x01read failed\n",
+			status: ExitFileErrors,
+		},
+		{
+			name:   "download short reads",
+			fault:  faultfs.Fault{Op: "read", Short: 2},
+			args:   []string{"-f", "/a"},
+			setup:  writeFiles("/a", "hello"),
+			input:  "\x00\x00\x00",
+			output: "C0644 5 a\nhello\x00",
+		},
+		{
+			name:   "download read error after data",
+			fault:  faultfs.Fault{Op: "read", Short: 2, Err: errors.New("read failed")},
+			args:   []string{"-f", "/a"},
+			setup:  writeFiles("/a", "hello"),
+			input:  "\x00\x00\x00",
+			output: "C0644 5 a\n" + "he\x00\x00\x00" + "\x01read failed\n",
+			status: ExitFileErrors,
+		},
+		{
+			name:   "upload write error",
+			fault:  faultfs.Fault{Op: "write", Err: errors.New("disk full")},
+			args:   []string{"-t", "/"},
+			input:  "C0644 5 a\nhello\x00C0644 1 b\nx\x00",
+			output: "\x00" + "\x00\x01disk full\n" + "\x00\x01disk full\n",
+			status: ExitFileErrors,
+		},
+		{
+			name:   "upload close error",
+			fault:  faultfs.Fault{Op: "close", Path: "/a", Err: errors.New("close failed")},
+			args:   []string{"-t", "/"},
+			input:  "C0644 5 a\nhello\x00",
+			output: "\x00" + "\x00\x01close failed\n",
+			status: ExitFileErrors,
+		},
+		{
+			name:   "recursive download stat error",
+			fault:  faultfs.Fault{Op: "fstat", Path: "/dir/a", Err: errors.New("stat failed")},
+			args:   []string{"-r", "-f", "/dir"},
+			setup:  writeFiles("/dir/a", "1", "/dir/b", "2"),
+			input:  "\x00\x00\x00\x00\x00",
+			output: "D0755 0 dir\n" + "\x01stat failed\n" + "C0644 1 b\n2\x00" + "E\n",
+			status: ExitFileErrors,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base := mem.New()
+			if tc.setup != nil {
+				tc.setup(t, base)
+			}
+			fs := faultfs.New(base)
+			fs.Inject(tc.fault)
+			var out bytes.Buffer
+			err := run(tc.args, fs, bytes.NewBufferString(tc.input), &out)
+			if status := exitStatus(err); status != tc.status {
+				t.Errorf("exit status %d, expected %d: %v", status, tc.status, err)
+			}
+			if got := out.String(); got != tc.output {
+				t.Errorf("output:\n%q\nexpected:\n%q", got, tc.output)
+			}
+			if openFiles != 0 {
+				t.Fatalf("%d files left open", openFiles)
+			}
+		})
+	}
+}
+
+// Transcripts of sessions limited by -max-files and -read-only.
+func TestPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxFiles int
+		readOnly bool
+		args     []string
+		setup    func(t *testing.T, fs *mem.Fs)
+		input    string
+		output   string
+		status   int
+	}{
+		{
+			// The directory being sent is open while its files are.
+			name:     "too many open files",
+			maxFiles: 1,
+			args:     []string{"-r", "-f", "/dir"},
+			setup:    writeFiles("/dir/a", "1", "/dir/b", "22"),
+			input:    "\x00\x00\x00",
+			output:   "D0755 0 dir\n" + "\x01too many open files\n" + "\x01too many open files\n" + "E\n",
+			status:   ExitFileErrors,
+		},
+		{
+			name:     "within open file limit",
+			maxFiles: 2,
+			args:     []string{"-r", "-f", "/dir"},
+			setup:    writeFiles("/dir/a", "1"),
+			input:    "\x00" + "\x00" + "\x00\x00" + "\x00",
+			output:   "D0755 0 dir\n" + "C0644 1 a\n1\x00" + "E\n",
+		},
+		{
+			name:     "receive read-only",
+			readOnly: true,
+			args:     []string{"-r", "-t", "/"},
+			input:    "C0644 5 a\n" + "D0755 0 d\n",
+			output:   "\x00" + "\x01permission denied\n" + "\x01permission denied\n",
+			status:   ExitFileErrors,
+		},
+		{
+			name:     "send read-only",
+			readOnly: true,
+			args:     []string{"-f", "/a"},
+			setup:    writeFiles("/a", "x"),
+			input:    "\x00\x00\x00",
+			output:   "C0644 1 a\nx\x00",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base := mem.New()
+			if tc.setup != nil {
+				tc.setup(t, base)
+			}
+			var fs vfs.VFS = base
+			if tc.readOnly {
+				fs = &vfs.ReadOnlyVFS{Fs: base}
+			}
+			MaxFiles = tc.maxFiles
+			defer func() { MaxFiles = 0 }()
+			var out bytes.Buffer
+			err := run(tc.args, fs, bytes.NewBufferString(tc.input), &out)
+			if status := exitStatus(err); status != tc.status {
+				t.Errorf("exit status %d, expected %d: %v", status, tc.status, err)
+			}
+			if got := out.String(); got != tc.output {
+				t.Errorf("output:\n%q\nexpected:\n%q", got, tc.output)
+			}
+			if openFiles != 0 {
+				t.Fatalf("%d files left open", openFiles)
+			}
+			if tc.readOnly {
+				expectMissing(t, base, "/d")
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"golang.org/x/sys/unix"
+)
+
+// Zero blocks of this size received are left as holes.
+const sparseBlockSize = 4096
+
+// Files, like the *os.File of the local backend, that can
+// seek to data and holes and be resized without writing.
+type seekerAt interface {
+	io.ReaderAt
+	io.Seeker
+}
+
+type truncaterAt interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// Files open for scp are wrapped, sparse file
+// support needs the backend file itself.
+func backendFile(f vfs.File) vfs.File {
+	if cf, ok := f.(*countedFile); ok {
+		return cf.File
+	}
+	return f
+}
+
+// A reader of the data of f, with sparse files read by seeking
+// over their holes and returning zeros for them rather than
+// reading them. The scp protocol has no way to skip holes,
+// they are sent as zeros.
+func dataReader(f vfs.File, st os.FileInfo) io.Reader {
+	sf, ok := backendFile(f).(seekerAt)
+	if !ok {
+		return f
+	}
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok || sys.Blocks*512 >= st.Size() {
+		return f
+	}
+	return &holeReader{f: sf, size: st.Size()}
+}
+
+type holeReader struct {
+	f    seekerAt
+	off  int64
+	size int64
+	// Data is known to extend to dataEnd,
+	// or there is a hole up to holeEnd.
+	dataEnd int64
+	holeEnd int64
+}
+
+func (r *holeReader) Read(buf []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.off >= r.dataEnd && r.off >= r.holeEnd {
+		r.findData()
+	}
+	if r.off < r.holeEnd {
+		n := len(buf)
+		if int64(n) > r.holeEnd-r.off {
+			n = int(r.holeEnd - r.off)
+		}
+		for i := range buf[:n] {
+			buf[i] = 0
+		}
+		r.off += int64(n)
+		return n, nil
+	}
+	if int64(len(buf)) > r.dataEnd-r.off {
+		buf = buf[:r.dataEnd-r.off]
+	}
+	n, err := r.f.ReadAt(buf, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Find the data or hole at r.off. Errors from the seeks mean
+// the file system can't find holes, the rest is read as data.
+func (r *holeReader) findData() {
+	data, err := r.f.Seek(r.off, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		// Only a hole remains.
+		data = r.size
+	} else if err != nil {
+		r.dataEnd = r.size
+		return
+	}
+	if data > r.off {
+		r.holeEnd = data
+		if r.holeEnd > r.size {
+			r.holeEnd = r.size
+		}
+		return
+	}
+	hole, err := r.f.Seek(r.off, unix.SEEK_HOLE)
+	if err != nil || hole > r.size {
+		hole = r.size
+	}
+	r.dataEnd = hole
+}
+
+// A writer for files received into f, leaving blocks of zeros
+// as holes when f can be resized, or nil if it can't.
+func newSparseWriter(f vfs.File) *sparseWriter {
+	tf, ok := backendFile(f).(truncaterAt)
+	if !ok {
+		return nil
+	}
+	return &sparseWriter{f: tf}
+}
+
+type sparseWriter struct {
+	f   truncaterAt
+	off int64
+}
+
+// Empty the file before writing, so holes
+// left do not keep what was there before.
+func (w *sparseWriter) start() error {
+	return w.f.Truncate(0)
+}
+
+func (w *sparseWriter) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		// Blocks are aligned to the offset in the file.
+		n := sparseBlockSize - int(w.off%sparseBlockSize)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if !isZero(buf[:n]) {
+			if _, err := w.f.WriteAt(buf[:n], w.off); err != nil {
+				return written, err
+			}
+		}
+		w.off += int64(n)
+		written += n
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+// Extend the file over any hole at its end.
+func (w *sparseWriter) finish() error {
+	return w.f.Truncate(w.off)
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
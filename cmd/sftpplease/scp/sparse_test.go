@@ -0,0 +1,87 @@
+package scp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp-sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 1 << 20
+	expected := make([]byte, size)
+	copy(expected[3*sparseBlockSize+10:], "hello")
+	copy(expected[size/2:], "world")
+
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	// Existing data must not show through holes.
+	if _, err := dst.Write(bytes.Repeat([]byte{'x'}, size+100)); err != nil {
+		t.Fatal(err)
+	}
+
+	sw := newSparseWriter(dst)
+	if sw == nil {
+		t.Fatal("local files should be written sparsely")
+	}
+	if err := sw.start(); err != nil {
+		t.Fatal(err)
+	}
+	// Odd sized writes, as they come from the network.
+	for buf := expected; len(buf) > 0; {
+		n := 1000
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err := sw.Write(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		buf = buf[n:]
+	}
+	if err := sw.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := dst.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != size {
+		t.Fatalf("size %d, expected %d", st.Size(), size)
+	}
+	if blocks := st.Sys().(*syscall.Stat_t).Blocks * 512; blocks >= size {
+		t.Skipf("file system does not support sparse files, %d bytes allocated", blocks)
+	}
+
+	src, err := os.Open(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	r := dataReader(src, st)
+	if _, ok := r.(*holeReader); !ok {
+		t.Fatal("expected sparse file to be read by seeking holes")
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal("sparse file read back wrong")
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Where transfer progress, a summary of each file and of
+// the session are written, nil to not report them.
+var StatsLog *log.Logger
+
+// How often progress of a file still being transferred is reported.
+var ProgressInterval = 10 * time.Second
+
+var session struct {
+	start time.Time
+	files int
+	bytes int64
+}
+
+// Counts the bytes of one file transferred, reporting progress
+// to StatsLog. Copy file data through it with io.TeeReader.
+type transfer struct {
+	verb       string
+	name       string
+	perm       os.FileMode
+	size       int64
+	n          int64
+	start      time.Time
+	end        time.Time
+	lastReport time.Time
+}
+
+// The transfer of a file, verb being "send" or "receive".
+func newTransfer(verb, name string, perm os.FileMode, size int64) *transfer {
+	now := time.Now()
+	return &transfer{
+		verb:       verb,
+		name:       name,
+		perm:       perm,
+		size:       size,
+		start:      now,
+		lastReport: now,
+	}
+}
+
+func (t *transfer) Write(p []byte) (int, error) {
+	t.n += int64(len(p))
+	if StatsLog != nil && ProgressInterval > 0 {
+		if now := time.Now(); now.Sub(t.lastReport) >= ProgressInterval {
+			t.lastReport = now
+			StatsLog.Printf("scp %s %s: %d/%d bytes (%d%%), %s",
+				t.verb, t.name, t.n, t.size, percent(t.n, t.size), rate(t.n, now.Sub(t.start)))
+		}
+	}
+	return len(p), nil
+}
+
+// Report the file transferred, err being why it was not completely.
+func (t *transfer) done(err error) {
+	t.end = time.Now()
+	session.files++
+	session.bytes += t.n
+	t.record(err)
+	if StatsLog == nil {
+		return
+	}
+	elapsed := t.end.Sub(t.start)
+	if err != nil {
+		StatsLog.Printf("scp %s %s failed after %d/%d bytes: %s", t.verb, t.name, t.n, t.size, err)
+		return
+	}
+	StatsLog.Printf("scp %s %s: %d bytes in %s, %s",
+		t.verb, t.name, t.n, elapsed.Round(time.Millisecond), rate(t.n, elapsed))
+}
+
+// Wrap r so data read from it is counted by t.
+func (t *transfer) reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, t)
+}
+
+func startSession() {
+	session.start = time.Now()
+	session.files = 0
+	session.bytes = 0
+}
+
+func reportSession(err error) {
+	if StatsLog == nil {
+		return
+	}
+	elapsed := time.Since(session.start)
+	status := "done"
+	if err != nil {
+		status = "ended with errors"
+	}
+	StatsLog.Printf("scp session %s: %d files, %d bytes in %s, %s",
+		status, session.files, session.bytes, elapsed.Round(time.Millisecond), rate(session.bytes, elapsed))
+}
+
+func percent(n, size int64) int64 {
+	if size <= 0 {
+		return 100
+	}
+	return n * 100 / size
+}
+
+func rate(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "- B/s"
+	}
+	bps := float64(n) / elapsed.Seconds()
+	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
+	i := 0
+	for bps >= 1024 && i < len(units)-1 {
+		bps /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bps, units[i])
+}
@@ -0,0 +1,64 @@
+package extradbx
+
+import (
+	"crypto/sha256"
+	"hash"
+)
+
+// The size of the blocks hashed separately by the content hash.
+const contentHashBlockSize = 4 * 1024 * 1024
+
+// ContentHash computes the dropbox content hash of the data written to
+// it, the sha256 of the sha256 hashes of each 4MiB block of the data,
+// see https://www.dropbox.com/developers/reference/content-hash
+type ContentHash struct {
+	blockSums []byte
+	block     hash.Hash
+	blockLen  int
+}
+
+func NewContentHash() *ContentHash {
+	return &ContentHash{block: sha256.New()}
+}
+
+func (h *ContentHash) Write(buf []byte) (int, error) {
+	n := len(buf)
+	for len(buf) != 0 {
+		chunk := buf
+		if remaining := contentHashBlockSize - h.blockLen; len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+		_, _ = h.block.Write(chunk)
+		h.blockLen += len(chunk)
+		buf = buf[len(chunk):]
+		if h.blockLen == contentHashBlockSize {
+			h.blockSums = h.block.Sum(h.blockSums)
+			h.block.Reset()
+			h.blockLen = 0
+		}
+	}
+	return n, nil
+}
+
+func (h *ContentHash) Sum(b []byte) []byte {
+	overall := sha256.New()
+	_, _ = overall.Write(h.blockSums)
+	if h.blockLen != 0 {
+		_, _ = overall.Write(h.block.Sum(nil))
+	}
+	return overall.Sum(b)
+}
+
+func (h *ContentHash) Reset() {
+	h.blockSums = nil
+	h.block.Reset()
+	h.blockLen = 0
+}
+
+func (h *ContentHash) Size() int {
+	return sha256.Size
+}
+
+func (h *ContentHash) BlockSize() int {
+	return sha256.BlockSize
+}
@@ -0,0 +1,40 @@
+package extradbx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestContentHash(t *testing.T) {
+	h := NewContentHash()
+	empty := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got := hex.EncodeToString(h.Sum(nil)); got != empty {
+		t.Fatalf("empty content hash %s", got)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), contentHashBlockSize/10*2+1000)
+	var blockSums []byte
+	for off := 0; off < len(data); off += contentHashBlockSize {
+		end := off + contentHashBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha256.Sum256(data[off:end])
+		blockSums = append(blockSums, sum[:]...)
+	}
+	expected := sha256.Sum256(blockSums)
+
+	// Write in pieces that do not line up with blocks.
+	for off := 0; off < len(data); off += 1000003 {
+		end := off + 1000003
+		if end > len(data) {
+			end = len(data)
+		}
+		_, _ = h.Write(data[off:end])
+	}
+	if !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Fatal("content hash mismatch")
+	}
+}
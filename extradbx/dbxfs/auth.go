@@ -0,0 +1,90 @@
+package dbxfs
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+const tokenURL = "https://api.dropboxapi.com/oauth2/token"
+
+// refreshTransport authorizes requests with short lived access tokens
+// obtained with a refresh token, refreshing them as they expire. Calls
+// rejected as unauthorized are retried once with a new token, as tokens
+// may be revoked before they expire. Uploads cannot be sent twice so
+// they are not retried.
+type refreshTransport struct {
+	conf         oauth2.Config
+	refreshToken string
+	base         http.RoundTripper
+
+	lock  sync.Mutex
+	token *oauth2.Token
+}
+
+func newRefreshTransport(opts *Options, tokenURL string, base http.RoundTripper) *refreshTransport {
+	return &refreshTransport{
+		conf: oauth2.Config{
+			ClientID:     opts.AppKey,
+			ClientSecret: opts.AppSecret,
+			Endpoint: oauth2.Endpoint{
+				TokenURL:  tokenURL,
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+		refreshToken: opts.RefreshToken,
+		base:         base,
+	}
+}
+
+// Get a valid access token, refreshing it if it
+// has expired or is the rejected token.
+func (t *refreshTransport) accessToken(rejected string) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token == nil || !t.token.Valid() || t.token.AccessToken == rejected {
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: t.base})
+		token, err := t.conf.TokenSource(ctx, &oauth2.Token{RefreshToken: t.refreshToken}).Token()
+		if err != nil {
+			return "", err
+		}
+		t.token = token
+	}
+	return t.token.AccessToken, nil
+}
+
+func authorize(req *http.Request, token string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func (t *refreshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.accessToken("")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authorize(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	token, err = t.accessToken(token)
+	if err != nil {
+		return resp, nil
+	}
+	retry := authorize(req, token)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+	}
+	_ = resp.Body.Close()
+	return t.base.RoundTrip(retry)
+}
@@ -0,0 +1,187 @@
+package dbxfs
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/async"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// The most entries dropbox takes in one batch.
+const maxBatchEntries = 1000
+
+// How long to wait between checks of a running batch job.
+var batchPollInterval = time.Second
+
+// Remove paths with a batch delete per thousand paths, dropbox
+// counts each batch as a single write against its rate limits.
+func (fs *Fs) RemoveBatch(paths []string) error {
+	for _, p := range paths {
+		if fs.revisionPath(p) != nil {
+			return os.ErrPermission
+		}
+	}
+	defer func() {
+		for _, p := range paths {
+			fs.cache.invalidate(p)
+		}
+	}()
+	for start := 0; start < len(paths); start += maxBatchEntries {
+		end := start + maxBatchEntries
+		if end > len(paths) {
+			end = len(paths)
+		}
+		err := fs.deleteBatch(paths[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *Fs) deleteBatch(paths []string) error {
+	args := make([]*files.DeleteArg, len(paths))
+	for i, p := range paths {
+		args[i] = files.NewDeleteArg(p)
+	}
+	var launch *files.DeleteBatchLaunch
+	err := fs.retry.Do(func() error {
+		var err error
+		launch, err = fs.api.DeleteBatch(files.NewDeleteBatchArg(args))
+		return err
+	})
+	if err != nil {
+		return mapError(err)
+	}
+
+	res := launch.Complete
+	for res == nil {
+		if launch.AsyncJobId == "" {
+			return ErrBatchFailed
+		}
+		time.Sleep(batchPollInterval)
+		var status *files.DeleteBatchJobStatus
+		err := fs.retry.Do(func() error {
+			var err error
+			status, err = fs.api.DeleteBatchCheck(async.NewPollArg(launch.AsyncJobId))
+			return err
+		})
+		if err != nil {
+			return mapError(err)
+		}
+		switch status.Tag {
+		case "in_progress":
+		case "complete":
+			res = status.Complete
+		case "failed":
+			if status.Failed != nil && status.Failed.Tag == "too_many_write_operations" {
+				return ErrTooManyWrites
+			}
+			return ErrBatchFailed
+		default:
+			return ErrBatchFailed
+		}
+	}
+
+	for i, entry := range res.Entries {
+		if entry.Tag == "failure" && entry.Failure != nil {
+			return mapError(files.DeleteV2APIError{
+				APIError:      dropbox.APIError{ErrorSummary: fmt.Sprintf("removing %s: %s", paths[i], entry.Failure.Tag)},
+				EndpointError: entry.Failure,
+			})
+		}
+	}
+	return nil
+}
+
+// Rename paths with a batch move per thousand renames.
+func (fs *Fs) RenameBatch(renames []vfs.Rename) error {
+	for _, r := range renames {
+		// Restoring revisions has no batch.
+		if fs.revisionPath(r.From) != nil || fs.revisionPath(r.To) != nil {
+			return os.ErrPermission
+		}
+	}
+	defer func() {
+		for _, r := range renames {
+			fs.cache.invalidate(r.From)
+			fs.cache.invalidate(r.To)
+		}
+	}()
+	for start := 0; start < len(renames); start += maxBatchEntries {
+		end := start + maxBatchEntries
+		if end > len(renames) {
+			end = len(renames)
+		}
+		err := fs.moveBatch(renames[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *Fs) moveBatch(renames []vfs.Rename) error {
+	args := make([]*files.RelocationPath, len(renames))
+	for i, r := range renames {
+		args[i] = files.NewRelocationPath(r.From, r.To)
+	}
+	var launch *files.RelocationBatchV2Launch
+	err := fs.retry.Do(func() error {
+		var err error
+		launch, err = fs.api.MoveBatchV2(files.NewMoveBatchArg(args))
+		return err
+	})
+	if err != nil {
+		return mapError(err)
+	}
+
+	res := launch.Complete
+	for res == nil {
+		if launch.AsyncJobId == "" {
+			return ErrBatchFailed
+		}
+		time.Sleep(batchPollInterval)
+		var status *files.RelocationBatchV2JobStatus
+		err := fs.retry.Do(func() error {
+			var err error
+			status, err = fs.api.MoveBatchCheckV2(async.NewPollArg(launch.AsyncJobId))
+			return err
+		})
+		if err != nil {
+			return mapError(err)
+		}
+		switch status.Tag {
+		case "in_progress":
+		case "complete":
+			res = status.Complete
+		default:
+			return ErrBatchFailed
+		}
+	}
+
+	for i, entry := range res.Entries {
+		if entry.Tag != "failure" || entry.Failure == nil {
+			continue
+		}
+		switch entry.Failure.Tag {
+		case "relocation_error":
+			if entry.Failure.RelocationError == nil {
+				return ErrBatchFailed
+			}
+			return mapError(files.MoveV2APIError{
+				APIError:      dropbox.APIError{ErrorSummary: fmt.Sprintf("renaming %s: %s", renames[i].From, entry.Failure.RelocationError.Tag)},
+				EndpointError: entry.Failure.RelocationError,
+			})
+		case "too_many_write_operations":
+			return ErrTooManyWrites
+		default:
+			return ErrBatchFailed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package dbxfs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default time metadata is remembered for.
+const DefaultCacheTTL = 5 * time.Second
+
+// Entries are pruned once there are this many.
+const metaCacheMaxEntries = 10000
+
+// metaCache remembers the metadata of paths, or that they do not
+// exist, for ttl, so the constant stats of sftp clients do not each
+// cost a dropbox call. Changes made through the Fs drop affected
+// entries, changes made by others may be missed for up to ttl
+// unless the Fs watches for them. A zero ttl disables the cache,
+// as does a nil one.
+type metaCache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	entries map[string]metaCacheEntry
+}
+
+type metaCacheEntry struct {
+	// Nil if the path does not exist.
+	st      *FileStat
+	expires time.Time
+}
+
+// Dropbox paths are case insensitive, keys are
+// clean and lower case like path_lower.
+func metaCacheKey(fpath string) string {
+	return strings.ToLower(path.Clean("/" + fpath))
+}
+
+func (c *metaCache) get(fpath string) (*FileStat, bool) {
+	if c == nil || c.ttl == 0 {
+		return nil, false
+	}
+	key := metaCacheKey(fpath)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.st, true
+}
+
+func (c *metaCache) put(fpath string, st *FileStat) {
+	if c == nil || c.ttl == 0 {
+		return
+	}
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]metaCacheEntry)
+	}
+	if len(c.entries) >= metaCacheMaxEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= metaCacheMaxEntries {
+			c.entries = make(map[string]metaCacheEntry)
+		}
+	}
+	c.entries[metaCacheKey(fpath)] = metaCacheEntry{st: st, expires: now.Add(c.ttl)}
+}
+
+func (c *metaCache) clear() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = nil
+}
+
+// Drop fpath and everything inside it.
+func (c *metaCache) invalidate(fpath string) {
+	if c == nil {
+		return
+	}
+	key := metaCacheKey(fpath)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, key)
+	for k := range c.entries {
+		if strings.HasPrefix(k, key+"/") {
+			delete(c.entries, k)
+		}
+	}
+}
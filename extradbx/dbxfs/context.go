@@ -0,0 +1,75 @@
+package dbxfs
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// A view of fs whose dropbox requests are aborted once ctx is done,
+// including the downloads and uploads of files it opens. The view
+// shares the metadata cache and files being written with fs, closing
+// it does not stop fs watching for changes.
+func (fs *Fs) WithContext(ctx context.Context) vfs.VFS {
+	cfg := fs.cfg
+	cfg.Client = contextClient(ctx, cfg.Client, cfg.Token)
+	return &Fs{
+		cfg:         cfg,
+		api:         files.New(cfg),
+		retry:       fs.retry,
+		verify:      fs.verify,
+		cache:       fs.cache,
+		parallel:    fs.parallel,
+		chunkSize:   fs.chunkSize,
+		maxBuffered: fs.maxBuffered,
+		fileMode:    fs.fileMode,
+		dirMode:     fs.dirMode,
+		revisions:   fs.revisions,
+		parent:      fs.root(),
+	}
+}
+
+// The Fs a view made by WithContext came from.
+func (fs *Fs) root() *Fs {
+	if fs.parent != nil {
+		return fs.parent
+	}
+	return fs
+}
+
+// A client sending requests as client does, bound to ctx. The sdk
+// only adds the token itself when it creates the client, so requests
+// are authorized with token if there is no client to wrap.
+func contextClient(ctx context.Context, client *http.Client, token string) *http.Client {
+	var base http.RoundTripper = &tokenTransport{token: token, base: http.DefaultTransport}
+	if client != nil {
+		base = client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		c := *client
+		c.Transport = &contextTransport{ctx: ctx, base: base}
+		return &c
+	}
+	return &http.Client{Transport: &contextTransport{ctx: ctx, base: base}}
+}
+
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(authorize(req, t.token))
+}
@@ -2,6 +2,12 @@ package dbxfs
 
 import (
 	"errors"
+	"os"
+
+	"github.com/andrewchambers/sftpplease/extradbx"
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
 )
 
 var (
@@ -10,8 +16,94 @@ var (
 	ErrBadPath            = errors.New("bad path")
 	ErrNotOpen            = errors.New("file not open")
 	ErrBadOpenFileOptions = errors.New("bad open file options")
-	ErrNotSupported       = errors.New("not supported")
+	ErrNotSupported       = vfs.ErrUnsupported
+	ErrCorrupt            = vfs.ErrCorrupt
 	ErrStatUnavailable    = errors.New("stat unavailable")
 	ErrBadReadWriteOffset = errors.New("bad read/write offset")
 	ErrUnimplemented      = errors.New("unimplemented")
+	ErrTooManyWrites      = errors.New("too many writes, try again later")
+	ErrBatchFailed        = errors.New("dropbox batch job failed")
+
+	// The account is out of space, rather than the file being
+	// too large as vfs.ErrQuotaExceeded usually means.
+	ErrInsufficientSpace = &vfs.StatusError{
+		Code: protosftp.FX_QUOTA_EXCEEDED,
+		Msg:  "dropbox account is out of space",
+		Err:  vfs.ErrQuotaExceeded,
+	}
 )
+
+// Replace dropbox errors with the os and vfs errors meaning the
+// same, so sftp clients are told why their requests failed.
+// Other errors are returned as they are.
+func mapError(err error) error {
+	if lerr := lookupErrorOf(err); lerr != nil {
+		switch lerr.Tag {
+		case "not_found":
+			return os.ErrNotExist
+		case "not_file":
+			return ErrNotFile
+		case "not_folder":
+			return ErrNotDir
+		case "malformed_path":
+			return ErrBadPath
+		case "restricted_content":
+			return os.ErrPermission
+		}
+	}
+	if werr := extradbx.WriteErrorOf(err); werr != nil {
+		switch werr.Tag {
+		case "conflict":
+			return os.ErrExist
+		case "insufficient_space":
+			return ErrInsufficientSpace
+		case "no_write_permission", "team_folder":
+			return os.ErrPermission
+		case "malformed_path", "disallowed_name":
+			return ErrBadPath
+		case "too_many_write_operations":
+			return ErrTooManyWrites
+		}
+	}
+	return err
+}
+
+// The reason a call reading a path failed, or nil
+// if err is not an error looking up a path.
+func lookupErrorOf(err error) *files.LookupError {
+	switch err := err.(type) {
+	case files.GetMetadataAPIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.Path
+		}
+	case files.ListFolderAPIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.Path
+		}
+	case files.ListFolderContinueAPIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.Path
+		}
+	case files.DownloadAPIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.Path
+		}
+	case files.ListRevisionsAPIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.Path
+		}
+	case files.DeleteV2APIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.PathLookup
+		}
+	case files.MoveV2APIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.FromLookup
+		}
+	case files.RestoreAPIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.PathLookup
+		}
+	}
+	return nil
+}
@@ -1,11 +1,14 @@
 package dbxfs
 
 import (
-	"encoding/gob"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/andrewchambers/sftpplease/extradbx"
@@ -14,18 +17,55 @@ import (
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
 )
 
+// The furthest ahead of the current download a read may start
+// before a new download is started at the read offset.
+const maxReadSkip = 1024 * 1024
+
+// The permissions reported by default, dropbox has none of its own.
+const (
+	DefaultFileMode os.FileMode = 0644
+	DefaultDirMode  os.FileMode = 0755
+)
+
 func init() {
 	vfs.RegisterEngine("dropbox", vfsFactory)
 }
 
-func vfsFactory(token string) (vfs.VFS, error) {
-	return Attach(dropbox.Config{
-		Token: token,
-	})
+func vfsFactory(param string) (vfs.VFS, error) {
+	opts, err := ParseOptions(param)
+	if err != nil {
+		return nil, err
+	}
+	return New(opts)
 }
 
 type Fs struct {
-	api files.Client
+	cfg      dropbox.Config
+	api      files.Client
+	retry    extradbx.RetryPolicy
+	verify   bool
+	cache    *metaCache
+	parallel int
+
+	chunkSize   int64
+	maxBuffered int64
+
+	// The permissions stats report.
+	fileMode os.FileMode
+	dirMode  os.FileMode
+
+	// Files being written, so their times can be
+	// set before they are committed. Views made by
+	// WithContext share those of their parent.
+	parent      *Fs
+	uploadsLock sync.Mutex
+	uploads     map[string]*FileHandle
+
+	// Serve the revisions directory.
+	revisions bool
+
+	// Closed to stop watching for changes.
+	stopWatch chan struct{}
 }
 
 type FileHandle struct {
@@ -34,49 +74,93 @@ type FileHandle struct {
 	fpath  string
 	dbxfid string
 	isDir  bool
-
-	dirEntTempFile *os.File
-	dirEntDecoder  *gob.Decoder
+	size   int64
+
+	// Handles in the revisions directory list the revisions of
+	// the file target, or the directory target with its files
+	// shown as the directories of their revisions.
+	target         string
+	revisionsOf    bool
+	revisionsOfDir bool
+
+	// The cursor of the next page of the listing, and
+	// the entries of the current page not yet read.
+	listed  bool
+	cursor  string
+	hasMore bool
+	dirEnts []os.FileInfo
 
 	openForReading bool
 	openForWriting bool
 
 	readOffset int64
 	reader     io.ReadCloser
+	// The hash of a download started at the beginning of the
+	// file, checked against the metadata once it is all read.
+	readHash     *extradbx.ContentHash
+	expectedHash string
+	expectedSize int64
 
 	writeOffset int64
-	writer      io.WriteCloser
+	writer      *extradbx.Upload
+	// The modification time to commit the file with, guarded
+	// by the uploadsLock of the root of fs.
+	mtime time.Time
 }
 
 type FileStat struct {
 	FileMetadata   *files.FileMetadata
 	FolderMetadata *files.FolderMetadata
+	perm           os.FileMode
 }
 
 func Attach(cfg dropbox.Config) (*Fs, error) {
 
 	fs := &Fs{
-		api: files.New(cfg),
+		cfg:      cfg,
+		api:      files.New(cfg),
+		retry:    extradbx.DefaultRetryPolicy,
+		verify:   true,
+		cache:    &metaCache{ttl: DefaultCacheTTL},
+		parallel: 1,
+		fileMode: DefaultFileMode,
+		dirMode:  DefaultDirMode,
 	}
 
 	return fs, nil
 }
 
-func doWithRetry(f func() error) error {
-again:
-	err := f()
+func New(opts *Options) (*Fs, error) {
+	cfg, err := opts.Config()
 	if err != nil {
-		// XXX string checking?
-		if strings.HasPrefix("too_many_write_operations", err.Error()) {
-			// XXX Totally arbitrary
-			time.Sleep(100 * time.Millisecond)
-			goto again
-		}
+		return nil, err
 	}
-	return err
+	fs, err := Attach(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fs.retry = opts.Retry
+	fs.verify = opts.VerifyContentHash
+	fs.cache.ttl = opts.CacheTTL
+	fs.parallel = opts.Parallelism
+	fs.chunkSize = opts.ChunkSize
+	fs.maxBuffered = opts.MaxBuffered
+	fs.revisions = opts.Revisions
+	fs.fileMode = opts.FileMode
+	fs.dirMode = opts.DirMode
+	if opts.Longpoll && fs.cache.ttl != 0 {
+		fs.stopWatch = make(chan struct{})
+		go fs.watch(fs.stopWatch)
+	}
+	return fs, nil
 }
 
 func (fs *Fs) Create(fpath string) (*FileHandle, error) {
+	if fs.revisionPath(fpath) != nil {
+		return nil, os.ErrPermission
+	}
+
+	fs.cache.invalidate(fpath)
 
 	fh := &FileHandle{
 		fs:    fs,
@@ -84,19 +168,64 @@ func (fs *Fs) Create(fpath string) (*FileHandle, error) {
 	}
 
 	fh.openForWriting = true
+
+	u := fs.root()
+	u.uploadsLock.Lock()
+	defer u.uploadsLock.Unlock()
+	if u.uploads == nil {
+		u.uploads = make(map[string]*FileHandle)
+	}
+	u.uploads[metaCacheKey(fpath)] = fh
+
 	return fh, nil
 }
 
 func (fs *Fs) Chmod(fpath string, mode os.FileMode) error {
+	if fs.revisionPath(fpath) != nil {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// Dropbox records one modification time per file, given when
+// the file is uploaded. It can be set while a file is being
+// written, but not changed once the file is committed.
+func (fs *Fs) Chtimes(fpath string, atime time.Time, mtime time.Time) error {
+	if fs.revisionPath(fpath) != nil {
+		return os.ErrPermission
+	}
+
+	u := fs.root()
+	u.uploadsLock.Lock()
+	fh, ok := u.uploads[metaCacheKey(fpath)]
+	if ok {
+		fh.mtime = mtime
+	}
+	u.uploadsLock.Unlock()
+	if ok {
+		return nil
+	}
+
+	st, err := fs.stat(fpath)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() || !st.ModTime().Equal(mtime.Truncate(time.Second)) {
+		return ErrNotSupported
+	}
 	return nil
 }
 
 func (fs *Fs) Open(fpath string) (vfs.File, error) {
+	if rp := fs.revisionPath(fpath); rp != nil {
+		return fs.openRevision(fpath, rp)
+	}
+
 	if fpath == "/" {
 		fpath = ""
 	}
 
-	st, err := dbxStat(fs.api, fpath)
+	st, err := fs.stat(fpath)
 	if err != nil {
 		return nil, err
 	}
@@ -105,6 +234,7 @@ func (fs *Fs) Open(fpath string) (vfs.File, error) {
 		fs:     fs,
 		fpath:  fpath,
 		dbxfid: st.GetDropboxId(),
+		size:   st.Size(),
 	}
 
 	fh.isDir = st.IsDir()
@@ -130,14 +260,18 @@ func (fs *Fs) OpenFile(fpath string, flags int, perm os.FileMode) (vfs.File, err
 }
 
 func (fs *Fs) Mkdir(fpath string, mode os.FileMode) error {
-	_, err := fs.api.CreateFolderV2(files.NewCreateFolderArg(fpath))
-	if err != nil {
-		return err
+	if fs.revisionPath(fpath) != nil {
+		return os.ErrPermission
 	}
-	return nil
+
+	defer fs.cache.invalidate(fpath)
+	return mapError(fs.retry.Do(func() error {
+		_, err := fs.api.CreateFolderV2(files.NewCreateFolderArg(fpath))
+		return err
+	}))
 }
 
-func dbxMetadataToFileStat(md files.IsMetadata) (*FileStat, error) {
+func (fs *Fs) dbxMetadataToFileStat(md files.IsMetadata) (*FileStat, error) {
 	fileMetadata, _ := md.(*files.FileMetadata)
 	folderMetadata, _ := md.(*files.FolderMetadata)
 
@@ -145,62 +279,161 @@ func dbxMetadataToFileStat(md files.IsMetadata) (*FileStat, error) {
 		return nil, ErrStatUnavailable
 	}
 
-	return &FileStat{
-		FileMetadata:   fileMetadata,
-		FolderMetadata: folderMetadata,
-	}, nil
+	return fs.newFileStat(fileMetadata, folderMetadata), nil
 
 }
 
-func dbxStat(api files.Client, fpath string) (*FileStat, error) {
+// Dropbox has no permissions, stats report those of the options.
+func (fs *Fs) newFileStat(file *files.FileMetadata, folder *files.FolderMetadata) *FileStat {
+	st := &FileStat{FileMetadata: file, FolderMetadata: folder, perm: fs.fileMode}
+	if folder != nil {
+		st.perm = fs.dirMode
+	}
+	return st
+}
+
+func (fs *Fs) stat(fpath string) (*FileStat, error) {
 	if fpath == "/" || fpath == "" {
-		return &FileStat{
-			FolderMetadata: &files.FolderMetadata{},
-		}, nil
+		return fs.newFileStat(nil, &files.FolderMetadata{}), nil
+	}
+
+	if st, ok := fs.cache.get(fpath); ok {
+		if st == nil {
+			return nil, os.ErrNotExist
+		}
+		return st, nil
 	}
 
-	md, err := api.GetMetadata(files.NewGetMetadataArg(fpath))
+	var md files.IsMetadata
+	err := fs.retry.Do(func() error {
+		var err error
+		md, err = fs.api.GetMetadata(files.NewGetMetadataArg(fpath))
+		return err
+	})
 	if err != nil {
-		switch err := err.(type) {
-		case files.GetMetadataAPIError:
-			switch err.EndpointError.Path.Tag {
-			case "not_found":
-				return nil, os.ErrNotExist
-			}
+		err = mapError(err)
+		if err == os.ErrNotExist {
+			fs.cache.put(fpath, nil)
 		}
 		return nil, err
 	}
-	return dbxMetadataToFileStat(md)
+	st, err := fs.dbxMetadataToFileStat(md)
+	if err != nil {
+		return nil, err
+	}
+	fs.cache.put(fpath, st)
+	return st, nil
 }
 
 func (fs *Fs) Stat(fpath string) (os.FileInfo, error) {
-	return dbxStat(fs.api, fpath)
+	if rp := fs.revisionPath(fpath); rp != nil {
+		return fs.statRevision(rp)
+	}
+	return fs.stat(fpath)
 }
 
 func (fs *Fs) Rename(from, to string) error {
-	return doWithRetry(func() error {
+	if fs.revisionPath(from) != nil {
+		return fs.restore(from, to)
+	}
+	if fs.revisionPath(to) != nil {
+		return os.ErrPermission
+	}
+	if strings.EqualFold(path.Clean("/"+from), path.Clean("/"+to)) {
+		return fs.renameCase(from, to)
+	}
+	return fs.move(from, to)
+}
+
+func (fs *Fs) move(from, to string) error {
+	defer fs.cache.invalidate(to)
+	defer fs.cache.invalidate(from)
+	return mapError(fs.retry.Do(func() error {
 		_, err := fs.api.MoveV2(files.NewRelocationArg(from, to))
-		if err != nil {
-			return err
-		}
+		return err
+	}))
+}
+
+// Dropbox paths are case insensitive, so renames only changing the
+// case of a name are checked against its display path, and are made
+// through a temporary name so dropbox does not take them as no-ops.
+func (fs *Fs) renameCase(from, to string) error {
+	st, err := fs.stat(from)
+	if err != nil {
+		return err
+	}
+	to = path.Clean("/" + to)
+	if path.Base(st.PathDisplay()) == path.Base(to) {
 		return nil
-	})
+	}
+	tmp := path.Join(path.Dir(to), fmt.Sprintf(".%s.%d.rename", path.Base(to), time.Now().UnixNano()))
+	err = fs.move(from, tmp)
+	if err != nil {
+		return err
+	}
+	err = fs.move(tmp, to)
+	if err != nil {
+		_ = fs.move(tmp, from)
+	}
+	return err
 }
 
 func (fs *Fs) Remove(fpath string) error {
 	// XXX: Should we refuse to delete
 	// non empty dirs for consistency?
 
-	return doWithRetry(func() error {
+	if fs.revisionPath(fpath) != nil {
+		return os.ErrPermission
+	}
+
+	defer fs.cache.invalidate(fpath)
+	return mapError(fs.retry.Do(func() error {
 		_, err := fs.api.DeleteV2(files.NewDeleteArg(fpath))
-		if err != nil {
-			return err
-		}
-		return nil
-	})
+		return err
+	}))
+}
+
+func (fs *Fs) Link(oldname, newname string) error {
+	// Dropbox has no concept of hard links.
+	return ErrNotSupported
+}
+
+// The dropbox content hash, see
+// https://www.dropbox.com/developers/reference/content-hash
+const ContentHashAlgorithm = "content-hash@dropbox.com"
+
+func (fs *Fs) ChecksumAlgorithms() []string {
+	return []string{ContentHashAlgorithm}
+}
+
+func (fs *Fs) Checksum(fpath string, algorithm string) ([]byte, error) {
+	if algorithm != ContentHashAlgorithm {
+		return nil, ErrNotSupported
+	}
+
+	var st *FileStat
+	var err error
+	if rp := fs.revisionPath(fpath); rp != nil {
+		st, err = fs.statRevision(rp)
+	} else {
+		st, err = fs.stat(fpath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if st.IsDir() {
+		return nil, ErrNotFile
+	}
+
+	return hex.DecodeString(st.FileMetadata.ContentHash)
 }
 
 func (fs *Fs) Close() error {
+	if fs.stopWatch != nil {
+		close(fs.stopWatch)
+		fs.stopWatch = nil
+	}
 	return nil
 }
 
@@ -208,6 +441,60 @@ func (f *FileHandle) Stat() (os.FileInfo, error) {
 	return f.fs.Stat(f.fpath)
 }
 
+// Fetch the next page of the listing, pages are fetched
+// as the client reads so huge folders are never held in memory.
+func (f *FileHandle) fetchPage() error {
+	if f.revisionsOf {
+		return f.fetchRevisions()
+	}
+	lpath := f.fpath
+	if f.revisionsOfDir {
+		lpath = f.target
+	}
+
+	var res *files.ListFolderResult
+	err := f.fs.retry.Do(func() error {
+		var err error
+		if !f.listed {
+			arg := files.NewListFolderArg(lpath)
+			// Shared folders the user added to their dropbox are
+			// listed like their own folders, as in the web ui.
+			arg.IncludeMountedFolders = true
+			res, err = f.fs.api.ListFolder(arg)
+		} else {
+			res, err = f.fs.api.ListFolderContinue(files.NewListFolderContinueArg(f.cursor))
+		}
+		return err
+	})
+	if err != nil {
+		return mapError(err)
+	}
+	for _, entry := range res.Entries {
+		fileStat, err := f.fs.dbxMetadataToFileStat(entry)
+		if err != nil {
+			return err
+		}
+		if f.fs.revisionPath(path.Join(lpath, fileStat.Name())) != nil {
+			// Hidden by the revisions directory.
+			continue
+		}
+		if f.revisionsOfDir {
+			// Everything has a directory of revisions.
+			md := &files.FolderMetadata{}
+			md.Name = fileStat.Name()
+			f.dirEnts = append(f.dirEnts, f.fs.revisionStat(nil, md))
+			continue
+		}
+		// Listings are as good as stats.
+		f.fs.cache.put(path.Join(f.fpath, fileStat.Name()), fileStat)
+		f.dirEnts = append(f.dirEnts, fileStat)
+	}
+	f.listed = true
+	f.cursor = res.Cursor
+	f.hasMore = res.HasMore
+	return nil
+}
+
 func (f *FileHandle) Readdir(n int) ([]os.FileInfo, error) {
 	if !f.isDir {
 		return nil, ErrNotDir
@@ -217,69 +504,29 @@ func (f *FileHandle) Readdir(n int) ([]os.FileInfo, error) {
 		return nil, ErrNotOpen
 	}
 
-	if f.dirEntTempFile == nil {
-		dirEntTempFile, err := ioutil.TempFile("", "")
-		if err != nil {
-			return nil, err
-		}
-		encoder := gob.NewEncoder(dirEntTempFile)
-		res, err := f.fs.api.ListFolder(files.NewListFolderArg(f.fpath))
-		if err != nil {
-			return nil, err
-		}
-	HasMore:
-
-		for _, entry := range res.Entries {
-			fileStat, err := dbxMetadataToFileStat(entry)
-			if err != nil {
-				return nil, err
-			}
-			err = encoder.Encode(fileStat)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		if res.HasMore {
-			arg := files.NewListFolderContinueArg(res.Cursor)
-			res, err = f.fs.api.ListFolderContinue(arg)
-			if err != nil {
-				return nil, err
-			}
-			goto HasMore
-		}
-
-		err = dirEntTempFile.Sync()
-		if err != nil {
-			return nil, err
-		}
-
-		_, err = dirEntTempFile.Seek(0, io.SeekStart)
+	for (!f.listed || f.hasMore) && (n <= 0 || len(f.dirEnts) < n) {
+		err := f.fetchPage()
 		if err != nil {
 			return nil, err
 		}
-
-		f.dirEntTempFile = dirEntTempFile
-		f.dirEntDecoder = gob.NewDecoder(dirEntTempFile)
 	}
 
-	stats := []os.FileInfo{}
-	for len(stats) != n || n <= 0 {
-		st := &FileStat{}
-		err := f.dirEntDecoder.Decode(st)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
+	if n <= 0 {
+		stats := f.dirEnts
+		f.dirEnts = nil
+		if stats == nil {
+			stats = []os.FileInfo{}
 		}
-		stats = append(stats, st)
+		return stats, nil
 	}
-
-	if len(stats) == 0 && n > 0 {
-		return stats, io.EOF
+	if len(f.dirEnts) == 0 {
+		return []os.FileInfo{}, io.EOF
 	}
-
+	if n > len(f.dirEnts) {
+		n = len(f.dirEnts)
+	}
+	stats := f.dirEnts[:n]
+	f.dirEnts = f.dirEnts[n:]
 	return stats, nil
 }
 
@@ -294,6 +541,48 @@ func (f *FileHandle) Readdirnames(n int) ([]string, error) {
 	return names, err
 }
 
+// Start a download from off, using a range request
+// so reads can start anywhere in the file.
+func (f *FileHandle) openReader(off int64) error {
+	arg := files.NewDownloadArg(f.dbxfid)
+	if off != 0 {
+		arg.ExtraHeaders = map[string]string{"Range": fmt.Sprintf("bytes=%d-", off)}
+	}
+	return mapError(f.fs.retry.Do(func() error {
+		md, contents, err := f.fs.api.Download(arg)
+		if err != nil {
+			return err
+		}
+		f.reader = contents
+		f.readOffset = off
+		f.readHash = nil
+		if off == 0 && f.fs.verify {
+			f.readHash = extradbx.NewContentHash()
+			f.expectedHash = md.ContentHash
+			f.expectedSize = int64(md.Size)
+		}
+		return nil
+	}))
+}
+
+// Hash data read from the current download, checking
+// the hash once the whole file has been read.
+func (f *FileHandle) hashRead(b []byte) error {
+	if f.readHash == nil {
+		return nil
+	}
+	_, _ = f.readHash.Write(b)
+	if f.readOffset < f.expectedSize {
+		return nil
+	}
+	sum := hex.EncodeToString(f.readHash.Sum(nil))
+	f.readHash = nil
+	if sum != f.expectedHash {
+		return ErrCorrupt
+	}
+	return nil
+}
+
 func (f *FileHandle) ReadAt(b []byte, off int64) (int, error) {
 
 	if f.isDir {
@@ -304,25 +593,52 @@ func (f *FileHandle) ReadAt(b []byte, off int64) (int, error) {
 		return 0, ErrNotOpen
 	}
 
-	if off != f.readOffset {
+	if off < 0 {
 		return 0, ErrBadReadWriteOffset
 	}
 
-	// Lazily open reader in case it is never used
-	if f.reader == nil {
-		_, contents, err := f.fs.api.Download(files.NewDownloadArg(f.dbxfid))
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	// Short skips ahead, e.g. from reordered reads, are cheaper
+	// to read through than to start a new download.
+	if f.reader != nil && off > f.readOffset && off-f.readOffset <= maxReadSkip {
+		var skipped io.Writer = ioutil.Discard
+		if f.readHash != nil {
+			skipped = f.readHash
+		}
+		n, err := io.CopyN(skipped, f.reader, off-f.readOffset)
+		f.readOffset += n
+		if err != nil {
+			_ = f.reader.Close()
+			f.reader = nil
+		}
+	}
+
+	// Lazily open reader in case it is never used,
+	// reusing it for sequential reads.
+	if f.reader == nil || off != f.readOffset {
+		if f.reader != nil {
+			_ = f.reader.Close()
+			f.reader = nil
+		}
+		err := f.openReader(off)
 		if err != nil {
 			return 0, err
 		}
-		f.reader = contents
 	}
 
 	ntot := 0
 	for len(b) != 0 {
 		n, err := f.reader.Read(b)
+		f.readOffset += int64(n)
+		herr := f.hashRead(b[:n])
 		b = b[n:]
 		ntot += n
-		f.readOffset += int64(n)
+		if herr != nil {
+			return ntot, herr
+		}
 		if err != nil {
 			return ntot, err
 		}
@@ -350,7 +666,14 @@ func (f *FileHandle) WriteAt(b []byte, off int64) (int, error) {
 
 	// Lazily open writer in case it is never used
 	if f.writer == nil {
-		writer, err := extradbx.NewUpload(f.fs.api, f.fpath)
+		writer, err := extradbx.NewUploadWithOptions(f.fs.api, f.fpath, extradbx.UploadOptions{
+			Retry:             f.fs.retry,
+			VerifyContentHash: f.fs.verify,
+			ChunkSize:         f.fs.chunkSize,
+			Parallelism:       f.fs.parallel,
+			MaxBuffered:       f.fs.maxBuffered,
+			Config:            &f.fs.cfg,
+		})
 		if err != nil {
 			return 0, err
 		}
@@ -363,7 +686,16 @@ func (f *FileHandle) WriteAt(b []byte, off int64) (int, error) {
 
 	n, err := f.writer.Write(b)
 	f.writeOffset += int64(n)
-	return n, err
+	return n, mapError(err)
+}
+
+func (f *FileHandle) Sync() error {
+	// Uploads are only committed to dropbox when the
+	// upload session is finished on Close.
+	if f.writer != nil {
+		return ErrNotSupported
+	}
+	return nil
 }
 
 func (f *FileHandle) Close() error {
@@ -371,23 +703,33 @@ func (f *FileHandle) Close() error {
 	f.openForReading = false
 	f.openForWriting = false
 
-	if f.dirEntTempFile != nil {
-		name := f.dirEntTempFile.Name()
-		_ = f.dirEntTempFile.Close()
-		_ = os.Remove(name)
-		f.dirEntTempFile = nil
-		f.dirEntDecoder = nil
-	}
+	f.dirEnts = nil
 
 	if f.reader != nil {
 		_ = f.reader.Close()
 		f.reader = nil
 	}
 
+	u := f.fs.root()
+	u.uploadsLock.Lock()
+	key := metaCacheKey(f.fpath)
+	if u.uploads[key] == f {
+		delete(u.uploads, key)
+	}
+	mtime := f.mtime
+	u.uploadsLock.Unlock()
+
 	if f.writer != nil {
+		defer f.fs.cache.invalidate(f.fpath)
+		if !mtime.IsZero() {
+			f.writer.SetClientModified(mtime)
+		}
 		err := f.writer.Close()
+		if err == extradbx.ErrContentHashMismatch {
+			err = ErrCorrupt
+		}
 		if err != nil {
-			return err
+			return mapError(err)
 		}
 		f.writer = nil
 	}
@@ -411,6 +753,15 @@ func (st *FileStat) Name() string {
 	}
 }
 
+// The path of the file with the case it was created with.
+func (st *FileStat) PathDisplay() string {
+	if st.IsDir() {
+		return st.FolderMetadata.PathDisplay
+	} else {
+		return st.FileMetadata.PathDisplay
+	}
+}
+
 func (st *FileStat) GetDropboxId() string {
 	if st.IsDir() {
 		return st.FolderMetadata.Id
@@ -428,9 +779,9 @@ func (st *FileStat) Size() int64 {
 
 func (st *FileStat) Mode() os.FileMode {
 	if st.IsDir() {
-		return os.ModeDir | 0755
+		return os.ModeDir | st.perm
 	}
-	return 0755
+	return st.perm
 }
 
 func (st *FileStat) ModTime() time.Time {
@@ -0,0 +1,760 @@
+package dbxfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/extradbx"
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/async"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// A dropbox api serving one file, calls
+// not implemented here panic.
+type fakeClient struct {
+	files.Client
+	contents    []byte
+	contentHash string
+	downloads   int
+}
+
+func (c *fakeClient) Download(arg *files.DownloadArg) (*files.FileMetadata, io.ReadCloser, error) {
+	c.downloads++
+	off := 0
+	if r, ok := arg.ExtraHeaders["Range"]; ok {
+		_, err := fmt.Sscanf(r, "bytes=%d-", &off)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	md := &files.FileMetadata{Size: uint64(len(c.contents)), ContentHash: c.contentHash}
+	return md, ioutil.NopCloser(bytes.NewReader(c.contents[off:])), nil
+}
+
+func TestRangedReadAt(t *testing.T) {
+	contents := make([]byte, 4*maxReadSkip)
+	for i := range contents {
+		contents[i] = byte(i % 251)
+	}
+	api := &fakeClient{contents: contents}
+	f := &FileHandle{
+		fs:             &Fs{api: api, retry: extradbx.DefaultRetryPolicy},
+		dbxfid:         "id:test",
+		size:           int64(len(contents)),
+		openForReading: true,
+	}
+
+	buf := make([]byte, 1000)
+	for _, tc := range []struct {
+		off       int64
+		downloads int
+	}{
+		// Sequential reads and short skips share a download.
+		{0, 1},
+		{1000, 1},
+		{5000, 1},
+		// Long skips and reads behind start new ones.
+		{5000 + 2*maxReadSkip, 2},
+		{10, 3},
+		{1010, 3},
+	} {
+		n, err := f.ReadAt(buf, tc.off)
+		if err != nil || n != len(buf) {
+			t.Fatalf("read at %d: %d %v", tc.off, n, err)
+		}
+		if !bytes.Equal(buf, contents[tc.off:tc.off+int64(n)]) {
+			t.Fatalf("read at %d returned the wrong data", tc.off)
+		}
+		if api.downloads != tc.downloads {
+			t.Fatalf("read at %d: %d downloads, expected %d", tc.off, api.downloads, tc.downloads)
+		}
+	}
+
+	n, err := f.ReadAt(buf, int64(len(contents)-10))
+	if n != 10 || err != io.EOF {
+		t.Fatalf("unexpected read at end %d %v", n, err)
+	}
+	n, err = f.ReadAt(buf, int64(len(contents)))
+	if n != 0 || err != io.EOF {
+		t.Fatalf("unexpected read past end %d %v", n, err)
+	}
+}
+
+func TestDownloadVerification(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 500000)
+	h := extradbx.NewContentHash()
+	_, _ = h.Write(contents)
+
+	for _, contentHash := range []string{hex.EncodeToString(h.Sum(nil)), "bad"} {
+		api := &fakeClient{contents: contents, contentHash: contentHash}
+		f := &FileHandle{
+			fs:             &Fs{api: api, retry: extradbx.DefaultRetryPolicy, verify: true},
+			dbxfid:         "id:test",
+			size:           int64(len(contents)),
+			openForReading: true,
+		}
+		// Skipped data is still verified.
+		buf := make([]byte, 300000)
+		_, err := f.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.ReadAt(buf, 2*int64(len(buf)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(f)
+		if contentHash == "bad" && err != ErrCorrupt {
+			t.Fatalf("expected ErrCorrupt, got %v", err)
+		}
+		if contentHash != "bad" && err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A dropbox api listing a folder in pages.
+type listClient struct {
+	files.Client
+	pages   [][]string
+	fetched int
+}
+
+func (c *listClient) page(i int) *files.ListFolderResult {
+	c.fetched++
+	res := &files.ListFolderResult{Cursor: fmt.Sprint(i + 1), HasMore: i+1 < len(c.pages)}
+	for _, name := range c.pages[i] {
+		md := &files.FileMetadata{}
+		md.Name = name
+		res.Entries = append(res.Entries, md)
+	}
+	return res
+}
+
+func (c *listClient) ListFolder(arg *files.ListFolderArg) (*files.ListFolderResult, error) {
+	return c.page(0), nil
+}
+
+func (c *listClient) ListFolderContinue(arg *files.ListFolderContinueArg) (*files.ListFolderResult, error) {
+	var i int
+	_, err := fmt.Sscan(arg.Cursor, &i)
+	if err != nil {
+		return nil, err
+	}
+	return c.page(i), nil
+}
+
+func TestStreamingReaddir(t *testing.T) {
+	api := &listClient{pages: [][]string{{"a", "b", "c"}, {}, {"d"}, {"e", "f"}}}
+	f := &FileHandle{
+		fs:             &Fs{api: api, retry: extradbx.DefaultRetryPolicy},
+		isDir:          true,
+		openForReading: true,
+	}
+
+	var names []string
+	for _, tc := range []struct {
+		n       int
+		fetched int
+	}{
+		{2, 1},
+		{1, 1},
+		{1, 3},
+		{5, 4},
+	} {
+		got, err := f.Readdirnames(tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if api.fetched != tc.fetched {
+			t.Fatalf("%d pages fetched, expected %d", api.fetched, tc.fetched)
+		}
+		names = append(names, got...)
+	}
+	if fmt.Sprint(names) != "[a b c d e f]" {
+		t.Fatalf("unexpected names %v", names)
+	}
+	_, err := f.Readdirnames(1)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+// A dropbox api counting metadata lookups of a set of files.
+type metaClient struct {
+	files.Client
+	paths   map[string]bool
+	lookups int
+}
+
+func (c *metaClient) GetMetadata(arg *files.GetMetadataArg) (files.IsMetadata, error) {
+	c.lookups++
+	if !c.paths[strings.ToLower(arg.Path)] {
+		return nil, files.GetMetadataAPIError{
+			EndpointError: &files.GetMetadataError{Path: &files.LookupError{Tagged: dropbox.Tagged{Tag: "not_found"}}},
+		}
+	}
+	md := &files.FileMetadata{}
+	md.Name = path.Base(arg.Path)
+	return md, nil
+}
+
+func (c *metaClient) MoveV2(arg *files.RelocationArg) (*files.RelocationResult, error) {
+	delete(c.paths, strings.ToLower(arg.FromPath))
+	c.paths[strings.ToLower(arg.ToPath)] = true
+	return &files.RelocationResult{}, nil
+}
+
+func (c *metaClient) DeleteV2(arg *files.DeleteArg) (*files.DeleteResult, error) {
+	delete(c.paths, strings.ToLower(arg.Path))
+	return &files.DeleteResult{}, nil
+}
+
+func TestMetadataCache(t *testing.T) {
+	api := &metaClient{paths: map[string]bool{"/a": true}}
+	fs := &Fs{api: api, retry: extradbx.DefaultRetryPolicy, cache: &metaCache{ttl: time.Hour}}
+
+	exists := func(p string, expected bool, lookups int) {
+		t.Helper()
+		_, err := fs.Stat(p)
+		if expected && err != nil || !expected && err != os.ErrNotExist {
+			t.Fatalf("stat %s: %v", p, err)
+		}
+		if api.lookups != lookups {
+			t.Fatalf("stat %s: %d lookups, expected %d", p, api.lookups, lookups)
+		}
+	}
+
+	exists("/a", true, 1)
+	exists("/A", true, 1)
+	exists("/b", false, 2)
+	exists("/b", false, 2)
+
+	err := fs.Rename("/a", "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists("/a", false, 3)
+	exists("/b", true, 4)
+
+	err = fs.Remove("/B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists("/b", false, 5)
+
+	fs.cache.ttl = 0
+	exists("/b", false, 6)
+	exists("/b", false, 7)
+}
+
+// A dropbox api recording the commit of an upload.
+type uploadClient struct {
+	files.Client
+	commit *files.CommitInfo
+}
+
+func (c *uploadClient) UploadSessionStart(arg *files.UploadSessionStartArg, content io.Reader) (*files.UploadSessionStartResult, error) {
+	_, err := io.Copy(ioutil.Discard, content)
+	return &files.UploadSessionStartResult{SessionId: "session"}, err
+}
+
+func (c *uploadClient) UploadSessionFinish(arg *files.UploadSessionFinishArg, content io.Reader) (*files.FileMetadata, error) {
+	c.commit = arg.Commit
+	return &files.FileMetadata{}, nil
+}
+
+func TestUploadClientModified(t *testing.T) {
+	api := &uploadClient{}
+	fs := &Fs{api: api, retry: extradbx.DefaultRetryPolicy}
+
+	f, err := fs.OpenFile("/Upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 600, time.FixedZone("X", 3600))
+	err = fs.Chtimes("/upload", mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.commit == nil || !api.commit.ClientModified.Equal(mtime.Truncate(time.Second)) || api.commit.ClientModified.Location() != time.UTC {
+		t.Fatalf("unexpected commit %#v", api.commit)
+	}
+
+	// Handles are forgotten once they are committed.
+	if len(fs.uploads) != 0 {
+		t.Fatal("upload not forgotten")
+	}
+}
+
+// A dropbox api with the revisions of the file /a
+// and of the deleted file /d.
+type revClient struct {
+	files.Client
+	revs     map[string][]string
+	restored string
+}
+
+func (c *revClient) GetMetadata(arg *files.GetMetadataArg) (files.IsMetadata, error) {
+	for fpath, revs := range c.revs {
+		for _, rev := range revs {
+			if arg.Path == "rev:"+rev {
+				md := &files.FileMetadata{Rev: rev, Size: uint64(len(rev))}
+				md.Name = path.Base(fpath)
+				return md, nil
+			}
+		}
+	}
+	if arg.Path == "/a" {
+		md := &files.FileMetadata{Rev: c.revs["/a"][0]}
+		md.Name = "a"
+		return md, nil
+	}
+	return nil, files.GetMetadataAPIError{
+		EndpointError: &files.GetMetadataError{Path: &files.LookupError{Tagged: dropbox.Tagged{Tag: "not_found"}}},
+	}
+}
+
+func (c *revClient) ListFolder(arg *files.ListFolderArg) (*files.ListFolderResult, error) {
+	md := &files.FileMetadata{}
+	md.Name = "a"
+	hidden := &files.FolderMetadata{}
+	hidden.Name = ".revisions"
+	return &files.ListFolderResult{Entries: []files.IsMetadata{md, hidden}}, nil
+}
+
+func (c *revClient) ListRevisions(arg *files.ListRevisionsArg) (*files.ListRevisionsResult, error) {
+	revs, ok := c.revs[arg.Path]
+	if !ok {
+		return nil, files.ListRevisionsAPIError{
+			EndpointError: &files.ListRevisionsError{Path: &files.LookupError{Tagged: dropbox.Tagged{Tag: "not_found"}}},
+		}
+	}
+	res := &files.ListRevisionsResult{}
+	for _, rev := range revs {
+		res.Entries = append(res.Entries, &files.FileMetadata{Rev: rev})
+	}
+	return res, nil
+}
+
+func (c *revClient) Restore(arg *files.RestoreArg) (*files.FileMetadata, error) {
+	c.restored = arg.Path + "@" + arg.Rev
+	return &files.FileMetadata{}, nil
+}
+
+func TestRevisions(t *testing.T) {
+	api := &revClient{revs: map[string][]string{
+		"/a": {"a00000002", "a00000001"},
+		"/d": {"d00000001"},
+	}}
+	fs := &Fs{api: api, retry: extradbx.DefaultRetryPolicy, cache: &metaCache{ttl: time.Hour}, revisions: true}
+
+	list := func(p string) []string {
+		t.Helper()
+		f, err := fs.Open(p)
+		if err != nil {
+			t.Fatalf("open %s: %v", p, err)
+		}
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			t.Fatalf("list %s: %v", p, err)
+		}
+		return names
+	}
+
+	if names := list("/"); fmt.Sprint(names) != "[a]" {
+		t.Fatalf("unexpected root listing %v", names)
+	}
+	if names := list("/.revisions"); fmt.Sprint(names) != "[a]" {
+		t.Fatalf("unexpected revisions listing %v", names)
+	}
+	if names := list("/.revisions/a"); fmt.Sprint(names) != "[a00000002 a00000001]" {
+		t.Fatalf("unexpected revisions of /a %v", names)
+	}
+	if names := list("/.revisions/d"); fmt.Sprint(names) != "[d00000001]" {
+		t.Fatalf("unexpected revisions of /d %v", names)
+	}
+	_, err := fs.Stat("/.revisions/x")
+	if err != os.ErrNotExist {
+		t.Fatalf("expected revisions of /x not to exist, got %v", err)
+	}
+
+	st, err := fs.Stat("/.revisions/a/a00000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.IsDir() || st.Name() != "a00000001" || st.Size() != 9 {
+		t.Fatalf("unexpected revision stat %v %v %v", st.IsDir(), st.Name(), st.Size())
+	}
+	f, err := fs.Open("/.revisions/a/a00000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.(*FileHandle).dbxfid != "rev:a00000001" {
+		t.Fatalf("unexpected download path %s", f.(*FileHandle).dbxfid)
+	}
+
+	for _, p := range []string{"/.revisions/b", "/.revisions/a/a00000001"} {
+		_, err = fs.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != os.ErrPermission {
+			t.Fatalf("create %s: expected permission error, got %v", p, err)
+		}
+		err = fs.Remove(p)
+		if err != os.ErrPermission {
+			t.Fatalf("remove %s: expected permission error, got %v", p, err)
+		}
+	}
+
+	err = fs.Rename("/.revisions/d/d00000001", "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.restored != "/d@d00000001" {
+		t.Fatalf("unexpected restore %s", api.restored)
+	}
+	err = fs.Rename("/.revisions/d", "/e")
+	if err != os.ErrPermission {
+		t.Fatalf("expected permission error renaming revisions, got %v", err)
+	}
+}
+
+// A dropbox api reporting the deletion of /a/b to watchers.
+type watchClient struct {
+	files.Client
+	polls   chan bool
+	cursors []string
+}
+
+func (c *watchClient) ListFolderGetLatestCursor(arg *files.ListFolderArg) (*files.ListFolderGetLatestCursorResult, error) {
+	return &files.ListFolderGetLatestCursorResult{Cursor: "1"}, nil
+}
+
+func (c *watchClient) ListFolderLongpoll(arg *files.ListFolderLongpollArg) (*files.ListFolderLongpollResult, error) {
+	changes := <-c.polls
+	return &files.ListFolderLongpollResult{Changes: changes}, nil
+}
+
+func (c *watchClient) ListFolderContinue(arg *files.ListFolderContinueArg) (*files.ListFolderResult, error) {
+	c.cursors = append(c.cursors, arg.Cursor)
+	if arg.Cursor == "1" {
+		return &files.ListFolderResult{Cursor: "2", HasMore: true}, nil
+	}
+	md := &files.DeletedMetadata{}
+	md.PathLower = "/a/b"
+	return &files.ListFolderResult{Entries: []files.IsMetadata{md}, Cursor: "3"}, nil
+}
+
+func TestLongpoll(t *testing.T) {
+	api := &watchClient{polls: make(chan bool)}
+	fs := &Fs{api: api, retry: extradbx.DefaultRetryPolicy, cache: &metaCache{ttl: time.Hour}}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		fs.watch(stop)
+		close(done)
+	}()
+
+	// Caching after the first poll starts keeps
+	// the cache from being cleared for the cursor.
+	api.polls <- false
+	fs.cache.put("/a", &FileStat{FolderMetadata: &files.FolderMetadata{}})
+	fs.cache.put("/A/B", &FileStat{FileMetadata: &files.FileMetadata{}})
+	fs.cache.put("/c", nil)
+
+	api.polls <- true
+	api.polls <- false
+	close(stop)
+	close(api.polls)
+	<-done
+
+	if _, ok := fs.cache.get("/a/b"); ok {
+		t.Fatal("expected /a/b to be invalidated")
+	}
+	for _, p := range []string{"/a", "/c"} {
+		if _, ok := fs.cache.get(p); !ok {
+			t.Fatalf("expected %s to stay cached", p)
+		}
+	}
+	if fmt.Sprint(api.cursors) != "[1 2]" {
+		t.Fatalf("unexpected cursors %v", api.cursors)
+	}
+}
+
+func TestMapError(t *testing.T) {
+	lookup := func(tag string) *files.LookupError {
+		return &files.LookupError{Tagged: dropbox.Tagged{Tag: tag}}
+	}
+	write := func(tag string) *files.WriteError {
+		return &files.WriteError{Tagged: dropbox.Tagged{Tag: tag}}
+	}
+	other := errors.New("other")
+	for _, tc := range []struct {
+		err      error
+		expected error
+	}{
+		{files.GetMetadataAPIError{EndpointError: &files.GetMetadataError{Path: lookup("not_found")}}, os.ErrNotExist},
+		{files.DownloadAPIError{EndpointError: &files.DownloadError{Path: lookup("not_file")}}, ErrNotFile},
+		{files.ListFolderAPIError{EndpointError: &files.ListFolderError{Path: lookup("not_folder")}}, ErrNotDir},
+		{files.DeleteV2APIError{EndpointError: &files.DeleteError{PathLookup: lookup("not_found")}}, os.ErrNotExist},
+		{files.MoveV2APIError{EndpointError: &files.RelocationError{To: write("conflict")}}, os.ErrExist},
+		{files.CreateFolderV2APIError{EndpointError: &files.CreateFolderError{Path: write("conflict")}}, os.ErrExist},
+		{files.UploadSessionFinishAPIError{EndpointError: &files.UploadSessionFinishError{Path: write("insufficient_space")}}, ErrInsufficientSpace},
+		{files.RestoreAPIError{EndpointError: &files.RestoreError{PathWrite: write("no_write_permission")}}, os.ErrPermission},
+		{files.DeleteV2APIError{EndpointError: &files.DeleteError{PathWrite: write("too_many_write_operations")}}, ErrTooManyWrites},
+		{files.DeleteV2APIError{EndpointError: &files.DeleteError{PathWrite: write("other")}}, nil},
+		{other, other},
+		{nil, nil},
+	} {
+		expected := tc.expected
+		if expected == nil {
+			expected = tc.err
+		}
+		if err := mapError(tc.err); !reflect.DeepEqual(err, expected) {
+			t.Fatalf("mapped %v to %v, expected %v", tc.err, err, expected)
+		}
+	}
+}
+
+// A dropbox api running batch deletes as async jobs finishing on
+// their second check, failing to delete /missing. Batch moves
+// finish at once.
+type batchClient struct {
+	files.Client
+	checks  int
+	pending *files.DeleteBatchResult
+	deleted []string
+	moved   []string
+}
+
+func (c *batchClient) DeleteBatch(arg *files.DeleteBatchArg) (*files.DeleteBatchLaunch, error) {
+	if len(arg.Entries) > maxBatchEntries {
+		return nil, errors.New("batch too large")
+	}
+	c.pending = &files.DeleteBatchResult{}
+	for _, entry := range arg.Entries {
+		result := &files.DeleteBatchResultEntry{Tagged: dropbox.Tagged{Tag: "success"}}
+		if entry.Path == "/missing" {
+			result = &files.DeleteBatchResultEntry{
+				Tagged: dropbox.Tagged{Tag: "failure"},
+				Failure: &files.DeleteError{
+					Tagged:     dropbox.Tagged{Tag: "path_lookup"},
+					PathLookup: &files.LookupError{Tagged: dropbox.Tagged{Tag: "not_found"}},
+				},
+			}
+		} else {
+			c.deleted = append(c.deleted, entry.Path)
+		}
+		c.pending.Entries = append(c.pending.Entries, result)
+	}
+	c.checks = 0
+	return &files.DeleteBatchLaunch{Tagged: dropbox.Tagged{Tag: "async_job_id"}, AsyncJobId: "job"}, nil
+}
+
+func (c *batchClient) DeleteBatchCheck(arg *async.PollArg) (*files.DeleteBatchJobStatus, error) {
+	c.checks++
+	if c.checks < 2 {
+		return &files.DeleteBatchJobStatus{Tagged: dropbox.Tagged{Tag: "in_progress"}}, nil
+	}
+	return &files.DeleteBatchJobStatus{Tagged: dropbox.Tagged{Tag: "complete"}, Complete: c.pending}, nil
+}
+
+func (c *batchClient) MoveBatchV2(arg *files.MoveBatchArg) (*files.RelocationBatchV2Launch, error) {
+	res := &files.RelocationBatchV2Result{}
+	for _, entry := range arg.Entries {
+		c.moved = append(c.moved, entry.FromPath+"->"+entry.ToPath)
+		res.Entries = append(res.Entries, &files.RelocationBatchResultEntry{Tagged: dropbox.Tagged{Tag: "success"}})
+	}
+	return &files.RelocationBatchV2Launch{Tagged: dropbox.Tagged{Tag: "complete"}, Complete: res}, nil
+}
+
+func TestBatch(t *testing.T) {
+	defer func(d time.Duration) { batchPollInterval = d }(batchPollInterval)
+	batchPollInterval = 0
+
+	api := &batchClient{}
+	fs := &Fs{api: api, retry: extradbx.DefaultRetryPolicy, cache: &metaCache{ttl: time.Hour}}
+	fs.cache.put("/x/y", &FileStat{FileMetadata: &files.FileMetadata{}})
+
+	var paths []string
+	for i := 0; i < maxBatchEntries+1; i++ {
+		paths = append(paths, fmt.Sprintf("/x/%d", i))
+	}
+	paths = append(paths, "/x/y")
+	err := vfs.RemoveBatch(fs, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.deleted) != len(paths) {
+		t.Fatalf("deleted %d paths, expected %d", len(api.deleted), len(paths))
+	}
+	if _, ok := fs.cache.get("/x/y"); ok {
+		t.Fatal("expected /x/y to be invalidated")
+	}
+
+	err = fs.RemoveBatch([]string{"/a", "/missing"})
+	if err != os.ErrNotExist {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+
+	err = vfs.RenameBatch(fs, []vfs.Rename{{From: "/a", To: "/b"}, {From: "/c", To: "/d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(api.moved) != "[/a->/b /c->/d]" {
+		t.Fatalf("unexpected moves %v", api.moved)
+	}
+}
+
+// A case insensitive dropbox api keeping the
+// case of paths, keyed by their lower case.
+type caseClient struct {
+	files.Client
+	paths map[string]string
+	moves int
+}
+
+func (c *caseClient) GetMetadata(arg *files.GetMetadataArg) (files.IsMetadata, error) {
+	display, ok := c.paths[strings.ToLower(arg.Path)]
+	if !ok {
+		return nil, files.GetMetadataAPIError{
+			EndpointError: &files.GetMetadataError{Path: &files.LookupError{Tagged: dropbox.Tagged{Tag: "not_found"}}},
+		}
+	}
+	md := &files.FileMetadata{}
+	md.Name = path.Base(display)
+	md.PathDisplay = display
+	return md, nil
+}
+
+func (c *caseClient) MoveV2(arg *files.RelocationArg) (*files.RelocationResult, error) {
+	c.moves++
+	from, to := strings.ToLower(arg.FromPath), strings.ToLower(arg.ToPath)
+	if from == to {
+		// Dropbox takes the paths to be the same.
+		return &files.RelocationResult{}, nil
+	}
+	if _, ok := c.paths[to]; ok {
+		return nil, files.MoveV2APIError{
+			EndpointError: &files.RelocationError{To: &files.WriteError{Tagged: dropbox.Tagged{Tag: "conflict"}}},
+		}
+	}
+	delete(c.paths, from)
+	c.paths[to] = arg.ToPath
+	return &files.RelocationResult{}, nil
+}
+
+func TestRenameCase(t *testing.T) {
+	api := &caseClient{paths: map[string]string{"/readme": "/readme", "/other": "/other"}}
+	fs := &Fs{api: api, retry: extradbx.DefaultRetryPolicy, cache: &metaCache{ttl: time.Hour}}
+
+	err := fs.Rename("/readme", "/README")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := fs.Stat("/readme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Name() != "README" || len(api.paths) != 2 {
+		t.Fatalf("unexpected name %s after renaming, paths %v", st.Name(), api.paths)
+	}
+
+	moves := api.moves
+	err = fs.Rename("/readme", "/README")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.moves != moves {
+		t.Fatal("expected renaming to the same name to do nothing")
+	}
+
+	err = fs.Rename("/README", "/Other")
+	if err != os.ErrExist {
+		t.Fatalf("expected exists error, got %v", err)
+	}
+}
+
+func TestModes(t *testing.T) {
+	fs := &Fs{fileMode: 0600, dirMode: 0700, revisions: true}
+	st, err := fs.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != os.ModeDir|0700 {
+		t.Fatalf("unexpected root mode %v", st.Mode())
+	}
+	st, err = fs.Stat("/.revisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != os.ModeDir|0500 {
+		t.Fatalf("unexpected revisions mode %v", st.Mode())
+	}
+	st, _ = fs.dbxMetadataToFileStat(&files.FileMetadata{})
+	if st.Mode() != 0600 {
+		t.Fatalf("unexpected file mode %v", st.Mode())
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	auth := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := contextClient(ctx, nil, "secret")
+	done := make(chan error)
+	go func() {
+		_, err := client.Get(srv.URL)
+		done <- err
+	}()
+	if a := <-auth; a != "Bearer secret" {
+		t.Fatalf("unexpected authorization %q", a)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be cancelled, got %v", err)
+	}
+
+	fs := &Fs{cache: &metaCache{ttl: time.Hour}}
+	view := fs.WithContext(context.Background()).(*Fs)
+	fs.cache.put("/a", &FileStat{FolderMetadata: &files.FolderMetadata{}})
+	if _, ok := view.cache.get("/a"); !ok {
+		t.Fatal("expected views to share the cache")
+	}
+	fh := &FileHandle{fs: view, fpath: "/b"}
+	view.root().uploads = map[string]*FileHandle{"/b": fh}
+	mtime := time.Unix(1000, 0)
+	if err := fs.Chtimes("/b", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if !fh.mtime.Equal(mtime) {
+		t.Fatal("expected views to share the files being written")
+	}
+}
@@ -0,0 +1,137 @@
+package dbxfs
+
+import (
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// How long watching waits after a failed call before trying again.
+const longpollErrorWait = 30 * time.Second
+
+// Watch the whole dropbox for changes made elsewhere with long polls,
+// dropping the cached metadata of changed paths so long lived sessions
+// see them without waiting for it to expire. Should watching fail the
+// cache still expires entries as usual. Runs until stop is closed.
+func (fs *Fs) watch(stop chan struct{}) {
+	cursor := ""
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if cursor == "" {
+			var err error
+			cursor, err = fs.latestCursor()
+			if err != nil {
+				if !sleepOrStop(longpollErrorWait, stop) {
+					return
+				}
+				continue
+			}
+			// Changes made without a cursor were missed.
+			fs.cache.clear()
+		}
+
+		var res *files.ListFolderLongpollResult
+		err := fs.retry.Do(func() error {
+			var err error
+			res, err = fs.api.ListFolderLongpoll(files.NewListFolderLongpollArg(cursor))
+			return err
+		})
+		if err == nil && res.Changes {
+			cursor, err = fs.applyChanges(cursor)
+		}
+		if err != nil {
+			if isCursorReset(err) {
+				cursor = ""
+				continue
+			}
+			if !sleepOrStop(longpollErrorWait, stop) {
+				return
+			}
+			continue
+		}
+		if res.Backoff != 0 {
+			if !sleepOrStop(time.Duration(res.Backoff)*time.Second, stop) {
+				return
+			}
+		}
+	}
+}
+
+func (fs *Fs) latestCursor() (string, error) {
+	arg := files.NewListFolderArg("")
+	arg.Recursive = true
+	arg.IncludeMountedFolders = true
+	arg.IncludeDeleted = true
+	var res *files.ListFolderGetLatestCursorResult
+	err := fs.retry.Do(func() error {
+		var err error
+		res, err = fs.api.ListFolderGetLatestCursor(arg)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return res.Cursor, nil
+}
+
+// Invalidate the paths changed since cursor,
+// returning the cursor after the changes.
+func (fs *Fs) applyChanges(cursor string) (string, error) {
+	for {
+		var res *files.ListFolderResult
+		err := fs.retry.Do(func() error {
+			var err error
+			res, err = fs.api.ListFolderContinue(files.NewListFolderContinueArg(cursor))
+			return err
+		})
+		if err != nil {
+			return cursor, err
+		}
+		for _, entry := range res.Entries {
+			var md *files.Metadata
+			switch entry := entry.(type) {
+			case *files.FileMetadata:
+				md = &entry.Metadata
+			case *files.FolderMetadata:
+				md = &entry.Metadata
+			case *files.DeletedMetadata:
+				md = &entry.Metadata
+			default:
+				continue
+			}
+			fs.cache.invalidate(md.PathLower)
+		}
+		cursor = res.Cursor
+		if !res.HasMore {
+			return cursor, nil
+		}
+	}
+}
+
+// Cursors expire, and must then be replaced.
+func isCursorReset(err error) bool {
+	switch err := err.(type) {
+	case files.ListFolderLongpollAPIError:
+		return err.EndpointError != nil && err.EndpointError.Tag == files.ListFolderLongpollErrorReset
+	case files.ListFolderContinueAPIError:
+		return err.EndpointError != nil && err.EndpointError.Tag == files.ListFolderContinueErrorReset
+	}
+	return false
+}
+
+// Sleep for d, returning false early if stop is closed.
+func sleepOrStop(d time.Duration, stop chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
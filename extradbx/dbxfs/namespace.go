@@ -0,0 +1,56 @@
+package dbxfs
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/andrewchambers/sftpplease/extradbx"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/common"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/users"
+)
+
+// Serve the namespace of the account root, which for members of teams
+// with team spaces contains the team folders beside their own folder.
+const RootTeam = "team"
+
+// Serve the home namespace of the account, the default.
+const RootHome = "home"
+
+// The namespace id of the root of the account cfg is for.
+func accountRoot(cfg dropbox.Config, retry extradbx.RetryPolicy) (string, error) {
+	var account *users.FullAccount
+	err := retry.Do(func() error {
+		var err error
+		account, err = users.New(cfg).GetCurrentAccount()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	switch info := account.RootInfo.(type) {
+	case *common.TeamRootInfo:
+		return info.RootNamespaceId, nil
+	case *common.UserRootInfo:
+		return info.RootNamespaceId, nil
+	case *common.RootInfo:
+		return info.RootNamespaceId, nil
+	}
+	return "", errors.New("dropbox account has no root namespace")
+}
+
+// Make every call of cfg relative to the namespace nsid, which
+// dropbox selects with the Dropbox-API-Path-Root header.
+func setPathRoot(cfg *dropbox.Config, nsid string) error {
+	root, err := json.Marshal(&common.PathRoot{
+		Tagged:      dropbox.Tagged{Tag: common.PathRootNamespaceId},
+		NamespaceId: nsid,
+	})
+	if err != nil {
+		return err
+	}
+	cfg.HeaderGenerator = func(hostType string, style string, namespace string, route string) map[string]string {
+		return map[string]string{"Dropbox-API-Path-Root": string(root)}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package dbxfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/extradbx"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+)
+
+// Options of the dropbox engine, parsed from the engine
+// parameter 'dropbox:[TOKEN][,KEY=VALUE...]'.
+type Options struct {
+	// A long lived access token.
+	Token string
+	// The app key, secret and refresh token used to get short
+	// lived access tokens. The secret may be empty for apps
+	// authorized with PKCE.
+	AppKey       string
+	AppSecret    string
+	RefreshToken string
+	// Applied to every dropbox call, set with 'retries=N' and
+	// 'retry-wait=DURATION', e.g. 'retry-wait=10m'.
+	Retry extradbx.RetryPolicy
+	// Compare the content hash of uploaded and downloaded files
+	// with their data, disabled with 'verify=false' for speed.
+	VerifyContentHash bool
+	// How long metadata is cached, set with 'cache-ttl=DURATION',
+	// zero disables the cache.
+	CacheTTL time.Duration
+	// The most chunks of one upload sent at once, set with
+	// 'parallel=N'. Each is buffered in memory.
+	Parallelism int
+	// The size of upload chunks, set with 'chunk=SIZE', e.g.
+	// 'chunk=16M'. Parallel uploads need multiples of 4M.
+	ChunkSize int64
+	// The most bytes one parallel upload buffers, set with
+	// 'max-buffered=SIZE', limiting its parallelism to fit.
+	MaxBuffered int64
+	// The team member to act as, set with 'member=ID', needed
+	// for tokens of team apps.
+	MemberID string
+	// The namespace served, set with 'root=team', 'root=home' or
+	// 'root=NAMESPACE_ID'. Empty is the home namespace.
+	Root string
+	// Serve the read only /.revisions directory of file
+	// revisions, set with 'revisions=true'.
+	Revisions bool
+	// Watch for changes made elsewhere to keep cached metadata
+	// current, set with 'longpoll=true'.
+	Longpoll bool
+	// The permissions reported for files and directories, set
+	// in octal with 'file-mode=MODE' and 'dir-mode=MODE'.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+}
+
+// Parse the engine parameter. Secrets missing from it are taken from
+// the SFTPPLEASE_DROPBOX_APP_SECRET and SFTPPLEASE_DROPBOX_REFRESH_TOKEN
+// environment variables, keeping them out of the process list.
+func ParseOptions(param string) (*Options, error) {
+	opts := &Options{
+		Retry:             extradbx.DefaultRetryPolicy,
+		VerifyContentHash: true,
+		CacheTTL:          DefaultCacheTTL,
+		Parallelism:       1,
+		ChunkSize:         extradbx.DefaultChunkSize,
+		FileMode:          DefaultFileMode,
+		DirMode:           DefaultDirMode,
+	}
+	for i, field := range strings.Split(param, ",") {
+		idx := strings.Index(field, "=")
+		if idx == -1 {
+			if i != 0 {
+				return nil, fmt.Errorf("dropbox option '%s' is not KEY=VALUE", field)
+			}
+			opts.Token = field
+			continue
+		}
+		key, value := field[:idx], field[idx+1:]
+		switch key {
+		case "app-key":
+			opts.AppKey = value
+		case "app-secret":
+			opts.AppSecret = value
+		case "refresh-token":
+			opts.RefreshToken = value
+		case "retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid dropbox retries '%s'", value)
+			}
+			opts.Retry.MaxRetries = n
+		case "retry-wait":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid dropbox retry-wait '%s'", value)
+			}
+			opts.Retry.MaxWait = d
+		case "verify":
+			verify, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dropbox verify '%s'", value)
+			}
+			opts.VerifyContentHash = verify
+		case "cache-ttl":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid dropbox cache-ttl '%s'", value)
+			}
+			opts.CacheTTL = d
+		case "parallel":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid dropbox parallel '%s'", value)
+			}
+			opts.Parallelism = n
+		case "chunk":
+			n, err := parseSize(value)
+			if err != nil || n < 1 || n > extradbx.MaxChunkSize {
+				return nil, fmt.Errorf("invalid dropbox chunk '%s'", value)
+			}
+			opts.ChunkSize = n
+		case "max-buffered":
+			n, err := parseSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dropbox max-buffered '%s'", value)
+			}
+			opts.MaxBuffered = n
+		case "member":
+			opts.MemberID = value
+		case "root":
+			if !validRoot(value) {
+				return nil, fmt.Errorf("invalid dropbox root '%s'", value)
+			}
+			opts.Root = value
+		case "revisions":
+			revisions, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dropbox revisions '%s'", value)
+			}
+			opts.Revisions = revisions
+		case "longpoll":
+			longpoll, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dropbox longpoll '%s'", value)
+			}
+			opts.Longpoll = longpoll
+		case "file-mode", "dir-mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0777 {
+				return nil, fmt.Errorf("invalid dropbox %s '%s'", key, value)
+			}
+			if key == "file-mode" {
+				opts.FileMode = os.FileMode(mode)
+			} else {
+				opts.DirMode = os.FileMode(mode)
+			}
+		default:
+			return nil, fmt.Errorf("unknown dropbox option '%s'", key)
+		}
+	}
+
+	if opts.AppKey != "" {
+		if opts.AppSecret == "" {
+			opts.AppSecret = os.Getenv("SFTPPLEASE_DROPBOX_APP_SECRET")
+		}
+		if opts.RefreshToken == "" {
+			opts.RefreshToken = os.Getenv("SFTPPLEASE_DROPBOX_REFRESH_TOKEN")
+		}
+		if opts.RefreshToken == "" {
+			return nil, errors.New("dropbox app-key requires a refresh token")
+		}
+	} else if opts.RefreshToken != "" {
+		return nil, errors.New("dropbox refresh-token requires an app-key")
+	}
+	if opts.Parallelism > 1 && opts.ChunkSize%extradbx.ConcurrentChunkAlign != 0 {
+		return nil, errors.New("dropbox chunk must be a multiple of 4M for parallel uploads")
+	}
+	if opts.Token == "" && opts.RefreshToken == "" {
+		return nil, errors.New("dropbox requires an access token or an app-key and refresh token")
+	}
+	return opts, nil
+}
+
+// Parse a size in bytes with an optional
+// K, M or G suffix, e.g. '16M'.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			mult = 1024
+		case 'M', 'm':
+			mult = 1024 * 1024
+		case 'G', 'g':
+			mult = 1024 * 1024 * 1024
+		}
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size '%s' out of range", s)
+	}
+	return n * mult, nil
+}
+
+// Roots are the names RootTeam and RootHome, or namespace ids,
+// which are numbers.
+func validRoot(root string) bool {
+	if root == RootTeam || root == RootHome {
+		return true
+	}
+	if root == "" {
+		return false
+	}
+	for _, c := range root {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// The sdk config for opts. The namespace of the account
+// root is looked up when opts.Root is RootTeam.
+func (opts *Options) Config() (dropbox.Config, error) {
+	cfg := dropbox.Config{
+		Token:      opts.Token,
+		AsMemberID: opts.MemberID,
+	}
+	if opts.RefreshToken != "" {
+		// The sdk only adds the token itself when it creates the client.
+		cfg.Client = &http.Client{
+			Transport: newRefreshTransport(opts, tokenURL, http.DefaultTransport),
+		}
+	}
+	switch opts.Root {
+	case "", RootHome:
+	case RootTeam:
+		nsid, err := accountRoot(cfg, opts.Retry)
+		if err != nil {
+			return cfg, err
+		}
+		err = setPathRoot(&cfg, nsid)
+		if err != nil {
+			return cfg, err
+		}
+	default:
+		err := setPathRoot(&cfg, opts.Root)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,122 @@
+package dbxfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/extradbx"
+)
+
+func TestParseOptions(t *testing.T) {
+	opts, err := ParseOptions("TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opts, &Options{Token: "TOKEN", Retry: extradbx.DefaultRetryPolicy, VerifyContentHash: true, CacheTTL: DefaultCacheTTL, Parallelism: 1, ChunkSize: extradbx.DefaultChunkSize, FileMode: DefaultFileMode, DirMode: DefaultDirMode}) {
+		t.Fatalf("unexpected options %#v", opts)
+	}
+
+	opts, err = ParseOptions(",app-key=KEY,app-secret=SECRET,refresh-token=REFRESH,retries=2,retry-wait=1m,verify=false,cache-ttl=0,parallel=4,chunk=16M,max-buffered=1G,member=dbmid:MEMBER,root=12345,revisions=true,longpoll=true,file-mode=600,dir-mode=0700")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Options{
+		AppKey:       "KEY",
+		AppSecret:    "SECRET",
+		RefreshToken: "REFRESH",
+		Retry:        extradbx.RetryPolicy{MaxRetries: 2, MaxWait: time.Minute},
+		Parallelism:  4,
+		ChunkSize:    16 * 1024 * 1024,
+		MaxBuffered:  1024 * 1024 * 1024,
+		MemberID:     "dbmid:MEMBER",
+		Root:         "12345",
+		Revisions:    true,
+		Longpoll:     true,
+		FileMode:     0600,
+		DirMode:      0700,
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("unexpected options %#v", opts)
+	}
+
+	for _, bad := range []string{"", "TOKEN,bogus=1", "TOKEN,other", ",refresh-token=REFRESH", "TOKEN,retries=x", "TOKEN,cache-ttl=-1s", "TOKEN,parallel=0", "TOKEN,chunk=0", "TOKEN,chunk=151M", "TOKEN,parallel=2,chunk=5M", "TOKEN,max-buffered=1X", "TOKEN,root=", "TOKEN,root=other", "TOKEN,revisions=x", "TOKEN,longpoll=x", "TOKEN,file-mode=8", "TOKEN,dir-mode=1000"} {
+		_, err := ParseOptions(bad)
+		if err == nil {
+			t.Fatalf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestPathRoot(t *testing.T) {
+	opts, err := ParseOptions("TOKEN,root=12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := opts.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := cfg.HeaderGenerator("api", "rpc", "files", "get_metadata")["Dropbox-API-Path-Root"]
+	var root map[string]string
+	err = json.Unmarshal([]byte(header), &root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(root, map[string]string{".tag": "namespace_id", "namespace_id": "12345"}) {
+		t.Fatalf("unexpected path root %s", header)
+	}
+}
+
+func TestRefreshTransport(t *testing.T) {
+	var refreshes int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "REFRESH" || r.FormValue("client_id") != "KEY" {
+			http.Error(w, "bad refresh", http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt32(&refreshes, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": strings.Repeat("t", int(n)),
+			"token_type":   "bearer",
+			"expires_in":   14400,
+		})
+	}))
+	defer tokenServer.Close()
+
+	// The first token is revoked.
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tt" {
+			http.Error(w, "expired_access_token", http.StatusUnauthorized)
+			return
+		}
+		buf := make([]byte, 4)
+		n, _ := r.Body.Read(buf)
+		_, _ = w.Write(buf[:n])
+	}))
+	defer apiServer.Close()
+
+	opts := &Options{AppKey: "KEY", RefreshToken: "REFRESH"}
+	client := &http.Client{Transport: newRefreshTransport(opts, tokenServer.URL, http.DefaultTransport)}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(apiServer.URL, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		n, _ := resp.Body.Read(buf)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(buf[:n]) != "body" {
+			t.Fatalf("unexpected response %s %q", resp.Status, buf[:n])
+		}
+	}
+	if refreshes != 2 {
+		t.Fatalf("expected 2 refreshes, got %d", refreshes)
+	}
+}
@@ -0,0 +1,178 @@
+package dbxfs
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// The read only directory exposing the revisions of files. Each file,
+// including deleted files, has a directory of the same path in it
+// holding its revisions named by their revision ids. Renaming a
+// revision out of it restores the revision to the new path.
+const revisionsDir = "/.revisions"
+
+// The most revisions dropbox lists for one file.
+const maxRevisions = 100
+
+// A path in the revisions directory, naming either the
+// directory of the revisions of target, or one of them.
+type revisionPath struct {
+	target string
+	// The metadata of the revision named, nil
+	// for the directory of revisions.
+	rev *files.FileMetadata
+}
+
+// Revision ids are hex strings.
+func isRevision(name string) bool {
+	if len(name) < 9 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// The revision path fpath refers to, or nil if
+// it is not in the revisions directory.
+func (fs *Fs) revisionPath(fpath string) *revisionPath {
+	if !fs.revisions {
+		return nil
+	}
+	p := path.Clean("/" + fpath)
+	if p == revisionsDir {
+		return &revisionPath{target: "/"}
+	}
+	if !strings.HasPrefix(p, revisionsDir+"/") {
+		return nil
+	}
+	target := p[len(revisionsDir):]
+	name := path.Base(target)
+	if isRevision(name) {
+		// A file named like a revision id is only
+		// taken as one if dropbox has no such revision.
+		st, err := fs.stat("rev:" + name)
+		if err == nil && !st.IsDir() {
+			md := *st.FileMetadata
+			md.Name = name
+			return &revisionPath{target: path.Dir(target), rev: &md}
+		}
+	}
+	return &revisionPath{target: target}
+}
+
+func (fs *Fs) listRevisions(target string, limit uint64) (*files.ListRevisionsResult, error) {
+	arg := files.NewListRevisionsArg(target)
+	arg.Limit = limit
+	var res *files.ListRevisionsResult
+	err := fs.retry.Do(func() error {
+		var err error
+		res, err = fs.api.ListRevisions(arg)
+		return err
+	})
+	return res, mapError(err)
+}
+
+// Everything in the revisions directory is read only.
+func (fs *Fs) revisionStat(file *files.FileMetadata, folder *files.FolderMetadata) *FileStat {
+	st := fs.newFileStat(file, folder)
+	st.perm &^= 0222
+	return st
+}
+
+func (fs *Fs) statRevision(rp *revisionPath) (*FileStat, error) {
+	if rp.rev != nil {
+		return fs.revisionStat(rp.rev, nil), nil
+	}
+
+	md := &files.FolderMetadata{}
+	md.Name = path.Base(rp.target)
+	if rp.target == "/" {
+		md.Name = path.Base(revisionsDir)
+		return fs.revisionStat(nil, md), nil
+	}
+
+	_, err := fs.stat(rp.target)
+	if err == os.ErrNotExist {
+		// Deleted files still have revisions.
+		res, err := fs.listRevisions(rp.target, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) == 0 {
+			return nil, os.ErrNotExist
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return fs.revisionStat(nil, md), nil
+}
+
+func (fs *Fs) openRevision(fpath string, rp *revisionPath) (*FileHandle, error) {
+	st, err := fs.statRevision(rp)
+	if err != nil {
+		return nil, err
+	}
+
+	fh := &FileHandle{
+		fs:             fs,
+		fpath:          fpath,
+		target:         rp.target,
+		openForReading: true,
+	}
+
+	if rp.rev != nil {
+		fh.dbxfid = "rev:" + rp.rev.Rev
+		fh.size = st.Size()
+		return fh, nil
+	}
+
+	fh.isDir = true
+	if rp.target == "/" {
+		fh.target = ""
+		fh.revisionsOfDir = true
+		return fh, nil
+	}
+	tst, err := fs.stat(rp.target)
+	if err == nil && tst.IsDir() {
+		fh.revisionsOfDir = true
+	} else {
+		fh.revisionsOf = true
+	}
+	return fh, nil
+}
+
+// Fetch the revisions of the file of f, they all fit in one page.
+func (f *FileHandle) fetchRevisions() error {
+	res, err := f.fs.listRevisions(f.target, maxRevisions)
+	if err != nil {
+		return err
+	}
+	for _, entry := range res.Entries {
+		md := *entry
+		md.Name = md.Rev
+		f.dirEnts = append(f.dirEnts, f.fs.revisionStat(&md, nil))
+	}
+	f.listed = true
+	f.hasMore = false
+	return nil
+}
+
+// Restore the revision named by from to the path to.
+func (fs *Fs) restore(from, to string) error {
+	rp := fs.revisionPath(from)
+	if rp.rev == nil || fs.revisionPath(to) != nil {
+		return os.ErrPermission
+	}
+	defer fs.cache.invalidate(to)
+	return mapError(fs.retry.Do(func() error {
+		_, err := fs.api.Restore(files.NewRestoreArg(to, rp.rev.Rev))
+		return err
+	}))
+}
@@ -0,0 +1,167 @@
+package extradbx
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// Start an upload session accepting chunks in any order. The sdk
+// predates concurrent sessions, so the request is built by its
+// context to be authorized and routed like the calls it makes.
+func startConcurrentSession(cfg dropbox.Config) (string, error) {
+	ctx := dropbox.NewContext(cfg)
+	headers := map[string]string{
+		"Content-Type":    "application/octet-stream",
+		"Dropbox-API-Arg": `{"close":false,"session_type":{".tag":"concurrent"}}`,
+	}
+	if cfg.AsMemberID != "" {
+		headers["Dropbox-API-Select-User"] = cfg.AsMemberID
+	}
+	req, err := ctx.NewRequest("content", "upload", true, "files", "upload_session/start", headers, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ctx.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusOK {
+		var res struct {
+			SessionId string `json:"session_id"`
+		}
+		err = json.Unmarshal(body, &res)
+		return res.SessionId, err
+	}
+	err = auth.HandleCommonAuthErrors(cfg, resp, body)
+	if err == nil {
+		err = dropbox.HandleCommonAPIErrors(cfg, resp, body)
+	}
+	return "", err
+}
+
+// Upload chunks read from the pipe in parallel to a concurrent upload
+// session. Chunks are buffered until they are appended, so unlike
+// sequential uploads failed appends can be retried.
+func (u *Upload) doParallelUpload(client files.Client, fpath string, opts UploadOptions, chunkSize int64) error {
+	pipe := u.pipeReader
+
+	nBuffers := opts.Parallelism
+	if opts.MaxBuffered > 0 && int64(nBuffers)*chunkSize > opts.MaxBuffered {
+		nBuffers = int(opts.MaxBuffered / chunkSize)
+		if nBuffers < 1 {
+			nBuffers = 1
+		}
+	}
+	// Buffers are allocated as they are first needed.
+	buffers := make(chan []byte, nBuffers)
+	for i := 0; i < nBuffers; i++ {
+		buffers <- nil
+	}
+
+	var sessionId string
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var appendErr error
+
+	defer wg.Wait()
+
+	failed := func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		return appendErr
+	}
+
+	appendChunk := func(chunk []byte, offset int64, last bool) error {
+		appendArg := files.NewUploadSessionAppendArg(files.NewUploadSessionCursor(sessionId, uint64(offset)))
+		appendArg.Close = last
+		return opts.Retry.Do(func() error {
+			return client.UploadSessionAppendV2(appendArg, bytes.NewReader(chunk))
+		})
+	}
+
+	var offset int64
+	for {
+		buf := <-buffers
+		if buf == nil {
+			buf = make([]byte, chunkSize)
+		}
+		n, err := io.ReadFull(pipe, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(buf)
+
+		if offset == 0 && last {
+			// Files that fit in one chunk need
+			// only one call before the commit.
+			var res *files.UploadSessionStartResult
+			err := opts.Retry.Do(func() error {
+				var err error
+				res, err = client.UploadSessionStart(files.NewUploadSessionStartArg(), bytes.NewReader(buf[:n]))
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return u.finish(client, fpath, opts, res.SessionId, int64(n))
+		}
+
+		if offset == 0 {
+			err := opts.Retry.Do(func() error {
+				var err error
+				sessionId, err = startConcurrentSession(*opts.Config)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if last {
+			// The chunk closing the session is sent
+			// once all the others have been appended.
+			wg.Wait()
+			err := failed()
+			if err != nil {
+				return err
+			}
+			err = appendChunk(buf[:n], offset, true)
+			if err != nil {
+				return err
+			}
+			return u.finish(client, fpath, opts, sessionId, offset+int64(n))
+		}
+
+		err = failed()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func(chunk []byte, offset int64) {
+			defer wg.Done()
+			err := appendChunk(chunk, offset, false)
+			if err != nil {
+				lock.Lock()
+				if appendErr == nil {
+					appendErr = err
+				}
+				lock.Unlock()
+			}
+			buffers <- chunk
+		}(buf, offset)
+		offset += int64(n)
+	}
+}
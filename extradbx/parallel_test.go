@@ -0,0 +1,172 @@
+package extradbx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// A dropbox api assembling the chunks of upload sessions.
+type sessionClient struct {
+	files.Client
+
+	lock     sync.Mutex
+	chunks   map[uint64][]byte
+	closed   bool
+	inFlight int
+	// The most appends made at once.
+	maxInFlight int
+	// Appends failing before they succeed.
+	failures int
+}
+
+func (c *sessionClient) UploadSessionStart(arg *files.UploadSessionStartArg, content io.Reader) (*files.UploadSessionStartResult, error) {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	c.chunks[0] = data
+	return &files.UploadSessionStartResult{SessionId: "sequential"}, nil
+}
+
+func (c *sessionClient) UploadSessionAppendV2(arg *files.UploadSessionAppendArg, content io.Reader) error {
+	c.lock.Lock()
+	c.inFlight++
+	if c.inFlight > c.maxInFlight {
+		c.maxInFlight = c.inFlight
+	}
+	c.lock.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.inFlight--
+	if arg.Cursor.SessionId != "concurrent" || c.closed {
+		return errors.New("bad append")
+	}
+	if c.failures > 0 {
+		c.failures--
+		return timeoutError{}
+	}
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	c.chunks[arg.Cursor.Offset] = data
+	c.closed = arg.Close
+	return nil
+}
+
+func (c *sessionClient) UploadSessionFinish(arg *files.UploadSessionFinishArg, content io.Reader) (*files.FileMetadata, error) {
+	var data []byte
+	for len(c.chunks) != 0 {
+		chunk, ok := c.chunks[uint64(len(data))]
+		if !ok {
+			return nil, errors.New("missing chunk")
+		}
+		delete(c.chunks, uint64(len(data)))
+		data = append(data, chunk...)
+	}
+	if uint64(len(data)) != arg.Cursor.Offset {
+		return nil, fmt.Errorf("finished at %d with %d bytes", arg.Cursor.Offset, len(data))
+	}
+	if arg.Cursor.SessionId == "concurrent" && !c.closed {
+		return nil, errors.New("session not closed")
+	}
+	h := NewContentHash()
+	_, _ = h.Write(data)
+	return &files.FileMetadata{ContentHash: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestParallelUpload(t *testing.T) {
+	const chunkSize = 4
+	defer func() { sleep = time.Sleep }()
+	sleep = func(time.Duration) {}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/upload_session/start" || !strings.Contains(r.Header.Get("Dropbox-API-Arg"), "concurrent") {
+			http.Error(w, "bad start", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"session_id": "concurrent"}`))
+	}))
+	defer server.Close()
+	cfg := &dropbox.Config{
+		Client: server.Client(),
+		URLGenerator: func(hostType string, style string, namespace string, route string) string {
+			return server.URL + "/" + namespace + "/" + route
+		},
+	}
+
+	for _, tc := range []struct {
+		size        int
+		parallelism int
+		maxBuffered int64
+	}{
+		{0, 3, 0},
+		{3, 3, 0},
+		{4, 3, 0},
+		{39, 3, 0},
+		{40, 3, 0},
+		{40, 3, 8},
+		{40, 3, 1},
+	} {
+		api := &sessionClient{chunks: make(map[uint64][]byte), failures: 2}
+		u, err := NewUploadWithOptions(api, "/f", UploadOptions{
+			Retry:             DefaultRetryPolicy,
+			VerifyContentHash: true,
+			ChunkSize:         chunkSize,
+			Parallelism:       tc.parallelism,
+			MaxBuffered:       tc.maxBuffered,
+			Config:            cfg,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte("x"), tc.size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		_, err = u.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = u.Close()
+		if err != nil {
+			t.Fatalf("upload of %d bytes: %v", tc.size, err)
+		}
+		limit := tc.parallelism
+		if tc.maxBuffered != 0 && tc.maxBuffered/chunkSize < int64(limit) {
+			limit = int(tc.maxBuffered / chunkSize)
+			if limit < 1 {
+				limit = 1
+			}
+		}
+		if api.maxInFlight > limit {
+			t.Fatalf("upload of %d bytes: %d appends at once, limit is %d", tc.size, api.maxInFlight, limit)
+		}
+		if tc.size >= 40 && limit > 1 && api.maxInFlight < 2 {
+			t.Fatalf("upload of %d bytes was not parallel", tc.size)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package extradbx
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = time.Minute
+)
+
+// RetryPolicy retries dropbox calls that fail because of rate limits
+// or transient errors. Rate limited calls wait as long as dropbox asks,
+// other calls back off exponentially with jitter.
+type RetryPolicy struct {
+	// The most times one call is retried.
+	MaxRetries int
+	// The longest one call spends waiting to be retried.
+	MaxWait time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 8,
+	MaxWait:    5 * time.Minute,
+}
+
+// Replaced by tests.
+var sleep = time.Sleep
+
+// Call f until it succeeds, fails with an error that is not worth
+// retrying, or the retry budget is used up, returning its last error.
+func (p RetryPolicy) Do(f func() error) error {
+	backoff := minBackoff
+	var waited time.Duration
+	for retries := 0; ; retries++ {
+		err := f()
+		if err == nil || retries >= p.MaxRetries {
+			return err
+		}
+		delay, ok := retryDelay(err)
+		if !ok {
+			return err
+		}
+		if delay == 0 {
+			delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		if waited+delay > p.MaxWait {
+			return err
+		}
+		sleep(delay)
+		waited += delay
+	}
+}
+
+// Whether err is worth retrying, and how long dropbox asked us to
+// wait, zero if it did not say. Rate limit errors carry the value
+// of the Retry-After header dropbox sends with them. Calls
+// aborted by their context are never retried.
+func retryDelay(err error) (time.Duration, bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0, false
+	}
+	switch err := err.(type) {
+	case auth.RateLimitAPIError:
+		if err.RateLimitError != nil {
+			return time.Duration(err.RateLimitError.RetryAfter) * time.Second, true
+		}
+		return 0, true
+	case net.Error:
+		return 0, err.Timeout() || err.Temporary()
+	}
+	if werr := WriteErrorOf(err); werr != nil && werr.Tag == "too_many_write_operations" {
+		return 0, true
+	}
+	return 0, false
+}
+
+// The reason a call writing to a path failed, or nil
+// if err is not an error writing to a path.
+func WriteErrorOf(err error) *files.WriteError {
+	switch err := err.(type) {
+	case files.CreateFolderV2APIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.Path
+		}
+	case files.DeleteV2APIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.PathWrite
+		}
+	case files.MoveV2APIError:
+		if err.EndpointError != nil {
+			if err.EndpointError.FromWrite != nil {
+				return err.EndpointError.FromWrite
+			}
+			return err.EndpointError.To
+		}
+	case files.UploadSessionFinishAPIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.Path
+		}
+	case files.RestoreAPIError:
+		if err.EndpointError != nil {
+			return err.EndpointError.PathWrite
+		}
+	}
+	return nil
+}
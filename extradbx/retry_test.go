@@ -0,0 +1,92 @@
+package extradbx
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	rateLimited := auth.RateLimitAPIError{RateLimitError: &auth.RateLimitError{RetryAfter: 3}}
+	tooManyWrites := files.DeleteV2APIError{
+		EndpointError: &files.DeleteError{
+			PathWrite: &files.WriteError{Tagged: dropbox.Tagged{Tag: "too_many_write_operations"}},
+		},
+	}
+	errs := []error{rateLimited, tooManyWrites, tooManyWrites, nil}
+	calls := 0
+	err := DefaultRetryPolicy.Do(func() error {
+		err := errs[calls]
+		calls++
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 || len(slept) != 3 {
+		t.Fatalf("unexpected %d calls and %d sleeps", calls, len(slept))
+	}
+	if slept[0] != 3*time.Second {
+		t.Fatalf("expected to wait as long as asked, waited %s", slept[0])
+	}
+	if slept[1] < minBackoff/2 || slept[1] > minBackoff || slept[2] < minBackoff || slept[2] > 2*minBackoff {
+		t.Fatalf("unexpected backoff %v", slept)
+	}
+
+	// Other errors are not retried.
+	slept = nil
+	calls = 0
+	permanent := errors.New("permanent")
+	err = DefaultRetryPolicy.Do(func() error {
+		calls++
+		return permanent
+	})
+	if err != permanent || calls != 1 {
+		t.Fatalf("unexpected %v after %d calls", err, calls)
+	}
+
+	// Nor are calls whose context was cancelled or timed out,
+	// although the errors the http client gives for them are
+	// temporary net.Errors.
+	for _, cause := range []error{context.Canceled, context.DeadlineExceeded} {
+		calls = 0
+		aborted := &url.Error{Op: "Post", URL: "https://content.dropboxapi.com", Err: cause}
+		err = DefaultRetryPolicy.Do(func() error {
+			calls++
+			return aborted
+		})
+		if err != aborted || calls != 1 {
+			t.Fatalf("unexpected %v after %d calls", err, calls)
+		}
+	}
+
+	// The budget limits retries.
+	calls = 0
+	policy := RetryPolicy{MaxRetries: 2, MaxWait: time.Hour}
+	err = policy.Do(func() error {
+		calls++
+		return rateLimited
+	})
+	if err == nil || calls != 3 {
+		t.Fatalf("unexpected %v after %d calls", err, calls)
+	}
+	calls = 0
+	policy = RetryPolicy{MaxRetries: 10, MaxWait: 5 * time.Second}
+	err = policy.Do(func() error {
+		calls++
+		return rateLimited
+	})
+	if err == nil || calls != 2 {
+		t.Fatalf("unexpected %v after %d calls", err, calls)
+	}
+}
@@ -1,13 +1,20 @@
 package extradbx
 
 import (
+	"encoding/hex"
 	"errors"
 	"io"
+	"sync"
+	"time"
 
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
 )
 
-var ErrCanceled = errors.New("Upload canceled")
+var (
+	ErrCanceled            = errors.New("Upload canceled")
+	ErrContentHashMismatch = errors.New("content hash mismatch")
+)
 
 type Upload struct {
 	curChunkOffset int
@@ -15,19 +22,74 @@ type Upload struct {
 	pipeReader     *io.PipeReader
 	pipeWriter     *io.PipeWriter
 	errChan        chan error
+
+	// The hash of the written data, and the
+	// metadata of the file once it is uploaded.
+	hash     *ContentHash
+	metadata *files.FileMetadata
+
+	lock           sync.Mutex
+	clientModified time.Time
+}
+
+type UploadOptions struct {
+	// Retries the calls of the upload that can be repeated, chunks
+	// are only sent again if they are buffered for parallel uploads.
+	Retry RetryPolicy
+	// Compare the content hash of the uploaded
+	// file with the hash of the written data.
+	VerifyContentHash bool
+	// The size of the chunks sent in one call, at most 150MB. Chunks
+	// of parallel uploads must be multiples of ConcurrentChunkAlign.
+	// Zero is DefaultChunkSize.
+	ChunkSize int64
+	// The most chunks uploaded at once. More than one buffers
+	// chunks in memory and needs the Config of the client.
+	Parallelism int
+	// The most bytes of chunks buffered by parallel uploads,
+	// lowering their parallelism if needed. Zero is no limit.
+	MaxBuffered int64
+	// The config the client was created with, used to start the
+	// concurrent upload sessions of parallel uploads. The sdk
+	// cannot start them itself.
+	Config *dropbox.Config
+}
+
+var DefaultUploadOptions = UploadOptions{
+	Retry:             DefaultRetryPolicy,
+	VerifyContentHash: true,
+	Parallelism:       1,
 }
 
+const (
+	DefaultChunkSize = 80 * 1024 * 1024
+	// The most data dropbox accepts in one call.
+	MaxChunkSize = 150 * 1024 * 1024
+	// Chunks of concurrent upload sessions, except the
+	// last, must be multiples of this size.
+	ConcurrentChunkAlign = 4 * 1024 * 1024
+)
+
 func NewUpload(client files.Client, fpath string) (*Upload, error) {
+	return NewUploadWithOptions(client, fpath, DefaultUploadOptions)
+}
+
+func NewUploadWithOptions(client files.Client, fpath string, opts UploadOptions) (*Upload, error) {
 	u := &Upload{
 		errChan: make(chan error, 1),
 	}
+	if opts.VerifyContentHash {
+		u.hash = NewContentHash()
+	}
 	u.pipeReader, u.pipeWriter = io.Pipe()
-	go doUpload(client, u.pipeReader, u.errChan, fpath)
+	go u.doUpload(client, fpath, opts)
 
 	return u, nil
 }
 
-func doUpload(client files.Client, pipe *io.PipeReader, errChan chan error, fpath string) {
+func (u *Upload) doUpload(client files.Client, fpath string, opts UploadOptions) {
+	pipe := u.pipeReader
+	errChan := u.errChan
 	var sessionId string
 	var offset int64
 
@@ -36,8 +98,20 @@ func doUpload(client files.Client, pipe *io.PipeReader, errChan chan error, fpat
 		errChan <- err
 	}
 
-	// Upload in 80 meg chunks, 150 is the dropbox api limit.
-	chunkSize := int64(80 * 1024 * 1024)
+	chunkSize := opts.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	if opts.Parallelism > 1 && opts.Config != nil {
+		err := u.doParallelUpload(client, fpath, opts, chunkSize)
+		if err != nil {
+			signalErr(err)
+			return
+		}
+		errChan <- nil
+		return
+	}
 
 	for nLoops := 0; ; nLoops++ {
 		limitedReader := &io.LimitedReader{R: pipe, N: chunkSize}
@@ -63,8 +137,7 @@ func doUpload(client files.Client, pipe *io.PipeReader, errChan chan error, fpat
 		}
 	}
 
-	finishArg := files.NewUploadSessionFinishArg(files.NewUploadSessionCursor(sessionId, uint64(offset)), files.NewCommitInfo(fpath))
-	_, err := client.UploadSessionFinish(finishArg, &io.LimitedReader{N: 0})
+	err := u.finish(client, fpath, opts, sessionId, offset)
 	if err != nil {
 		signalErr(err)
 		return
@@ -73,16 +146,55 @@ func doUpload(client files.Client, pipe *io.PipeReader, errChan chan error, fpat
 	errChan <- nil
 }
 
+// Commit the session of size bytes to fpath.
+func (u *Upload) finish(client files.Client, fpath string, opts UploadOptions, sessionId string, size int64) error {
+	commitInfo := files.NewCommitInfo(fpath)
+	u.lock.Lock()
+	if !u.clientModified.IsZero() {
+		// Dropbox only accepts whole seconds.
+		commitInfo.ClientModified = u.clientModified.UTC().Truncate(time.Second)
+	}
+	u.lock.Unlock()
+	finishArg := files.NewUploadSessionFinishArg(files.NewUploadSessionCursor(sessionId, uint64(size)), commitInfo)
+	return opts.Retry.Do(func() error {
+		var err error
+		u.metadata, err = client.UploadSessionFinish(finishArg, &io.LimitedReader{N: 0})
+		return err
+	})
+}
+
 func (u *Upload) Write(buf []byte) (int, error) {
-	return u.pipeWriter.Write(buf)
+	n, err := u.pipeWriter.Write(buf)
+	if u.hash != nil {
+		_, _ = u.hash.Write(buf[:n])
+	}
+	return n, err
 }
 
+// Record t as the modification time of the uploaded file,
+// instead of the time the upload is committed. It must be
+// called before Close.
+func (u *Upload) SetClientModified(t time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.clientModified = t
+}
+
+// Finish the upload, failing with ErrContentHashMismatch if
+// the uploaded file differs from the data written.
 func (u *Upload) Close() error {
 	err := u.pipeWriter.Close()
 	if err != nil {
 		return err
 	}
-	return <-u.errChan
+	err = <-u.errChan
+	if err != nil {
+		return err
+	}
+	if u.hash != nil && u.metadata != nil && u.metadata.ContentHash != hex.EncodeToString(u.hash.Sum(nil)) {
+		return ErrContentHashMismatch
+	}
+	return nil
 }
 
 func (u *Upload) Cancel() error {
@@ -0,0 +1,117 @@
+package extraio
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// A RateLimiter is a token bucket limiting the rate of bytes
+// transferred, it may be shared by many sessions, of any
+// protocol, to apply a global limit.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// A RateLimiter allowing an average of bytesPerSecond,
+// with bursts of up to a second of data.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Wait until n more bytes may be transferred, or until ctx is done,
+// returning ctx.Err().
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// The tokens may go negative, reserving them
+	// for this caller while it sleeps.
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.lock.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait for n bytes from each of the limiters that is not nil,
+// or until ctx is done.
+func WaitAll(ctx context.Context, limiters []*RateLimiter, n int) error {
+	for _, l := range limiters {
+		if l != nil {
+			err := l.Wait(ctx, n)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+// A reader of r limited by all of limiters, nil limiters are ignored.
+// Once ctx is done reads fail with ctx.Err() instead of waiting.
+func LimitReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (l *limitedReader) Read(buf []byte) (int, error) {
+	n, err := l.r.Read(buf)
+	if werr := WaitAll(l.ctx, l.limiters, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*RateLimiter
+}
+
+// A writer to w limited by all of limiters, nil limiters are ignored.
+// Once ctx is done writes fail with ctx.Err() instead of waiting.
+func LimitWriter(ctx context.Context, w io.Writer, limiters ...*RateLimiter) io.Writer {
+	return &limitedWriter{ctx: ctx, w: w, limiters: limiters}
+}
+
+func (l *limitedWriter) Write(buf []byte) (int, error) {
+	err := WaitAll(l.ctx, l.limiters, len(buf))
+	if err != nil {
+		return 0, err
+	}
+	return l.w.Write(buf)
+}
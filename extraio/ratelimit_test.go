@@ -0,0 +1,53 @@
+package extraio
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestSharedRateLimiter(t *testing.T) {
+	shared := NewRateLimiter(10000)
+	start := time.Now()
+	// A second of burst, then the reader and
+	// writer share the limit for the rest.
+	w := LimitWriter(context.Background(), ioutil.Discard, shared)
+	if _, err := io.Copy(w, LimitReader(context.Background(), bytes.NewReader(make([]byte, 1000)), shared)); err != nil {
+		t.Fatal(err)
+	}
+	r := LimitReader(context.Background(), bytes.NewReader(make([]byte, 12000)), shared, nil)
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	// 14000 bytes less the burst of 10000 at 10000 bytes per second.
+	if elapsed < 350*time.Millisecond {
+		t.Fatalf("transfers were not limited, took %s", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := NewRateLimiter(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	// Without the cancel this would wait about an hour.
+	err := l.Wait(ctx, 3600*1000)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("wait was not cancelled, took %s", elapsed)
+	}
+
+	w := LimitWriter(ctx, ioutil.Discard, l)
+	if _, err := w.Write(make([]byte, 10)); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+// Package fusemount exposes a vfs.VFS as a local FUSE file system,
+// so any engine and wrapper usable over sftp can also be mounted.
+package fusemount
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// How long the kernel may cache attributes, kept short
+// as the backing file system may change underneath us.
+const attrValid = time.Second
+
+// Mount fs on dir and serve it until it is unmounted.
+func Mount(fs vfs.VFS, dir string, readOnly bool) error {
+	options := []fuse.MountOption{fuse.FSName("sftpplease"), fuse.Subtype("sftpplease")}
+	if readOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	c, err := fuse.Mount(dir, options...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = fusefs.Serve(c, New(fs))
+	if err != nil {
+		return err
+	}
+	<-c.Ready
+	return c.MountError
+}
+
+// Unmount the file system mounted on dir, making Mount return.
+func Unmount(dir string) error {
+	return fuse.Unmount(dir)
+}
+
+func errno(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == vfs.ErrUnsupported:
+		return fuse.ENOTSUP
+	case errors.Is(err, vfs.ErrQuotaExceeded):
+		return fuse.Errno(syscall.EFBIG)
+	case os.IsNotExist(err) || err == os.ErrNotExist:
+		return fuse.ENOENT
+	case os.IsExist(err) || err == os.ErrExist:
+		return fuse.EEXIST
+	case os.IsPermission(err) || err == os.ErrPermission:
+		return fuse.Errno(syscall.EACCES)
+	}
+	if _, ok := err.(fuse.ErrorNumber); ok {
+		return err
+	}
+	return fuse.EIO
+}
+
+// FS serves a vfs.VFS over FUSE. FUSE refers to files by node rather
+// than by path, so nodes are kept for every path the kernel knows
+// about and renamed along with the files they refer to.
+type FS struct {
+	fs vfs.VFS
+
+	lock  sync.Mutex
+	nodes map[string]*Node
+}
+
+func New(fs vfs.VFS) *FS {
+	return &FS{fs: fs, nodes: make(map[string]*Node)}
+}
+
+func (f *FS) Root() (fusefs.Node, error) {
+	return f.node("/"), nil
+}
+
+func (f *FS) node(p string) *Node {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, ok := f.nodes[p]
+	if !ok {
+		n = &Node{fs: f, path: p}
+		f.nodes[p] = n
+	}
+	return n
+}
+
+// Update the paths of nodes below from, now found below to.
+func (f *FS) renamed(from, to string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	moved := make(map[string]*Node)
+	for p, n := range f.nodes {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			delete(f.nodes, p)
+			n.path = to + p[len(from):]
+			moved[n.path] = n
+		}
+	}
+	for p := range f.nodes {
+		if p == to || strings.HasPrefix(p, to+"/") {
+			delete(f.nodes, p)
+		}
+	}
+	for p, n := range moved {
+		f.nodes[p] = n
+	}
+}
+
+// A file or directory known to the kernel.
+type Node struct {
+	fs *FS
+	// Protected by fs.lock.
+	path string
+}
+
+func (n *Node) getPath() string {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	return n.path
+}
+
+func (n *Node) child(name string) string {
+	return path.Join(n.getPath(), name)
+}
+
+func (n *Node) Attr(ctx context.Context, attr *fuse.Attr) error {
+	fi, err := n.fs.fs.Stat(n.getPath())
+	if err != nil {
+		return errno(err)
+	}
+	fillAttr(attr, fi)
+	return nil
+}
+
+func fillAttr(attr *fuse.Attr, fi os.FileInfo) {
+	attr.Valid = attrValid
+	attr.Size = uint64(fi.Size())
+	attr.Blocks = (attr.Size + 511) / 512
+	attr.Mode = fi.Mode()
+	attr.Mtime = fi.ModTime()
+	attr.Ctime = fi.ModTime()
+	attr.Atime = fi.ModTime()
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+}
+
+func (n *Node) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	p := n.child(name)
+	_, err := n.fs.fs.Stat(p)
+	if err != nil {
+		return nil, errno(err)
+	}
+	return n.fs.node(p), nil
+}
+
+func (n *Node) Forget() {
+	n.fs.lock.Lock()
+	defer n.fs.lock.Unlock()
+	if n.fs.nodes[n.path] == n && n.path != "/" {
+		delete(n.fs.nodes, n.path)
+	}
+}
+
+// File sizes can only be set by truncating to zero, vfs.VFS has
+// no way to set other sizes or change modification times, so
+// those are ignored as sftp does.
+func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	p := n.getPath()
+	if req.Valid.Mode() {
+		err := n.fs.fs.Chmod(p, req.Mode.Perm())
+		if err != nil {
+			return errno(err)
+		}
+	}
+	if req.Valid.Size() {
+		fi, err := n.fs.fs.Stat(p)
+		if err != nil {
+			return errno(err)
+		}
+		if uint64(fi.Size()) != req.Size {
+			if req.Size != 0 {
+				return fuse.ENOTSUP
+			}
+			f, err := n.fs.fs.OpenFile(p, os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				return errno(err)
+			}
+			err = f.Close()
+			if err != nil {
+				return errno(err)
+			}
+		}
+	}
+	fi, err := n.fs.fs.Stat(p)
+	if err != nil {
+		return errno(err)
+	}
+	fillAttr(&resp.Attr, fi)
+	return nil
+}
+
+// Appends are written at the offsets the kernel gives,
+// the vfs may not support WriteAt on append only files.
+func openFlags(flags fuse.OpenFlags) int {
+	return int(flags) &^ (os.O_APPEND | os.O_CREATE | os.O_EXCL)
+}
+
+func (n *Node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	p := n.getPath()
+	if req.Dir {
+		return &DirHandle{fs: n.fs, path: p}, nil
+	}
+	f, err := n.fs.fs.OpenFile(p, openFlags(req.Flags), 0)
+	if err != nil {
+		return nil, errno(err)
+	}
+	return &Handle{f: f}, nil
+}
+
+func (n *Node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	p := n.child(req.Name)
+	flag := openFlags(req.Flags) | os.O_CREATE
+	if req.Flags&fuse.OpenFlags(os.O_EXCL) != 0 {
+		flag |= os.O_EXCL
+	}
+	f, err := n.fs.fs.OpenFile(p, flag, req.Mode.Perm())
+	if err != nil {
+		return nil, nil, errno(err)
+	}
+	return n.fs.node(p), &Handle{f: f}, nil
+}
+
+func (n *Node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
+	p := n.child(req.Name)
+	err := n.fs.fs.Mkdir(p, req.Mode.Perm())
+	if err != nil {
+		return nil, errno(err)
+	}
+	return n.fs.node(p), nil
+}
+
+func (n *Node) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	p := n.child(req.Name)
+	err := n.fs.fs.Remove(p)
+	if err != nil {
+		return errno(err)
+	}
+	// A new file created at p gets a new node.
+	n.fs.lock.Lock()
+	delete(n.fs.nodes, p)
+	n.fs.lock.Unlock()
+	return nil
+}
+
+func (n *Node) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	nd, ok := newDir.(*Node)
+	if !ok {
+		return fuse.EIO
+	}
+	from := n.child(req.OldName)
+	to := nd.child(req.NewName)
+	err := n.fs.fs.Rename(from, to)
+	if err != nil {
+		return errno(err)
+	}
+	n.fs.renamed(from, to)
+	return nil
+}
+
+func (n *Node) Link(ctx context.Context, req *fuse.LinkRequest, old fusefs.Node) (fusefs.Node, error) {
+	on, ok := old.(*Node)
+	if !ok {
+		return nil, fuse.EIO
+	}
+	p := n.child(req.NewName)
+	err := n.fs.fs.Link(on.getPath(), p)
+	if err != nil {
+		return nil, errno(err)
+	}
+	return n.fs.node(p), nil
+}
+
+func (n *Node) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return nil
+}
+
+// Handle is an open file.
+type Handle struct {
+	f vfs.File
+}
+
+func (h *Handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.f.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return errno(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *Handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n, err := h.f.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	return errno(err)
+}
+
+func (h *Handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
+
+func (h *Handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return errno(h.f.Close())
+}
+
+// DirHandle is an open directory, listed when it is first read.
+type DirHandle struct {
+	fs   *FS
+	path string
+}
+
+func (d *DirHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	f, err := d.fs.fs.Open(d.path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, errno(err)
+	}
+	dirents := make([]fuse.Dirent, 0, len(fis))
+	for _, fi := range fis {
+		dirent := fuse.Dirent{Name: fi.Name(), Type: fuse.DT_File}
+		if fi.IsDir() {
+			dirent.Type = fuse.DT_Dir
+		}
+		dirents = append(dirents, dirent)
+	}
+	return dirents, nil
+}
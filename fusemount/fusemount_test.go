@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package fusemount
+
+import (
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestRenamed(t *testing.T) {
+	fs := New(mem.New())
+	a := fs.node("/a")
+	ab := fs.node("/a/b")
+	abc := fs.node("/a/bc")
+	other := fs.node("/ab")
+	replaced := fs.node("/x")
+
+	fs.renamed("/a", "/x")
+
+	for _, tc := range []struct {
+		n    *Node
+		path string
+	}{
+		{a, "/x"},
+		{ab, "/x/b"},
+		{abc, "/x/bc"},
+		{other, "/ab"},
+	} {
+		if tc.n.getPath() != tc.path {
+			t.Fatalf("expected %s, got %s", tc.path, tc.n.getPath())
+		}
+		if fs.node(tc.path) != tc.n {
+			t.Fatalf("node for %s was not kept", tc.path)
+		}
+	}
+	if fs.node("/x") == replaced {
+		t.Fatal("replaced node still in use")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fusemount
+
+import (
+	"errors"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+var ErrUnsupportedPlatform = errors.New("fuse mounts are not supported on this platform")
+
+func Mount(fs vfs.VFS, dir string, readOnly bool) error {
+	return ErrUnsupportedPlatform
+}
+
+func Unmount(dir string) error {
+	return ErrUnsupportedPlatform
+}
@@ -1,17 +1,37 @@
 module github.com/andrewchambers/sftpplease
 
 require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
+	github.com/BurntSushi/toml v0.4.1
 	github.com/anmitsu/go-shlex v0.0.0-20161002113705-648efa622239
 	github.com/dropbox/dropbox-sdk-go-unofficial v5.4.0+incompatible
-	github.com/mattn/go-runewidth v0.0.4 // indirect
-	github.com/russross/blackfriday v2.0.0+incompatible // indirect
-	github.com/shurcooL/go v0.0.0-20190121191506-3fef8c783dec // indirect
-	github.com/shurcooL/markdownfmt v0.0.0-20180625154226-5ba28a0bf004 // indirect
-	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20190211182817-74369b46fc67 // indirect
-	golang.org/x/net v0.0.0-20190213061140-3a22650c66bd // indirect
-	golang.org/x/oauth2 v0.0.0-20190212230446-3e8b2be13635 // indirect
-	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a
+	github.com/go-git/go-billy/v5 v5.3.1
+	github.com/hirochachacha/go-smb2 v1.1.0
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/spf13/afero v1.2.2
+	github.com/t3rm1n4l/go-mega v0.0.0-20200416171014-ffad7fcb44b8
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
+	golang.org/x/oauth2 v0.0.0-20190226205417-e64efc72b421
+	golang.org/x/sys v0.0.0-20211020064051-0ec99a608a1b
+	storj.io/uplink v1.7.1
 )
 
-go 1.13
+require (
+	github.com/btcsuite/btcutil v1.0.3-0.20201208143702-a53e38424cce // indirect
+	github.com/calebcase/tmpfile v1.0.3 // indirect
+	github.com/geoffgarside/ber v1.1.0 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.5.0 // indirect
+	github.com/spacemonkeygo/monkit/v3 v3.0.17 // indirect
+	github.com/vivint/infectious v0.0.0-20200605153912-25a574ae18a3 // indirect
+	github.com/zeebo/errs v1.2.2 // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/text v0.3.6 // indirect
+	google.golang.org/appengine v1.4.0 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
+	storj.io/common v0.0.0-20211102144601-401a79f0706a // indirect
+	storj.io/drpc v0.0.26 // indirect
+)
+
+go 1.18
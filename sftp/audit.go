@@ -0,0 +1,44 @@
+package sftp
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// An AuditLog receives a record of every client operation that
+// modifies the file system: opens for writing, writes, renames,
+// removals, directory creation, attribute changes and links.
+// Denied and failed operations are recorded too.
+type AuditLog interface {
+	Audit(session string, op *OpRecord)
+}
+
+// An AuditLog writing one JSON object per line, with the fields
+// of JSONLogger operation records plus session and result, which
+// is "ok" or the error.
+type JSONAuditLog struct {
+	jsonWriter
+}
+
+func NewJSONAuditLog(w io.Writer) *JSONAuditLog {
+	l := &JSONAuditLog{}
+	l.enc = json.NewEncoder(w)
+	return l
+}
+
+type jsonAuditRecord struct {
+	*jsonOpRecord
+	Result string `json:"result"`
+}
+
+func (l *JSONAuditLog) Audit(session string, op *OpRecord) {
+	rec := &jsonAuditRecord{
+		jsonOpRecord: newJSONOpRecord(op),
+		Result:       "ok",
+	}
+	rec.Session = session
+	if op.Err != nil {
+		rec.Result = op.Err.Error()
+	}
+	l.write(rec)
+}
@@ -0,0 +1,158 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// The size of the file read and written by the benchmarks, requests
+// wrap around to its start.
+const benchFileSize = 8 * 1024 * 1024
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkData(b, false)
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkData(b, true)
+}
+
+func benchmarkData(b *testing.B, write bool) {
+	for _, size := range []int{32 * 1024, 256 * 1024} {
+		// OpenSSH keeps up to 64 requests in flight.
+		for _, depth := range []int{1, 16, 64} {
+			b.Run(fmt.Sprintf("%dKiB/depth=%d", size/1024, depth), func(b *testing.B) {
+				benchmarkRequests(b, write, size, depth)
+			})
+		}
+	}
+}
+
+// Measure a session serving reads or writes of size bytes from a file
+// in mem, with depth requests in flight at once. Requests are made
+// ahead of time and responses are read without decoding them, so the
+// allocations reported are those of the session.
+func benchmarkRequests(b *testing.B, write bool, size int, depth int) {
+	fs := mem.New()
+	f, err := fs.OpenFile("/f", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, benchFileSize), 0); err != nil {
+		b.Fatal(err)
+	}
+	_ = f.Close()
+
+	handle, rw := benchSession(b, fs)
+	defer rw.Close()
+
+	// Request ids are reused once responded to, each is only in
+	// flight once at a time.
+	var reqs [][]byte
+	data := make([]byte, size)
+	for i := 0; i <= depth; i++ {
+		off := uint64(i*size) % (benchFileSize - uint64(size))
+		var req protosftp.Packet = &protosftp.FxpReadPacket{ID: uint32(i), Handle: handle, Offset: off, Len: uint32(size)}
+		if write {
+			req = &protosftp.FxpWritePacket{ID: uint32(i), Handle: handle, Offset: off, Length: uint32(size), Data: data}
+		}
+		var buf bytes.Buffer
+		if err := protosftp.WritePacket(&buf, req); err != nil {
+			b.Fatal(err)
+		}
+		reqs = append(reqs, buf.Bytes())
+	}
+
+	inFlight := make(chan struct{}, depth)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < b.N; i++ {
+			if err := readBenchResponse(rw, write); err != nil {
+				b.Error(err)
+				return
+			}
+			<-inFlight
+		}
+	}()
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inFlight <- struct{}{}
+		if _, err := rw.Write(reqs[i%len(reqs)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+	b.StopTimer()
+}
+
+// Serve fs over a pipe and open /f on it, returning the handle and the
+// client side of the pipe.
+func benchSession(b *testing.B, fs vfs.VFS) (string, net.Conn) {
+	server, client := net.Pipe()
+	go Serve(&Options{Logger: LogFunc(func(string, ...interface{}) {})}, fs, server)
+
+	err := protosftp.WritePacket(client, &protosftp.FxpInitPacket{Version: protosftp.ProtocolVersion})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := protosftp.ReadResponsePacket(client); err != nil {
+		b.Fatal(err)
+	}
+	err = protosftp.WritePacket(client, &protosftp.FxpOpenPacket{
+		ID:     1,
+		Path:   "/f",
+		Pflags: protosftp.FXF_READ | protosftp.FXF_WRITE,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	resp, err := protosftp.ReadResponsePacket(client)
+	if err != nil {
+		b.Fatal(err)
+	}
+	h, ok := resp.(*protosftp.FxpHandlePacket)
+	if !ok {
+		b.Fatalf("expected a handle, got %#v", resp)
+	}
+	return h.Handle, client
+}
+
+// Read a response to a read or write, discarding any data.
+func readBenchResponse(r io.Reader, write bool) error {
+	// The length, type, id and for statuses the code.
+	var hdr [13]byte
+	if _, err := io.ReadFull(r, hdr[:9]); err != nil {
+		return err
+	}
+	length := int64(binary.BigEndian.Uint32(hdr[:4]))
+	rest := length - 5
+	switch {
+	case hdr[4] == protosftp.FXP_DATA && !write:
+	case hdr[4] == protosftp.FXP_STATUS && write:
+		if _, err := io.ReadFull(r, hdr[9:]); err != nil {
+			return err
+		}
+		rest -= 4
+		if code := binary.BigEndian.Uint32(hdr[9:]); code != protosftp.FX_OK {
+			return fmt.Errorf("request failed with status %d", code)
+		}
+	default:
+		return fmt.Errorf("unexpected %s response", protosftp.PacketTypeName(hdr[4]))
+	}
+	_, err := io.CopyN(ioutil.Discard, r, rest)
+	return err
+}
@@ -0,0 +1,259 @@
+package sftp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// Implementation of check-file-name and check-file-handle from
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-extensions-00#section-3
+
+var (
+	ErrBadBlockSize      = errors.New("bad check-file block size")
+	ErrCheckFileTooLarge = errors.New("check-file reply too large, use a larger block size")
+)
+
+var checkFileHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// The hash algorithms computed by reading files.
+const checkFileAlgorithms = "md5,sha1,sha224,sha256,sha384,sha512,crc32"
+
+func init() {
+	RegisterExtension("check-file", checkFileAlgorithms, nil)
+	RegisterExtension("check-file-name", "", handleCheckFileName)
+	RegisterExtension("check-file-handle", "", handleCheckFileHandle)
+}
+
+// The check-file algorithms advertised to clients, those the
+// file system computes natively first.
+func (s *Session) checkFileAlgorithms() string {
+	native := vfs.ChecksumAlgorithms(s.fs)
+	if len(native) == 0 {
+		return checkFileAlgorithms
+	}
+	return strings.Join(native, ",") + "," + checkFileAlgorithms
+}
+
+func handleCheckFileName(s *Session, req *protosftp.FxpExtendedPacket) {
+	err := s.checkAllowed(s.policy().AllowRead)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	cf := &protosftp.FxpExtendedCheckFilePacket{}
+	err = cf.UnmarshalBinary(req.Data)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	fpath, err := s.checkPath(cf.Name)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	err = s.authorize(req.ExtendedRequest, fpath)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	// The file is open for as long as it is read, so it counts
+	// as an open file, which also limits how many checks run
+	// at once.
+	err = s.reserveHandle()
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	// Like requests on handles, checks run on their own goroutine
+	// so other requests are not held up by reading the file.
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.releaseHandle()
+
+		if s.checkFileNative(req.ID, cf, fpath) {
+			return
+		}
+
+		f, err := s.fs.Open(fpath)
+		if err != nil {
+			s.respondError(req.ID, err)
+			return
+		}
+		defer f.Close()
+
+		s.checkFile(req.ID, cf, f)
+	}()
+}
+
+func handleCheckFileHandle(s *Session, req *protosftp.FxpExtendedPacket) {
+	cf := &protosftp.FxpExtendedCheckFilePacket{}
+	err := cf.UnmarshalBinary(req.Data)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	h, ok := s.handles.get(cf.Name)
+	if !ok {
+		s.respondError(req.ID, ErrInvalidHandle)
+		return
+	}
+
+	s.WithFile(req, cf.Name, func(f vfs.File) {
+		if s.checkFileNative(req.ID, cf, h.Path) {
+			return
+		}
+		s.checkFile(req.ID, cf, f)
+	})
+}
+
+// Try to answer a whole file check-file request using
+// hashes stored by the backend, returns true if a response was sent.
+func (s *Session) checkFileNative(respId uint32, cf *protosftp.FxpExtendedCheckFilePacket, fpath string) bool {
+	if cf.StartOffset != 0 || cf.Length != 0 || cf.BlockSize != 0 {
+		return false
+	}
+
+	cs, ok := s.fs.(vfs.Checksummer)
+	if !ok {
+		return false
+	}
+
+	for _, alg := range strings.Split(cf.HashAlgorithms, ",") {
+		sum, err := cs.Checksum(fpath, alg)
+		if err == vfs.ErrUnsupported {
+			continue
+		}
+		if err != nil {
+			s.respondError(respId, err)
+			return true
+		}
+		s.respondCheckFile(respId, alg, sum)
+		return true
+	}
+
+	return false
+}
+
+func (s *Session) checkFile(respId uint32, cf *protosftp.FxpExtendedCheckFilePacket, f vfs.File) {
+	var alg string
+	var newHash func() hash.Hash
+	for _, a := range strings.Split(cf.HashAlgorithms, ",") {
+		if fn, ok := checkFileHashes[a]; ok {
+			alg, newHash = a, fn
+			break
+		}
+	}
+	if newHash == nil {
+		s.respondError(respId, ErrUnsupported)
+		return
+	}
+
+	if cf.BlockSize != 0 && cf.BlockSize < 256 {
+		s.respondError(respId, ErrBadBlockSize)
+		return
+	}
+
+	if cf.StartOffset > math.MaxInt64 {
+		s.respondError(respId, io.EOF)
+		return
+	}
+
+	var r io.Reader = io.NewSectionReader(f, int64(cf.StartOffset), math.MaxInt64-int64(cf.StartOffset))
+	if cf.Length != 0 && cf.Length <= math.MaxInt64 {
+		r = io.LimitReader(r, int64(cf.Length))
+	}
+
+	if cf.BlockSize != 0 {
+		// Every block's hash is sent in one reply, refuse
+		// before reading if they would not fit in a packet.
+		fi, err := f.Stat()
+		if err != nil {
+			s.respondError(respId, err)
+			return
+		}
+		n := uint64(0)
+		if size := uint64(fi.Size()); fi.Size() > 0 && cf.StartOffset < size {
+			n = size - cf.StartOffset
+		}
+		if cf.Length != 0 && cf.Length < n {
+			n = cf.Length
+		}
+		blocks := n / uint64(cf.BlockSize)
+		if n%uint64(cf.BlockSize) != 0 {
+			blocks++
+		}
+		replyLen := uint64(s.maxPacketLength() - packetOverhead - uint32(len(alg)))
+		if blocks > replyLen/uint64(newHash().Size()) {
+			s.respondError(respId, ErrCheckFileTooLarge)
+			return
+		}
+		// Ignore anything written since.
+		r = io.LimitReader(r, int64(n))
+	}
+
+	var sums []byte
+	if cf.BlockSize == 0 {
+		h := newHash()
+		_, err := io.Copy(h, r)
+		if err != nil {
+			s.respondError(respId, err)
+			return
+		}
+		sums = h.Sum(nil)
+	} else {
+		for {
+			h := newHash()
+			n, err := io.CopyN(h, r, int64(cf.BlockSize))
+			if n > 0 {
+				sums = h.Sum(sums)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				s.respondError(respId, err)
+				return
+			}
+		}
+	}
+
+	s.respondCheckFile(respId, alg, sums)
+}
+
+func (s *Session) respondCheckFile(respId uint32, alg string, sum []byte) {
+	data, err := protosftp.FxpExtendedCheckFileReply{
+		HashAlgorithm: alg,
+		Hash:          sum,
+	}.MarshalBinary()
+	if err != nil {
+		s.respondError(respId, err)
+		return
+	}
+	s.RespondExtended(respId, data)
+}
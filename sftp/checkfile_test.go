@@ -0,0 +1,191 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// A file system with a native "path" checksum of the path asked for,
+// which waits for release to be closed.
+type checksumFs struct {
+	*mem.Fs
+	release chan struct{}
+}
+
+func (fs *checksumFs) Checksum(p string, algorithm string) ([]byte, error) {
+	if algorithm != "path" {
+		return nil, vfs.ErrUnsupported
+	}
+	<-fs.release
+	return []byte(p), nil
+}
+
+func (fs *checksumFs) ChecksumAlgorithms() []string {
+	return []string{"path"}
+}
+
+func checkFile(c *Client, ext string, name string, algorithms string) (*protosftp.FxpExtendedCheckFileReply, error) {
+	return checkFileBlocks(c, ext, protosftp.FxpExtendedCheckFilePacket{Name: name, HashAlgorithms: algorithms})
+}
+
+func checkFileBlocks(c *Client, ext string, cf protosftp.FxpExtendedCheckFilePacket) (*protosftp.FxpExtendedCheckFileReply, error) {
+	buf, err := cf.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.request(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpExtendedPacket{ID: id, ExtendedRequest: ext, Data: buf}
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch resp := resp.(type) {
+	case *protosftp.FxpStatusPacket:
+		return nil, statusToError(&resp.StatusError)
+	case *protosftp.FxpExtendedReplyPacket:
+		reply := &protosftp.FxpExtendedCheckFileReply{}
+		err = reply.UnmarshalBinary(resp.Data)
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
+	default:
+		return nil, unexpectedResponse(resp)
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	fs := &checksumFs{Fs: mem.New(), release: make(chan struct{})}
+	c, _ := serveFaults(t, context.Background(), fs, &Options{})
+	defer c.Close()
+
+	if algs := c.Extensions["check-file"]; !strings.HasPrefix(algs, "path,") {
+		t.Fatalf("expected the native algorithm to be advertised first, got %q", algs)
+	}
+
+	data := []byte("hello")
+	f, err := c.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The native checksum blocks, other requests are still answered.
+	type result struct {
+		reply *protosftp.FxpExtendedCheckFileReply
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		reply, err := checkFile(c, "check-file-name", "a", "path")
+		results <- result{reply, err}
+	}()
+	_, err = c.Stat("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(fs.release)
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.reply.HashAlgorithm != "path" || string(r.reply.Hash) != "/a" {
+		t.Fatalf("unexpected reply %q %q", r.reply.HashAlgorithm, r.reply.Hash)
+	}
+
+	reply, err := checkFile(c, "check-file-name", "/a", "unknown,sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if reply.HashAlgorithm != "sha256" || !bytes.Equal(reply.Hash, sum[:]) {
+		t.Fatalf("unexpected reply %q %x", reply.HashAlgorithm, reply.Hash)
+	}
+
+	// Handles are checked natively by the path they were opened with.
+	handle, err := c.requestHandle(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpOpenPacket{ID: id, Path: "a", Pflags: protosftp.FXF_READ}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err = checkFile(c, "check-file-handle", handle, "path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Hash) != "/a" {
+		t.Fatalf("expected the handle path, got %q", reply.Hash)
+	}
+}
+
+func TestCheckFileBlocks(t *testing.T) {
+	fs := mem.New()
+	c, _ := serveFaults(t, context.Background(), fs, &Options{MaxPacketLength: minPacketLength})
+	defer c.Close()
+
+	data := make([]byte, 512*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	f, err := c.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := checkFileBlocks(c, "check-file-name", protosftp.FxpExtendedCheckFilePacket{
+		Name:           "/a",
+		HashAlgorithms: "sha256",
+		StartOffset:    1000,
+		Length:         1000,
+		BlockSize:      256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expect []byte
+	for off := 1000; off < 2000; off += 256 {
+		end := off + 256
+		if end > 2000 {
+			end = 2000
+		}
+		sum := sha256.Sum256(data[off:end])
+		expect = append(expect, sum[:]...)
+	}
+	if !bytes.Equal(reply.Hash, expect) {
+		t.Fatalf("unexpected block hashes %x", reply.Hash)
+	}
+
+	// The hash of every block would not fit in a reply.
+	_, err = checkFileBlocks(c, "check-file-name", protosftp.FxpExtendedCheckFilePacket{
+		Name:           "/a",
+		HashAlgorithms: "sha256",
+		BlockSize:      256,
+	})
+	st, ok := err.(*protosftp.StatusError)
+	if !ok || st.Code != protosftp.FX_FAILURE {
+		t.Fatalf("expected FX_FAILURE, got %v", err)
+	}
+}
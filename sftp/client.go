@@ -0,0 +1,607 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+var ErrClientClosed = errors.New("sftp client closed")
+
+// The largest read or write sent in one request,
+// servers are only required to support 32KiB.
+const clientMaxPacketData = 32 * 1024
+
+// An SFTP version 3 client, for example speaking to a server
+// over the stdin and stdout of 'ssh -s host sftp'.
+//
+// Client implements vfs.VFS so remote servers can be served
+// through sftpplease with the usual wrappers applied.
+type Client struct {
+	rw io.ReadWriteCloser
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan protosftp.Packet
+	err     error
+
+	// Extensions advertised by the server.
+	Extensions map[string]string
+}
+
+// Perform the protocol handshake over rw and start the client.
+func NewClient(rw io.ReadWriteCloser) (*Client, error) {
+	err := protosftp.WritePacket(rw, &protosftp.FxpInitPacket{Version: protosftp.ProtocolVersion})
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := protosftp.ReadResponsePacket(rw)
+	if err != nil {
+		return nil, err
+	}
+	version, ok := pkt.(*protosftp.FxVersionPacket)
+	if !ok {
+		return nil, fmt.Errorf("expected version packet, got %T", pkt)
+	}
+	if version.Version != protosftp.ProtocolVersion {
+		return nil, fmt.Errorf("unsupported sftp version %d", version.Version)
+	}
+
+	c := &Client{
+		rw:         rw,
+		pending:    make(map[uint32]chan protosftp.Packet),
+		Extensions: make(map[string]string),
+	}
+	for _, ext := range version.Extensions {
+		c.Extensions[ext.Name] = ext.Data
+	}
+	go c.readResponses()
+	return c, nil
+}
+
+func responseID(pkt protosftp.Packet) (uint32, bool) {
+	switch pkt := pkt.(type) {
+	case *protosftp.FxpStatusPacket:
+		return pkt.ID, true
+	case *protosftp.FxpHandlePacket:
+		return pkt.ID, true
+	case *protosftp.FxpDataPacket:
+		return pkt.ID, true
+	case *protosftp.FxpNamePacket:
+		return pkt.ID, true
+	case *protosftp.FxpStatResponse:
+		return pkt.ID, true
+	case *protosftp.FxpExtendedReplyPacket:
+		return pkt.ID, true
+	}
+	return 0, false
+}
+
+func (c *Client) readResponses() {
+	var err error
+	for {
+		var pkt protosftp.Packet
+		pkt, err = protosftp.ReadResponsePacket(c.rw)
+		if err != nil {
+			break
+		}
+		id, ok := responseID(pkt)
+		if !ok {
+			err = fmt.Errorf("unexpected packet %T", pkt)
+			break
+		}
+		c.lock.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.lock.Unlock()
+		if !ok {
+			err = fmt.Errorf("response with unexpected id %d", id)
+			break
+		}
+		ch <- pkt
+	}
+	c.fail(err)
+}
+
+// Fail all pending and future requests with err.
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	if err == io.EOF {
+		err = ErrClientClosed
+	}
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	_ = c.rw.Close()
+}
+
+// Send the request made by mkReq and wait for its response.
+func (c *Client) request(mkReq func(id uint32) protosftp.Packet) (protosftp.Packet, error) {
+	ch := make(chan protosftp.Packet, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.lock.Unlock()
+
+	c.writeLock.Lock()
+	err := protosftp.WritePacket(c.rw, mkReq(id))
+	c.writeLock.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+
+	resp, ok := <-ch
+	if !ok {
+		c.lock.Lock()
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func statusToError(st *protosftp.StatusError) error {
+	switch st.Code {
+	case protosftp.FX_OK:
+		return nil
+	case protosftp.FX_EOF:
+		return io.EOF
+	case protosftp.FX_NO_SUCH_FILE, protosftp.FX_NO_SUCH_PATH:
+		return os.ErrNotExist
+	case protosftp.FX_PERMISSION_DENIED, protosftp.FX_WRITE_PROTECT:
+		return os.ErrPermission
+	case protosftp.FX_FILE_ALREADY_EXISTS:
+		return os.ErrExist
+	case protosftp.FX_OP_UNSUPPORTED:
+		return vfs.ErrUnsupported
+	case protosftp.FX_QUOTA_EXCEEDED:
+		return vfs.ErrQuotaExceeded
+	case protosftp.FX_FILE_CORRUPT:
+		return vfs.ErrCorrupt
+	}
+	return &protosftp.StatusError{Code: st.Code, Msg: st.Msg, Lang: st.Lang}
+}
+
+func unexpectedResponse(pkt protosftp.Packet) error {
+	if st, ok := pkt.(*protosftp.FxpStatusPacket); ok {
+		err := statusToError(&st.StatusError)
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("unexpected response %T", pkt)
+}
+
+// Perform a request that is answered with a status.
+func (c *Client) requestStatus(mkReq func(id uint32) protosftp.Packet) error {
+	resp, err := c.request(mkReq)
+	if err != nil {
+		return err
+	}
+	st, ok := resp.(*protosftp.FxpStatusPacket)
+	if !ok {
+		return unexpectedResponse(resp)
+	}
+	return statusToError(&st.StatusError)
+}
+
+func (c *Client) requestAttrs(mkReq func(id uint32) protosftp.Packet) (protosftp.FileStat, error) {
+	resp, err := c.request(mkReq)
+	if err != nil {
+		return protosftp.FileStat{}, err
+	}
+	attrs, ok := resp.(*protosftp.FxpStatResponse)
+	if !ok {
+		return protosftp.FileStat{}, unexpectedResponse(resp)
+	}
+	return attrs.Info, nil
+}
+
+func (c *Client) requestHandle(mkReq func(id uint32) protosftp.Packet) (string, error) {
+	resp, err := c.request(mkReq)
+	if err != nil {
+		return "", err
+	}
+	handle, ok := resp.(*protosftp.FxpHandlePacket)
+	if !ok {
+		return "", unexpectedResponse(resp)
+	}
+	return handle.Handle, nil
+}
+
+func (c *Client) extended(name string, data protosftp.Packet) error {
+	if _, ok := c.Extensions[name]; !ok {
+		return vfs.ErrUnsupported
+	}
+	buf, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpExtendedPacket{ID: id, ExtendedRequest: name, Data: buf}
+	})
+}
+
+type clientFileInfo struct {
+	name string
+	stat protosftp.FileStat
+}
+
+func (fi *clientFileInfo) Name() string       { return fi.name }
+func (fi *clientFileInfo) Size() int64        { return int64(fi.stat.Size) }
+func (fi *clientFileInfo) ModTime() time.Time { return time.Unix(int64(fi.stat.Mtime), 0) }
+func (fi *clientFileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *clientFileInfo) Sys() interface{}   { return &fi.stat }
+
+func (fi *clientFileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.stat.Mode & 0777)
+	switch fi.stat.Mode & protosftp.S_IFMT {
+	case protosftp.S_IFDIR:
+		mode |= os.ModeDir
+	case protosftp.S_IFLNK:
+		mode |= os.ModeSymlink
+	case protosftp.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case protosftp.S_IFSOCK:
+		mode |= os.ModeSocket
+	case protosftp.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case protosftp.S_IFBLK:
+		mode |= os.ModeDevice
+	}
+	return mode
+}
+
+func (c *Client) Stat(p string) (os.FileInfo, error) {
+	stat, err := c.requestAttrs(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpStatPacket{ID: id, Path: p}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &clientFileInfo{name: path.Base(p), stat: stat}, nil
+}
+
+func (c *Client) Lstat(p string) (os.FileInfo, error) {
+	stat, err := c.requestAttrs(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpLstatPacket{ID: id, Path: p}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &clientFileInfo{name: path.Base(p), stat: stat}, nil
+}
+
+// The path the server resolves p to, its links followed.
+func (c *Client) RealPath(p string) (string, error) {
+	resp, err := c.request(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpRealpathPacket{ID: id, Path: p}
+	})
+	if err != nil {
+		return "", err
+	}
+	names, ok := resp.(*protosftp.FxpNamePacket)
+	if !ok {
+		return "", unexpectedResponse(resp)
+	}
+	if len(names.NameAttrs) != 1 {
+		return "", fmt.Errorf("server sent %d names for realpath, expected 1", len(names.NameAttrs))
+	}
+	return names.NameAttrs[0].Name, nil
+}
+
+func (c *Client) Chmod(p string, mode os.FileMode) error {
+	return c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpSetStatPacket{
+			ID:    id,
+			Path:  p,
+			Attrs: protosftp.FileStat{Flags: protosftp.FILEXFER_ATTR_PERMISSIONS, Mode: uint32(mode.Perm())},
+		}
+	})
+}
+
+// Times are sent in whole seconds.
+func (c *Client) Chtimes(p string, atime time.Time, mtime time.Time) error {
+	return c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpSetStatPacket{
+			ID:    id,
+			Path:  p,
+			Attrs: protosftp.FileStat{Flags: protosftp.FILEXFER_ATTR_ACMODTIME, Atime: uint32(atime.Unix()), Mtime: uint32(mtime.Unix())},
+		}
+	})
+}
+
+func (c *Client) Open(p string) (vfs.File, error) {
+	return c.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (c *Client) OpenFile(p string, flags int, perm os.FileMode) (vfs.File, error) {
+	f := &ClientFile{c: c, name: p}
+
+	// Only directories opened for reading can be listed, which
+	// needs a separate request.
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		fi, err := c.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			f.isDir = true
+			f.handle, err = c.requestHandle(func(id uint32) protosftp.Packet {
+				return &protosftp.FxpOpendirPacket{ID: id, Path: p}
+			})
+			if err != nil {
+				return nil, err
+			}
+			return f, nil
+		}
+	}
+
+	var pflags uint32
+	switch flags & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		pflags = protosftp.FXF_READ
+	case os.O_WRONLY:
+		pflags = protosftp.FXF_WRITE
+	case os.O_RDWR:
+		pflags = protosftp.FXF_READ | protosftp.FXF_WRITE
+	}
+	if flags&os.O_APPEND != 0 {
+		pflags |= protosftp.FXF_APPEND
+	}
+	if flags&os.O_CREATE != 0 {
+		pflags |= protosftp.FXF_CREAT
+	}
+	if flags&os.O_TRUNC != 0 {
+		pflags |= protosftp.FXF_TRUNC
+	}
+	if flags&os.O_EXCL != 0 {
+		pflags |= protosftp.FXF_EXCL
+	}
+
+	var err error
+	f.handle, err = c.requestHandle(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpOpenPacket{
+			ID:     id,
+			Path:   p,
+			Pflags: pflags,
+			Attrs:  protosftp.FileStat{Flags: protosftp.FILEXFER_ATTR_PERMISSIONS, Mode: uint32(perm.Perm())},
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *Client) Mkdir(p string, perm os.FileMode) error {
+	return c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpMkdirPacket{
+			ID:    id,
+			Path:  p,
+			Attrs: protosftp.FileStat{Flags: protosftp.FILEXFER_ATTR_PERMISSIONS, Mode: uint32(perm.Perm())},
+		}
+	})
+}
+
+// Rename from to to, replacing to if the server
+// supports posix-rename@openssh.com.
+func (c *Client) Rename(from, to string) error {
+	if _, ok := c.Extensions["posix-rename@openssh.com"]; ok {
+		// The request has the same layout as a hardlink request.
+		return c.extended("posix-rename@openssh.com", &protosftp.FxpExtendedHardlinkPacket{Oldpath: from, Newpath: to})
+	}
+	return c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpRenamePacket{ID: id, Oldpath: from, Newpath: to}
+	})
+}
+
+func (c *Client) Remove(p string) error {
+	fi, err := c.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return c.requestStatus(func(id uint32) protosftp.Packet {
+			return &protosftp.FxpRmdirPacket{ID: id, Path: p}
+		})
+	}
+	return c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpRemovePacket{ID: id, Filename: p}
+	})
+}
+
+func (c *Client) Link(oldname, newname string) error {
+	return c.extended("hardlink@openssh.com", &protosftp.FxpExtendedHardlinkPacket{Oldpath: oldname, Newpath: newname})
+}
+
+func (c *Client) Close() error {
+	c.fail(ErrClientClosed)
+	return nil
+}
+
+// A file or directory open on the server.
+type ClientFile struct {
+	c      *Client
+	name   string
+	handle string
+	isDir  bool
+	offset int64
+
+	// Entries returned by the server not yet consumed by Readdir.
+	dirEnts []os.FileInfo
+	dirEOF  bool
+}
+
+func (f *ClientFile) Name() string {
+	return f.name
+}
+
+func (f *ClientFile) Chmod(mode os.FileMode) error {
+	return f.c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpFSetStatPacket{
+			ID:     id,
+			Handle: f.handle,
+			Attrs:  protosftp.FileStat{Flags: protosftp.FILEXFER_ATTR_PERMISSIONS, Mode: uint32(mode.Perm())},
+		}
+	})
+}
+
+func (f *ClientFile) Stat() (os.FileInfo, error) {
+	stat, err := f.c.requestAttrs(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpFstatPacket{ID: id, Handle: f.handle}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &clientFileInfo{name: path.Base(f.name), stat: stat}, nil
+}
+
+func (f *ClientFile) ReadAt(buf []byte, offset int64) (int, error) {
+	nread := 0
+	for nread < len(buf) {
+		chunk := len(buf) - nread
+		if chunk > clientMaxPacketData {
+			chunk = clientMaxPacketData
+		}
+		off := offset + int64(nread)
+		resp, err := f.c.request(func(id uint32) protosftp.Packet {
+			return &protosftp.FxpReadPacket{ID: id, Handle: f.handle, Offset: uint64(off), Len: uint32(chunk)}
+		})
+		if err != nil {
+			return nread, err
+		}
+		data, ok := resp.(*protosftp.FxpDataPacket)
+		if !ok {
+			return nread, unexpectedResponse(resp)
+		}
+		if len(data.Data) > chunk {
+			return nread, fmt.Errorf("server sent %d bytes, expected at most %d", len(data.Data), chunk)
+		}
+		nread += copy(buf[nread:], data.Data)
+	}
+	return nread, nil
+}
+
+func (f *ClientFile) Read(buf []byte) (int, error) {
+	// Short reads are fine for Read, only request one packet.
+	if len(buf) > clientMaxPacketData {
+		buf = buf[:clientMaxPacketData]
+	}
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *ClientFile) WriteAt(buf []byte, offset int64) (int, error) {
+	nwritten := 0
+	for nwritten < len(buf) {
+		chunk := buf[nwritten:]
+		if len(chunk) > clientMaxPacketData {
+			chunk = chunk[:clientMaxPacketData]
+		}
+		off := offset + int64(nwritten)
+		err := f.c.requestStatus(func(id uint32) protosftp.Packet {
+			return &protosftp.FxpWritePacket{ID: id, Handle: f.handle, Offset: uint64(off), Length: uint32(len(chunk)), Data: chunk}
+		})
+		if err != nil {
+			return nwritten, err
+		}
+		nwritten += len(chunk)
+	}
+	return nwritten, nil
+}
+
+func (f *ClientFile) Write(buf []byte) (int, error) {
+	n, err := f.WriteAt(buf, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *ClientFile) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.isDir {
+		return nil, ErrInvalidHandle
+	}
+	for !f.dirEOF && (n <= 0 || len(f.dirEnts) < n) {
+		resp, err := f.c.request(func(id uint32) protosftp.Packet {
+			return &protosftp.FxpReaddirPacket{ID: id, Handle: f.handle}
+		})
+		if err != nil {
+			return nil, err
+		}
+		names, ok := resp.(*protosftp.FxpNamePacket)
+		if !ok {
+			err = unexpectedResponse(resp)
+			if err == io.EOF {
+				f.dirEOF = true
+				break
+			}
+			return nil, err
+		}
+		for _, na := range names.NameAttrs {
+			if na.Name == "." || na.Name == ".." {
+				continue
+			}
+			f.dirEnts = append(f.dirEnts, &clientFileInfo{name: na.Name, stat: na.Attrs})
+		}
+	}
+
+	if n <= 0 {
+		fis := f.dirEnts
+		f.dirEnts = nil
+		return fis, nil
+	}
+	if len(f.dirEnts) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirEnts) {
+		n = len(f.dirEnts)
+	}
+	fis := f.dirEnts[:n]
+	f.dirEnts = f.dirEnts[n:]
+	return fis, nil
+}
+
+func (f *ClientFile) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *ClientFile) Sync() error {
+	return f.c.extended("fsync@openssh.com", &protosftp.FxpExtendedFsyncPacket{Handle: f.handle})
+}
+
+func (f *ClientFile) Close() error {
+	return f.c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpClosePacket{ID: id, Handle: f.handle}
+	})
+}
@@ -0,0 +1,210 @@
+package sftp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func testClient(t *testing.T) (*Client, *mem.Fs) {
+	t.Helper()
+	fs := mem.New()
+	server, client := net.Pipe()
+	go Serve(&Options{Logger: LogFunc(func(string, ...interface{}) {})}, fs, server)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, fs
+}
+
+func TestClient(t *testing.T) {
+	c, _ := testClient(t)
+	defer c.Close()
+
+	if _, ok := c.Extensions["hardlink@openssh.com"]; !ok {
+		t.Fatal("expected hardlink extension")
+	}
+
+	err := c.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*clientMaxPacketData+17)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	f, err := c.OpenFile("/d/a", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := c.Stat("/d/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(data)) || fi.IsDir() || fi.Mode().Perm() != 0644 {
+		t.Fatalf("bad stat %d %v %s", fi.Size(), fi.IsDir(), fi.Mode())
+	}
+
+	f, err = c.Open("/d/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatal("read data differs from written data")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Link("/d/a", "/d/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rename("/d/b", "/d/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := c.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "a" || names[1] != "c" {
+		t.Fatalf("bad listing %v", names)
+	}
+	_, err = d.Readdirnames(1)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Remove("/d/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Stat("/d/a")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestClientSetStat(t *testing.T) {
+	c, _ := testClient(t)
+	defer c.Close()
+
+	f, err := c.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sent as FXP_FSETSTAT.
+	err = f.Chmod(0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	err = c.Chtimes("/a", mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := c.Stat("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("bad stat %s %s", fi.Mode(), fi.ModTime())
+	}
+
+	err = c.Chtimes("/missing", mtime, mtime)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	c, _ := testClient(t)
+	err := c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Stat("/")
+	if err != ErrClientClosed {
+		t.Fatalf("expected ErrClientClosed, got %v", err)
+	}
+}
+
+// A file system recording the contexts sessions bind it to.
+type contextFs struct {
+	*mem.Fs
+	ctxs chan context.Context
+}
+
+func (fs *contextFs) WithContext(ctx context.Context) vfs.VFS {
+	fs.ctxs <- ctx
+	return fs.Fs
+}
+
+func TestSessionContext(t *testing.T) {
+	fs := &contextFs{Fs: mem.New(), ctxs: make(chan context.Context, 1)}
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Serve(&Options{Logger: LogFunc(func(string, ...interface{}) {})}, fs, server)
+		close(done)
+	}()
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := <-fs.ctxs
+	_, err = c.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected the context to be live during the session")
+	}
+	_ = c.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the context to be cancelled when the client disconnects")
+	}
+	<-done
+}
@@ -0,0 +1,150 @@
+package sftp
+
+import (
+	"os"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// A coalescingFile merges sequential writes into writes of up to
+// max bytes before passing them to the underlying file. This helps
+// backends like dropbox where each WriteAt is expensive.
+//
+// Buffered data is flushed before any other operation on the file,
+// and on close. Like a write back cache, an error flushing data that
+// has already been acknowledged is returned by the next operation on
+// the file.
+type coalescingFile struct {
+	vfs.File
+
+	max    int
+	offset int64
+	buf    []byte
+	err    error
+}
+
+func newCoalescingFile(f vfs.File, max int) *coalescingFile {
+	return &coalescingFile{
+		File: f,
+		max:  max,
+	}
+}
+
+func (cf *coalescingFile) flush() error {
+	if len(cf.buf) == 0 {
+		return nil
+	}
+
+	_, err := cf.File.WriteAt(cf.buf, cf.offset)
+	cf.buf = cf.buf[:0]
+	if err != nil && cf.err == nil {
+		cf.err = err
+	}
+	return err
+}
+
+func (cf *coalescingFile) takeErr() error {
+	err := cf.err
+	cf.err = nil
+	return err
+}
+
+func (cf *coalescingFile) WriteAt(data []byte, off int64) (int, error) {
+	if len(cf.buf) != 0 && off != cf.offset+int64(len(cf.buf)) {
+		cf.flush()
+	}
+
+	if len(cf.buf)+len(data) > cf.max {
+		cf.flush()
+	}
+
+	if err := cf.takeErr(); err != nil {
+		return 0, err
+	}
+
+	if len(data) >= cf.max {
+		return cf.File.WriteAt(data, off)
+	}
+
+	if len(cf.buf) == 0 {
+		if cf.buf == nil {
+			cf.buf = make([]byte, 0, cf.max)
+		}
+		cf.offset = off
+	}
+	cf.buf = append(cf.buf, data...)
+	return len(data), nil
+}
+
+func (cf *coalescingFile) Write(data []byte) (int, error) {
+	cf.flush()
+	if err := cf.takeErr(); err != nil {
+		return 0, err
+	}
+	return cf.File.Write(data)
+}
+
+func (cf *coalescingFile) Read(buf []byte) (int, error) {
+	cf.flush()
+	if err := cf.takeErr(); err != nil {
+		return 0, err
+	}
+	return cf.File.Read(buf)
+}
+
+func (cf *coalescingFile) ReadAt(buf []byte, off int64) (int, error) {
+	cf.flush()
+	if err := cf.takeErr(); err != nil {
+		return 0, err
+	}
+	return cf.File.ReadAt(buf, off)
+}
+
+func (cf *coalescingFile) Stat() (os.FileInfo, error) {
+	cf.flush()
+	if err := cf.takeErr(); err != nil {
+		return nil, err
+	}
+	return cf.File.Stat()
+}
+
+func (cf *coalescingFile) Chmod(mode os.FileMode) error {
+	cf.flush()
+	if err := cf.takeErr(); err != nil {
+		return err
+	}
+	return cf.File.Chmod(mode)
+}
+
+func (cf *coalescingFile) Readdir(n int) ([]os.FileInfo, error) {
+	cf.flush()
+	if err := cf.takeErr(); err != nil {
+		return nil, err
+	}
+	return cf.File.Readdir(n)
+}
+
+func (cf *coalescingFile) Readdirnames(n int) ([]string, error) {
+	cf.flush()
+	if err := cf.takeErr(); err != nil {
+		return nil, err
+	}
+	return cf.File.Readdirnames(n)
+}
+
+func (cf *coalescingFile) Sync() error {
+	cf.flush()
+	if err := cf.takeErr(); err != nil {
+		return err
+	}
+	return cf.File.Sync()
+}
+
+func (cf *coalescingFile) Close() error {
+	cf.flush()
+	err := cf.File.Close()
+	if flushErr := cf.takeErr(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package sftp
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+type writeAtCall struct {
+	off int64
+	n   int
+}
+
+// A file recording the writes made to it, failing them with err if set.
+type recordingFile struct {
+	vfs.File
+	writes []writeAtCall
+	err    error
+}
+
+func (f *recordingFile) WriteAt(buf []byte, off int64) (int, error) {
+	f.writes = append(f.writes, writeAtCall{off, len(buf)})
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.File.WriteAt(buf, off)
+}
+
+func newRecordingFile(t *testing.T) *recordingFile {
+	f, err := mem.New().OpenFile("/f", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &recordingFile{File: f}
+}
+
+func TestCoalesceSequential(t *testing.T) {
+	rf := newRecordingFile(t)
+	cf := newCoalescingFile(rf, 100)
+	for i := 0; i < 5; i++ {
+		_, err := cf.WriteAt(make([]byte, 30), int64(i*30))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rf.writes) != 1 || rf.writes[0] != (writeAtCall{0, 90}) {
+		t.Fatalf("expected one merged write, got %v", rf.writes)
+	}
+
+	// Reads see the buffered data.
+	fi, err := cf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 150 {
+		t.Fatalf("expected size 150, got %d", fi.Size())
+	}
+	if len(rf.writes) != 2 || rf.writes[1] != (writeAtCall{90, 60}) {
+		t.Fatalf("expected the buffer to be flushed, got %v", rf.writes)
+	}
+
+	err = cf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesceNonContiguous(t *testing.T) {
+	rf := newRecordingFile(t)
+	cf := newCoalescingFile(rf, 100)
+	for _, off := range []int64{0, 10, 50, 60} {
+		_, err := cf.WriteAt(make([]byte, 10), off)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rf.writes) != 1 || rf.writes[0] != (writeAtCall{0, 20}) {
+		t.Fatalf("expected the gap to flush the buffer, got %v", rf.writes)
+	}
+	err := cf.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rf.writes) != 2 || rf.writes[1] != (writeAtCall{50, 20}) {
+		t.Fatalf("expected sync to flush the buffer, got %v", rf.writes)
+	}
+	_ = cf.Close()
+}
+
+func TestCoalesceDeferredError(t *testing.T) {
+	errFlush := errors.New("flush failed")
+	for _, tc := range []struct {
+		op string
+		fn func(cf *coalescingFile) error
+	}{
+		{"sync", func(cf *coalescingFile) error { return cf.Sync() }},
+		{"close", func(cf *coalescingFile) error { return cf.Close() }},
+		{"stat", func(cf *coalescingFile) error { _, err := cf.Stat(); return err }},
+		{"readat", func(cf *coalescingFile) error { _, err := cf.ReadAt(make([]byte, 1), 0); return err }},
+		{"chmod", func(cf *coalescingFile) error { return cf.Chmod(0600) }},
+	} {
+		rf := newRecordingFile(t)
+		rf.err = errFlush
+		cf := newCoalescingFile(rf, 100)
+		// The buffered write succeeds, its error is deferred.
+		_, err := cf.WriteAt(make([]byte, 10), 0)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.op, err)
+		}
+		err = tc.fn(cf)
+		if err != errFlush {
+			t.Fatalf("%s: expected the flush error, got %v", tc.op, err)
+		}
+		if tc.op == "close" {
+			continue
+		}
+		// The error is only reported once.
+		rf.err = nil
+		err = cf.Sync()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.op, err)
+		}
+		_ = cf.Close()
+	}
+}
@@ -0,0 +1,202 @@
+package sftp
+
+import (
+	"path"
+	"strings"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/version"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// An ExtensionHandler processes a single FXP_EXTENDED request,
+// it must send exactly one response for the request, either
+// a status or an FXP_EXTENDED_REPLY.
+type ExtensionHandler func(s *Session, req *protosftp.FxpExtendedPacket)
+
+type extension struct {
+	name    string
+	data    string
+	handler ExtensionHandler
+}
+
+// Registered extensions, kept in registration order so
+// FXP_VERSION advertises them in a stable order.
+var extensionRegistry []extension
+
+// Register a handler for FXP_EXTENDED requests named name. If
+// data is not empty the extension is advertised to clients in FXP_VERSION,
+// fn may be nil for extensions that are only advertised.
+// Extensions should be registered before any sessions are served.
+func RegisterExtension(name, data string, fn ExtensionHandler) {
+	for i := range extensionRegistry {
+		if extensionRegistry[i].name == name {
+			extensionRegistry[i] = extension{name: name, data: data, handler: fn}
+			return
+		}
+	}
+	extensionRegistry = append(extensionRegistry, extension{name: name, data: data, handler: fn})
+}
+
+func init() {
+	RegisterExtension("hardlink@openssh.com", "1", handleHardlink)
+	RegisterExtension("fsync@openssh.com", "1", handleFsync)
+	RegisterExtension("expand-path@openssh.com", "1", handleExpandPath)
+	RegisterExtension("limits@openssh.com", "1", handleLimits)
+
+	vendorID, _ := protosftp.FxpExtendedVendorID{
+		VendorName:     version.Name,
+		ProductName:    version.Name,
+		ProductVersion: version.Get(),
+	}.MarshalBinary()
+	RegisterExtension("vendor-id", string(vendorID), nil)
+}
+
+// A request to run on a file handle's goroutine, so it is
+// ordered with the other requests for that file.
+type fileExtendedRequest struct {
+	*protosftp.FxpExtendedPacket
+	fn func(f vfs.File)
+}
+
+func (s *Session) handleExtended(req *protosftp.FxpExtendedPacket) {
+	fn, ok := s.extensions[req.ExtendedRequest]
+	if !ok || fn == nil {
+		s.respondError(req.ID, ErrUnsupported)
+		return
+	}
+	fn(s, req)
+}
+
+// The virtual file system the session is serving.
+func (s *Session) VFS() vfs.VFS {
+	return s.fs
+}
+
+// Respond to a request with a status, err may be nil
+// to indicate success.
+func (s *Session) RespondStatus(respId uint32, err error) {
+	if err != nil {
+		s.respondError(respId, err)
+		return
+	}
+	s.respondOk(respId)
+}
+
+// Respond to an extended request with an FXP_EXTENDED_REPLY.
+func (s *Session) RespondExtended(respId uint32, data []byte) {
+	s.Respond(&protosftp.FxpExtendedReplyPacket{
+		ID:   respId,
+		Data: data,
+	})
+}
+
+// Run fn with the file for handle on the file's own goroutine,
+// fn is responsible for responding to req.
+func (s *Session) WithFile(req *protosftp.FxpExtendedPacket, handle string, fn func(f vfs.File)) {
+	h, ok := s.handles.get(handle)
+	if !ok {
+		s.respondError(req.ID, ErrInvalidHandle)
+		return
+	}
+	if err := s.authorize(req.ExtendedRequest, h.Path); err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+	h.reqChan <- &fileExtendedRequest{
+		FxpExtendedPacket: req,
+		fn:                fn,
+	}
+}
+
+func handleHardlink(s *Session, req *protosftp.FxpExtendedPacket) {
+	err := s.checkAllowed(s.policy().AllowWrite)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	hl := &protosftp.FxpExtendedHardlinkPacket{}
+	err = hl.UnmarshalBinary(req.Data)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	oldpath, err := s.checkPath(hl.Oldpath)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	newpath, err := s.checkPath(hl.Newpath)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	for _, p := range []string{oldpath, newpath} {
+		err = s.authorize(req.ExtendedRequest, p)
+		if err != nil {
+			s.respondError(req.ID, err)
+			return
+		}
+	}
+
+	err = s.fs.Link(oldpath, newpath)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+	s.respondOk(req.ID)
+}
+
+func handleFsync(s *Session, req *protosftp.FxpExtendedPacket) {
+	fsync := &protosftp.FxpExtendedFsyncPacket{}
+	err := fsync.UnmarshalBinary(req.Data)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	s.WithFile(req, fsync.Handle, func(f vfs.File) {
+		err := f.Sync()
+		if err != nil {
+			s.respondError(req.ID, err)
+			return
+		}
+		s.respondOk(req.ID)
+	})
+}
+
+func handleExpandPath(s *Session, req *protosftp.FxpExtendedPacket) {
+	ep := &protosftp.FxpExtendedExpandPathPacket{}
+	err := ep.UnmarshalBinary(req.Data)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	p := ep.Path
+	if p == "~" {
+		p = s.homeDir()
+	} else if strings.HasPrefix(p, "~/") {
+		p = path.Join(s.homeDir(), p[2:])
+	} else if strings.HasPrefix(p, "~") {
+		// There are no other users to expand ~user for.
+		s.respondError(req.ID, ErrUnsupported)
+		return
+	}
+
+	p, err = s.realPath(p)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+	err = s.authorize(req.ExtendedRequest, p)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+	s.respondPath(req.ID, p)
+}
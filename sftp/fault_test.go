@@ -0,0 +1,165 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/faultfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// Serve fs until ctx is done or the client disconnects, the
+// returned channel receives the error the session ended with.
+func serveFaults(t *testing.T, ctx context.Context, fs vfs.VFS, opts *Options) (*Client, <-chan error) {
+	opts.Logger = LogFunc(func(string, ...interface{}) {})
+	server, client := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ServeContext(ctx, opts, fs, server)
+	}()
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, errs
+}
+
+func TestFaultStatuses(t *testing.T) {
+	fs := faultfs.New(mem.New())
+	c, _ := serveFaults(t, context.Background(), fs, &Options{})
+	defer c.Close()
+
+	for _, tc := range []struct {
+		err  error
+		code uint32
+		msg  string
+	}{
+		{&os.PathError{Op: "stat", Path: "/backend/a", Err: os.ErrNotExist}, protosftp.FX_NO_SUCH_FILE, "file does not exist"},
+		{&os.PathError{Op: "stat", Path: "/backend/a", Err: syscall.EACCES}, protosftp.FX_PERMISSION_DENIED, "permission denied"},
+		{syscall.EROFS, protosftp.FX_PERMISSION_DENIED, syscall.EROFS.Error()},
+		{syscall.ENOSPC, protosftp.FX_FAILURE, syscall.ENOSPC.Error()},
+		{&vfs.StatusError{Code: protosftp.FX_OP_UNSUPPORTED, Msg: "not here"}, protosftp.FX_OP_UNSUPPORTED, "not here"},
+		{errors.New("failed reading /backend/a"), protosftp.FX_FAILURE, ""},
+	} {
+		fs.Reset()
+		fs.Inject(faultfs.Fault{Op: "stat", Err: tc.err})
+		resp, err := c.request(func(id uint32) protosftp.Packet {
+			return &protosftp.FxpStatPacket{ID: id, Path: "/a"}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, ok := resp.(*protosftp.FxpStatusPacket)
+		if !ok {
+			t.Fatalf("%v: expected a status, got %#v", tc.err, resp)
+		}
+		if st.StatusError.Code != tc.code {
+			t.Fatalf("%v: expected status %d, got %d", tc.err, tc.code, st.StatusError.Code)
+		}
+		if tc.msg != "" && st.StatusError.Msg != tc.msg {
+			t.Fatalf("%v: expected message %q, got %q", tc.err, tc.msg, st.StatusError.Msg)
+		}
+		if strings.Contains(st.StatusError.Msg, "/backend") {
+			t.Fatalf("%v: backend path sent to the client", tc.err)
+		}
+	}
+
+	// Short writes fail rather than losing data silently.
+	fs.Reset()
+	f, err := c.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Inject(faultfs.Fault{Op: "write", Short: 2})
+	_, err = f.WriteAt([]byte("hello"), 0)
+	if err == nil {
+		t.Fatal("expected a short write to fail")
+	}
+	_ = f.Close()
+}
+
+func TestFaultHandleCleanup(t *testing.T) {
+	fs := faultfs.New(mem.New())
+	limit := NewHandleLimit(10)
+	c, errs := serveFaults(t, context.Background(), fs, &Options{SharedHandleLimit: limit})
+
+	for _, p := range []string{"/a", "/b"} {
+		_, err := c.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.OpenFile("/missing/c", os.O_WRONLY|os.O_CREATE, 0644)
+	if err == nil {
+		t.Fatal("expected the open to fail")
+	}
+	if limit.Open() != 2 {
+		t.Fatalf("expected 2 open files, got %d", limit.Open())
+	}
+
+	// Files the client left open are closed when it disconnects,
+	// and count as closed even if closing them fails.
+	fs.Inject(faultfs.Fault{Op: "close", Err: errors.New("close failed")})
+	_ = c.Close()
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to end")
+	}
+	if fs.Calls("close") != 2 {
+		t.Fatalf("expected 2 files to be closed, got %d", fs.Calls("close"))
+	}
+	if limit.Open() != 0 {
+		t.Fatalf("expected no open files, got %d", limit.Open())
+	}
+}
+
+func TestFaultHangingRead(t *testing.T) {
+	fs := faultfs.New(mem.New())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, errs := serveFaults(t, ctx, fs, &Options{})
+	defer c.Close()
+
+	f, err := c.OpenFile("/a", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	fs.Inject(faultfs.Fault{Op: "read", Hang: release})
+	go func() {
+		_, _ = f.ReadAt(make([]byte, 10), 0)
+	}()
+	for fs.Calls("read") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The session waits for the read in progress before
+	// closing the file.
+	cancel()
+	select {
+	case <-errs:
+		t.Fatal("expected the session to wait for the read")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err = <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to end")
+	}
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if fs.Calls("close") != 1 {
+		t.Fatal("expected the file to be closed")
+	}
+}
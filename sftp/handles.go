@@ -0,0 +1,123 @@
+package sftp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A HandleLimit bounds the files open at once in all the sessions
+// sharing it, so many clients cannot exhaust the file descriptors or
+// backend connections of one server.
+type HandleLimit struct {
+	max int
+
+	lock sync.Mutex
+	open int
+}
+
+// A limit of max files open at once.
+func NewHandleLimit(max int) *HandleLimit {
+	return &HandleLimit{max: max}
+}
+
+// The number of files open in the sessions sharing l.
+func (l *HandleLimit) Open() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.open
+}
+
+func (l *HandleLimit) acquire() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.open >= l.max {
+		return false
+	}
+	l.open++
+	return true
+}
+
+func (l *HandleLimit) release() {
+	l.lock.Lock()
+	l.open--
+	l.lock.Unlock()
+}
+
+// The open files of a session by handle. Handles are looked up and
+// added by the request loop, while files are closed by their own
+// goroutines, so a file counts as open until it has been closed
+// rather than from when the client asked to close it.
+type handleRegistry struct {
+	lock    sync.Mutex
+	handles map[string]*handle
+	next    int64
+	open    int
+}
+
+// Count a file about to be opened, failing with ErrTooManyOpenFiles
+// if the session already has max files open or the shared limit is
+// reached. releaseHandle must be called once the file is closed,
+// or if opening it fails.
+func (s *Session) reserveHandle() error {
+	r := &s.handles
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if s.Options.MaxFiles > 0 && r.open >= s.Options.MaxFiles {
+		return ErrTooManyOpenFiles
+	}
+	if s.Options.SharedHandleLimit != nil && !s.Options.SharedHandleLimit.acquire() {
+		return ErrTooManyOpenFiles
+	}
+	r.open++
+	return nil
+}
+
+func (s *Session) releaseHandle() {
+	r := &s.handles
+	r.lock.Lock()
+	r.open--
+	r.lock.Unlock()
+	if s.Options.SharedHandleLimit != nil {
+		s.Options.SharedHandleLimit.release()
+	}
+}
+
+// Register h under a new handle id.
+func (r *handleRegistry) add(h *handle) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.handles == nil {
+		r.handles = make(map[string]*handle)
+	}
+	h.Id = fmt.Sprintf("%d", r.next)
+	r.next++
+	r.handles[h.Id] = h
+}
+
+func (r *handleRegistry) get(id string) (*handle, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	h, ok := r.handles[id]
+	return h, ok
+}
+
+// Unregister the handle id, later requests for it fail.
+func (r *handleRegistry) remove(id string) (*handle, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	h, ok := r.handles[id]
+	delete(r.handles, id)
+	return h, ok
+}
+
+// Unregister every handle, returning them.
+func (r *handleRegistry) removeAll() []*handle {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var all []*handle
+	for id, h := range r.handles {
+		all = append(all, h)
+		delete(r.handles, id)
+	}
+	return all
+}
@@ -0,0 +1,120 @@
+package sftp
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestHandleLimits(t *testing.T) {
+	fs := mem.New()
+	limit := NewHandleLimit(3)
+	serve := func() (*Client, chan struct{}) {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		opts := &Options{
+			MaxFiles:          2,
+			SharedHandleLimit: limit,
+			Logger:            LogFunc(func(string, ...interface{}) {}),
+		}
+		go func() {
+			Serve(opts, fs, server)
+			close(done)
+		}()
+		c, err := NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, done
+	}
+	open := func(c *Client, name string) (vfs.File, error) {
+		return c.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+	}
+
+	c1, done1 := serve()
+	a, err := open(c1, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = open(c1, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The session limit.
+	_, err = open(c1, "/c")
+	if err == nil {
+		t.Fatal("expected the third file of a session to be refused")
+	}
+	err = a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = open(c1, "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit shared by sessions.
+	c2, done2 := serve()
+	defer c2.Close()
+	_, err = open(c2, "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = open(c2, "/e")
+	if err == nil {
+		t.Fatal("expected the shared limit to refuse a fourth file")
+	}
+	if n := limit.Open(); n != 3 {
+		t.Fatalf("expected 3 open files, got %d", n)
+	}
+
+	// Files left open are released when their session ends.
+	_ = c1.Close()
+	<-done1
+	if n := limit.Open(); n != 1 {
+		t.Fatalf("expected 1 open file, got %d", n)
+	}
+	_, err = open(c2, "/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c2.Close()
+	select {
+	case <-done2:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+	if n := limit.Open(); n != 0 {
+		t.Fatalf("expected no open files, got %d", n)
+	}
+}
+
+func TestHandleLimitBadFlags(t *testing.T) {
+	limit := NewHandleLimit(2)
+	c, _ := serveFaults(t, context.Background(), mem.New(), &Options{MaxFiles: 2, SharedHandleLimit: limit})
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		_, err := c.requestHandle(func(id uint32) protosftp.Packet {
+			return &protosftp.FxpOpenPacket{ID: id, Path: "/a", Pflags: protosftp.FXF_WRITE | protosftp.FXF_CREAT | 0x1000}
+		})
+		if err == nil {
+			t.Fatal("expected unknown flags to be refused")
+		}
+	}
+	if n := limit.Open(); n != 0 {
+		t.Fatalf("expected no open files, got %d", n)
+	}
+	f, err := c.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+}
@@ -0,0 +1,63 @@
+package sftp
+
+import (
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+)
+
+// Room left in packets for the fields around the data of reads and
+// writes, the same as OpenSSH leaves.
+const packetOverhead = 1024
+
+// The shortest packets servers should accept according to the
+// protocol draft, shorter limits are raised to it.
+const minPacketLength = 34000
+
+// The directory entries sent in one READDIR response by default.
+const defaultReaddirBatchSize = 64
+
+func (s *Session) maxPacketLength() uint32 {
+	switch {
+	case s.Options.MaxPacketLength == 0:
+		return protosftp.DefaultMaxPacketLength
+	case s.Options.MaxPacketLength < minPacketLength:
+		return minPacketLength
+	}
+	return s.Options.MaxPacketLength
+}
+
+// Longer reads would not fit in a response packet, so larger
+// limits are lowered to fit.
+func (s *Session) maxReadLength() uint32 {
+	max := s.maxPacketLength() - packetOverhead
+	if s.Options.MaxReadLength != 0 && s.Options.MaxReadLength < max {
+		return s.Options.MaxReadLength
+	}
+	return max
+}
+
+func (s *Session) maxWriteLength() uint32 {
+	max := s.maxPacketLength() - packetOverhead
+	if s.Options.MaxWriteLength != 0 && s.Options.MaxWriteLength < max {
+		return s.Options.MaxWriteLength
+	}
+	return max
+}
+
+func (s *Session) readdirBatchSize() int {
+	if s.Options.ReaddirBatchSize <= 0 {
+		return defaultReaddirBatchSize
+	}
+	return s.Options.ReaddirBatchSize
+}
+
+// Tell the client how large its requests may be, so clients like
+// OpenSSH sftp size their reads and writes to fit.
+func handleLimits(s *Session, req *protosftp.FxpExtendedPacket) {
+	data, _ := protosftp.FxpExtendedLimitsReply{
+		MaxPacketLength: uint64(s.maxPacketLength()),
+		MaxReadLength:   uint64(s.maxReadLength()),
+		MaxWriteLength:  uint64(s.maxWriteLength()),
+		MaxOpenHandles:  uint64(s.Options.MaxFiles),
+	}.MarshalBinary()
+	s.RespondExtended(req.ID, data)
+}
@@ -0,0 +1,138 @@
+package sftp
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestLimits(t *testing.T) {
+	fs := mem.New()
+	server, client := net.Pipe()
+	opts := &Options{
+		MaxFiles:        9,
+		MaxPacketLength: 64 * 1024,
+		MaxReadLength:   1000,
+		MaxWriteLength:  1024 * 1024,
+		Logger:          LogFunc(func(string, ...interface{}) {}),
+	}
+	go Serve(opts, fs, server)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.Extensions["limits@openssh.com"] != "1" {
+		t.Fatal("expected the limits extension to be advertised")
+	}
+	resp, err := c.request(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpExtendedPacket{ID: id, ExtendedRequest: "limits@openssh.com"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limits protosftp.FxpExtendedLimitsReply
+	err = limits.UnmarshalBinary(resp.(*protosftp.FxpExtendedReplyPacket).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := protosftp.FxpExtendedLimitsReply{
+		MaxPacketLength: 64 * 1024,
+		MaxReadLength:   1000,
+		// Writes must still fit in a packet.
+		MaxWriteLength: 63 * 1024,
+		MaxOpenHandles: 9,
+	}
+	if limits != expected {
+		t.Fatalf("got limits %+v, expected %+v", limits, expected)
+	}
+
+	f, err := c.OpenFile("/a", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Long reads are clamped instead of failing.
+	handle := f.(*ClientFile).handle
+	resp, err = c.request(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpReadPacket{ID: id, Handle: handle, Len: 4000}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := resp.(*protosftp.FxpDataPacket)
+	if !ok || len(data.Data) != 1000 {
+		t.Fatalf("expected 1000 bytes of data, got %#v", resp)
+	}
+
+	// Writes too long for the limit are refused.
+	resp, err = c.request(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpWritePacket{ID: id, Handle: handle, Length: 63*1024 + 1, Data: make([]byte, 63*1024+1)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, ok := resp.(*protosftp.FxpStatusPacket); !ok || st.StatusError.Code == protosftp.FX_OK {
+		t.Fatalf("expected the write to fail, got %#v", resp)
+	}
+}
+
+func TestLimitsClampRead(t *testing.T) {
+	fs := mem.New()
+	server, client := net.Pipe()
+	opts := &Options{
+		MaxPacketLength: 64 * 1024,
+		MaxReadLength:   1024 * 1024,
+		Logger:          LogFunc(func(string, ...interface{}) {}),
+	}
+	go Serve(opts, fs, server)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp, err := c.request(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpExtendedPacket{ID: id, ExtendedRequest: "limits@openssh.com"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limits protosftp.FxpExtendedLimitsReply
+	err = limits.UnmarshalBinary(resp.(*protosftp.FxpExtendedReplyPacket).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reads must fit in a packet too.
+	if limits.MaxReadLength != 63*1024 {
+		t.Fatalf("expected a read limit of %d, got %d", 63*1024, limits.MaxReadLength)
+	}
+
+	f, err := c.OpenFile("/a", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 128*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := f.(*ClientFile).handle
+	resp, err = c.request(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpReadPacket{ID: id, Handle: handle, Len: 1024 * 1024}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := resp.(*protosftp.FxpDataPacket)
+	if !ok || len(data.Data) != 63*1024 {
+		t.Fatalf("expected %d bytes of data, got %#v", 63*1024, resp)
+	}
+}
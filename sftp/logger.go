@@ -0,0 +1,385 @@
+package sftp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/version"
+)
+
+// A Logger receives session log messages and a record of
+// every operation a client performs.
+type Logger interface {
+	Logf(format string, args ...interface{})
+	LogOp(op *OpRecord)
+}
+
+// The record of a single client request.
+type OpRecord struct {
+	Op   string
+	Path string
+	// New path for rename and link requests.
+	Target string
+	Handle string
+	// Open flags, for example "write,create,trunc".
+	Flags string
+	// Permissions requested by open, mkdir and setstat.
+	Mode *os.FileMode
+	// Offset and bytes read or written.
+	Offset   int64
+	Bytes    int64
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+
+	// Set for operations that modify the file system.
+	mutating bool
+	// Set for extended requests the session does not support.
+	unknownExtension bool
+}
+
+// A Logger that passes messages to a printf style function,
+// operation records are discarded.
+type LogFunc func(format string, args ...interface{})
+
+func (f LogFunc) Logf(format string, args ...interface{}) {
+	f(format, args...)
+}
+
+func (f LogFunc) LogOp(op *OpRecord) {}
+
+type jsonWriter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func (w *jsonWriter) write(v interface{}) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	// Nowhere to report a failure to log.
+	_ = w.enc.Encode(v)
+}
+
+// A Logger writing one JSON object per line, suitable for
+// log shippers. Operation records have the fields time, op, path,
+// target, handle, flags, mode, offset, bytes, duration_ms and error,
+// messages have the fields time and msg.
+type JSONLogger struct {
+	jsonWriter
+}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	l := &JSONLogger{}
+	l.enc = json.NewEncoder(w)
+	return l
+}
+
+type jsonMessage struct {
+	Time    string `json:"time"`
+	Version string `json:"version"`
+	Msg     string `json:"msg"`
+}
+
+type jsonOpRecord struct {
+	Time       string  `json:"time"`
+	Version    string  `json:"version"`
+	Session    string  `json:"session,omitempty"`
+	Op         string  `json:"op"`
+	Path       string  `json:"path,omitempty"`
+	Target     string  `json:"target,omitempty"`
+	Handle     string  `json:"handle,omitempty"`
+	Flags      string  `json:"flags,omitempty"`
+	Mode       string  `json:"mode,omitempty"`
+	Offset     *int64  `json:"offset,omitempty"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func newJSONOpRecord(op *OpRecord) *jsonOpRecord {
+	rec := &jsonOpRecord{
+		Time:       op.Start.UTC().Format(time.RFC3339Nano),
+		Version:    version.Get(),
+		Op:         op.Op,
+		Path:       op.Path,
+		Target:     op.Target,
+		Handle:     op.Handle,
+		Flags:      op.Flags,
+		Bytes:      op.Bytes,
+		DurationMs: float64(op.Duration) / float64(time.Millisecond),
+	}
+	if op.Op == "read" || op.Op == "write" {
+		rec.Offset = &op.Offset
+	}
+	if op.Mode != nil {
+		rec.Mode = fmt.Sprintf("%04o", uint32(*op.Mode))
+	}
+	if op.Err != nil {
+		rec.Error = op.Err.Error()
+	}
+	return rec
+}
+
+func (l *JSONLogger) Logf(format string, args ...interface{}) {
+	l.write(&jsonMessage{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Version: version.Get(),
+		Msg:     fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *JSONLogger) LogOp(op *OpRecord) {
+	l.write(newJSONOpRecord(op))
+}
+
+// The id of request req, false for requests without one.
+func requestID(req protosftp.Packet) (uint32, bool) {
+	switch req := req.(type) {
+	case *protosftp.FxpOpenPacket:
+		return req.ID, true
+	case *protosftp.FxpOpendirPacket:
+		return req.ID, true
+	case *protosftp.FxpClosePacket:
+		return req.ID, true
+	case *protosftp.FxpReadPacket:
+		return req.ID, true
+	case *protosftp.FxpWritePacket:
+		return req.ID, true
+	case *protosftp.FxpReaddirPacket:
+		return req.ID, true
+	case *protosftp.FxpFstatPacket:
+		return req.ID, true
+	case *protosftp.FxpFSetStatPacket:
+		return req.ID, true
+	case *protosftp.FxpStatPacket:
+		return req.ID, true
+	case *protosftp.FxpLstatPacket:
+		return req.ID, true
+	case *protosftp.FxpSetStatPacket:
+		return req.ID, true
+	case *protosftp.FxpMkdirPacket:
+		return req.ID, true
+	case *protosftp.FxpRmdirPacket:
+		return req.ID, true
+	case *protosftp.FxpRemovePacket:
+		return req.ID, true
+	case *protosftp.FxpRenamePacket:
+		return req.ID, true
+	case *protosftp.FxpReadlinkPacket:
+		return req.ID, true
+	case *protosftp.FxpRealpathPacket:
+		return req.ID, true
+	case *protosftp.FxpSymlinkPacket:
+		return req.ID, true
+	case *protosftp.FxpExtendedPacket:
+		return req.ID, true
+	}
+	return 0, false
+}
+
+// Begin the operation record for req, it is
+// completed and logged when req is responded to.
+func (s *Session) startOp(req protosftp.Packet) {
+	var id uint32
+	op := &OpRecord{Start: time.Now()}
+
+	switch req := req.(type) {
+	case *protosftp.FxpOpenPacket:
+		id, op.Op, op.Path = req.ID, "open", req.Path
+		op.Flags = openFlagsString(req.Pflags)
+		op.Mode = attrsMode(&req.Attrs)
+		op.mutating = req.Pflags&(protosftp.FXF_WRITE|protosftp.FXF_CREAT|protosftp.FXF_TRUNC|protosftp.FXF_APPEND) != 0
+	case *protosftp.FxpOpendirPacket:
+		id, op.Op, op.Path = req.ID, "opendir", req.Path
+	case *protosftp.FxpClosePacket:
+		id, op.Op, op.Handle = req.ID, "close", req.Handle
+	case *protosftp.FxpReadPacket:
+		id, op.Op, op.Handle = req.ID, "read", req.Handle
+		op.Offset = int64(req.Offset)
+	case *protosftp.FxpWritePacket:
+		id, op.Op, op.Handle = req.ID, "write", req.Handle
+		op.Offset = int64(req.Offset)
+		op.Bytes = int64(len(req.Data))
+		op.mutating = true
+	case *protosftp.FxpReaddirPacket:
+		id, op.Op, op.Handle = req.ID, "readdir", req.Handle
+	case *protosftp.FxpFstatPacket:
+		id, op.Op, op.Handle = req.ID, "fstat", req.Handle
+	case *protosftp.FxpFSetStatPacket:
+		id, op.Op, op.Handle = req.ID, "fsetstat", req.Handle
+		op.Mode = attrsMode(&req.Attrs)
+		op.mutating = true
+	case *protosftp.FxpStatPacket:
+		id, op.Op, op.Path = req.ID, "stat", req.Path
+	case *protosftp.FxpLstatPacket:
+		id, op.Op, op.Path = req.ID, "lstat", req.Path
+	case *protosftp.FxpSetStatPacket:
+		id, op.Op, op.Path = req.ID, "setstat", req.Path
+		op.Mode = attrsMode(&req.Attrs)
+		op.mutating = true
+	case *protosftp.FxpMkdirPacket:
+		id, op.Op, op.Path = req.ID, "mkdir", req.Path
+		op.Mode = attrsMode(&req.Attrs)
+		op.mutating = true
+	case *protosftp.FxpRmdirPacket:
+		id, op.Op, op.Path = req.ID, "rmdir", req.Path
+		op.mutating = true
+	case *protosftp.FxpRemovePacket:
+		id, op.Op, op.Path = req.ID, "remove", req.Filename
+		op.mutating = true
+	case *protosftp.FxpRenamePacket:
+		id, op.Op, op.Path, op.Target = req.ID, "rename", req.Oldpath, req.Newpath
+		op.mutating = true
+	case *protosftp.FxpReadlinkPacket:
+		id, op.Op, op.Path = req.ID, "readlink", req.Path
+	case *protosftp.FxpRealpathPacket:
+		id, op.Op, op.Path = req.ID, "realpath", req.Path
+	case *protosftp.FxpSymlinkPacket:
+		id, op.Op, op.Path, op.Target = req.ID, "symlink", req.Targetpath, req.Linkpath
+		op.mutating = true
+	case *protosftp.FxpExtendedPacket:
+		id, op.Op = req.ID, req.ExtendedRequest
+		_, known := s.extensions[req.ExtendedRequest]
+		op.unknownExtension = !known
+		if req.ExtendedRequest == "hardlink@openssh.com" {
+			hl := &protosftp.FxpExtendedHardlinkPacket{}
+			if hl.UnmarshalBinary(req.Data) == nil {
+				op.Path, op.Target = hl.Oldpath, hl.Newpath
+			}
+			op.mutating = true
+		}
+	default:
+		return
+	}
+
+	s.opsLock.Lock()
+	s.ops[id] = op
+	s.opsLock.Unlock()
+}
+
+// Replace the paths in the operation record for req with the paths
+// the request is handled with, once they are normalized and any
+// middleware has rewritten them.
+func (s *Session) setOpPaths(req protosftp.Packet) {
+	p, t := packetPaths(req)
+	if p == nil {
+		return
+	}
+	id, _ := requestID(req)
+	s.opsLock.Lock()
+	defer s.opsLock.Unlock()
+	if op, ok := s.ops[id]; ok {
+		op.Path = *p
+		if t != nil {
+			op.Target = *t
+		}
+	}
+}
+
+// The number of requests that have not been responded to.
+func (s *Session) pendingOps() int {
+	s.opsLock.Lock()
+	defer s.opsLock.Unlock()
+	return len(s.ops)
+}
+
+// Set the error of the operation record for request id, it is
+// logged instead of the status sent to the client.
+func (s *Session) failOp(id uint32, err error) {
+	s.opsLock.Lock()
+	defer s.opsLock.Unlock()
+	if op, ok := s.ops[id]; ok {
+		op.Err = err
+	}
+}
+
+// Complete and log the operation record for request id, if any.
+func (s *Session) endOp(id uint32, n int64, handle string, err error) {
+	s.opsLock.Lock()
+	op, ok := s.ops[id]
+	delete(s.ops, id)
+	s.opsLock.Unlock()
+	if !ok {
+		return
+	}
+
+	op.Duration = time.Since(op.Start)
+	op.Bytes += n
+	if op.Handle == "" {
+		op.Handle = handle
+	}
+	if op.Err == nil {
+		op.Err = err
+	}
+	s.Options.Logger.LogOp(op)
+	if op.mutating && s.Options.AuditLog != nil {
+		s.Options.AuditLog.Audit(s.Options.SessionID, op)
+	}
+	name := op.Op
+	if op.unknownExtension {
+		// Clients choose the names of extended requests,
+		// metrics must not count each one they make up.
+		name = "unknown-extension"
+	}
+	s.metrics().Observe(name, op.Bytes, op.Duration, op.Err)
+	for i := len(s.Options.Middleware) - 1; i >= 0; i-- {
+		s.Options.Middleware[i].After(s, op)
+	}
+}
+
+func attrsMode(attrs *protosftp.FileStat) *os.FileMode {
+	if attrs.Flags&protosftp.FILEXFER_ATTR_PERMISSIONS == 0 {
+		return nil
+	}
+	mode := os.FileMode(attrs.Mode & 07777)
+	return &mode
+}
+
+func openFlagsString(pflags uint32) string {
+	names := []struct {
+		flag uint32
+		name string
+	}{
+		{protosftp.FXF_READ, "read"},
+		{protosftp.FXF_WRITE, "write"},
+		{protosftp.FXF_APPEND, "append"},
+		{protosftp.FXF_CREAT, "create"},
+		{protosftp.FXF_TRUNC, "trunc"},
+		{protosftp.FXF_EXCL, "excl"},
+	}
+	var flags []string
+	for _, n := range names {
+		if pflags&n.flag != 0 {
+			flags = append(flags, n.name)
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// Complete the operation record resp is responding to.
+func (s *Session) endOpWithResponse(resp protosftp.Packet) {
+	switch resp := resp.(type) {
+	case *protosftp.FxpStatusPacket:
+		var err error
+		if resp.StatusError.Code != protosftp.FX_OK {
+			err = &resp.StatusError
+		}
+		s.endOp(resp.ID, 0, "", err)
+	case *protosftp.FxpDataPacket:
+		s.endOp(resp.ID, int64(resp.Length), "", nil)
+	case *protosftp.FxpHandlePacket:
+		s.endOp(resp.ID, 0, resp.Handle, nil)
+	case *protosftp.FxpNamePacket:
+		s.endOp(resp.ID, 0, "", nil)
+	case *protosftp.FxpStatResponse:
+		s.endOp(resp.ID, 0, "", nil)
+	case *protosftp.FxpExtendedReplyPacket:
+		s.endOp(resp.ID, 0, "", nil)
+	}
+}
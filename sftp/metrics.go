@@ -0,0 +1,148 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receive every operation a client performs, with the bytes it
+// read or wrote, how long it took and the error it failed with, if any.
+// Observe is called from several goroutines at once.
+type Metrics interface {
+	Observe(op string, bytes int64, duration time.Duration, err error)
+}
+
+// Metrics that discard every operation.
+type NopMetrics struct{}
+
+func (NopMetrics) Observe(op string, bytes int64, duration time.Duration, err error) {}
+
+func (s *Session) metrics() Metrics {
+	if s.Options.Metrics == nil {
+		return NopMetrics{}
+	}
+	return s.Options.Metrics
+}
+
+// The upper bounds in seconds of the operation duration histogram.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+type opMetrics struct {
+	count   uint64
+	errors  uint64
+	bytes   int64
+	seconds float64
+	// Operations at most as long as each of durationBuckets.
+	buckets []uint64
+}
+
+// Metrics kept in memory and served in the Prometheus text format,
+// counting the operations, errors and bytes of each kind of
+// operation and the distribution of their durations.
+type PrometheusMetrics struct {
+	lock sync.Mutex
+	ops  map[string]*opMetrics
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{ops: make(map[string]*opMetrics)}
+}
+
+func (m *PrometheusMetrics) Observe(op string, bytes int64, duration time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	o, ok := m.ops[op]
+	if !ok {
+		o = &opMetrics{buckets: make([]uint64, len(durationBuckets))}
+		m.ops[op] = o
+	}
+	o.count++
+	if err != nil {
+		o.errors++
+	}
+	o.bytes += bytes
+	seconds := duration.Seconds()
+	o.seconds += seconds
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			o.buckets[i]++
+		}
+	}
+}
+
+// Write the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var names []string
+	for op := range m.ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+
+	cw := &countingWriter{w: w}
+	fmt.Fprintf(cw, "# HELP sftpplease_operations_total SFTP operations performed.\n")
+	fmt.Fprintf(cw, "# TYPE sftpplease_operations_total counter\n")
+	for _, op := range names {
+		fmt.Fprintf(cw, "sftpplease_operations_total{op=\"%s\"} %d\n", labelValue(op), m.ops[op].count)
+	}
+	fmt.Fprintf(cw, "# HELP sftpplease_operation_errors_total SFTP operations that failed.\n")
+	fmt.Fprintf(cw, "# TYPE sftpplease_operation_errors_total counter\n")
+	for _, op := range names {
+		fmt.Fprintf(cw, "sftpplease_operation_errors_total{op=\"%s\"} %d\n", labelValue(op), m.ops[op].errors)
+	}
+	fmt.Fprintf(cw, "# HELP sftpplease_operation_bytes_total Bytes read and written by SFTP operations.\n")
+	fmt.Fprintf(cw, "# TYPE sftpplease_operation_bytes_total counter\n")
+	for _, op := range names {
+		fmt.Fprintf(cw, "sftpplease_operation_bytes_total{op=\"%s\"} %d\n", labelValue(op), m.ops[op].bytes)
+	}
+	fmt.Fprintf(cw, "# HELP sftpplease_operation_duration_seconds Duration of SFTP operations.\n")
+	fmt.Fprintf(cw, "# TYPE sftpplease_operation_duration_seconds histogram\n")
+	for _, op := range names {
+		o := m.ops[op]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(cw, "sftpplease_operation_duration_seconds_bucket{op=\"%s\",le=\"%s\"} %d\n",
+				labelValue(op), strconv.FormatFloat(le, 'g', -1, 64), o.buckets[i])
+		}
+		fmt.Fprintf(cw, "sftpplease_operation_duration_seconds_bucket{op=\"%s\",le=\"+Inf\"} %d\n", labelValue(op), o.count)
+		fmt.Fprintf(cw, "sftpplease_operation_duration_seconds_sum{op=\"%s\"} %s\n", labelValue(op), strconv.FormatFloat(o.seconds, 'g', -1, 64))
+		fmt.Fprintf(cw, "sftpplease_operation_duration_seconds_count{op=\"%s\"} %d\n", labelValue(op), o.count)
+	}
+	return cw.n, cw.err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// Serve the metrics to a Prometheus scraper.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = m.WriteTo(w)
+}
+
+// Counts the bytes written to w, remembering the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(buf []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(buf)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
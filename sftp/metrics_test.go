@@ -0,0 +1,94 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.Observe("read", 100, 2*time.Millisecond, nil)
+	m.Observe("read", 50, 20*time.Second, errors.New("failed"))
+	m.Observe(`a"b`, 0, 0, nil)
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		`sftpplease_operations_total{op="read"} 2`,
+		`sftpplease_operation_errors_total{op="read"} 1`,
+		`sftpplease_operation_bytes_total{op="read"} 150`,
+		`sftpplease_operation_duration_seconds_bucket{op="read",le="0.001"} 0`,
+		`sftpplease_operation_duration_seconds_bucket{op="read",le="0.005"} 1`,
+		`sftpplease_operation_duration_seconds_bucket{op="read",le="30"} 2`,
+		`sftpplease_operation_duration_seconds_bucket{op="read",le="+Inf"} 2`,
+		`sftpplease_operation_duration_seconds_count{op="read"} 2`,
+		`sftpplease_operations_total{op="a\"b"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("expected %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestSessionMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	server, client := net.Pipe()
+	opts := &Options{
+		Metrics: m,
+		Logger:  LogFunc(func(string, ...interface{}) {}),
+	}
+	done := make(chan struct{})
+	go func() {
+		Serve(opts, mem.New(), server)
+		close(done)
+	}()
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	_, err = c.Stat("/missing")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	err = c.requestStatus(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpExtendedPacket{ID: id, ExtendedRequest: "made-up@example.com"}
+	})
+	if err == nil {
+		t.Fatal("expected an unknown extension to fail")
+	}
+	_ = c.Close()
+	<-done
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.ops["write"] == nil || m.ops["write"].bytes != 1000 {
+		t.Fatal("expected the write to be observed with its bytes")
+	}
+	if m.ops["stat"] == nil || m.ops["stat"].errors != 1 {
+		t.Fatal("expected the failed stat to be observed")
+	}
+	if m.ops["unknown-extension"] == nil || m.ops["made-up@example.com"] != nil {
+		t.Fatal("expected unknown extensions to be observed under one name")
+	}
+}
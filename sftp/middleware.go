@@ -0,0 +1,126 @@
+package sftp
+
+import (
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+)
+
+// A Middleware is called around every request a session handles, to
+// implement policies and record metrics without changing the session.
+type Middleware interface {
+	// Called before req is handled, once the paths of req have been
+	// normalized and checked against the session root and policy. An
+	// error denies the request, the client is sent its status.
+	Before(s *Session, req *Request) error
+	// Called once the request has been responded to, including when
+	// it was denied, with the record of its outcome. After may be
+	// called from several goroutines at once.
+	After(s *Session, op *OpRecord)
+}
+
+// A request passed to middleware.
+type Request struct {
+	// The decoded request packet.
+	Packet protosftp.Packet
+	// The operation, as in operation records.
+	Op string
+	// The path of the request and the new path of rename and symlink
+	// requests. Middleware may change them, the new paths are checked
+	// against the session root again before the request is handled.
+	// Realpath and extended requests resolve and check their own
+	// paths, they have none here.
+	Path   string
+	Target string
+}
+
+// Middleware from functions, either of which may be nil.
+type MiddlewareFuncs struct {
+	BeforeFunc func(s *Session, req *Request) error
+	AfterFunc  func(s *Session, op *OpRecord)
+}
+
+func (m MiddlewareFuncs) Before(s *Session, req *Request) error {
+	if m.BeforeFunc == nil {
+		return nil
+	}
+	return m.BeforeFunc(s, req)
+}
+
+func (m MiddlewareFuncs) After(s *Session, op *OpRecord) {
+	if m.AfterFunc != nil {
+		m.AfterFunc(s, op)
+	}
+}
+
+// The path fields of req, nil if it has none.
+func packetPaths(req protosftp.Packet) (*string, *string) {
+	switch req := req.(type) {
+	case *protosftp.FxpOpenPacket:
+		return &req.Path, nil
+	case *protosftp.FxpOpendirPacket:
+		return &req.Path, nil
+	case *protosftp.FxpStatPacket:
+		return &req.Path, nil
+	case *protosftp.FxpLstatPacket:
+		return &req.Path, nil
+	case *protosftp.FxpSetStatPacket:
+		return &req.Path, nil
+	case *protosftp.FxpMkdirPacket:
+		return &req.Path, nil
+	case *protosftp.FxpRmdirPacket:
+		return &req.Path, nil
+	case *protosftp.FxpRemovePacket:
+		return &req.Filename, nil
+	case *protosftp.FxpReadlinkPacket:
+		return &req.Path, nil
+	case *protosftp.FxpRenamePacket:
+		return &req.Oldpath, &req.Newpath
+	case *protosftp.FxpSymlinkPacket:
+		return &req.Targetpath, &req.Linkpath
+	}
+	return nil, nil
+}
+
+// Pass req to the Before method of each middleware in turn, on
+// failure it returns the id to respond to and the error.
+func (s *Session) runMiddleware(req protosftp.Packet) (uint32, error) {
+	if len(s.Options.Middleware) == 0 {
+		return 0, nil
+	}
+	id, ok := requestID(req)
+	if !ok {
+		return 0, nil
+	}
+	s.opsLock.Lock()
+	op, ok := s.ops[id]
+	s.opsLock.Unlock()
+	if !ok {
+		return 0, nil
+	}
+
+	r := &Request{Packet: req, Op: op.Op}
+	p, t := packetPaths(req)
+	if p != nil {
+		r.Path = *p
+	}
+	if t != nil {
+		r.Target = *t
+	}
+	for _, m := range s.Options.Middleware {
+		if err := m.Before(s, r); err != nil {
+			return id, err
+		}
+	}
+
+	var err error
+	if p != nil && r.Path != *p {
+		if *p, err = s.checkPath(r.Path); err != nil {
+			return id, err
+		}
+	}
+	if t != nil && r.Target != *t {
+		if *t, err = s.checkPath(r.Target); err != nil {
+			return id, err
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,185 @@
+package sftp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestMiddleware(t *testing.T) {
+	fs := mem.New()
+	for _, dir := range []string{"/real", "/other"} {
+		err := fs.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	errKeep := errors.New("keep")
+
+	var lock sync.Mutex
+	var order []string
+	var ops []*OpRecord
+	rewrite := MiddlewareFuncs{
+		BeforeFunc: func(s *Session, req *Request) error {
+			lock.Lock()
+			order = append(order, "rewrite")
+			lock.Unlock()
+			if strings.HasPrefix(req.Path, "/real/alias/") {
+				req.Path = "/real/" + strings.TrimPrefix(req.Path, "/real/alias/")
+			}
+			if req.Path == "/real/escape" {
+				req.Path = "/other"
+			}
+			return nil
+		},
+		AfterFunc: func(s *Session, op *OpRecord) {
+			lock.Lock()
+			ops = append(ops, op)
+			lock.Unlock()
+		},
+	}
+	deny := MiddlewareFuncs{
+		BeforeFunc: func(s *Session, req *Request) error {
+			lock.Lock()
+			order = append(order, "deny")
+			lock.Unlock()
+			if req.Op == "remove" {
+				return &os.PathError{Op: "remove", Path: req.Path, Err: os.ErrPermission}
+			}
+			if req.Op == "mkdir" {
+				return errKeep
+			}
+			return nil
+		},
+	}
+
+	server, client := net.Pipe()
+	opts := &Options{
+		Root:       "/real",
+		Middleware: []Middleware{rewrite, deny},
+		Logger:     LogFunc(func(string, ...interface{}) {}),
+	}
+	go Serve(opts, fs, server)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.OpenFile("/real/alias/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	_, err = fs.Stat("/real/a")
+	if err != nil {
+		t.Fatal("expected the rewritten path to be created")
+	}
+
+	err = c.Remove("/real/alias/a")
+	if !os.IsPermission(err) {
+		t.Fatalf("expected the remove to be denied, got %v", err)
+	}
+	_, err = fs.Stat("/real/a")
+	if err != nil {
+		t.Fatal("expected the denied remove to leave the file")
+	}
+	err = c.Mkdir("/real/b", 0755)
+	if err == nil {
+		t.Fatal("expected the mkdir to be denied")
+	}
+
+	_, err = c.Stat("/real/escape")
+	if err == nil || os.IsNotExist(err) {
+		t.Fatalf("expected the rewritten path to be checked against the root, got %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if order[0] != "rewrite" || order[1] != "deny" {
+		t.Fatalf("expected middleware to be called in order, got %v", order)
+	}
+	var removed *OpRecord
+	for _, op := range ops {
+		if op.Op == "remove" {
+			removed = op
+		}
+	}
+	if removed == nil || removed.Err == nil {
+		t.Fatal("expected the denied remove to be recorded with its error")
+	}
+}
+
+type testAuditLog struct {
+	lock sync.Mutex
+	ops  []*OpRecord
+}
+
+func (l *testAuditLog) Audit(session string, op *OpRecord) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.ops = append(l.ops, op)
+}
+
+func TestAuditPaths(t *testing.T) {
+	fs := mem.New()
+	err := fs.Mkdir("/real", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite := MiddlewareFuncs{
+		BeforeFunc: func(s *Session, req *Request) error {
+			if strings.HasPrefix(req.Target, "/real/alias/") {
+				req.Target = "/real/" + strings.TrimPrefix(req.Target, "/real/alias/")
+			}
+			return nil
+		},
+	}
+	audit := &testAuditLog{}
+	server, client := net.Pipe()
+	opts := &Options{
+		Root:       "/real",
+		HomeDir:    "/real",
+		Middleware: []Middleware{rewrite},
+		AuditLog:   audit,
+		Logger:     LogFunc(func(string, ...interface{}) {}),
+	}
+	done := make(chan struct{})
+	go func() {
+		Serve(opts, fs, server)
+		close(done)
+	}()
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Mkdir("sub/../b", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rename("b", "/real/alias/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records are audited once responses are sent.
+	_ = c.Close()
+	<-done
+
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	if len(audit.ops) != 2 {
+		t.Fatalf("expected 2 audit records, got %d", len(audit.ops))
+	}
+	if op := audit.ops[0]; op.Op != "mkdir" || op.Path != "/real/b" {
+		t.Fatalf("expected the normalized mkdir path, got %s %q", op.Op, op.Path)
+	}
+	if op := audit.ops[1]; op.Op != "rename" || op.Path != "/real/b" || op.Target != "/real/c" {
+		t.Fatalf("expected the normalized and rewritten rename paths, got %s %q %q", op.Op, op.Path, op.Target)
+	}
+}
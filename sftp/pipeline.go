@@ -0,0 +1,100 @@
+package sftp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// A readPipeline runs the reads of one file concurrently, up to depth
+// at once, sending their responses in the order the reads arrived.
+// Clients like OpenSSH sftp keep many reads of a file outstanding, so
+// backends doing a range request per read fetch them in parallel
+// instead of one after another.
+type readPipeline struct {
+	s *Session
+	h *handle
+	f vfs.File
+
+	// Reads not yet responded to, in the order they arrived.
+	queue chan *pipelinedRead
+	wg    sync.WaitGroup
+}
+
+type pipelinedRead struct {
+	req  *protosftp.FxpReadPacket
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+// Start responding to the reads of f, whose ReadAt must
+// allow concurrent calls.
+func (s *Session) newReadPipeline(h *handle, f vfs.File, depth int) *readPipeline {
+	p := &readPipeline{
+		s: s,
+		h: h,
+		f: f,
+		// The responder holds the oldest read as it waits for it.
+		queue: make(chan *pipelinedRead, depth-1),
+	}
+	go p.respond()
+	return p
+}
+
+// Start req, waiting while depth reads are in progress.
+func (p *readPipeline) start(req *protosftp.FxpReadPacket) {
+	r := &pipelinedRead{req: req, done: make(chan struct{})}
+	p.wg.Add(1)
+	p.queue <- r
+	go func() {
+		defer close(r.done)
+		r.buf, r.err = p.s.readFile(p.h, p.f, req)
+	}()
+}
+
+func (p *readPipeline) respond() {
+	for r := range p.queue {
+		<-r.done
+		p.s.respondRead(r.req.ID, r.buf, r.err)
+		p.wg.Done()
+	}
+}
+
+// Wait until every read started has been responded to.
+func (p *readPipeline) wait() {
+	p.wg.Wait()
+}
+
+// Wait for the reads started, then stop the responder.
+func (p *readPipeline) stop() {
+	p.wg.Wait()
+	close(p.queue)
+}
+
+// Read the data req asks for from f.
+func (s *Session) readFile(h *handle, f vfs.File, req *protosftp.FxpReadPacket) ([]byte, error) {
+	buf := make([]byte, req.Len, req.Len)
+	n, err := f.ReadAt(buf, int64(req.Offset))
+	atomic.AddInt64(&h.bytesRead, int64(n))
+	if werr := s.waitBandwidth(n); werr != nil && err == nil {
+		err = werr
+	}
+	return buf[:n], err
+}
+
+// Respond with the data read, or the error if there is none. Short
+// reads at the end of a file are answered with the data read.
+func (s *Session) respondRead(respId uint32, buf []byte, err error) {
+	if err != nil && len(buf) == 0 {
+		s.respondError(respId, err)
+		return
+	}
+	s.Respond(&protosftp.FxpDataPacket{
+		ID:     respId,
+		Length: uint32(len(buf)),
+		Data:   buf,
+	})
+}
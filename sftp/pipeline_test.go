@@ -0,0 +1,121 @@
+package sftp
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// Tracks the most reads of its files in progress at once.
+type slowReadFs struct {
+	*mem.Fs
+	lock     sync.Mutex
+	current  int
+	greatest int
+}
+
+func (fs *slowReadFs) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowReadFile{File: f, fs: fs}, nil
+}
+
+type slowReadFile struct {
+	vfs.File
+	fs *slowReadFs
+}
+
+func (f *slowReadFile) ReadAt(buf []byte, off int64) (int, error) {
+	f.fs.lock.Lock()
+	f.fs.current++
+	if f.fs.current > f.fs.greatest {
+		f.fs.greatest = f.fs.current
+	}
+	f.fs.lock.Unlock()
+	// Later reads finish first, their responses must still be
+	// sent after those of the reads before them.
+	time.Sleep(time.Duration(10-off/1000) * time.Millisecond)
+	f.fs.lock.Lock()
+	f.fs.current--
+	f.fs.lock.Unlock()
+	return f.File.ReadAt(buf, off)
+}
+
+func TestReadPipeline(t *testing.T) {
+	fs := &slowReadFs{Fs: mem.New()}
+	data := make([]byte, 8000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	w, err := fs.Fs.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+
+	server, client := net.Pipe()
+	opts := &Options{
+		ReadPipelineDepth: 4,
+		Logger:            LogFunc(func(string, ...interface{}) {}),
+	}
+	go Serve(opts, fs, server)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.OpenFile("/a", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	var wg sync.WaitGroup
+	for i := 0; i < len(data); i += 1000 {
+		wg.Add(1)
+		go func(off int) {
+			defer wg.Done()
+			_, err := f.ReadAt(got[off:off+1000], int64(off))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if !bytes.Equal(got, data) {
+		t.Fatal("read unexpected data")
+	}
+	if fs.greatest < 2 || fs.greatest > 4 {
+		t.Fatalf("expected 2 to 4 reads at once, got %d", fs.greatest)
+	}
+
+	// Writes wait for the reads before them.
+	_, err = f.WriteAt([]byte("xyz"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "xyz" {
+		t.Fatalf("expected to read what was written, got %q", buf)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
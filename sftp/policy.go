@@ -0,0 +1,179 @@
+package sftp
+
+import (
+	"errors"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+)
+
+var (
+	ErrOpNotAllowed = errors.New("operation not allowed")
+)
+
+// A Policy controls which operations clients may perform. Stat,
+// realpath and operations on already open handles are always allowed.
+// A nil policy allows everything.
+type Policy struct {
+	// Open files for reading and list directories.
+	AllowRead bool
+	// Create files, open files for writing, and create links.
+	AllowWrite   bool
+	AllowDelete  bool
+	AllowRename  bool
+	AllowMkdir   bool
+	AllowSetstat bool
+}
+
+// A policy allowing every operation.
+func AllowAllPolicy() *Policy {
+	return &Policy{
+		AllowRead:    true,
+		AllowWrite:   true,
+		AllowDelete:  true,
+		AllowRename:  true,
+		AllowMkdir:   true,
+		AllowSetstat: true,
+	}
+}
+
+func (s *Session) policy() *Policy {
+	if s.Options.Policy == nil {
+		return AllowAllPolicy()
+	}
+	return s.Options.Policy
+}
+
+func (s *Session) checkAllowed(allowed bool) error {
+	if !allowed {
+		return ErrOpNotAllowed
+	}
+	return nil
+}
+
+// Report if an open with pflags gives a readable handle, handleOpen
+// opens anything without FXF_WRITE for reading.
+func openReads(pflags uint32) bool {
+	return pflags&protosftp.FXF_READ != 0 || pflags&protosftp.FXF_WRITE == 0
+}
+
+// Check req is allowed by the session policy, on failure it returns
+// the id to respond to and the error.
+//
+// Extended requests must check the policy themselves.
+func (s *Session) checkPolicy(req protosftp.Packet) (uint32, error) {
+	p := s.policy()
+	switch req := req.(type) {
+	case *protosftp.FxpOpenPacket:
+		if openReads(req.Pflags) && !p.AllowRead {
+			return req.ID, ErrOpNotAllowed
+		}
+		writeFlags := uint32(protosftp.FXF_WRITE | protosftp.FXF_CREAT | protosftp.FXF_TRUNC | protosftp.FXF_APPEND)
+		if req.Pflags&writeFlags != 0 && !p.AllowWrite {
+			return req.ID, ErrOpNotAllowed
+		}
+	case *protosftp.FxpOpendirPacket:
+		return req.ID, s.checkAllowed(p.AllowRead)
+	case *protosftp.FxpRemovePacket:
+		return req.ID, s.checkAllowed(p.AllowDelete)
+	case *protosftp.FxpRmdirPacket:
+		return req.ID, s.checkAllowed(p.AllowDelete)
+	case *protosftp.FxpRenamePacket:
+		return req.ID, s.checkAllowed(p.AllowRename)
+	case *protosftp.FxpMkdirPacket:
+		return req.ID, s.checkAllowed(p.AllowMkdir)
+	case *protosftp.FxpSetStatPacket:
+		return req.ID, s.checkAllowed(p.AllowSetstat)
+	case *protosftp.FxpFSetStatPacket:
+		return req.ID, s.checkAllowed(p.AllowSetstat)
+	case *protosftp.FxpSymlinkPacket:
+		return req.ID, s.checkAllowed(p.AllowWrite)
+	}
+	return 0, nil
+}
+
+// Check the client may perform op on p with Options.Authorize.
+func (s *Session) authorize(op string, p string) error {
+	if s.Options.Authorize == nil {
+		return nil
+	}
+	return s.Options.Authorize(op, p, s)
+}
+
+// Check every path req operates on with Options.Authorize, on failure
+// it returns the id to respond to and the error. Requests on handles
+// are checked against the path the handle was opened with.
+//
+// Extended requests must authorize themselves.
+func (s *Session) authorizeRequest(req protosftp.Packet) (uint32, error) {
+	if s.Options.Authorize == nil {
+		return 0, nil
+	}
+	var id uint32
+	var op, handle string
+	var paths []string
+	switch req := req.(type) {
+	case *protosftp.FxpOpenPacket:
+		// Opens are checked as the reads and writes they allow.
+		if openReads(req.Pflags) {
+			if err := s.authorize("read", req.Path); err != nil {
+				return req.ID, err
+			}
+		}
+		writeFlags := uint32(protosftp.FXF_WRITE | protosftp.FXF_CREAT | protosftp.FXF_TRUNC | protosftp.FXF_APPEND)
+		if req.Pflags&writeFlags != 0 {
+			if err := s.authorize("write", req.Path); err != nil {
+				return req.ID, err
+			}
+		}
+		return 0, nil
+	case *protosftp.FxpOpendirPacket:
+		id, op, paths = req.ID, "opendir", []string{req.Path}
+	case *protosftp.FxpStatPacket:
+		id, op, paths = req.ID, "stat", []string{req.Path}
+	case *protosftp.FxpLstatPacket:
+		id, op, paths = req.ID, "lstat", []string{req.Path}
+	case *protosftp.FxpSetStatPacket:
+		id, op, paths = req.ID, "setstat", []string{req.Path}
+	case *protosftp.FxpMkdirPacket:
+		id, op, paths = req.ID, "mkdir", []string{req.Path}
+	case *protosftp.FxpRmdirPacket:
+		id, op, paths = req.ID, "rmdir", []string{req.Path}
+	case *protosftp.FxpRemovePacket:
+		id, op, paths = req.ID, "remove", []string{req.Filename}
+	case *protosftp.FxpReadlinkPacket:
+		id, op, paths = req.ID, "readlink", []string{req.Path}
+	case *protosftp.FxpRealpathPacket:
+		id, op, paths = req.ID, "realpath", []string{s.clampPath(req.Path)}
+	case *protosftp.FxpRenamePacket:
+		id, op, paths = req.ID, "rename", []string{req.Oldpath, req.Newpath}
+	case *protosftp.FxpSymlinkPacket:
+		id, op, paths = req.ID, "symlink", []string{req.Targetpath, req.Linkpath}
+	case *protosftp.FxpReadPacket:
+		id, op, handle = req.ID, "read", req.Handle
+	case *protosftp.FxpWritePacket:
+		id, op, handle = req.ID, "write", req.Handle
+	case *protosftp.FxpReaddirPacket:
+		id, op, handle = req.ID, "readdir", req.Handle
+	case *protosftp.FxpFstatPacket:
+		id, op, handle = req.ID, "fstat", req.Handle
+	case *protosftp.FxpFSetStatPacket:
+		id, op, handle = req.ID, "fsetstat", req.Handle
+	default:
+		// Closing is always allowed, so files are not left open.
+		return 0, nil
+	}
+	if handle != "" {
+		h, ok := s.handles.get(handle)
+		if !ok {
+			// Left for the handler to report.
+			return 0, nil
+		}
+		paths = []string{h.Path}
+	}
+	for _, p := range paths {
+		if err := s.authorize(op, p); err != nil {
+			return id, err
+		}
+	}
+	return 0, nil
+}
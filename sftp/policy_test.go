@@ -0,0 +1,158 @@
+package sftp
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestAuthorize(t *testing.T) {
+	fs := mem.New()
+	for _, dir := range []string{"/pub", "/incoming"} {
+		err := fs.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"/pub/a", "/secret"} {
+		w, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = w.Close()
+	}
+
+	// Anyone may read /pub, but only write to /incoming.
+	authorize := func(op string, p string, s *Session) error {
+		switch op {
+		case "read", "opendir", "readdir", "stat", "lstat", "fstat", "realpath":
+			if p == "/" || strings.HasPrefix(p, "/pub") || strings.HasPrefix(p, "/incoming") {
+				return nil
+			}
+		case "write", "fsetstat", "setstat", "mkdir", "remove", "rename":
+			if strings.HasPrefix(p, "/incoming/") {
+				return nil
+			}
+		}
+		return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+	}
+
+	server, client := net.Pipe()
+	opts := &Options{
+		Authorize: authorize,
+		Logger:    LogFunc(func(string, ...interface{}) {}),
+	}
+	go Serve(opts, fs, server)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.OpenFile("/pub/a", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	_, err = c.OpenFile("/pub/a", os.O_RDWR, 0)
+	if !os.IsPermission(err) {
+		t.Fatalf("expected writing /pub to be denied, got %v", err)
+	}
+	// Opens without FXF_READ or FXF_WRITE are still reads.
+	_, err = c.requestHandle(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpOpenPacket{ID: id, Path: "/secret", Pflags: 0}
+	})
+	if !os.IsPermission(err) {
+		t.Fatalf("expected reading outside the allowed directories to be denied, got %v", err)
+	}
+	_, err = c.OpenFile("/pub/b", os.O_WRONLY|os.O_CREATE, 0644)
+	if !os.IsPermission(err) {
+		t.Fatalf("expected creating files in /pub to be denied, got %v", err)
+	}
+
+	f, err = c.OpenFile("/incoming/b", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Rename("/incoming/b", "/pub/b")
+	if !os.IsPermission(err) {
+		t.Fatalf("expected renaming into /pub to be denied, got %v", err)
+	}
+	err = c.Rename("/incoming/b", "/incoming/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Remove("/pub/a")
+	if !os.IsPermission(err) {
+		t.Fatalf("expected removing from /pub to be denied, got %v", err)
+	}
+	_, err = c.Stat("/etc")
+	if !os.IsPermission(err) {
+		t.Fatalf("expected stat outside the allowed directories to be denied, got %v", err)
+	}
+}
+
+func TestPolicyDenyRead(t *testing.T) {
+	fs := mem.New()
+	w, err := fs.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+
+	server, client := net.Pipe()
+	opts := &Options{
+		Policy: &Policy{AllowWrite: true},
+		Logger: LogFunc(func(string, ...interface{}) {}),
+	}
+	go Serve(opts, fs, server)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Opens without FXF_WRITE are opened for reading.
+	for _, pflags := range []uint32{
+		protosftp.FXF_READ,
+		0,
+		protosftp.FXF_CREAT,
+		protosftp.FXF_EXCL,
+	} {
+		handle, err := c.requestHandle(func(id uint32) protosftp.Packet {
+			return &protosftp.FxpOpenPacket{ID: id, Path: "/a", Pflags: pflags}
+		})
+		if err == nil {
+			resp, _ := c.request(func(id uint32) protosftp.Packet {
+				return &protosftp.FxpReadPacket{ID: id, Handle: handle, Len: 6}
+			})
+			t.Fatalf("pflags %#x: expected the open to be denied, read %v", pflags, resp)
+		}
+		if !os.IsPermission(err) {
+			t.Fatalf("pflags %#x: expected permission denied, got %v", pflags, err)
+		}
+	}
+
+	f, err := c.OpenFile("/b", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+}
@@ -0,0 +1,129 @@
+//go:build go1.18
+// +build go1.18
+
+package protosftp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Every packet that can be unmarshaled, whether received by
+// the server or by the client.
+func fuzzPackets() []Packet {
+	return []Packet{
+		&FxpInitPacket{},
+		&FxVersionPacket{},
+		&FxpReaddirPacket{},
+		&FxpOpendirPacket{},
+		&FxpLstatPacket{},
+		&FxpStatPacket{},
+		&FxpFstatPacket{},
+		&FxpStatResponse{},
+		&FxpClosePacket{},
+		&FxpRemovePacket{},
+		&FxpRmdirPacket{},
+		&FxpSymlinkPacket{},
+		&FxpReadlinkPacket{},
+		&FxpRealpathPacket{},
+		&FxpNamePacket{},
+		&FxpOpenPacket{},
+		&FxpReadPacket{},
+		&FxpRenamePacket{},
+		&FxpWritePacket{},
+		&FxpExtendedPacket{},
+		&FxpExtendedReplyPacket{},
+		&FxpExtendedHardlinkPacket{},
+		&FxpExtendedFsyncPacket{},
+		&FxpExtendedExpandPathPacket{},
+		&FxpExtendedCheckFilePacket{},
+		&FxpExtendedCheckFileReply{},
+		&FxpExtendedLimitsReply{},
+		&FxpExtendedVendorID{},
+		&FxpMkdirPacket{},
+		&FxpSetStatPacket{},
+		&FxpFSetStatPacket{},
+		&FxpHandlePacket{},
+		&FxpStatusPacket{},
+		&FxpDataPacket{},
+	}
+}
+
+// Add p, as sent on the wire, to the corpus of f.
+func addPacket(f *testing.F, p Packet) {
+	var buf bytes.Buffer
+	err := WritePacket(&buf, p)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+}
+
+func addSeeds(f *testing.F) {
+	stat := FileStat{
+		Flags: FILEXFER_ATTR_SIZE | FILEXFER_ATTR_PERMISSIONS | FILEXFER_ATTR_ACMODTIME | FILEXFER_ATTR_EXTENDED,
+		Size:  100,
+		Mode:  S_IFREG | 0644,
+	}
+	addPacket(f, &FxpInitPacket{Version: 3, Extensions: []extensionPair{{"a", "b"}}})
+	addPacket(f, &FxpOpenPacket{ID: 1, Path: "/a", Pflags: FXF_READ, Attrs: stat})
+	addPacket(f, &FxpReadPacket{ID: 2, Handle: "1", Offset: 10, Len: 100})
+	addPacket(f, &FxpWritePacket{ID: 3, Handle: "1", Length: 3, Data: []byte("abc")})
+	addPacket(f, &FxpRenamePacket{ID: 4, Oldpath: "/a", Newpath: "/b"})
+	addPacket(f, &FxpSetStatPacket{ID: 5, Path: "/a", Attrs: stat})
+	addPacket(f, &FxpExtendedPacket{ID: 6, ExtendedRequest: "hardlink@openssh.com", Data: []byte("\x00\x00\x00\x01a\x00\x00\x00\x01b")})
+	addPacket(f, &FxpNamePacket{ID: 7, NameAttrs: []FxpNameAttr{{Name: "a", LongName: "a", Attrs: stat}}})
+	addPacket(f, &FxpDataPacket{ID: 8, Length: 3, Data: []byte("abc")})
+	addPacket(f, &FxpStatusPacket{ID: 9, StatusError: StatusError{Code: FX_FAILURE, Msg: "failed"}})
+	f.Add([]byte{0, 0, 0, 5, FXP_DATA, 0, 0, 0, 1})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+}
+
+func FuzzReadPacket(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			pkt, err := ReadPacket(r)
+			if err != nil {
+				break
+			}
+			_, err = pkt.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		r = bytes.NewReader(data)
+		for {
+			pkt, err := ReadResponsePacket(r)
+			if err != nil {
+				break
+			}
+			_, err = pkt.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Skip the length and type the seeds start with,
+		// so the rest of them is a packet body.
+		if len(data) > 5 {
+			data = data[5:]
+		}
+		for _, p := range fuzzPackets() {
+			if p.UnmarshalBinary(data) != nil {
+				continue
+			}
+			// Anything accepted must be sent back without panicking.
+			_, err := p.MarshalBinary()
+			if err != nil {
+				t.Fatalf("%T: %s", p, err)
+			}
+		}
+	})
+}
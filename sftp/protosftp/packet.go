@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"reflect"
 )
 
 type Packet interface {
@@ -36,7 +35,51 @@ func WritePacket(w io.Writer, m Packet) error {
 	return nil
 }
 
+// The largest packets read by default, counting everything after
+// the length. Larger packets are refused without reading them.
+const DefaultMaxPacketLength = 1024 * 1024
+
+// Packets longer than this are read in pieces, so a client
+// can't make the reader allocate a large buffer by sending
+// a length alone.
+const packetReadChunk = 64 * 1024
+
+var zeroChunk [packetReadChunk]byte
+
+// Read the l bytes of a packet following its length, growing
+// the buffer as they arrive.
+func readPacketBody(r io.Reader, l uint32) ([]byte, error) {
+	if l <= packetReadChunk {
+		b := make([]byte, l)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	b := make([]byte, 0, packetReadChunk)
+	for uint32(len(b)) < l {
+		n := l - uint32(len(b))
+		if n > packetReadChunk {
+			n = packetReadChunk
+		}
+		b = append(b, zeroChunk[:n]...)
+		if _, err := io.ReadFull(r, b[len(b)-int(n):]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
 func ReadPacket(r io.Reader) (Packet, error) {
+	return ReadPacketMax(r, DefaultMaxPacketLength)
+}
+
+// Read a request like ReadPacket, refusing packets
+// longer than maxLength.
+func ReadPacketMax(r io.Reader, maxLength uint32) (Packet, error) {
 	var b = []byte{0, 0, 0, 0}
 	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, err
@@ -46,7 +89,7 @@ func ReadPacket(r io.Reader) (Packet, error) {
 
 	l, _ := unmarshalUint32(b)
 
-	if l > 1024*1024 {
+	if l > maxLength {
 		return nil, errors.New("packet too large")
 	}
 
@@ -54,8 +97,8 @@ func ReadPacket(r io.Reader) (Packet, error) {
 		return nil, errors.New("packet too small")
 	}
 
-	b = make([]byte, l)
-	if _, err := io.ReadFull(r, b); err != nil {
+	b, err := readPacketBody(r, l)
+	if err != nil {
 		return nil, err
 	}
 
@@ -100,6 +143,60 @@ func ReadPacket(r io.Reader) (Packet, error) {
 		pkt = &FxpReadlinkPacket{}
 	case FXP_SYMLINK:
 		pkt = &FxpSymlinkPacket{}
+	case FXP_EXTENDED:
+		pkt = &FxpExtendedPacket{}
+	default:
+		return nil, fmt.Errorf("unhandled packet type: %s", pktType)
+	}
+
+	if err := pkt.UnmarshalBinary(b[1:]); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+// Read a server response, the client side counterpart of ReadPacket.
+func ReadResponsePacket(r io.Reader) (Packet, error) {
+	var b = []byte{0, 0, 0, 0}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	var pkt Packet
+
+	l, _ := unmarshalUint32(b)
+
+	if l > DefaultMaxPacketLength {
+		return nil, errors.New("packet too large")
+	}
+
+	if l <= 1 {
+		return nil, errors.New("packet too small")
+	}
+
+	b, err := readPacketBody(r, l)
+	if err != nil {
+		return nil, err
+	}
+
+	pktType := fxp(b[0])
+
+	switch pktType {
+	case FXP_VERSION:
+		pkt = &FxVersionPacket{}
+	case FXP_STATUS:
+		pkt = &FxpStatusPacket{}
+	case FXP_HANDLE:
+		pkt = &FxpHandlePacket{}
+	case FXP_DATA:
+		pkt = &FxpDataPacket{}
+	case FXP_NAME:
+		pkt = &FxpNamePacket{}
+	case FXP_ATTRS:
+		pkt = &FxpStatResponse{}
+	case FXP_EXTENDED_REPLY:
+		pkt = &FxpExtendedReplyPacket{}
 	default:
 		return nil, fmt.Errorf("unhandled packet type: %s", pktType)
 	}
@@ -130,37 +227,6 @@ func marshalStatus(b []byte, err StatusError) []byte {
 	return b
 }
 
-func marshal(b []byte, v interface{}) []byte {
-	if v == nil {
-		return b
-	}
-	switch v := v.(type) {
-	case uint8:
-		return append(b, v)
-	case uint32:
-		return marshalUint32(b, v)
-	case uint64:
-		return marshalUint64(b, v)
-	case string:
-		return marshalString(b, v)
-	default:
-		switch d := reflect.ValueOf(v); d.Kind() {
-		case reflect.Struct:
-			for i, n := 0, d.NumField(); i < n; i++ {
-				b = append(marshal(b, d.Field(i).Interface()))
-			}
-			return b
-		case reflect.Slice:
-			for i, n := 0, d.Len(); i < n; i++ {
-				b = append(marshal(b, d.Index(i).Interface()))
-			}
-			return b
-		default:
-			panic(fmt.Sprintf("marshal(%#v): cannot handle type %T", v, v))
-		}
-	}
-}
-
 func unmarshalUint32(b []byte) (uint32, []byte) {
 	v := uint32(b[3]) | uint32(b[2])<<8 | uint32(b[1])<<16 | uint32(b[0])<<24
 	return v, b[4:]
@@ -285,8 +351,20 @@ func (p FxVersionPacket) MarshalBinary() ([]byte, error) {
 	return b, nil
 }
 
-func (p FxVersionPacket) UnmarshalBinary(b []byte) error {
-	return errors.New("XXX: unimplemented")
+func (p *FxVersionPacket) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.Version, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		var ep extensionPair
+		ep, b, err = unmarshalExtensionPair(b)
+		if err != nil {
+			return err
+		}
+		p.Extensions = append(p.Extensions, struct{ Name, Data string }{ep.Name, ep.Data})
+	}
+	return nil
 }
 
 func marshalIDString(packetType byte, id uint32, str string) ([]byte, error) {
@@ -381,14 +459,23 @@ type FxpStatResponse struct {
 }
 
 func (p FxpStatResponse) MarshalBinary() ([]byte, error) {
-	b := []byte{FXP_ATTRS}
+	l := 1 + 4 +
+		fileStatLen(&p.Info)
+
+	b := make([]byte, 0, l)
+	b = append(b, FXP_ATTRS)
 	b = marshalUint32(b, p.ID)
 	b = marshalFileStat(b, &p.Info)
 	return b, nil
 }
 
-func (p FxpStatResponse) UnmarshalBinary(b []byte) error {
-	return errors.New("unimplemented")
+func (p *FxpStatResponse) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	}
+	_, err = unmarshalFileStatSafe(b, &p.Info)
+	return err
 }
 
 type FxpClosePacket struct {
@@ -496,11 +583,22 @@ type FxpNameAttr struct {
 var EmptyFileStat = FileStat{}
 
 func (p FxpNameAttr) MarshalBinary() ([]byte, error) {
-	b := []byte{}
+	b := make([]byte, 0, nameAttrLen(&p))
+	b = marshalNameAttr(b, &p)
+	return b, nil
+}
+
+func nameAttrLen(p *FxpNameAttr) int {
+	return 4 + len(p.Name) +
+		4 + len(p.LongName) +
+		fileStatLen(&p.Attrs)
+}
+
+func marshalNameAttr(b []byte, p *FxpNameAttr) []byte {
 	b = marshalString(b, p.Name)
 	b = marshalString(b, p.LongName)
 	b = marshalFileStat(b, &p.Attrs)
-	return b, nil
+	return b
 }
 
 type FxpNamePacket struct {
@@ -509,23 +607,45 @@ type FxpNamePacket struct {
 }
 
 func (p FxpNamePacket) MarshalBinary() ([]byte, error) {
-	b := []byte{}
+	l := 1 + 4 + 4
+	for i := range p.NameAttrs {
+		l += nameAttrLen(&p.NameAttrs[i])
+	}
+
+	b := make([]byte, 0, l)
 	b = append(b, FXP_NAME)
 	b = marshalUint32(b, p.ID)
 	b = marshalUint32(b, uint32(len(p.NameAttrs)))
-	for _, na := range p.NameAttrs {
-		ab, err := na.MarshalBinary()
-		if err != nil {
-			return nil, err
-		}
-
-		b = append(b, ab...)
+	for i := range p.NameAttrs {
+		b = marshalNameAttr(b, &p.NameAttrs[i])
 	}
 	return b, nil
 }
 
-func (p FxpNamePacket) UnmarshalBinary(b []byte) error {
-	return errors.New("unimplemented XXX")
+func (p *FxpNamePacket) UnmarshalBinary(b []byte) error {
+	var err error
+	var count uint32
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if count, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	}
+	// Each entry is at least 12 bytes, don't trust count for allocation.
+	if uint64(count)*12 > uint64(len(b)) {
+		return errShortPacket
+	}
+	p.NameAttrs = make([]FxpNameAttr, count)
+	for i := range p.NameAttrs {
+		na := &p.NameAttrs[i]
+		if na.Name, b, err = unmarshalStringSafe(b); err != nil {
+			return err
+		} else if na.LongName, b, err = unmarshalStringSafe(b); err != nil {
+			return err
+		} else if b, err = unmarshalFileStatSafe(b, &na.Attrs); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type FxpOpenPacket struct {
@@ -663,7 +783,7 @@ func (p *FxpWritePacket) UnmarshalBinary(b []byte) error {
 		return err
 	} else if p.Length, b, err = unmarshalUint32Safe(b); err != nil {
 		return err
-	} else if uint32(len(b)) < p.Length {
+	} else if uint64(len(b)) < uint64(p.Length) {
 		return errShortPacket
 	}
 
@@ -671,6 +791,278 @@ func (p *FxpWritePacket) UnmarshalBinary(b []byte) error {
 	return nil
 }
 
+type FxpExtendedPacket struct {
+	ID              uint32
+	ExtendedRequest string
+	Data            []byte
+}
+
+func (p FxpExtendedPacket) MarshalBinary() ([]byte, error) {
+	l := 1 + 4 +
+		4 + len(p.ExtendedRequest) +
+		len(p.Data)
+
+	b := make([]byte, 0, l)
+	b = append(b, FXP_EXTENDED)
+	b = marshalUint32(b, p.ID)
+	b = marshalString(b, p.ExtendedRequest)
+	b = append(b, p.Data...)
+	return b, nil
+}
+
+func (p *FxpExtendedPacket) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.ExtendedRequest, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+
+	p.Data = append([]byte{}, b...)
+	return nil
+}
+
+type FxpExtendedReplyPacket struct {
+	ID   uint32
+	Data []byte
+}
+
+func (p FxpExtendedReplyPacket) MarshalBinary() ([]byte, error) {
+	l := 1 + 4 +
+		len(p.Data)
+
+	b := make([]byte, 0, l)
+	b = append(b, FXP_EXTENDED_REPLY)
+	b = marshalUint32(b, p.ID)
+	b = append(b, p.Data...)
+	return b, nil
+}
+
+func (p *FxpExtendedReplyPacket) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	}
+
+	p.Data = append([]byte{}, b...)
+	return nil
+}
+
+// The request specific data of a hardlink@openssh.com
+// extended request, found in FxpExtendedPacket.Data.
+type FxpExtendedHardlinkPacket struct {
+	Oldpath string
+	Newpath string
+}
+
+func (p FxpExtendedHardlinkPacket) MarshalBinary() ([]byte, error) {
+	l := 4 + len(p.Oldpath) +
+		4 + len(p.Newpath)
+
+	b := make([]byte, 0, l)
+	b = marshalString(b, p.Oldpath)
+	b = marshalString(b, p.Newpath)
+	return b, nil
+}
+
+func (p *FxpExtendedHardlinkPacket) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.Oldpath, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.Newpath, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The request specific data of a fsync@openssh.com
+// extended request, found in FxpExtendedPacket.Data.
+type FxpExtendedFsyncPacket struct {
+	Handle string
+}
+
+func (p FxpExtendedFsyncPacket) MarshalBinary() ([]byte, error) {
+	l := 4 + len(p.Handle)
+
+	b := make([]byte, 0, l)
+	b = marshalString(b, p.Handle)
+	return b, nil
+}
+
+func (p *FxpExtendedFsyncPacket) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.Handle, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The request specific data of an expand-path@openssh.com
+// extended request, found in FxpExtendedPacket.Data.
+type FxpExtendedExpandPathPacket struct {
+	Path string
+}
+
+func (p FxpExtendedExpandPathPacket) MarshalBinary() ([]byte, error) {
+	l := 4 + len(p.Path)
+
+	b := make([]byte, 0, l)
+	b = marshalString(b, p.Path)
+	return b, nil
+}
+
+func (p *FxpExtendedExpandPathPacket) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.Path, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The request specific data of a check-file-name or
+// check-file-handle extended request, found in FxpExtendedPacket.Data.
+// Name is the file name or handle depending on the request.
+type FxpExtendedCheckFilePacket struct {
+	Name           string
+	HashAlgorithms string
+	StartOffset    uint64
+	Length         uint64
+	BlockSize      uint32
+}
+
+func (p FxpExtendedCheckFilePacket) MarshalBinary() ([]byte, error) {
+	l := 4 + len(p.Name) +
+		4 + len(p.HashAlgorithms) +
+		8 + 8 + 4
+
+	b := make([]byte, 0, l)
+	b = marshalString(b, p.Name)
+	b = marshalString(b, p.HashAlgorithms)
+	b = marshalUint64(b, p.StartOffset)
+	b = marshalUint64(b, p.Length)
+	b = marshalUint32(b, p.BlockSize)
+	return b, nil
+}
+
+func (p *FxpExtendedCheckFilePacket) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.Name, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.HashAlgorithms, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.StartOffset, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.Length, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.BlockSize, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The reply specific data of a check-file-name or check-file-handle
+// request, sent as FxpExtendedReplyPacket.Data.
+type FxpExtendedCheckFileReply struct {
+	HashAlgorithm string
+	Hash          []byte
+}
+
+func (p FxpExtendedCheckFileReply) MarshalBinary() ([]byte, error) {
+	l := 4 + len("check-file") +
+		4 + len(p.HashAlgorithm) +
+		len(p.Hash)
+
+	b := make([]byte, 0, l)
+	b = marshalString(b, "check-file")
+	b = marshalString(b, p.HashAlgorithm)
+	b = append(b, p.Hash...)
+	return b, nil
+}
+
+func (p *FxpExtendedCheckFileReply) UnmarshalBinary(b []byte) error {
+	var err error
+	var name string
+	if name, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if name != "check-file" {
+		return errUnknownExtendedPacket
+	} else if p.HashAlgorithm, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+
+	p.Hash = append([]byte{}, b...)
+	return nil
+}
+
+// The reply specific data of a limits@openssh.com request, sent as
+// FxpExtendedReplyPacket.Data. Zero means a limit is unknown, or
+// for MaxOpenHandles that there is none.
+type FxpExtendedLimitsReply struct {
+	MaxPacketLength uint64
+	MaxReadLength   uint64
+	MaxWriteLength  uint64
+	MaxOpenHandles  uint64
+}
+
+func (p FxpExtendedLimitsReply) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 4*8)
+	b = marshalUint64(b, p.MaxPacketLength)
+	b = marshalUint64(b, p.MaxReadLength)
+	b = marshalUint64(b, p.MaxWriteLength)
+	b = marshalUint64(b, p.MaxOpenHandles)
+	return b, nil
+}
+
+func (p *FxpExtendedLimitsReply) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.MaxPacketLength, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.MaxReadLength, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.MaxWriteLength, b, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	} else if p.MaxOpenHandles, _, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The data of the vendor-id extension advertised in FXP_VERSION.
+type FxpExtendedVendorID struct {
+	VendorName         string
+	ProductName        string
+	ProductVersion     string
+	ProductBuildNumber uint64
+}
+
+func (p FxpExtendedVendorID) MarshalBinary() ([]byte, error) {
+	l := 4 + len(p.VendorName) +
+		4 + len(p.ProductName) +
+		4 + len(p.ProductVersion) +
+		8
+
+	b := make([]byte, 0, l)
+	b = marshalString(b, p.VendorName)
+	b = marshalString(b, p.ProductName)
+	b = marshalString(b, p.ProductVersion)
+	b = marshalUint64(b, p.ProductBuildNumber)
+	return b, nil
+}
+
+func (p *FxpExtendedVendorID) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.VendorName, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.ProductName, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.ProductVersion, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	} else if p.ProductBuildNumber, _, err = unmarshalUint64Safe(b); err != nil {
+		return err
+	}
+	return nil
+}
+
 type FxpMkdirPacket struct {
 	ID    uint32
 	Path  string
@@ -770,14 +1162,11 @@ type FxpHandlePacket struct {
 }
 
 func (p FxpHandlePacket) MarshalBinary() ([]byte, error) {
-	b := []byte{FXP_HANDLE}
-	b = marshalUint32(b, p.ID)
-	b = marshalString(b, p.Handle)
-	return b, nil
+	return marshalIDString(FXP_HANDLE, p.ID, p.Handle)
 }
 
 func (p *FxpHandlePacket) UnmarshalBinary(b []byte) error {
-	return errors.New("unimplemented")
+	return unmarshalIDString(b, &p.ID, &p.Handle)
 }
 
 type FxpStatusPacket struct {
@@ -786,14 +1175,37 @@ type FxpStatusPacket struct {
 }
 
 func (p FxpStatusPacket) MarshalBinary() ([]byte, error) {
-	b := []byte{FXP_STATUS}
+	l := 1 + 4 +
+		4 +
+		4 + len(p.StatusError.Msg) +
+		4 + len(p.StatusError.Lang)
+
+	b := make([]byte, 0, l)
+	b = append(b, FXP_STATUS)
 	b = marshalUint32(b, p.ID)
 	b = marshalStatus(b, p.StatusError)
 	return b, nil
 }
 
-func (p FxpStatusPacket) UnmarshalBinary(b []byte) error {
-	return errors.New("unimplemented XXX")
+func (p *FxpStatusPacket) UnmarshalBinary(b []byte) error {
+	var err error
+	if p.ID, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	} else if p.StatusError.Code, b, err = unmarshalUint32Safe(b); err != nil {
+		return err
+	}
+	// Version 3 servers may omit the message and language tag.
+	if len(b) == 0 {
+		return nil
+	}
+	if p.StatusError.Msg, b, err = unmarshalStringSafe(b); err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	p.StatusError.Lang, _, err = unmarshalStringSafe(b)
+	return err
 }
 
 type FxpDataPacket struct {
@@ -803,7 +1215,11 @@ type FxpDataPacket struct {
 }
 
 func (p FxpDataPacket) MarshalBinary() ([]byte, error) {
-	b := []byte{FXP_DATA}
+	l := 1 + 4 +
+		4 + int(p.Length)
+
+	b := make([]byte, 0, l)
+	b = append(b, FXP_DATA)
 	b = marshalUint32(b, p.ID)
 	b = marshalUint32(b, p.Length)
 	b = append(b, p.Data[:p.Length]...)
@@ -816,12 +1232,11 @@ func (p *FxpDataPacket) UnmarshalBinary(b []byte) error {
 		return err
 	} else if p.Length, b, err = unmarshalUint32Safe(b); err != nil {
 		return err
-	} else if uint32(len(b)) < p.Length {
+	} else if uint64(len(b)) < uint64(p.Length) {
 		return errors.New("truncated packet")
 	}
 
-	p.Data = make([]byte, p.Length)
-	copy(p.Data, b)
+	p.Data = append([]byte{}, b[:p.Length]...)
 	return nil
 }
 
@@ -841,6 +1256,23 @@ type FileStat struct {
 	Extended []StatExtended
 }
 
+func fileStatLen(stat *FileStat) int {
+	l := 4
+	if stat.Flags&FILEXFER_ATTR_SIZE != 0 {
+		l += 8
+	}
+	if stat.Flags&FILEXFER_ATTR_UIDGID != 0 {
+		l += 4 + 4
+	}
+	if stat.Flags&FILEXFER_ATTR_PERMISSIONS != 0 {
+		l += 4
+	}
+	if stat.Flags&FILEXFER_ATTR_ACMODTIME != 0 {
+		l += 4 + 4
+	}
+	return l
+}
+
 func marshalFileStat(b []byte, stat *FileStat) []byte {
 
 	b = marshalUint32(b, stat.Flags)
@@ -869,6 +1301,12 @@ func unmarshalFileStatSafe(b []byte, stat *FileStat) ([]byte, error) {
 		return nil, err
 	}
 
+	if stat.Flags&FILEXFER_ATTR_SIZE != 0 {
+		if stat.Size, b, err = unmarshalUint64Safe(b); err != nil {
+			return nil, err
+		}
+	}
+
 	if stat.Flags&FILEXFER_ATTR_UIDGID != 0 {
 		if stat.UID, b, err = unmarshalUint32Safe(b); err != nil {
 			return nil, err
@@ -893,6 +1331,22 @@ func unmarshalFileStatSafe(b []byte, stat *FileStat) ([]byte, error) {
 		}
 	}
 
+	if stat.Flags&FILEXFER_ATTR_EXTENDED != 0 {
+		var count uint32
+		if count, b, err = unmarshalUint32Safe(b); err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < count; i++ {
+			var ext StatExtended
+			if ext.ExtType, b, err = unmarshalStringSafe(b); err != nil {
+				return nil, err
+			} else if ext.ExtData, b, err = unmarshalStringSafe(b); err != nil {
+				return nil, err
+			}
+			stat.Extended = append(stat.Extended, ext)
+		}
+	}
+
 	return b, nil
 }
 
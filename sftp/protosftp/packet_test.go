@@ -0,0 +1,144 @@
+package protosftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func benchmarkMarshal(b *testing.B, p Packet) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bb, err := p.MarshalBinary()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(bb)))
+	}
+}
+
+var benchFileStat = FileStat{
+	Flags: FILEXFER_ATTR_SIZE | FILEXFER_ATTR_PERMISSIONS | FILEXFER_ATTR_ACMODTIME,
+	Size:  12345,
+	Mode:  S_IFREG | 0644,
+	Atime: 1550000000,
+	Mtime: 1550000000,
+}
+
+func BenchmarkMarshalNamePacket(b *testing.B) {
+	p := &FxpNamePacket{ID: 1}
+	for i := 0; i < 64; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		p.NameAttrs = append(p.NameAttrs, FxpNameAttr{
+			Name:     name,
+			LongName: "-rw-r--r--    1 user     user        12345 Feb 12 19:33 " + name,
+			Attrs:    benchFileStat,
+		})
+	}
+	benchmarkMarshal(b, p)
+}
+
+func BenchmarkMarshalDataPacket(b *testing.B) {
+	data := make([]byte, 32*1024)
+	benchmarkMarshal(b, &FxpDataPacket{ID: 1, Length: uint32(len(data)), Data: data})
+}
+
+func BenchmarkMarshalStatusPacket(b *testing.B) {
+	benchmarkMarshal(b, MakeStatus(1, "no such file", FX_NO_SUCH_FILE))
+}
+
+func BenchmarkMarshalStatResponse(b *testing.B) {
+	benchmarkMarshal(b, &FxpStatResponse{ID: 1, Info: benchFileStat})
+}
+
+func BenchmarkMarshalHandlePacket(b *testing.B) {
+	benchmarkMarshal(b, &FxpHandlePacket{ID: 1, Handle: "12"})
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	packets := []Packet{
+		&FxVersionPacket{Version: 3, Extensions: []struct{ Name, Data string }{{"fsync@openssh.com", "1"}}},
+		MakeStatus(1, "no such file", FX_NO_SUCH_FILE),
+		&FxpHandlePacket{ID: 2, Handle: "12"},
+		&FxpDataPacket{ID: 3, Length: 5, Data: []byte("hello")},
+		&FxpNamePacket{ID: 4, NameAttrs: []FxpNameAttr{{Name: "a", LongName: "-rw-r--r-- a", Attrs: benchFileStat}}},
+		&FxpStatResponse{ID: 5, Info: benchFileStat},
+		&FxpExtendedReplyPacket{ID: 6, Data: []byte("reply")},
+	}
+	for _, p := range packets {
+		buf := &bytes.Buffer{}
+		err := WritePacket(buf, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadResponsePacket(buf)
+		if err != nil {
+			t.Fatalf("%T: %s", p, err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Fatalf("%T: got %+v, expected %+v", p, got, p)
+		}
+	}
+}
+
+func TestReadPacketMax(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := WritePacket(buf, &FxpStatPacket{ID: 1, Path: "/a/long/path"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	_, err = ReadPacketMax(bytes.NewReader(b), 10)
+	if err == nil {
+		t.Fatal("expected a packet longer than the limit to be refused")
+	}
+	p, err := ReadPacketMax(bytes.NewReader(b), uint32(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.(*FxpStatPacket).Path != "/a/long/path" {
+		t.Fatalf("unexpected packet %#v", p)
+	}
+
+	limits := FxpExtendedLimitsReply{MaxPacketLength: 1, MaxReadLength: 2, MaxWriteLength: 3, MaxOpenHandles: 4}
+	data, err := limits.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got FxpExtendedLimitsReply
+	err = got.UnmarshalBinary(data)
+	if err != nil || got != limits {
+		t.Fatalf("got %+v, %v, expected %+v", got, err, limits)
+	}
+}
+
+func TestReadLargePacket(t *testing.T) {
+	data := make([]byte, 3*packetReadChunk+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	buf := &bytes.Buffer{}
+	err := WritePacket(buf, &FxpWritePacket{ID: 1, Handle: "1", Length: uint32(len(data)), Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	p, err := ReadPacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.(*FxpWritePacket).Data, data) {
+		t.Fatal("read unexpected data")
+	}
+
+	// A packet cut short is an error, whether it ends
+	// in the first piece read or a later one.
+	for _, n := range []int{4, 100, 2*packetReadChunk + 1} {
+		_, err = ReadPacket(bytes.NewReader(b[:n]))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected a truncated packet to fail, got %v", err)
+		}
+	}
+}
@@ -107,6 +107,11 @@ const (
 
 type fxp uint8
 
+// The name of packet type t, such as "FXP_OPEN".
+func PacketTypeName(t uint8) string {
+	return fxp(t).String()
+}
+
 func (f fxp) String() string {
 	switch f {
 	case FXP_INIT:
@@ -0,0 +1,11 @@
+package sftp
+
+import (
+	"github.com/andrewchambers/sftpplease/extraio"
+)
+
+// Wait for n bytes from the session and shared limiters, failing
+// once the session ends.
+func (s *Session) waitBandwidth(n int) error {
+	return extraio.WaitAll(s.ctx, []*extraio.RateLimiter{s.rateLimiter, s.Options.SharedRateLimiter}, n)
+}
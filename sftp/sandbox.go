@@ -0,0 +1,114 @@
+package sftp
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+var (
+	ErrPathNotAllowed = errors.New("path not allowed")
+)
+
+func (s *Session) rootDir() string {
+	if s.Options.Root == "" {
+		return "/"
+	}
+	return path.Clean("/" + s.Options.Root)
+}
+
+func (s *Session) inRoot(p string) bool {
+	root := s.rootDir()
+	return root == "/" || p == root || strings.HasPrefix(p, root+"/")
+}
+
+// Normalize a path from the client, returning ErrPathNotAllowed
+// if it is outside of the session root.
+func (s *Session) checkPath(p string) (string, error) {
+	if strings.IndexByte(p, 0) != -1 {
+		return "", ErrPathNotAllowed
+	}
+	p = s.absPath(p)
+	if !s.inRoot(p) {
+		return "", ErrPathNotAllowed
+	}
+	return p, nil
+}
+
+// Like checkPath, but paths outside of the root are
+// clamped to the root, like '..' in a chroot.
+func (s *Session) clampPath(p string) string {
+	p = s.absPath(p)
+	if !s.inRoot(p) {
+		return s.rootDir()
+	}
+	return p
+}
+
+// Like clampPath, then resolved by the file system as vfs.RealPath
+// does. Paths are confined to the root as written, links leading
+// out of it resolve to their own path.
+func (s *Session) realPath(p string) (string, error) {
+	p = s.clampPath(p)
+	real, err := vfs.RealPath(s.fs, p)
+	if err != nil {
+		return "", err
+	}
+	if !s.inRoot(real) {
+		return p, nil
+	}
+	return real, nil
+}
+
+// Normalize and check every path in req before it reaches the VFS, on
+// failure it returns the id to respond to and the error.
+//
+// Extended requests must check their own paths.
+func (s *Session) sandboxPaths(req protosftp.Packet) (uint32, error) {
+	var err error
+	switch req := req.(type) {
+	case *protosftp.FxpOpenPacket:
+		req.Path, err = s.checkPath(req.Path)
+		return req.ID, err
+	case *protosftp.FxpOpendirPacket:
+		req.Path, err = s.checkPath(req.Path)
+		return req.ID, err
+	case *protosftp.FxpStatPacket:
+		req.Path, err = s.checkPath(req.Path)
+		return req.ID, err
+	case *protosftp.FxpLstatPacket:
+		req.Path, err = s.checkPath(req.Path)
+		return req.ID, err
+	case *protosftp.FxpSetStatPacket:
+		req.Path, err = s.checkPath(req.Path)
+		return req.ID, err
+	case *protosftp.FxpMkdirPacket:
+		req.Path, err = s.checkPath(req.Path)
+		return req.ID, err
+	case *protosftp.FxpRmdirPacket:
+		req.Path, err = s.checkPath(req.Path)
+		return req.ID, err
+	case *protosftp.FxpRemovePacket:
+		req.Filename, err = s.checkPath(req.Filename)
+		return req.ID, err
+	case *protosftp.FxpReadlinkPacket:
+		req.Path, err = s.checkPath(req.Path)
+		return req.ID, err
+	case *protosftp.FxpRenamePacket:
+		if req.Oldpath, err = s.checkPath(req.Oldpath); err != nil {
+			return req.ID, err
+		}
+		req.Newpath, err = s.checkPath(req.Newpath)
+		return req.ID, err
+	case *protosftp.FxpSymlinkPacket:
+		if req.Targetpath, err = s.checkPath(req.Targetpath); err != nil {
+			return req.ID, err
+		}
+		req.Linkpath, err = s.checkPath(req.Linkpath)
+		return req.ID, err
+	}
+	return 0, nil
+}
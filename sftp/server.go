@@ -0,0 +1,181 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+var ErrServerClosed = errors.New("sftp server closed")
+
+// A Server serves sftp sessions on the connections it is given,
+// keeping track of them so they can be shut down together.
+type Server struct {
+	// The file system every session serves.
+	FS vfs.VFS
+	// The options of every session, shared by them.
+	Options *Options
+	// If set, returns the options of the session served on conn
+	// instead, e.g. to give each session its own SessionID.
+	ConnOptions func(conn io.ReadWriteCloser) *Options
+
+	lock      sync.Mutex
+	closed    bool
+	done      chan struct{}
+	listeners map[net.Listener]struct{}
+	sessions  map[*Session]struct{}
+	wg        sync.WaitGroup
+}
+
+func (srv *Server) init() {
+	if srv.done == nil {
+		srv.done = make(chan struct{})
+		srv.listeners = make(map[net.Listener]struct{})
+		srv.sessions = make(map[*Session]struct{})
+	}
+}
+
+// Accept connections on l, serving a session on each, until
+// accepting fails or the server is shut down, returning
+// ErrServerClosed once it is. l is closed on return.
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	srv.lock.Lock()
+	srv.init()
+	if srv.closed {
+		srv.lock.Unlock()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = struct{}{}
+	srv.lock.Unlock()
+
+	defer func() {
+		srv.lock.Lock()
+		delete(srv.listeners, l)
+		srv.lock.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go func() {
+			_ = srv.ServeConn(conn)
+		}()
+	}
+}
+
+// Serve a session on each connection received from conns, until
+// conns is closed or the server is shut down, returning
+// ErrServerClosed once it is.
+func (srv *Server) ServeConns(conns <-chan io.ReadWriteCloser) error {
+	srv.lock.Lock()
+	srv.init()
+	done := srv.done
+	srv.lock.Unlock()
+
+	for {
+		select {
+		case <-done:
+			return ErrServerClosed
+		case conn, ok := <-conns:
+			if !ok {
+				return nil
+			}
+			go func() {
+				_ = srv.ServeConn(conn)
+			}()
+		}
+	}
+}
+
+// Serve a session on conn, returning once it ends with the
+// error Session.Serve returns. conn is closed on return.
+func (srv *Server) ServeConn(conn io.ReadWriteCloser) error {
+	opt := srv.Options
+	if srv.ConnOptions != nil {
+		opt = srv.ConnOptions(conn)
+	}
+	s := NewSession(opt, srv.FS, conn)
+
+	srv.lock.Lock()
+	srv.init()
+	if srv.closed {
+		srv.lock.Unlock()
+		_ = conn.Close()
+		return ErrServerClosed
+	}
+	srv.sessions[s] = struct{}{}
+	srv.wg.Add(1)
+	srv.lock.Unlock()
+
+	defer func() {
+		srv.lock.Lock()
+		delete(srv.sessions, s)
+		srv.lock.Unlock()
+		srv.wg.Done()
+	}()
+
+	return s.Serve(context.Background())
+}
+
+// The number of sessions being served.
+func (srv *Server) ActiveSessions() int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return len(srv.sessions)
+}
+
+func (srv *Server) isClosed() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.closed
+}
+
+// Stop accepting connections and wait for the sessions being served
+// to end. If ctx is done first, the remaining sessions are closed and
+// ctx.Err() is returned once they have ended.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.lock.Lock()
+	srv.init()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.done)
+	}
+	for l := range srv.listeners {
+		_ = l.Close()
+	}
+	srv.lock.Unlock()
+
+	ended := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(ended)
+	}()
+
+	select {
+	case <-ended:
+		return nil
+	case <-ctx.Done():
+	}
+
+	srv.lock.Lock()
+	var sessions []*Session
+	for s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	srv.lock.Unlock()
+	for _, s := range sessions {
+		_ = s.Close()
+	}
+	<-ended
+	return ctx.Err()
+}
@@ -0,0 +1,109 @@
+package sftp
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// Wait for srv to be serving n sessions.
+func waitActiveSessions(t *testing.T, srv *Server, n int) {
+	for i := 0; srv.ActiveSessions() != n; i++ {
+		if i == 500 {
+			t.Fatalf("expected %d active sessions, got %d", n, srv.ActiveSessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := &Server{
+		FS:      mem.New(),
+		Options: &Options{Logger: LogFunc(func(string, ...interface{}) {})},
+	}
+	conns := make(chan io.ReadWriteCloser)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ServeConns(conns)
+	}()
+
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		server, client := net.Pipe()
+		conns <- server
+		c, err := NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	waitActiveSessions(t, srv, 2)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listened := make(chan error, 1)
+	go func() {
+		listened <- srv.Serve(l)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients = append(clients, c)
+	waitActiveSessions(t, srv, 3)
+
+	_ = clients[0].Close()
+	waitActiveSessions(t, srv, 2)
+
+	// The remaining clients stay connected, so they are
+	// closed once the shutdown times out.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the shutdown to time out, got %v", err)
+	}
+	if srv.ActiveSessions() != 0 {
+		t.Fatal("expected no active sessions after shutdown")
+	}
+	_, err = clients[1].Stat("/")
+	if err == nil {
+		t.Fatal("expected the session to be closed")
+	}
+	for _, c := range clients[1:] {
+		_ = c.Close()
+	}
+
+	for _, errs := range []chan error{served, listened} {
+		select {
+		case err = <-errs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the server to stop serving")
+		}
+		if err != ErrServerClosed {
+			t.Fatalf("expected ErrServerClosed, got %v", err)
+		}
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	err = srv.ServeConn(server)
+	if err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	// With no sessions to wait for shutdown finishes at once.
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package sftp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -8,8 +9,10 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/andrewchambers/sftpplease/extraio"
 	"github.com/andrewchambers/sftpplease/sftp/protosftp"
 	"github.com/andrewchambers/sftpplease/vfs"
 )
@@ -18,50 +21,191 @@ var (
 	ErrInvalidHandle    = errors.New("invalid handle")
 	ErrUnsupported      = errors.New("unsupported operation")
 	ErrBadRead          = errors.New("bad read")
+	ErrBadWrite         = errors.New("write larger than the server accepts")
 	ErrTooManyOpenFiles = errors.New("too many open files")
+	ErrSessionExpired   = errors.New("session reached its maximum duration")
+	ErrSessionIdle      = errors.New("session idle for too long")
+	ErrSessionClosed    = errors.New("session closed")
 )
 
 type Options struct {
-	Debug    bool
+	Debug bool
+	// If set, records every packet sent and received.
+	Tracer *Tracer
+	// The most files and directories a session may have open
+	// at once, 0 for no limit.
 	MaxFiles int
-	LogFunc  func(string, ...interface{})
+	// If set, limits the files open at once in all the
+	// sessions sharing it.
+	SharedHandleLimit *HandleLimit
+	// Directory relative paths and ~ are resolved against, defaults to Root.
+	HomeDir string
+	// Operations clients may perform, nil allows everything.
+	Policy *Policy
+	// If set, client paths are normalized and any request for a path
+	// outside of this directory is denied before it reaches the VFS.
+	Root string
+	// Modes for new files and directories when the client does
+	// not supply any, default to 0644 and 0755.
+	DefaultFileMode os.FileMode
+	DefaultDirMode  os.FileMode
+	// Permission bits cleared from the mode of every new file and directory.
+	Umask os.FileMode
+	// If non zero, sequential writes are merged into writes of up
+	// to this many bytes before being passed to the file system.
+	WriteCoalesceSize int
+	// The longest request packets accepted, defaults to
+	// protosftp.DefaultMaxPacketLength and is at least 34000 bytes.
+	// Longer packets end the session.
+	MaxPacketLength uint32
+	// The most data one read returns, longer reads are answered with
+	// less data as the protocol allows. Defaults to, and is at most,
+	// 1024 bytes less than MaxPacketLength, as is the most data one
+	// write may carry.
+	MaxReadLength  uint32
+	MaxWriteLength uint32
+	// The most directory entries sent in one READDIR response,
+	// defaults to 64. Responses must still fit the packets clients
+	// accept, OpenSSH accepts up to 256KiB.
+	ReaddirBatchSize int
+	// If set, formats the long names of directory entries, the lines
+	// clients such as OpenSSH sftp show for 'ls -l'. owner and group
+	// are named by the file system, or "user" if it can't. Defaults
+	// to the format of OpenSSH, that of 'ls -l' in the C locale.
+	LongName func(fi os.FileInfo, owner string, group string) string
+	// If greater than one, up to this many reads of one file are run
+	// at once, their responses are still sent in the order the reads
+	// arrived. The files of the file system must allow concurrent
+	// ReadAt calls, as os.File does.
+	ReadPipelineDepth int
+	// If non zero, writes that would make a file larger
+	// than this many bytes fail with FX_QUOTA_EXCEEDED, or
+	// FX_FAILURE for clients of versions without it.
+	MaxFileSize int64
+	// If non zero, the rate in bytes per second file data
+	// may be read and written in this session.
+	BandwidthLimit int64
+	// If set, limits the rate file data may be read and written
+	// in all the sessions sharing it.
+	SharedRateLimiter *extraio.RateLimiter
+	// If non zero, sessions that receive no requests for this
+	// long while no requests are in progress are shut down.
+	IdleTimeout time.Duration
+	// If non zero, sessions are ended after this long. Requests still
+	// in progress are finished, new requests fail, then the
+	// connection is closed.
+	MaxSessionDuration time.Duration
+	// Receives log messages and operation records, must be set.
+	Logger Logger
+	// If set, observes every operation, for example
+	// a PrometheusMetrics shared by every session.
+	Metrics Metrics
+	// If set, receives a record of every operation that
+	// modifies the file system.
+	AuditLog AuditLog
+	// Identifies the session in audit records.
+	SessionID string
+	// Called around every request, in order before it is
+	// handled and in reverse order once it is responded to.
+	Middleware []Middleware
+	// If set, called with every operation and normalized path a
+	// client request operates on, an error denies the request. The
+	// operations are those of operation records, except that opens
+	// are checked as "read" and "write" of the file. Requests on
+	// handles pass the path they were opened with, renames and links
+	// are checked for both paths. Closing handles is always allowed.
+	Authorize func(op string, path string, s *Session) error
 }
 
 type Session struct {
 	Options *Options
 
-	fs vfs.VFS
-
-	files     map[string]*handle
-	inbox     chan protosftp.Packet
-	outbox    chan protosftp.Packet
-	closed    chan struct{}
-	closeOnce sync.Once
-	wg        sync.WaitGroup
+	fs          vfs.VFS
+	rw          io.ReadWriter
+	rateLimiter *extraio.RateLimiter
+	// Done once the session ends, set by Serve.
+	ctx context.Context
+
+	handles    handleRegistry
+	extensions map[string]ExtensionHandler
+	inbox      chan protosftp.Packet
+	outbox     chan protosftp.Packet
+	closed     chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+	// Why the session ended, set before closed is closed.
+	err error
+	// Set once Serve is called, done is closed when it returns.
+	serving int32
+	done    chan struct{}
+
+	opsLock sync.Mutex
+	ops     map[uint32]*OpRecord
+
+	start            time.Time
+	clientVersion    uint32
+	clientExtensions []string
+	transfersLock    sync.Mutex
+	transfers        []transfer
+}
 
-	fcounter int64
+// Sent to a handle goroutine to close its file when the
+// session shuts down, done is closed once the file is closed.
+type closeHandleRequest struct {
+	protosftp.Packet
+	done chan struct{}
 }
 
 type handle struct {
 	Id      string
+	Path    string
 	reqChan chan protosftp.Packet
+
+	// Updated atomically by the handle goroutine.
+	bytesRead    int64
+	bytesWritten int64
 }
 
-func (s *Session) newFileHandle(f vfs.File) *handle {
-	id := fmt.Sprintf("%d", s.fcounter)
-	s.fcounter += 1
+// The end of a file opened for appending, where the handle writes
+// regardless of the offsets requested.
+type appendState struct {
+	// If set the file was opened with os.O_APPEND and appended to
+	// with Write, otherwise writes are made with WriteAt at eof.
+	native bool
+	eof    int64
+}
 
+// Register a handle for f, which was counted by reserveHandle.
+// If app is not nil, writes append to the file.
+func (s *Session) newFileHandle(p string, f vfs.File, app *appendState) *handle {
 	h := &handle{
-		Id:      id,
+		Path:    p,
 		reqChan: make(chan protosftp.Packet),
 	}
+	s.handles.add(h)
+
+	var reads *readPipeline
+	if s.Options.ReadPipelineDepth > 1 {
+		reads = s.newReadPipeline(h, f, s.Options.ReadPipelineDepth)
+	}
+
+	if s.Options.WriteCoalesceSize > 0 {
+		f = newCoalescingFile(f, s.Options.WriteCoalesceSize)
+	}
 
 	// Each file has it's own goroutine and request
 	// channel. This makes it easier do concurrent operations
 	// but still process file requests in the order they arrive.
 	// Some file systems have strict ordering requirements.
 	go func() {
+		if reads != nil {
+			defer reads.stop()
+		}
 		for req := range h.reqChan {
+			if _, ok := req.(*protosftp.FxpReadPacket); reads != nil && !ok {
+				// Other requests wait for the reads before them.
+				reads.wait()
+			}
 			switch req := req.(type) {
 			case *protosftp.FxpFstatPacket:
 				st, err := f.Stat()
@@ -74,33 +218,56 @@ func (s *Session) newFileHandle(f vfs.File) *handle {
 					Info: fileStatToSFTPStat(st),
 				})
 			case *protosftp.FxpWritePacket:
-				_, err := f.WriteAt(req.Data, int64(req.Offset))
+				if uint32(len(req.Data)) > s.maxWriteLength() {
+					s.respondError(req.ID, ErrBadWrite)
+					continue
+				}
+				off := int64(req.Offset)
+				if app != nil {
+					off = app.eof
+				}
+				if s.Options.MaxFileSize > 0 && off+int64(len(req.Data)) > s.Options.MaxFileSize {
+					s.respondError(req.ID, vfs.ErrQuotaExceeded)
+					continue
+				}
+				if err := s.waitBandwidth(len(req.Data)); err != nil {
+					s.respondError(req.ID, err)
+					continue
+				}
+				var n int
+				var err error
+				if app != nil && app.native {
+					n, err = f.Write(req.Data)
+				} else {
+					n, err = f.WriteAt(req.Data, off)
+				}
+				if app != nil {
+					app.eof += int64(n)
+				}
+				atomic.AddInt64(&h.bytesWritten, int64(n))
 				if err != nil {
 					s.respondError(req.ID, err)
 					continue
 				}
 				s.respondOk(req.ID)
 			case *protosftp.FxpReadPacket:
-				if req.Len > 1024*1024 {
-					s.respondError(req.ID, ErrBadRead)
-					continue
+				if req.Len > s.maxReadLength() {
+					req.Len = s.maxReadLength()
 				}
 
-				buf := make([]byte, req.Len, req.Len)
-
-				n, err := f.ReadAt(buf, int64(req.Offset))
-				if err != nil && n == 0 {
-					s.respondError(req.ID, err)
+				if reads != nil {
+					if cf, ok := f.(*coalescingFile); ok {
+						// Reads go around the buffer, so it
+						// must be written first.
+						cf.flush()
+					}
+					reads.start(req)
 					continue
 				}
-
-				s.Respond(&protosftp.FxpDataPacket{
-					ID:     req.ID,
-					Length: uint32(n),
-					Data:   buf[:n],
-				})
+				buf, err := s.readFile(h, f, req)
+				s.respondRead(req.ID, buf, err)
 			case *protosftp.FxpReaddirPacket:
-				stats, err := f.Readdir(64)
+				stats, err := f.Readdir(s.readdirBatchSize())
 				if err != nil {
 					s.respondError(req.ID, err)
 					continue
@@ -108,15 +275,33 @@ func (s *Session) newFileHandle(f vfs.File) *handle {
 
 				resp := &protosftp.FxpNamePacket{ID: req.ID}
 				for _, stat := range stats {
+					owner, group := s.lookupOwner(stat)
 					resp.NameAttrs = append(resp.NameAttrs, protosftp.FxpNameAttr{
 						Name:     stat.Name(),
-						LongName: runLsStat(stat),
+						LongName: s.longName(stat, owner, group),
 						Attrs:    fileStatToSFTPStat(stat),
 					})
 				}
 				s.Respond(resp)
+			case *protosftp.FxpFSetStatPacket:
+				// Run in order with the writes to the file, so times
+				// set before closing a new file apply to its data.
+				s.setStat(req.ID, h.Path, &req.Attrs)
+			case *fileExtendedRequest:
+				req.fn(f)
+			case *closeHandleRequest:
+				err := f.Close()
+				s.releaseHandle()
+				if err != nil {
+					s.Logf("closing %s at session end failed: %s", h.Path, err)
+				}
+				close(req.done)
+				return
 			case *protosftp.FxpClosePacket:
+				// The file no longer counts as open once
+				// the client is told it is closed.
 				err := f.Close()
+				s.releaseHandle()
 				if err != nil {
 					s.respondError(req.ID, err)
 					return
@@ -133,7 +318,7 @@ func (s *Session) newFileHandle(f vfs.File) *handle {
 }
 
 func (s *Session) Logf(format string, args ...interface{}) {
-	s.Options.LogFunc(format, args...)
+	s.Options.Logger.Logf(format, args...)
 }
 
 func (s *Session) Respond(resp protosftp.Packet) {
@@ -141,36 +326,119 @@ func (s *Session) Respond(resp protosftp.Packet) {
 	case <-s.closed:
 	case s.outbox <- resp:
 	}
+	s.endOpWithResponse(resp)
 }
 
+// Serve an sftp session on rw until the client disconnects or the
+// session times out. Files the client left open are closed, and rw is
+// closed before returning if it is an io.Closer. If fs is a
+// vfs.ContextVFS, operations still running when the session ends are
+// aborted, including uploads the client did not close.
 func Serve(opt *Options, fs vfs.VFS, rw io.ReadWriter) {
+	_ = ServeContext(context.Background(), opt, fs, rw)
+}
 
+// Serve an sftp session on rw as Serve does, also ending it when ctx
+// is done, and return why it ended.
+func ServeContext(ctx context.Context, opt *Options, fs vfs.VFS, rw io.ReadWriter) error {
+	return NewSession(opt, fs, rw).Serve(ctx)
+}
+
+// A session to be served on rw, Serve must be called once.
+func NewSession(opt *Options, fs vfs.VFS, rw io.ReadWriter) *Session {
 	s := &Session{
-		Options: opt,
-		fs:      fs,
-		files:   make(map[string]*handle),
-		inbox:   make(chan protosftp.Packet, 16),
-		outbox:  make(chan protosftp.Packet, 16),
-		closed:  make(chan struct{}),
+		Options:    opt,
+		fs:         fs,
+		rw:         rw,
+		extensions: make(map[string]ExtensionHandler),
+		ops:        make(map[uint32]*OpRecord),
+		inbox:      make(chan protosftp.Packet, 16),
+		outbox:     make(chan protosftp.Packet, 16),
+		closed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	for _, ext := range extensionRegistry {
+		s.extensions[ext.name] = ext.handler
+	}
+
+	if s.Options.BandwidthLimit > 0 {
+		s.rateLimiter = extraio.NewRateLimiter(s.Options.BandwidthLimit)
+	}
+	return s
+}
+
+// End the session with err unless it has already ended,
+// the first error is the one Serve returns.
+func (s *Session) end(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.closed)
+	})
+}
+
+// End the session, waiting for Serve to return if it has been called.
+func (s *Session) Close() error {
+	s.end(ErrSessionClosed)
+	if atomic.LoadInt32(&s.serving) != 0 {
+		<-s.done
 	}
+	return nil
+}
 
-	shutdown := func() {
-		s.closeOnce.Do(func() {
-			close(s.closed)
-		})
-		s.wg.Done()
+// Serve the session until the client disconnects, the session times
+// out, ctx is done or Close is called. Files the client left open are
+// closed, and rw is closed before returning if it is an io.Closer.
+// Operations of context aware file systems still running are aborted.
+//
+// The error is nil if the client disconnected, ctx.Err() if ctx ended
+// the session, and otherwise the reason it ended, such as
+// ErrSessionIdle, ErrSessionExpired or ErrSessionClosed.
+func (s *Session) Serve(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.serving, 0, 1) {
+		return errors.New("session already served")
+	}
+	defer close(s.done)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.ctx = ctx
+	s.fs = vfs.WithContext(s.fs, ctx)
+	s.start = time.Now()
+	rw := s.rw
+	if s.Options.Tracer != nil {
+		rw = s.Options.Tracer.wrap(rw, s.Options.SessionID)
 	}
 
 	s.wg.Add(1)
 	go func() {
-		defer shutdown()
+		defer s.wg.Done()
+		select {
+		case <-s.closed:
+		case <-ctx.Done():
+			s.end(ctx.Err())
+		}
+		// Abort operations of the ended session.
+		cancel()
+	}()
+
+	// The reader is not waited for, when the session ends for
+	// another reason it may be blocked reading from rw until rw is
+	// closed below.
+	go func() {
 		for {
-			req, err := protosftp.ReadPacket(rw)
+			req, err := protosftp.ReadPacketMax(rw, s.maxPacketLength())
 			if err != nil {
 				if s.Options.Debug {
 					s.Logf("reading message failed: %s", err)
 				}
-				break
+				if err == io.EOF {
+					err = nil
+				} else {
+					err = fmt.Errorf("reading request failed: %w", err)
+				}
+				s.end(err)
+				return
 			}
 			if s.Options.Debug {
 				s.Logf("got packet: %#v", req)
@@ -185,19 +453,24 @@ func Serve(opt *Options, fs vfs.VFS, rw io.ReadWriter) {
 
 	s.wg.Add(1)
 	go func() {
-		defer shutdown()
+		defer s.wg.Done()
+		pw := newPacketWriter(rw)
 		for {
 			select {
 			case <-s.closed:
+				// Flush responses queued before the session ended.
+				select {
+				case resp := <-s.outbox:
+					_ = s.writeResponses(pw, resp)
+				default:
+				}
 				return
 			case resp := <-s.outbox:
-				if s.Options.Debug {
-					s.Logf("sending response: %#v", resp)
-				}
-				err := protosftp.WritePacket(rw, resp)
+				err := s.writeResponses(pw, resp)
 				if err != nil {
 					s.Logf("writing response failed: %s", err)
-					break
+					s.end(fmt.Errorf("writing response failed: %w", err))
+					return
 				}
 			}
 		}
@@ -205,80 +478,158 @@ func Serve(opt *Options, fs vfs.VFS, rw io.ReadWriter) {
 
 	s.wg.Add(1)
 	go func() {
-		defer shutdown()
-		for {
-			select {
-			case <-s.closed:
-				return
-			case req := <-s.inbox:
-				switch req := req.(type) {
-				case *protosftp.FxpClosePacket:
-					s.handleClose(req)
-				case *protosftp.FxpFstatPacket:
-					s.handleFstat(req)
-				case *protosftp.FxpInitPacket:
-					s.handleInit(req)
-				case *protosftp.FxpLstatPacket:
-					s.handleLstat(req)
-				case *protosftp.FxpMkdirPacket:
-					s.handleMkdir(req)
-				case *protosftp.FxpOpendirPacket:
-					s.handleOpenDir(req)
-				case *protosftp.FxpOpenPacket:
-					s.handleOpen(req)
-				case *protosftp.FxpReaddirPacket:
-					s.handleReadDir(req)
-				case *protosftp.FxpReadlinkPacket:
-					s.handleReadLink(req)
-				case *protosftp.FxpReadPacket:
-					s.handleRead(req)
-				case *protosftp.FxpRealpathPacket:
-					s.handleRealPath(req)
-				case *protosftp.FxpRemovePacket:
-					s.handleRemove(req)
-				case *protosftp.FxpRenamePacket:
-					s.handleRename(req)
-				case *protosftp.FxpRmdirPacket:
-					s.handleRmdir(req)
-				case *protosftp.FxpSetStatPacket:
-					s.handleSetStat(req)
-				case *protosftp.FxpStatPacket:
-					s.handleStat(req)
-				case *protosftp.FxpSymlinkPacket:
-					s.handleSymlink(req)
-				case *protosftp.FxpWritePacket:
-					s.handleWrite(req)
-				default:
-					s.Logf("unimplemented request: %#v", req)
-					return
-				}
-			}
-		}
+		defer s.wg.Done()
+		s.end(s.handleRequests())
 	}()
 
 	s.wg.Wait()
+	s.closeHandles()
+	if c, ok := rw.(io.Closer); ok {
+		_ = c.Close()
+	}
+	if s.err != nil {
+		s.Logf("session ended: %s", s.err)
+	}
+	s.logSummary()
+	return s.err
 }
 
-func (s *Session) respondError(respId uint32, err error) {
-	code := uint32(protosftp.FX_FAILURE)
-	msg := "error"
-
-	if err == io.EOF {
-		code = protosftp.FX_EOF
-		msg = err.Error()
-	} else if err == os.ErrNotExist {
-		code = protosftp.FX_NO_SUCH_FILE
-		msg = err.Error()
-	} else if os.IsPermission(err) {
-		code = protosftp.FX_PERMISSION_DENIED
-		msg = err.Error()
-	} else if err == ErrUnsupported {
-		code = protosftp.FX_OP_UNSUPPORTED
-		msg = err.Error()
-	} else {
-		s.Logf("unhandled/unexpected error: %s", err)
+// Handle requests until the session ends, returning why it ended.
+func (s *Session) handleRequests() error {
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if s.Options.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(s.Options.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
 	}
 
+	var deadline <-chan time.Time
+	if s.Options.MaxSessionDuration > 0 {
+		deadlineTimer := time.NewTimer(s.Options.MaxSessionDuration)
+		defer deadlineTimer.Stop()
+		deadline = deadlineTimer.C
+	}
+	expired := false
+	// Polls for in progress requests to finish once expired.
+	var drain <-chan time.Time
+
+	for {
+		select {
+		case <-s.closed:
+			return nil
+		case <-deadline:
+			s.Logf("session reached maximum duration of %s, shutting down", s.Options.MaxSessionDuration)
+			expired = true
+			drainTicker := time.NewTicker(50 * time.Millisecond)
+			defer drainTicker.Stop()
+			drain = drainTicker.C
+		case <-drain:
+			if s.pendingOps() == 0 {
+				return ErrSessionExpired
+			}
+		case <-idle:
+			if s.pendingOps() != 0 {
+				idleTimer.Reset(s.Options.IdleTimeout)
+				continue
+			}
+			s.Logf("session idle for %s, shutting down", s.Options.IdleTimeout)
+			return ErrSessionIdle
+		case req := <-s.inbox:
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					<-idleTimer.C
+				}
+				idleTimer.Reset(s.Options.IdleTimeout)
+			}
+			s.startOp(req)
+			if expired {
+				if id, ok := requestID(req); ok {
+					s.respondError(id, ErrSessionExpired)
+				}
+				continue
+			}
+			if id, err := s.checkPolicy(req); err != nil {
+				s.respondError(id, err)
+				continue
+			}
+			if id, err := s.sandboxPaths(req); err != nil {
+				s.respondError(id, err)
+				continue
+			}
+			if id, err := s.runMiddleware(req); err != nil {
+				s.respondError(id, err)
+				continue
+			}
+			s.setOpPaths(req)
+			if id, err := s.authorizeRequest(req); err != nil {
+				s.respondError(id, err)
+				continue
+			}
+			switch req := req.(type) {
+			case *protosftp.FxpClosePacket:
+				s.handleClose(req)
+			case *protosftp.FxpFstatPacket:
+				s.handleFstat(req)
+			case *protosftp.FxpInitPacket:
+				s.handleInit(req)
+			case *protosftp.FxpLstatPacket:
+				s.handleLstat(req)
+			case *protosftp.FxpMkdirPacket:
+				s.handleMkdir(req)
+			case *protosftp.FxpOpendirPacket:
+				s.handleOpenDir(req)
+			case *protosftp.FxpOpenPacket:
+				s.handleOpen(req)
+			case *protosftp.FxpReaddirPacket:
+				s.handleReadDir(req)
+			case *protosftp.FxpReadlinkPacket:
+				s.handleReadLink(req)
+			case *protosftp.FxpReadPacket:
+				s.handleRead(req)
+			case *protosftp.FxpRealpathPacket:
+				s.handleRealPath(req)
+			case *protosftp.FxpRemovePacket:
+				s.handleRemove(req)
+			case *protosftp.FxpRenamePacket:
+				s.handleRename(req)
+			case *protosftp.FxpRmdirPacket:
+				s.handleRmdir(req)
+			case *protosftp.FxpSetStatPacket:
+				s.handleSetStat(req)
+			case *protosftp.FxpFSetStatPacket:
+				s.handleFSetStat(req)
+			case *protosftp.FxpStatPacket:
+				s.handleStat(req)
+			case *protosftp.FxpSymlinkPacket:
+				s.handleSymlink(req)
+			case *protosftp.FxpWritePacket:
+				s.handleWrite(req)
+			case *protosftp.FxpExtendedPacket:
+				s.handleExtended(req)
+			default:
+				s.Logf("unimplemented request: %#v", req)
+				return fmt.Errorf("unimplemented request type %T", req)
+			}
+		}
+	}
+}
+
+// Close the files the client left open, called once the session has
+// finished so file systems can release them. Backends that abort
+// operations when the session ends discard files not yet committed.
+func (s *Session) closeHandles() {
+	for _, h := range s.handles.removeAll() {
+		req := &closeHandleRequest{done: make(chan struct{})}
+		h.reqChan <- req
+		<-req.done
+		s.addTransfer(h)
+	}
+}
+
+func (s *Session) respondError(respId uint32, err error) {
+	code, msg := s.errorStatus(err)
+	s.failOp(respId, err)
 	s.Respond(protosftp.MakeStatus(respId, msg, code))
 }
 
@@ -287,21 +638,46 @@ func (s *Session) respondOk(respId uint32) {
 }
 
 func (s *Session) handleInit(req *protosftp.FxpInitPacket) {
-	s.Respond(&protosftp.FxVersionPacket{
-		Version:    protosftp.ProtocolVersion,
-		Extensions: nil,
-	})
+	s.clientVersion = req.Version
+	for _, ext := range req.Extensions {
+		s.clientExtensions = append(s.clientExtensions, ext.Name)
+	}
+
+	resp := &protosftp.FxVersionPacket{
+		Version: protosftp.ProtocolVersion,
+	}
+	for _, ext := range extensionRegistry {
+		data := ext.data
+		if ext.name == "check-file" && data != "" {
+			data = s.checkFileAlgorithms()
+		}
+		if data == "" {
+			continue
+		}
+		resp.Extensions = append(resp.Extensions, struct{ Name, Data string }{ext.name, data})
+	}
+	s.Respond(resp)
 }
 
-func (s *Session) handleRealPath(req *protosftp.FxpRealpathPacket) {
-	p := req.Path
+func (s *Session) homeDir() string {
+	if s.Options.HomeDir == "" {
+		return s.rootDir()
+	}
+	return path.Clean("/" + s.Options.HomeDir)
+}
+
+// Make p absolute, relative paths are relative
+// to the session home directory.
+func (s *Session) absPath(p string) string {
 	if !strings.HasPrefix(p, "/") {
-		p = "/" + p
+		p = path.Join(s.homeDir(), p)
 	}
-	p = path.Clean(p)
+	return path.Clean(p)
+}
 
+func (s *Session) respondPath(respId uint32, p string) {
 	s.Respond(&protosftp.FxpNamePacket{
-		ID: req.ID,
+		ID: respId,
 		NameAttrs: []protosftp.FxpNameAttr{{
 			Name:     p,
 			LongName: p, // XXX?
@@ -310,6 +686,15 @@ func (s *Session) handleRealPath(req *protosftp.FxpRealpathPacket) {
 	})
 }
 
+func (s *Session) handleRealPath(req *protosftp.FxpRealpathPacket) {
+	p, err := s.realPath(req.Path)
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+	s.respondPath(req.ID, p)
+}
+
 func (s *Session) handleRemove(req *protosftp.FxpRemovePacket) {
 	st, err := s.fs.Stat(req.Filename)
 	if err != nil {
@@ -355,7 +740,7 @@ func (s *Session) handleRmdir(req *protosftp.FxpRmdirPacket) {
 
 func (s *Session) handleFstat(req *protosftp.FxpFstatPacket) {
 
-	h, ok := s.files[req.Handle]
+	h, ok := s.handles.get(req.Handle)
 	if !ok {
 		s.respondError(req.ID, ErrInvalidHandle)
 		return
@@ -379,27 +764,50 @@ func (s *Session) handleStat(req *protosftp.FxpStatPacket) {
 }
 
 func (s *Session) handleSetStat(req *protosftp.FxpSetStatPacket) {
+	s.setStat(req.ID, req.Path, &req.Attrs)
+}
 
-	if req.Attrs.Flags&protosftp.FILEXFER_ATTR_PERMISSIONS != 0 {
-		err := s.fs.Chmod(req.Path, os.FileMode(req.Attrs.Mode))
+func (s *Session) handleFSetStat(req *protosftp.FxpFSetStatPacket) {
+
+	h, ok := s.handles.get(req.Handle)
+	if !ok {
+		s.respondError(req.ID, ErrInvalidHandle)
+		return
+	}
+
+	h.reqChan <- req
+}
+
+func (s *Session) setStat(id uint32, p string, attrs *protosftp.FileStat) {
+
+	if attrs.Flags&protosftp.FILEXFER_ATTR_PERMISSIONS != 0 {
+		err := s.fs.Chmod(p, os.FileMode(attrs.Mode))
 		if err != nil {
-			s.respondError(req.ID, err)
+			s.respondError(id, err)
 			return
 		}
 
 	}
 
-	if req.Attrs.Flags&protosftp.FILEXFER_ATTR_SIZE != 0 {
-		s.respondError(req.ID, ErrUnsupported)
+	if attrs.Flags&protosftp.FILEXFER_ATTR_SIZE != 0 {
+		s.respondError(id, ErrUnsupported)
 		return
 	}
 
-	if req.Attrs.Flags&protosftp.FILEXFER_ATTR_ACMODTIME != 0 {
-		s.respondError(req.ID, ErrUnsupported)
-		return
+	if attrs.Flags&protosftp.FILEXFER_ATTR_ACMODTIME != 0 {
+		ct, ok := s.fs.(vfs.Chtimeser)
+		if !ok {
+			s.respondError(id, ErrUnsupported)
+			return
+		}
+		err := ct.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+		if err != nil {
+			s.respondError(id, err)
+			return
+		}
 	}
 
-	s.respondOk(req.ID)
+	s.respondOk(id)
 }
 
 func (s *Session) handleLstat(req *protosftp.FxpLstatPacket) {
@@ -418,7 +826,7 @@ func (s *Session) handleLstat(req *protosftp.FxpLstatPacket) {
 
 func (s *Session) handleReadDir(req *protosftp.FxpReaddirPacket) {
 
-	h, ok := s.files[req.Handle]
+	h, ok := s.handles.get(req.Handle)
 	if !ok {
 		s.respondError(req.ID, ErrInvalidHandle)
 		return
@@ -428,19 +836,22 @@ func (s *Session) handleReadDir(req *protosftp.FxpReaddirPacket) {
 
 func (s *Session) handleClose(req *protosftp.FxpClosePacket) {
 
-	h, ok := s.files[req.Handle]
+	h, ok := s.handles.remove(req.Handle)
 	if !ok {
 		s.respondError(req.ID, ErrInvalidHandle)
 		return
 	}
-	delete(s.files, req.Handle)
+	// Earlier requests for the handle have finished once
+	// its goroutine accepts the close.
 	h.reqChan <- req
+	s.addTransfer(h)
 }
 
 func (s *Session) handleOpen(req *protosftp.FxpOpenPacket) {
 
-	if len(s.files) > s.Options.MaxFiles {
-		s.respondError(req.ID, ErrTooManyOpenFiles)
+	err := s.reserveHandle()
+	if err != nil {
+		s.respondError(req.ID, err)
 		return
 	}
 
@@ -467,8 +878,16 @@ func (s *Session) handleOpen(req *protosftp.FxpOpenPacket) {
 		req.Pflags &= ^uint32(protosftp.FXF_CREAT)
 	}
 
+	var app *appendState
 	if req.Pflags&protosftp.FXF_APPEND != 0 {
-		flags |= os.O_APPEND
+		// Writes to files opened with os.O_APPEND can't be made
+		// with WriteAt, so appending is done by the handle. File
+		// systems that can't append are written at the end of the
+		// file instead, which other writers may race with.
+		app = &appendState{native: vfs.AppendSupported(s.fs)}
+		if app.native {
+			flags |= os.O_APPEND
+		}
 		req.Pflags &= ^uint32(protosftp.FXF_APPEND)
 	}
 
@@ -478,34 +897,51 @@ func (s *Session) handleOpen(req *protosftp.FxpOpenPacket) {
 	}
 
 	if req.Pflags != 0 {
+		s.releaseHandle()
 		s.respondError(req.ID, ErrUnsupported)
 		return
 	}
 
-	mode := os.FileMode(0755)
-	if req.Attrs.Flags&protosftp.FILEXFER_ATTR_PERMISSIONS != 0 {
-		mode = os.FileMode(req.Attrs.Mode & 0777)
-	}
+	mode := s.createMode(&req.Attrs, s.Options.DefaultFileMode, 0644)
 
 	f, err := s.fs.OpenFile(req.Path, flags, mode)
 	if err != nil {
+		s.releaseHandle()
 		s.respondError(req.ID, err)
 		return
 	}
 
-	handle := s.newFileHandle(f)
+	if app != nil {
+		st, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			s.releaseHandle()
+			s.respondError(req.ID, err)
+			return
+		}
+		app.eof = st.Size()
+	}
 
-	s.files[handle.Id] = handle
+	handle := s.newFileHandle(req.Path, f, app)
 
 	s.Respond(&protosftp.FxpHandlePacket{ID: req.ID, Handle: handle.Id})
 }
 
+// The mode to create a file or directory with, the client supplied
+// permissions if there are any or the default, with the umask applied.
+func (s *Session) createMode(attrs *protosftp.FileStat, mode, fallback os.FileMode) os.FileMode {
+	if mode == 0 {
+		mode = fallback
+	}
+	if attrs.Flags&protosftp.FILEXFER_ATTR_PERMISSIONS != 0 {
+		mode = os.FileMode(attrs.Mode & 0777)
+	}
+	return mode &^ s.Options.Umask & 0777
+}
+
 func (s *Session) handleMkdir(req *protosftp.FxpMkdirPacket) {
 
-	mode := os.FileMode(0755)
-	if req.Attrs.Flags&protosftp.FILEXFER_ATTR_PERMISSIONS != 0 {
-		mode = os.FileMode(req.Attrs.Mode & 0777)
-	}
+	mode := s.createMode(&req.Attrs, s.Options.DefaultDirMode, 0755)
 
 	err := s.fs.Mkdir(req.Path, mode)
 	if err != nil {
@@ -518,27 +954,27 @@ func (s *Session) handleMkdir(req *protosftp.FxpMkdirPacket) {
 
 func (s *Session) handleOpenDir(req *protosftp.FxpOpendirPacket) {
 
-	if len(s.files) > s.Options.MaxFiles {
-		s.respondError(req.ID, ErrTooManyOpenFiles)
+	err := s.reserveHandle()
+	if err != nil {
+		s.respondError(req.ID, err)
 		return
 	}
 
 	f, err := s.fs.Open(req.Path)
 	if err != nil {
+		s.releaseHandle()
 		s.respondError(req.ID, err)
 		return
 	}
 
-	handle := s.newFileHandle(f)
-
-	s.files[handle.Id] = handle
+	handle := s.newFileHandle(req.Path, f, nil)
 
 	s.Respond(&protosftp.FxpHandlePacket{ID: req.ID, Handle: handle.Id})
 }
 
 func (s *Session) handleWrite(req *protosftp.FxpWritePacket) {
 
-	h, ok := s.files[req.Handle]
+	h, ok := s.handles.get(req.Handle)
 	if !ok {
 		s.respondError(req.ID, ErrInvalidHandle)
 		return
@@ -548,7 +984,7 @@ func (s *Session) handleWrite(req *protosftp.FxpWritePacket) {
 
 func (s *Session) handleRead(req *protosftp.FxpReadPacket) {
 
-	h, ok := s.files[req.Handle]
+	h, ok := s.handles.get(req.Handle)
 	if !ok {
 		s.respondError(req.ID, ErrInvalidHandle)
 		return
@@ -654,7 +1090,23 @@ func runLsTypeWord(mode os.FileMode) string {
 	return fmt.Sprintf("%c%c%c%c%c%c%c%c%c%c", tc, orc, owc, oxc, grc, gwc, gxc, arc, awc, axc)
 }
 
-func runLsStat(stat os.FileInfo) string {
+func (s *Session) lookupOwner(stat os.FileInfo) (string, string) {
+	if ol, ok := s.fs.(vfs.OwnerLookuper); ok {
+		if owner, group, ok := ol.LookupOwner(stat); ok {
+			return owner, group
+		}
+	}
+	return "user", "user"
+}
+
+func (s *Session) longName(stat os.FileInfo, owner, group string) string {
+	if s.Options.LongName != nil {
+		return s.Options.LongName(stat, owner, group)
+	}
+	return runLsStat(stat, owner, group)
+}
+
+func runLsStat(stat os.FileInfo, owner, group string) string {
 	// example from openssh sftp server:
 	// crw-rw-rw-    1 root     wheel           0 Jul 31 20:52 ttyvd
 	// format:
@@ -674,5 +1126,5 @@ func runLsStat(stat os.FileInfo) string {
 		yearOrTime = fmt.Sprintf("%d", year)
 	}
 
-	return fmt.Sprintf("%s %4d %-8s %-8s %8d %s %2d %5s %s", typeword, numLinks, "user", "user", stat.Size(), monthStr, day, yearOrTime, stat.Name())
+	return fmt.Sprintf("%s %4d %-8s %-8s %8d %s %2d %5s %s", typeword, numLinks, owner, group, stat.Size(), monthStr, day, yearOrTime, stat.Name())
 }
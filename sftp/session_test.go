@@ -0,0 +1,329 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/local"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// Serve a session on a pipe, returning a connected client and
+// a channel receiving the error the session ended with.
+func serveTestSession(t *testing.T, ctx context.Context, opts *Options) (*Session, *Client, <-chan error) {
+	opts.Logger = LogFunc(func(string, ...interface{}) {})
+	server, client := net.Pipe()
+	s := NewSession(opts, mem.New(), server)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve(ctx)
+	}()
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c, errs
+}
+
+func waitServe(t *testing.T, errs <-chan error) error {
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to end")
+		return nil
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	// A client disconnecting is not an error.
+	_, c, errs := serveTestSession(t, context.Background(), &Options{})
+	_ = c.Close()
+	err := waitServe(t, errs)
+	if err != nil {
+		t.Fatalf("expected no error once the client disconnects, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, c, errs = serveTestSession(t, ctx, &Options{})
+	_, err = c.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	err = waitServe(t, errs)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// The connection was closed with the session.
+	_, err = c.Stat("/")
+	if err == nil {
+		t.Fatal("expected the session to be gone")
+	}
+	_ = c.Close()
+
+	s, c, errs := serveTestSession(t, context.Background(), &Options{})
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Close waits for Serve to return.
+	select {
+	case err = <-errs:
+	default:
+		t.Fatal("expected the session to have ended once Close returns")
+	}
+	if err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+	_ = c.Close()
+
+	_, c, errs = serveTestSession(t, context.Background(), &Options{IdleTimeout: 50 * time.Millisecond})
+	err = waitServe(t, errs)
+	if err != ErrSessionIdle {
+		t.Fatalf("expected ErrSessionIdle, got %v", err)
+	}
+	_ = c.Close()
+
+	// Sessions closed before being served end at once.
+	server, client := net.Pipe()
+	defer client.Close()
+	s = NewSession(&Options{Logger: LogFunc(func(string, ...interface{}) {})}, mem.New(), server)
+	_ = s.Close()
+	err = s.Serve(context.Background())
+	if err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestServeBandwidthLimitClose(t *testing.T) {
+	s, c, errs := serveTestSession(t, context.Background(), &Options{BandwidthLimit: 1000})
+	defer c.Close()
+	f, err := c.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Past the burst, writing this waits about a minute.
+	go func() {
+		_, _ = f.Write(make([]byte, 60000))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the session waited for the bandwidth limit")
+	}
+	if err := waitServe(t, errs); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestRealPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"real/dir", "sub"} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"link":       "real/dir",
+		"loop":       "loop",
+		"out":        "/",
+		"sub/toreal": "../real",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := &vfs.ChrootVFS{Fs: &local.Fs{}, Root: dir}
+
+	for _, tc := range []struct {
+		root     string
+		path     string
+		expected string
+	}{
+		{"", "/link", "/real/dir"},
+		{"", "link/new", "/real/dir/new"},
+		// Links out of the roots of the file system
+		// and session resolve to their own path.
+		{"", "/out/tmp", "/out/tmp"},
+		{"/sub", "toreal", "/sub/toreal"},
+		{"", "/sub/toreal", "/real"},
+	} {
+		opts := &Options{Root: tc.root, Logger: LogFunc(func(string, ...interface{}) {})}
+		server, client := net.Pipe()
+		go Serve(opts, fs, server)
+		c, err := NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := c.RealPath(tc.path)
+		_ = c.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if p != tc.expected {
+			t.Fatalf("%s: expected %s, got %s", tc.path, tc.expected, p)
+		}
+	}
+
+	server, client := net.Pipe()
+	go Serve(&Options{Logger: LogFunc(func(string, ...interface{}) {})}, fs, server)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.request(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpRealpathPacket{ID: id, Path: "/loop/x"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, ok := resp.(*protosftp.FxpStatusPacket)
+	if !ok || st.StatusError.Code != statusForVersion(protosftp.FX_LINK_LOOP, protosftp.ProtocolVersion) {
+		t.Fatalf("expected a link loop status, got %#v", resp)
+	}
+}
+
+func TestReaddirOptions(t *testing.T) {
+	opts := &Options{
+		ReaddirBatchSize: 2,
+		LongName: func(fi os.FileInfo, owner string, group string) string {
+			return fmt.Sprintf("%s %s:%s %d", fi.Name(), owner, group, fi.Size())
+		},
+	}
+	_, c, _ := serveTestSession(t, context.Background(), opts)
+	defer c.Close()
+	if err := c.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		f, err := c.OpenFile(fmt.Sprintf("/dir/%d", i), os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+	}
+
+	handle, err := c.requestHandle(func(id uint32) protosftp.Packet {
+		return &protosftp.FxpOpendirPacket{ID: id, Path: "/dir"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		resp, err := c.request(func(id uint32) protosftp.Packet {
+			return &protosftp.FxpReaddirPacket{ID: id, Handle: handle}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		np, ok := resp.(*protosftp.FxpNamePacket)
+		if !ok {
+			break
+		}
+		if len(np.NameAttrs) > 2 {
+			t.Fatalf("expected at most 2 entries, got %d", len(np.NameAttrs))
+		}
+		for _, na := range np.NameAttrs {
+			if na.LongName != na.Name+" user:user 3" {
+				t.Fatalf("unexpected long name %q", na.LongName)
+			}
+			names = append(names, na.Name)
+		}
+	}
+	if len(names) != 5 {
+		t.Fatalf("expected 5 entries, got %v", names)
+	}
+}
+
+// A file system that can only write at the offsets given.
+type offsetOnlyFs struct {
+	vfs.VFS
+}
+
+func (fs offsetOnlyFs) OpenFile(p string, flag int, perm os.FileMode) (vfs.File, error) {
+	if flag&os.O_APPEND != 0 {
+		return nil, vfs.ErrUnsupported
+	}
+	return fs.VFS.OpenFile(p, flag, perm)
+}
+
+func TestAppend(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fs   vfs.VFS
+	}{
+		{"native", mem.New()},
+		{"emulated", offsetOnlyFs{mem.New()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := serveFaults(t, context.Background(), tc.fs, &Options{MaxFileSize: 10})
+			defer c.Close()
+			f, err := c.OpenFile("/f", os.O_WRONLY|os.O_CREATE, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("abc")); err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+
+			f, err = c.OpenFile("/f", os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			// Appends ignore the offsets written at.
+			for _, data := range []string{"de", "fgh"} {
+				if _, err := f.WriteAt([]byte(data), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := f.WriteAt([]byte("ij"), 1); err != nil {
+				t.Fatal(err)
+			}
+			// The end of the file counts against MaxFileSize.
+			_, err = f.WriteAt([]byte("kl"), 0)
+			if err == nil || !strings.Contains(err.Error(), "file size limit exceeded") {
+				t.Fatalf("expected the quota to be exceeded, got %v", err)
+			}
+
+			g, err := c.Open("/f")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(g)
+			_ = g.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "abcdefghij" {
+				t.Fatalf("unexpected contents %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// The status codes errors are reported with, tried in order so that
+// specific errors come before others they also match, like ENOTEMPTY
+// which is also an os.ErrExist. The message is that of err, so it
+// never reveals the paths of the backend.
+var errorStatuses = []struct {
+	err  error
+	code uint32
+}{
+	{os.ErrNotExist, protosftp.FX_NO_SUCH_FILE},
+	{ErrPathNotAllowed, protosftp.FX_PERMISSION_DENIED},
+	{ErrOpNotAllowed, protosftp.FX_PERMISSION_DENIED},
+	{os.ErrPermission, protosftp.FX_PERMISSION_DENIED},
+	{ErrUnsupported, protosftp.FX_OP_UNSUPPORTED},
+	{vfs.ErrUnsupported, protosftp.FX_OP_UNSUPPORTED},
+	{ErrSessionExpired, protosftp.FX_FAILURE},
+	{ErrTooManyOpenFiles, protosftp.FX_FAILURE},
+	{ErrCheckFileTooLarge, protosftp.FX_FAILURE},
+	{ErrInvalidHandle, protosftp.FX_INVALID_HANDLE},
+	{syscall.EROFS, protosftp.FX_WRITE_PROTECT},
+	{syscall.ENOSPC, protosftp.FX_NO_SPACE_ON_FILESYSTEM},
+	{vfs.ErrQuotaExceeded, protosftp.FX_QUOTA_EXCEEDED},
+	{syscall.EDQUOT, protosftp.FX_QUOTA_EXCEEDED},
+	{syscall.ENOTEMPTY, protosftp.FX_DIR_NOT_EMPTY},
+	{os.ErrExist, protosftp.FX_FILE_ALREADY_EXISTS},
+	{syscall.ENOTDIR, protosftp.FX_NOT_A_DIRECTORY},
+	{syscall.ENAMETOOLONG, protosftp.FX_INVALID_FILENAME},
+	{syscall.ELOOP, protosftp.FX_LINK_LOOP},
+	{syscall.EISDIR, protosftp.FX_FILE_IS_A_DIRECTORY},
+	{ErrBadWrite, protosftp.FX_INVALID_PARAMETER},
+	{vfs.ErrCorrupt, protosftp.FX_FILE_CORRUPT},
+}
+
+// The version that introduced each status code newer than version 3,
+// and the code older clients are sent instead, mostly the one OpenSSH
+// reports the same errors with. Unknown codes are sent as FX_FAILURE.
+var statusFallbacks = map[uint32]struct {
+	version  uint32
+	fallback uint32
+}{
+	protosftp.FX_INVALID_HANDLE:              {4, protosftp.FX_FAILURE},
+	protosftp.FX_NO_SUCH_PATH:                {4, protosftp.FX_NO_SUCH_FILE},
+	protosftp.FX_FILE_ALREADY_EXISTS:         {4, protosftp.FX_FAILURE},
+	protosftp.FX_WRITE_PROTECT:               {4, protosftp.FX_PERMISSION_DENIED},
+	protosftp.FX_NO_MEDIA:                    {4, protosftp.FX_FAILURE},
+	protosftp.FX_NO_SPACE_ON_FILESYSTEM:      {5, protosftp.FX_FAILURE},
+	protosftp.FX_QUOTA_EXCEEDED:              {5, protosftp.FX_FAILURE},
+	protosftp.FX_UNKNOWN_PRINCIPAL:           {5, protosftp.FX_FAILURE},
+	protosftp.FX_LOCK_CONFLICT:               {5, protosftp.FX_FAILURE},
+	protosftp.FX_DIR_NOT_EMPTY:               {6, protosftp.FX_FAILURE},
+	protosftp.FX_NOT_A_DIRECTORY:             {6, protosftp.FX_NO_SUCH_FILE},
+	protosftp.FX_INVALID_FILENAME:            {6, protosftp.FX_FAILURE},
+	protosftp.FX_LINK_LOOP:                   {6, protosftp.FX_NO_SUCH_FILE},
+	protosftp.FX_CANNOT_DELETE:               {6, protosftp.FX_PERMISSION_DENIED},
+	protosftp.FX_INVALID_PARAMETER:           {6, protosftp.FX_FAILURE},
+	protosftp.FX_FILE_IS_A_DIRECTORY:         {6, protosftp.FX_FAILURE},
+	protosftp.FX_BYTE_RANGE_LOCK_CONFLICT:    {6, protosftp.FX_FAILURE},
+	protosftp.FX_BYTE_RANGE_LOCK_REFUSED:     {6, protosftp.FX_FAILURE},
+	protosftp.FX_DELETE_PENDING:              {6, protosftp.FX_FAILURE},
+	protosftp.FX_FILE_CORRUPT:                {6, protosftp.FX_FAILURE},
+	protosftp.FX_OWNER_INVALID:               {6, protosftp.FX_FAILURE},
+	protosftp.FX_GROUP_INVALID:               {6, protosftp.FX_FAILURE},
+	protosftp.FX_NO_MATCHING_BYTE_RANGE_LOCK: {6, protosftp.FX_FAILURE},
+}
+
+// code, or the code clients of version are sent instead
+// if it is newer than they are.
+func statusForVersion(code uint32, version uint32) uint32 {
+	if code <= protosftp.FX_OP_UNSUPPORTED {
+		return code
+	}
+	fb, ok := statusFallbacks[code]
+	if !ok {
+		return protosftp.FX_FAILURE
+	}
+	if version < fb.version {
+		return fb.fallback
+	}
+	return code
+}
+
+// The protocol version agreed with the client. Older clients
+// are answered as version 3 clients, the oldest version served.
+func (s *Session) version() uint32 {
+	switch {
+	case s.clientVersion < 3:
+		return 3
+	case s.clientVersion < protosftp.ProtocolVersion:
+		return s.clientVersion
+	}
+	return protosftp.ProtocolVersion
+}
+
+// The status code and message err is reported to the client with.
+func (s *Session) errorStatus(err error) (uint32, string) {
+	code, msg, ok := errorStatus(err, s.version())
+	if !ok {
+		s.Logf("unhandled/unexpected error: %s", err)
+	}
+	return code, msg
+}
+
+// The status code and message err is reported with to clients of
+// version, false if err is not one clients are told about. File
+// systems choose the status of their errors with a vfs.StatusError,
+// and sftp file systems pass on the statuses of their server.
+func errorStatus(err error, version uint32) (uint32, string, bool) {
+	if err == io.EOF {
+		return protosftp.FX_EOF, err.Error(), true
+	}
+	var vst *vfs.StatusError
+	if errors.As(err, &vst) && vst.Code != protosftp.FX_OK {
+		return statusForVersion(vst.Code, version), vst.Msg, true
+	}
+	var pst *protosftp.StatusError
+	if errors.As(err, &pst) && pst.Code != protosftp.FX_OK {
+		return statusForVersion(pst.Code, version), pst.Msg, true
+	}
+	for _, st := range errorStatuses {
+		if errors.Is(err, st.err) {
+			return statusForVersion(st.code, version), st.err.Error(), true
+		}
+	}
+	return protosftp.FX_FAILURE, "error", false
+}
@@ -0,0 +1,57 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+func TestErrorStatus(t *testing.T) {
+	pathErr := func(err error) error {
+		return &os.PathError{Op: "remove", Path: "/srv/share/d", Err: err}
+	}
+	for _, tc := range []struct {
+		err error
+		v3  uint32
+		v6  uint32
+		msg string
+		ok  bool
+	}{
+		{io.EOF, protosftp.FX_EOF, protosftp.FX_EOF, "EOF", true},
+		{pathErr(syscall.ENOENT), protosftp.FX_NO_SUCH_FILE, protosftp.FX_NO_SUCH_FILE, "file does not exist", true},
+		{pathErr(syscall.EACCES), protosftp.FX_PERMISSION_DENIED, protosftp.FX_PERMISSION_DENIED, "permission denied", true},
+		{os.ErrExist, protosftp.FX_FAILURE, protosftp.FX_FILE_ALREADY_EXISTS, "file already exists", true},
+		{pathErr(syscall.ENOTEMPTY), protosftp.FX_FAILURE, protosftp.FX_DIR_NOT_EMPTY, "directory not empty", true},
+		{pathErr(syscall.EISDIR), protosftp.FX_FAILURE, protosftp.FX_FILE_IS_A_DIRECTORY, "is a directory", true},
+		{pathErr(syscall.ENOSPC), protosftp.FX_FAILURE, protosftp.FX_NO_SPACE_ON_FILESYSTEM, "no space left on device", true},
+		{pathErr(syscall.ENAMETOOLONG), protosftp.FX_FAILURE, protosftp.FX_INVALID_FILENAME, "file name too long", true},
+		{pathErr(syscall.ENOTDIR), protosftp.FX_NO_SUCH_FILE, protosftp.FX_NOT_A_DIRECTORY, "not a directory", true},
+		{fmt.Errorf("writing: %w", vfs.ErrQuotaExceeded), protosftp.FX_FAILURE, protosftp.FX_QUOTA_EXCEEDED, "file size limit exceeded", true},
+		{ErrInvalidHandle, protosftp.FX_FAILURE, protosftp.FX_INVALID_HANDLE, "invalid handle", true},
+		// File systems may choose the status themselves.
+		{fmt.Errorf("upload: %w", &vfs.StatusError{Code: protosftp.FX_QUOTA_EXCEEDED, Msg: "account full"}),
+			protosftp.FX_FAILURE, protosftp.FX_QUOTA_EXCEEDED, "account full", true},
+		{&vfs.StatusError{Code: protosftp.FX_NO_SUCH_PATH, Msg: "no parent"}, protosftp.FX_NO_SUCH_FILE, protosftp.FX_NO_SUCH_PATH, "no parent", true},
+		{&vfs.StatusError{Code: 1000, Msg: "odd"}, protosftp.FX_FAILURE, protosftp.FX_FAILURE, "odd", true},
+		{&protosftp.StatusError{Code: protosftp.FX_FAILURE, Msg: "upstream failed"}, protosftp.FX_FAILURE, protosftp.FX_FAILURE, "upstream failed", true},
+		// Errors never succeed.
+		{&vfs.StatusError{Code: protosftp.FX_OK, Msg: "ok", Err: os.ErrExist}, protosftp.FX_FAILURE, protosftp.FX_FILE_ALREADY_EXISTS, "file already exists", true},
+		{fmt.Errorf("backend broke"), protosftp.FX_FAILURE, protosftp.FX_FAILURE, "error", false},
+	} {
+		for _, v := range []struct {
+			version uint32
+			code    uint32
+		}{{3, tc.v3}, {6, tc.v6}} {
+			code, msg, ok := errorStatus(tc.err, v.version)
+			if code != v.code || msg != tc.msg || ok != tc.ok {
+				t.Fatalf("%v for version %d: got %d %q %v, expected %d %q %v",
+					tc.err, v.version, code, msg, ok, v.code, tc.msg, tc.ok)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package sftp
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type transfer struct {
+	path         string
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// Record the bytes transferred through h.
+func (s *Session) addTransfer(h *handle) {
+	t := transfer{
+		path:         h.Path,
+		bytesRead:    atomic.LoadInt64(&h.bytesRead),
+		bytesWritten: atomic.LoadInt64(&h.bytesWritten),
+	}
+	if t.bytesRead == 0 && t.bytesWritten == 0 {
+		return
+	}
+	s.transfersLock.Lock()
+	s.transfers = append(s.transfers, t)
+	s.transfersLock.Unlock()
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// Log the files uploaded and downloaded during the session, called
+// once the session has finished and its handles are closed.
+func (s *Session) logSummary() {
+	s.transfersLock.Lock()
+	defer s.transfersLock.Unlock()
+
+	nUploaded, nDownloaded := 0, 0
+	var bytesUploaded, bytesDownloaded int64
+	for _, t := range s.transfers {
+		if t.bytesWritten != 0 {
+			nUploaded += 1
+			bytesUploaded += t.bytesWritten
+		}
+		if t.bytesRead != 0 {
+			nDownloaded += 1
+			bytesDownloaded += t.bytesRead
+		}
+	}
+
+	s.Logf("session summary: duration %s, client version %d, client extensions [%s], uploaded %s (%d bytes), downloaded %s (%d bytes)",
+		time.Since(s.start).Round(time.Millisecond), s.clientVersion, strings.Join(s.clientExtensions, " "),
+		plural(nUploaded, "file"), bytesUploaded, plural(nDownloaded, "file"), bytesDownloaded)
+
+	for _, t := range s.transfers {
+		if t.bytesWritten != 0 {
+			s.Logf("uploaded %s (%d bytes)", t.path, t.bytesWritten)
+		}
+		if t.bytesRead != 0 {
+			s.Logf("downloaded %s (%d bytes)", t.path, t.bytesRead)
+		}
+	}
+}
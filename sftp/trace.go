@@ -0,0 +1,148 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+)
+
+// A Tracer records every packet sent and received by the sessions
+// using it, one JSON object per line with the fields time, session,
+// dir ("recv" or "send"), type, id and length. With payloads the
+// packet field holds the whole packet in hex, length included, so
+// the packets a client sent can be replayed with ReplayTrace.
+type Tracer struct {
+	jsonWriter
+	payloads bool
+}
+
+func NewTracer(w io.Writer, payloads bool) *Tracer {
+	t := &Tracer{payloads: payloads}
+	t.enc = json.NewEncoder(w)
+	return t
+}
+
+// A packet in a trace.
+type TraceRecord struct {
+	Time    string `json:"time"`
+	Session string `json:"session,omitempty"`
+	Dir     string `json:"dir"`
+	Type    string `json:"type"`
+	// The request id, or the protocol version of
+	// FXP_INIT and FXP_VERSION packets.
+	ID     uint32 `json:"id"`
+	Length uint32 `json:"length"`
+	Packet string `json:"packet,omitempty"`
+}
+
+func (t *Tracer) record(session, dir string, pkt []byte) {
+	rec := &TraceRecord{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Session: session,
+		Dir:     dir,
+		Type:    "unknown",
+		Length:  binary.BigEndian.Uint32(pkt),
+	}
+	if len(pkt) > 4 {
+		rec.Type = protosftp.PacketTypeName(pkt[4])
+	}
+	if len(pkt) >= 9 {
+		rec.ID = binary.BigEndian.Uint32(pkt[5:])
+	}
+	if t.payloads {
+		rec.Packet = hex.EncodeToString(pkt)
+	}
+	t.write(rec)
+}
+
+// Splits the bytes passing one way into packets to record.
+type traceStream struct {
+	t       *Tracer
+	session string
+	dir     string
+	// Bytes of the packet not yet complete.
+	buf []byte
+}
+
+func (ts *traceStream) add(b []byte) {
+	ts.buf = append(ts.buf, b...)
+	for len(ts.buf) >= 4 {
+		n := 4 + uint64(binary.BigEndian.Uint32(ts.buf))
+		if uint64(len(ts.buf)) < n {
+			return
+		}
+		ts.t.record(ts.session, ts.dir, ts.buf[:n])
+		ts.buf = append(ts.buf[:0], ts.buf[n:]...)
+	}
+}
+
+// Records the packets read from and written to rw.
+type tracingReadWriter struct {
+	rw   io.ReadWriter
+	recv traceStream
+	send traceStream
+}
+
+func (t *Tracer) wrap(rw io.ReadWriter, session string) *tracingReadWriter {
+	return &tracingReadWriter{
+		rw:   rw,
+		recv: traceStream{t: t, session: session, dir: "recv"},
+		send: traceStream{t: t, session: session, dir: "send"},
+	}
+}
+
+func (t *tracingReadWriter) Read(buf []byte) (int, error) {
+	n, err := t.rw.Read(buf)
+	t.recv.add(buf[:n])
+	return n, err
+}
+
+func (t *tracingReadWriter) Write(buf []byte) (int, error) {
+	n, err := t.rw.Write(buf)
+	t.send.add(buf[:n])
+	return n, err
+}
+
+func (t *tracingReadWriter) Close() error {
+	if c, ok := t.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Write the packets received in a trace to w, in the order they were
+// received, such as to a session to reproduce what a client did.
+// If session is not empty only the packets of that session are
+// written. The trace must have been recorded with payloads.
+func ReplayTrace(trace io.Reader, session string, w io.Writer) error {
+	dec := json.NewDecoder(trace)
+	for {
+		rec := &TraceRecord{}
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Dir != "recv" || (session != "" && rec.Session != session) {
+			continue
+		}
+		if rec.Packet == "" {
+			return fmt.Errorf("trace of %s packet %d has no payload", rec.Type, rec.ID)
+		}
+		pkt, err := hex.DecodeString(rec.Packet)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(pkt)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestTrace(t *testing.T) {
+	var trace bytes.Buffer
+	server, client := net.Pipe()
+	opts := &Options{
+		Tracer:    NewTracer(&trace, true),
+		SessionID: "a",
+		Logger:    LogFunc(func(string, ...interface{}) {}),
+	}
+	done := make(chan struct{})
+	go func() {
+		Serve(opts, mem.New(), server)
+		close(done)
+	}()
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	_ = c.Close()
+	<-done
+
+	var recs []*TraceRecord
+	dec := json.NewDecoder(bytes.NewReader(trace.Bytes()))
+	for {
+		rec := &TraceRecord{}
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	// Packets sent and received may be recorded in either order.
+	var types []string
+	var write *TraceRecord
+	for _, dir := range []string{"recv", "send"} {
+		for _, rec := range recs {
+			if rec.Session != "a" || rec.Packet == "" {
+				t.Fatalf("unexpected record %#v", rec)
+			}
+			if rec.Dir == dir {
+				types = append(types, rec.Dir+" "+rec.Type)
+			}
+			if rec.Type == "FXP_WRITE" {
+				write = rec
+			}
+		}
+	}
+	expected := []string{
+		"recv FXP_INIT", "recv FXP_OPEN", "recv FXP_WRITE", "recv FXP_CLOSE",
+		"send FXP_VERSION", "send FXP_HANDLE", "send FXP_STATUS", "send FXP_STATUS",
+	}
+	if len(types) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, types)
+		}
+	}
+	if write.Length != 1+4+4+1+8+4+5 {
+		t.Fatalf("unexpected write length %d", write.Length)
+	}
+
+	// Replaying the trace to another session repeats the upload.
+	fs := mem.New()
+	server, client = net.Pipe()
+	opts = &Options{Logger: LogFunc(func(string, ...interface{}) {})}
+	done = make(chan struct{})
+	go func() {
+		Serve(opts, fs, server)
+		close(done)
+	}()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, client)
+	}()
+	err = ReplayTrace(bytes.NewReader(trace.Bytes()), "a", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	<-done
+	r, err := fs.Open("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected the replayed upload, got %q", data)
+	}
+}
@@ -0,0 +1,56 @@
+package sftp
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/andrewchambers/sftpplease/sftp/protosftp"
+)
+
+// A packetWriter buffers response packets to the client, the
+// session flushes it once there are no more responses ready to
+// send, so bursts of small responses cost a single write.
+//
+// Packets are written in the order they were passed to Session.Respond.
+// Requests for a handle are processed one at a time by the handle's
+// goroutine, which responds before taking the next request, so the
+// responses for a given handle are always written in request order.
+type packetWriter struct {
+	bw *bufio.Writer
+}
+
+func newPacketWriter(w io.Writer) *packetWriter {
+	return &packetWriter{
+		bw: bufio.NewWriterSize(w, 64*1024),
+	}
+}
+
+func (pw *packetWriter) WritePacket(p protosftp.Packet) error {
+	return protosftp.WritePacket(pw.bw, p)
+}
+
+func (pw *packetWriter) Flush() error {
+	return pw.bw.Flush()
+}
+
+// Write resp and any other responses already queued in the
+// outbox, then flush them to the client.
+func (s *Session) writeResponses(pw *packetWriter, resp protosftp.Packet) error {
+	for {
+		if s.Options.Debug {
+			s.Logf("sending response: %#v", resp)
+		}
+		err := pw.WritePacket(resp)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case resp = <-s.outbox:
+			continue
+		default:
+		}
+
+		return pw.Flush()
+	}
+}
@@ -0,0 +1,30 @@
+// Package version identifies the sftpplease build, release builds
+// set it at link time with:
+//
+//	-ldflags "-X github.com/andrewchambers/sftpplease/version.Version=v1.2.3"
+package version
+
+import (
+	"runtime/debug"
+)
+
+var Version = ""
+
+const Name = "sftpplease"
+
+// The version of this build, from the linker flag, the module
+// version if built with go install, or "devel".
+func Get() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+// The name and version, e.g. "sftpplease v1.2.3".
+func String() string {
+	return Name + " " + Get()
+}
@@ -0,0 +1,359 @@
+// Package aferofs converts between afero file systems and vfs.VFS, so
+// afero backends can be served over sftp and a vfs.VFS can be used by
+// code written against afero.
+//
+// Paths passed to the afero.Fs are cleaned and rooted at "/", wrap an
+// afero.OsFs in an afero.BasePathFs to serve a single directory.
+package aferofs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/spf13/afero"
+)
+
+// Unwrap the errors of afero backends, which wrap os.ErrNotExist
+// and friends in *os.PathError or return syscall errors.
+func fixErr(err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return os.ErrNotExist
+	case os.IsExist(err):
+		return os.ErrExist
+	case os.IsPermission(err):
+		return os.ErrPermission
+	}
+	return err
+}
+
+// Fs serves an afero.Fs as a vfs.VFS.
+type Fs struct {
+	fs afero.Fs
+}
+
+func New(fs afero.Fs) *Fs {
+	return &Fs{fs: fs}
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (afs *Fs) Chmod(p string, mode os.FileMode) error {
+	return fixErr(afs.fs.Chmod(cleanPath(p), mode))
+}
+
+func (afs *Fs) Chtimes(p string, atime time.Time, mtime time.Time) error {
+	return fixErr(afs.fs.Chtimes(cleanPath(p), atime, mtime))
+}
+
+func (afs *Fs) Open(p string) (vfs.File, error) {
+	return afs.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (afs *Fs) OpenFile(p string, flag int, perm os.FileMode) (vfs.File, error) {
+	p = cleanPath(p)
+	f, err := afs.fs.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return &File{fs: afs, f: f, fpath: p}, nil
+}
+
+func (afs *Fs) Mkdir(p string, perm os.FileMode) error {
+	return fixErr(afs.fs.Mkdir(cleanPath(p), perm))
+}
+
+func (afs *Fs) Stat(p string) (os.FileInfo, error) {
+	fi, err := afs.fs.Stat(cleanPath(p))
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return fi, nil
+}
+
+func (afs *Fs) Rename(from, to string) error {
+	return fixErr(afs.fs.Rename(cleanPath(from), cleanPath(to)))
+}
+
+func (afs *Fs) Remove(p string) error {
+	return fixErr(afs.fs.Remove(cleanPath(p)))
+}
+
+func (afs *Fs) Link(oldname, newname string) error {
+	return vfs.ErrUnsupported
+}
+
+func (afs *Fs) Close() error {
+	return nil
+}
+
+type File struct {
+	fs    *Fs
+	f     afero.File
+	fpath string
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return fixErr(f.fs.fs.Chmod(f.fpath, mode))
+}
+
+func (f *File) Read(buf []byte) (int, error) {
+	n, err := f.f.Read(buf)
+	return n, fixErr(err)
+}
+
+func (f *File) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := f.f.ReadAt(buf, off)
+	return n, fixErr(err)
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	fis, err := f.f.Readdir(n)
+	return fis, fixErr(err)
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	names, err := f.f.Readdirnames(n)
+	return names, fixErr(err)
+}
+
+func (f *File) Write(buf []byte) (int, error) {
+	n, err := f.f.Write(buf)
+	return n, fixErr(err)
+}
+
+func (f *File) WriteAt(buf []byte, off int64) (int, error) {
+	n, err := f.f.WriteAt(buf, off)
+	return n, fixErr(err)
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return fi, nil
+}
+
+func (f *File) Sync() error {
+	return fixErr(f.f.Sync())
+}
+
+func (f *File) Close() error {
+	return fixErr(f.f.Close())
+}
+
+// AferoFs presents a vfs.VFS as an afero.Fs. Truncate is not supported
+// by vfs.VFS and returns vfs.ErrUnsupported, as does Chtimes unless the
+// vfs.VFS is a vfs.Chtimeser.
+type AferoFs struct {
+	Fs vfs.VFS
+}
+
+func (a *AferoFs) Name() string {
+	return "sftpplease"
+}
+
+func (a *AferoFs) Create(name string) (afero.File, error) {
+	return a.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (a *AferoFs) Mkdir(name string, perm os.FileMode) error {
+	return a.Fs.Mkdir(name, perm)
+}
+
+func (a *AferoFs) MkdirAll(p string, perm os.FileMode) error {
+	p = cleanPath(p)
+	fi, err := a.Fs.Stat(p)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+		}
+		return nil
+	}
+	if p != "/" {
+		err = a.MkdirAll(path.Dir(p), perm)
+		if err != nil {
+			return err
+		}
+	}
+	err = a.Fs.Mkdir(p, perm)
+	if err != nil {
+		// Lost a race with another caller.
+		if fi, serr := a.Fs.Stat(p); serr == nil && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *AferoFs) Open(name string) (afero.File, error) {
+	return a.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (a *AferoFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := a.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &AferoFile{F: f, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (a *AferoFs) Remove(name string) error {
+	return a.Fs.Remove(name)
+}
+
+func (a *AferoFs) RemoveAll(p string) error {
+	fi, err := a.Fs.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) || err == os.ErrNotExist {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		d, err := a.Fs.Open(p)
+		if err != nil {
+			return err
+		}
+		names, err := d.Readdirnames(-1)
+		_ = d.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = a.RemoveAll(path.Join(p, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return a.Fs.Remove(p)
+}
+
+func (a *AferoFs) Rename(oldname, newname string) error {
+	return a.Fs.Rename(oldname, newname)
+}
+
+func (a *AferoFs) Stat(name string) (os.FileInfo, error) {
+	return a.Fs.Stat(name)
+}
+
+func (a *AferoFs) Chmod(name string, mode os.FileMode) error {
+	return a.Fs.Chmod(name, mode)
+}
+
+func (a *AferoFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	ct, ok := a.Fs.(vfs.Chtimeser)
+	if !ok {
+		return vfs.ErrUnsupported
+	}
+	return ct.Chtimes(name, atime, mtime)
+}
+
+// AferoFile presents a vfs.File as an afero.File. Reads and writes
+// go through ReadAt and WriteAt so the file can seek, except writes
+// to files opened with os.O_APPEND.
+type AferoFile struct {
+	F      vfs.File
+	append bool
+
+	lock   sync.Mutex
+	offset int64
+}
+
+func (af *AferoFile) Name() string {
+	return af.F.Name()
+}
+
+func (af *AferoFile) Read(buf []byte) (int, error) {
+	af.lock.Lock()
+	defer af.lock.Unlock()
+	n, err := af.F.ReadAt(buf, af.offset)
+	af.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (af *AferoFile) ReadAt(buf []byte, off int64) (int, error) {
+	return af.F.ReadAt(buf, off)
+}
+
+func (af *AferoFile) Seek(offset int64, whence int) (int64, error) {
+	af.lock.Lock()
+	defer af.lock.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += af.offset
+	case io.SeekEnd:
+		fi, err := af.F.Stat()
+		if err != nil {
+			return af.offset, err
+		}
+		offset += fi.Size()
+	default:
+		return af.offset, os.ErrInvalid
+	}
+	if offset < 0 {
+		return af.offset, os.ErrInvalid
+	}
+	af.offset = offset
+	return offset, nil
+}
+
+func (af *AferoFile) Write(buf []byte) (int, error) {
+	af.lock.Lock()
+	defer af.lock.Unlock()
+	if af.append {
+		return af.F.Write(buf)
+	}
+	n, err := af.F.WriteAt(buf, af.offset)
+	af.offset += int64(n)
+	return n, err
+}
+
+func (af *AferoFile) WriteAt(buf []byte, off int64) (int, error) {
+	return af.F.WriteAt(buf, off)
+}
+
+func (af *AferoFile) WriteString(s string) (int, error) {
+	return af.Write([]byte(s))
+}
+
+func (af *AferoFile) Readdir(n int) ([]os.FileInfo, error) {
+	return af.F.Readdir(n)
+}
+
+func (af *AferoFile) Readdirnames(n int) ([]string, error) {
+	return af.F.Readdirnames(n)
+}
+
+func (af *AferoFile) Stat() (os.FileInfo, error) {
+	return af.F.Stat()
+}
+
+func (af *AferoFile) Sync() error {
+	return af.F.Sync()
+}
+
+func (af *AferoFile) Truncate(size int64) error {
+	return vfs.ErrUnsupported
+}
+
+func (af *AferoFile) Close() error {
+	return af.F.Close()
+}
@@ -0,0 +1,122 @@
+package aferofs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+	"github.com/spf13/afero"
+)
+
+func TestFs(t *testing.T) {
+	fs := New(afero.NewMemMapFs())
+
+	err := fs.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("/d/f", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = fs.Open("/d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	n, err := f.ReadAt(buf, 6)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Fatalf("unexpected read %q", buf[:n])
+	}
+	_ = f.Close()
+
+	d, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+	if !reflect.DeepEqual(names, []string{"f"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	err = fs.Rename("/d/f", "/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/d/f"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if _, err := fs.Open("/missing"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	err = fs.Remove("/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAferoFs(t *testing.T) {
+	a := &AferoFs{Fs: mem.New()}
+
+	err := a.MkdirAll("/a/b/c", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = afero.WriteFile(a, "/a/b/c/f", []byte("hello world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := a.Open("/a/b/c/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Seek(-5, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if string(data) != "world" {
+		t.Fatalf("unexpected read %q", data)
+	}
+
+	exists, err := afero.DirExists(a, "/a/b")
+	if err != nil || !exists {
+		t.Fatalf("expected /a/b to exist, %v", err)
+	}
+
+	err = a.RemoveAll("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Stat("/a"); !os.IsNotExist(err) && err != os.ErrNotExist {
+		t.Fatalf("expected not exist, got %v", err)
+	}
+	err = a.RemoveAll("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
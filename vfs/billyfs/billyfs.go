@@ -0,0 +1,287 @@
+// Package billyfs serves a go-billy file system, such as memfs or osfs,
+// as a vfs.VFS.
+//
+// Paths passed to the billy.Filesystem are cleaned and rooted at "/",
+// osfs.New(dir) serves only dir.
+package billyfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/go-git/go-billy/v5"
+)
+
+// Unwrap the errors of billy file systems and map
+// their own sentinel errors to those of vfs.
+func fixErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == billy.ErrReadOnly:
+		return os.ErrPermission
+	case err == billy.ErrNotSupported:
+		return vfs.ErrUnsupported
+	case os.IsNotExist(err):
+		return os.ErrNotExist
+	case os.IsExist(err):
+		return os.ErrExist
+	case os.IsPermission(err):
+		return os.ErrPermission
+	}
+	return err
+}
+
+type Fs struct {
+	fs billy.Filesystem
+}
+
+func New(fs billy.Filesystem) *Fs {
+	return &Fs{fs: fs}
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// Some billy file systems, such as memfs, have
+// no entry for their root directory.
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "/" }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (rootInfo) ModTime() time.Time { return time.Time{} }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() interface{}   { return nil }
+
+func (bfs *Fs) stat(p string) (os.FileInfo, error) {
+	fi, err := bfs.fs.Stat(p)
+	if err != nil {
+		if p == "/" && os.IsNotExist(err) {
+			return rootInfo{}, nil
+		}
+		return nil, fixErr(err)
+	}
+	return fi, nil
+}
+
+func (bfs *Fs) Chmod(p string, mode os.FileMode) error {
+	ch, ok := bfs.fs.(billy.Change)
+	if !ok {
+		return vfs.ErrUnsupported
+	}
+	return fixErr(ch.Chmod(cleanPath(p), mode))
+}
+
+func (bfs *Fs) Chtimes(p string, atime time.Time, mtime time.Time) error {
+	ch, ok := bfs.fs.(billy.Change)
+	if !ok {
+		return vfs.ErrUnsupported
+	}
+	return fixErr(ch.Chtimes(cleanPath(p), atime, mtime))
+}
+
+func (bfs *Fs) Open(p string) (vfs.File, error) {
+	return bfs.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (bfs *Fs) OpenFile(p string, flag int, perm os.FileMode) (vfs.File, error) {
+	p = cleanPath(p)
+	// Not all billy file systems can open directories,
+	// they are listed with ReadDir instead.
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		fi, err := bfs.stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			return &File{fs: bfs, fpath: p}, nil
+		}
+	}
+	f, err := bfs.fs.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return &File{fs: bfs, f: f, fpath: p}, nil
+}
+
+// Billy only has MkdirAll, so check what it would
+// silently do before calling it.
+func (bfs *Fs) Mkdir(p string, perm os.FileMode) error {
+	p = cleanPath(p)
+	_, err := bfs.stat(p)
+	if err == nil {
+		return os.ErrExist
+	}
+	parent, err := bfs.stat(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return os.ErrNotExist
+	}
+	return fixErr(bfs.fs.MkdirAll(p, perm))
+}
+
+func (bfs *Fs) Stat(p string) (os.FileInfo, error) {
+	return bfs.stat(cleanPath(p))
+}
+
+func (bfs *Fs) Rename(from, to string) error {
+	return fixErr(bfs.fs.Rename(cleanPath(from), cleanPath(to)))
+}
+
+func (bfs *Fs) Remove(p string) error {
+	return fixErr(bfs.fs.Remove(cleanPath(p)))
+}
+
+func (bfs *Fs) Link(oldname, newname string) error {
+	return vfs.ErrUnsupported
+}
+
+func (bfs *Fs) Close() error {
+	return nil
+}
+
+// File is an open billy.File, or a directory if f is nil.
+type File struct {
+	fs    *Fs
+	f     billy.File
+	fpath string
+
+	// Billy files only have a single offset,
+	// so WriteAt must seek and restore it.
+	lock sync.Mutex
+
+	listed  bool
+	dirents []os.FileInfo
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return f.fs.Chmod(f.fpath, mode)
+}
+
+func (f *File) Read(buf []byte) (int, error) {
+	if f.f == nil {
+		return 0, vfs.ErrUnsupported
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.f.Read(buf)
+	return n, fixErr(err)
+}
+
+func (f *File) ReadAt(buf []byte, off int64) (int, error) {
+	if f.f == nil {
+		return 0, vfs.ErrUnsupported
+	}
+	n, err := f.f.ReadAt(buf, off)
+	return n, fixErr(err)
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.f != nil {
+		return nil, vfs.ErrUnsupported
+	}
+	if !f.listed {
+		fis, err := f.fs.fs.ReadDir(f.fpath)
+		if err != nil {
+			return nil, fixErr(err)
+		}
+		f.dirents = fis
+		f.listed = true
+	}
+
+	if n <= 0 {
+		fis := f.dirents
+		f.dirents = nil
+		return fis, nil
+	}
+	if len(f.dirents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirents) {
+		n = len(f.dirents)
+	}
+	fis := f.dirents[:n]
+	f.dirents = f.dirents[n:]
+	return fis, nil
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *File) Write(buf []byte) (int, error) {
+	if f.f == nil {
+		return 0, vfs.ErrUnsupported
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.f.Write(buf)
+	return n, fixErr(err)
+}
+
+func (f *File) WriteAt(buf []byte, off int64) (int, error) {
+	if f.f == nil {
+		return 0, vfs.ErrUnsupported
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	cur, err := f.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fixErr(err)
+	}
+	_, err = f.f.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, fixErr(err)
+	}
+	n, err := f.f.Write(buf)
+	_, serr := f.f.Seek(cur, io.SeekStart)
+	if err == nil {
+		err = serr
+	}
+	return n, fixErr(err)
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	// Most billy files can stat themselves, though
+	// it is not part of the interface.
+	if st, ok := f.f.(interface{ Stat() (os.FileInfo, error) }); ok {
+		fi, err := st.Stat()
+		if err != nil {
+			return nil, fixErr(err)
+		}
+		return fi, nil
+	}
+	return f.fs.stat(f.fpath)
+}
+
+func (f *File) Sync() error {
+	return nil
+}
+
+func (f *File) Close() error {
+	if f.f == nil {
+		return nil
+	}
+	return fixErr(f.f.Close())
+}
@@ -0,0 +1,120 @@
+package billyfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+func TestBillyFs(t *testing.T) {
+	fs := New(memfs.New())
+
+	fi, err := fs.Stat("/")
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("expected root directory, %v", err)
+	}
+	err = fs.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/d", 0755); err != os.ErrExist {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+	if err := fs.Mkdir("/missing/d", 0755); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	f, err := fs.OpenFile("/d/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("hello "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("world"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("H"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sequential writes continue from where they were.
+	_, err = f.Write([]byte("W"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = fs.Open("/d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Hello World" {
+		t.Fatalf("unexpected contents %q", data)
+	}
+	fi, err = f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 11 {
+		t.Fatalf("unexpected size %d", fi.Size())
+	}
+	_ = f.Close()
+
+	d, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"d"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+	_ = d.Close()
+
+	d, err = fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err = d.Readdirnames(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"f"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+	if _, err := d.Readdirnames(1); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	_ = d.Close()
+
+	err = fs.Rename("/d/f", "/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/d/f"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if _, err := fs.Open("/missing"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	err = fs.Remove("/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
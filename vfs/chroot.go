@@ -0,0 +1,269 @@
+package vfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ChrootVFS confines all paths to the directory Root of Fs, every
+// path is cleaned as if it were absolute and then joined to Root,
+// so ".." can never escape the root.
+//
+// If Fs resolves symbolic links, as a RealPather, paths are resolved
+// before they are used and those leading outside of Root fail with a
+// permission error. Operations on links themselves, like removing or
+// renaming them, only resolve the directory the link is in. A link
+// swapped for another between the check and its use can still escape.
+type ChrootVFS struct {
+	Fs   VFS
+	Root string
+}
+
+func (c *ChrootVFS) realPath(p string) string {
+	return path.Join(c.Root, path.Clean("/"+p))
+}
+
+// Map p to its real path, checking the links in it don't lead outside
+// of Root. Unless follow is set, a link at the end of p is not resolved.
+func (c *ChrootVFS) confinedPath(op string, p string, follow bool) (string, error) {
+	real := c.realPath(p)
+	root := path.Clean(c.Root)
+	if root == "/" {
+		return real, nil
+	}
+	check := real
+	if !follow && real != root {
+		check = path.Dir(real)
+	}
+	resolved, err := RealPath(c.Fs, check)
+	if err != nil {
+		return "", c.fixErr(err)
+	}
+	// Root itself may be reached through links.
+	resolvedRoot, err := RealPath(c.Fs, root)
+	if err != nil {
+		return "", c.fixErr(err)
+	}
+	if resolvedRoot != "/" && resolved != resolvedRoot && !strings.HasPrefix(resolved, resolvedRoot+"/") {
+		return "", &os.PathError{Op: op, Path: path.Clean("/" + p), Err: os.ErrPermission}
+	}
+	return real, nil
+}
+
+func (c *ChrootVFS) virtualPath(p string) string {
+	root := path.Clean(c.Root)
+	if root == "/" {
+		return p
+	}
+	if p == root {
+		return "/"
+	}
+	if strings.HasPrefix(p, root+"/") {
+		return p[len(root):]
+	}
+	return p
+}
+
+// Rewrite real paths in errors so they are not leaked to clients.
+func (c *ChrootVFS) fixErr(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return &os.PathError{Op: e.Op, Path: c.virtualPath(e.Path), Err: e.Err}
+	case *os.LinkError:
+		return &os.LinkError{Op: e.Op, Old: c.virtualPath(e.Old), New: c.virtualPath(e.New), Err: e.Err}
+	}
+	return err
+}
+
+func (c *ChrootVFS) wrapFile(f File, err error) (File, error) {
+	if err != nil {
+		return nil, c.fixErr(err)
+	}
+	return &ChrootFile{File: f, c: c}, nil
+}
+
+func (c *ChrootVFS) Chmod(name string, mode os.FileMode) error {
+	real, err := c.confinedPath("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	return c.fixErr(c.Fs.Chmod(real, mode))
+}
+
+func (c *ChrootVFS) Open(path string) (File, error) {
+	real, err := c.confinedPath("open", path, true)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrapFile(c.Fs.Open(real))
+}
+
+func (c *ChrootVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	real, err := c.confinedPath("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrapFile(c.Fs.OpenFile(real, flag, perm))
+}
+
+func (c *ChrootVFS) Mkdir(path string, perm os.FileMode) error {
+	real, err := c.confinedPath("mkdir", path, false)
+	if err != nil {
+		return err
+	}
+	return c.fixErr(c.Fs.Mkdir(real, perm))
+}
+
+func (c *ChrootVFS) Stat(path string) (os.FileInfo, error) {
+	real, err := c.confinedPath("stat", path, true)
+	if err != nil {
+		return nil, err
+	}
+	st, err := c.Fs.Stat(real)
+	return st, c.fixErr(err)
+}
+
+func (c *ChrootVFS) Rename(from, to string) error {
+	realFrom, err := c.confinedPath("rename", from, false)
+	if err != nil {
+		return err
+	}
+	realTo, err := c.confinedPath("rename", to, false)
+	if err != nil {
+		return err
+	}
+	return c.fixErr(c.Fs.Rename(realFrom, realTo))
+}
+
+func (c *ChrootVFS) Remove(path string) error {
+	real, err := c.confinedPath("remove", path, false)
+	if err != nil {
+		return err
+	}
+	return c.fixErr(c.Fs.Remove(real))
+}
+
+func (c *ChrootVFS) Link(oldname, newname string) error {
+	realOld, err := c.confinedPath("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	realNew, err := c.confinedPath("link", newname, false)
+	if err != nil {
+		return err
+	}
+	return c.fixErr(c.Fs.Link(realOld, realNew))
+}
+
+func (c *ChrootVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := c.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	real, err := c.confinedPath("checksum", path, true)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := cs.Checksum(real, algorithm)
+	return sum, c.fixErr(err)
+}
+
+func (c *ChrootVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(c.Fs)
+}
+
+// Links leading outside of Root resolve to their own path.
+func (c *ChrootVFS) RealPath(p string) (string, error) {
+	real, err := RealPath(c.Fs, c.realPath(p))
+	if err != nil {
+		return "", c.fixErr(err)
+	}
+	root, err := RealPath(c.Fs, path.Clean(c.Root))
+	if err != nil {
+		return "", c.fixErr(err)
+	}
+	if root == "/" {
+		return real, nil
+	}
+	if real == root {
+		return "/", nil
+	}
+	if !strings.HasPrefix(real, root+"/") {
+		return path.Clean("/" + p), nil
+	}
+	return real[len(root):], nil
+}
+
+func (c *ChrootVFS) AppendSupported() bool {
+	return AppendSupported(c.Fs)
+}
+
+func (c *ChrootVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	ct, ok := c.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	real, err := c.confinedPath("chtimes", path, true)
+	if err != nil {
+		return err
+	}
+	return c.fixErr(ct.Chtimes(real, atime, mtime))
+}
+
+func (c *ChrootVFS) RemoveBatch(paths []string) error {
+	real := make([]string, len(paths))
+	for i, p := range paths {
+		var err error
+		real[i], err = c.confinedPath("remove", p, false)
+		if err != nil {
+			return err
+		}
+	}
+	return c.fixErr(RemoveBatch(c.Fs, real))
+}
+
+func (c *ChrootVFS) RenameBatch(renames []Rename) error {
+	real := make([]Rename, len(renames))
+	for i, r := range renames {
+		from, err := c.confinedPath("rename", r.From, false)
+		if err != nil {
+			return err
+		}
+		to, err := c.confinedPath("rename", r.To, false)
+		if err != nil {
+			return err
+		}
+		real[i] = Rename{From: from, To: to}
+	}
+	return c.fixErr(RenameBatch(c.Fs, real))
+}
+
+func (c *ChrootVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := c.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (c *ChrootVFS) WithContext(ctx context.Context) VFS {
+	copy := *c
+	copy.Fs = WithContext(c.Fs, ctx)
+	return &copy
+}
+
+func (c *ChrootVFS) Close() error {
+	return c.Fs.Close()
+}
+
+type ChrootFile struct {
+	File
+	c *ChrootVFS
+}
+
+func (cf *ChrootFile) Name() string {
+	return cf.c.virtualPath(cf.File.Name())
+}
@@ -0,0 +1,45 @@
+package vfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestChrootPaths(t *testing.T) {
+	c := &ChrootVFS{Root: "/srv/sftp"}
+
+	for _, tc := range []struct {
+		in, real string
+	}{
+		{"/", "/srv/sftp"},
+		{"", "/srv/sftp"},
+		{"foo", "/srv/sftp/foo"},
+		{"/foo/bar", "/srv/sftp/foo/bar"},
+		{"..", "/srv/sftp"},
+		{"/../../etc/passwd", "/srv/sftp/etc/passwd"},
+		{"foo/../../bar", "/srv/sftp/bar"},
+	} {
+		real := c.realPath(tc.in)
+		if real != tc.real {
+			t.Errorf("realPath(%q) = %q, want %q", tc.in, real, tc.real)
+		}
+	}
+
+	for _, tc := range []struct {
+		in, virtual string
+	}{
+		{"/srv/sftp", "/"},
+		{"/srv/sftp/foo", "/foo"},
+		{"/srv/sftpfoo", "/srv/sftpfoo"},
+	} {
+		virtual := c.virtualPath(tc.in)
+		if virtual != tc.virtual {
+			t.Errorf("virtualPath(%q) = %q, want %q", tc.in, virtual, tc.virtual)
+		}
+	}
+
+	err := c.fixErr(&os.PathError{Op: "open", Path: "/srv/sftp/secret", Err: os.ErrNotExist})
+	if err.Error() != "open /secret: file does not exist" {
+		t.Errorf("unexpected error message: %s", err)
+	}
+}
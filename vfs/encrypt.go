@@ -0,0 +1,800 @@
+package vfs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var ErrBadPassphrase = errors.New("wrong encryption passphrase")
+
+// The file at the root of an encrypted file system holding the key
+// derivation salt. It is hidden from clients.
+const EncryptKeyFile = ".sftpplease-encrypt"
+
+const (
+	encryptKeyMagic   = "SPENCKEY"
+	encryptFileMagic  = "SPE1"
+	encryptIterations = 200000
+	// Key files with iteration counts outside these are refused,
+	// so a tampered key file can't make opening hang.
+	encryptMinIterations = 10000
+	encryptMaxIterations = 10000000
+	encryptFlagNames     = 1
+	encryptFileIDSize    = 16
+	encryptHeaderSize    = len(encryptFileMagic) + encryptFileIDSize
+	encryptChunkSize     = 64 * 1024
+	encryptChunkOverhead = 12 + 16
+)
+
+var encryptNameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// EncryptVFS encrypts file contents, and optionally names, before they
+// reach Fs so the backend never sees cleartext.
+//
+// Contents are split into 64KiB chunks sealed with AES-256-GCM, each with
+// a random nonce and bound to its file and position so chunks can't be
+// swapped or dropped unnoticed. Names are sealed deterministically so
+// paths can still be looked up. Directory structure, file sizes and
+// modification times are not hidden.
+//
+// Files opened for writing without O_TRUNC need a backend that supports
+// reading files opened for writing, uploads that replace whole files
+// work with any backend.
+type EncryptVFS struct {
+	Fs VFS
+
+	encryptNames bool
+	content      cipher.AEAD
+	names        cipher.AEAD
+	nameIVKey    []byte
+}
+
+func deriveKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Wrap fs with encryption using a key derived from passphrase. The salt is
+// kept in EncryptKeyFile, which is created along with the choice of
+// encryptNames if it does not exist. Otherwise the stored choice is used
+// and the passphrase is checked.
+func NewEncryptVFS(fs VFS, passphrase []byte, encryptNames bool) (*EncryptVFS, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("encryption requires a passphrase")
+	}
+
+	var flags byte
+	var iterations uint32
+	var salt, check []byte
+
+	f, err := fs.Open("/" + EncryptKeyFile)
+	if err == nil {
+		buf := make([]byte, len(encryptKeyMagic)+1+4+16+32)
+		_, err = io.ReadFull(&offsetReader{f: f}, buf)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if string(buf[:len(encryptKeyMagic)]) != encryptKeyMagic {
+			return nil, errors.New("bad encryption key file")
+		}
+		buf = buf[len(encryptKeyMagic):]
+		flags = buf[0]
+		iterations = binary.BigEndian.Uint32(buf[1:5])
+		salt = buf[5:21]
+		check = buf[21:]
+		if iterations < encryptMinIterations || iterations > encryptMaxIterations {
+			return nil, fmt.Errorf("bad encryption key file: %d key derivation iterations", iterations)
+		}
+	} else if os.IsNotExist(err) || err == os.ErrNotExist {
+		if encryptNames {
+			flags |= encryptFlagNames
+		}
+		iterations = encryptIterations
+		salt = make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	master := pbkdf2.Key(passphrase, salt, int(iterations), 32, sha256.New)
+	// The flags are bound to the check, so they can't be changed
+	// without the passphrase, e.g. to store new names in cleartext.
+	expectedCheck := deriveKey(master, "check"+string([]byte{flags}))
+	if check != nil && !hmac.Equal(check, expectedCheck) {
+		return nil, ErrBadPassphrase
+	}
+
+	if check == nil {
+		buf := []byte(encryptKeyMagic)
+		buf = append(buf, flags)
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], iterations)
+		buf = append(buf, b[:]...)
+		buf = append(buf, salt...)
+		buf = append(buf, expectedCheck...)
+		f, err := fs.OpenFile("/"+EncryptKeyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(buf)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		err = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e := &EncryptVFS{
+		Fs:           fs,
+		encryptNames: flags&encryptFlagNames != 0,
+		nameIVKey:    deriveKey(master, "name-iv"),
+	}
+	e.content, err = newGCM(deriveKey(master, "content"))
+	if err != nil {
+		return nil, err
+	}
+	e.names, err = newGCM(deriveKey(master, "names"))
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reads a File from the start with ReadAt.
+type offsetReader struct {
+	f   File
+	off int64
+}
+
+func (r *offsetReader) Read(buf []byte) (int, error) {
+	n, err := r.f.ReadAt(buf, r.off)
+	r.off += int64(n)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (e *EncryptVFS) encryptName(name string) string {
+	if !e.encryptNames || name == "" || name == "." || name == ".." {
+		return name
+	}
+	// A synthetic nonce makes the encryption deterministic,
+	// equal names only leak that they are equal.
+	mac := hmac.New(sha256.New, e.nameIVKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:e.names.NonceSize()]
+	sealed := e.names.Seal(nonce, nonce, []byte(name), nil)
+	return encryptNameEncoding.EncodeToString(sealed)
+}
+
+func (e *EncryptVFS) decryptName(name string) (string, error) {
+	if !e.encryptNames {
+		return name, nil
+	}
+	sealed, err := encryptNameEncoding.DecodeString(name)
+	if err != nil || len(sealed) < e.names.NonceSize() {
+		return "", ErrCorrupt
+	}
+	nonce := sealed[:e.names.NonceSize()]
+	plain, err := e.names.Open(nil, nonce, sealed[len(nonce):], nil)
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	return string(plain), nil
+}
+
+func (e *EncryptVFS) keyFile(p string) bool {
+	return path.Clean("/"+p) == "/"+EncryptKeyFile
+}
+
+func (e *EncryptVFS) realPath(p string) string {
+	p = path.Clean("/" + p)
+	if !e.encryptNames || p == "/" {
+		return p
+	}
+	parts := strings.Split(p[1:], "/")
+	for i := range parts {
+		parts[i] = e.encryptName(parts[i])
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// The plaintext size of an encrypted file of size n.
+func encryptedToPlainSize(n int64) int64 {
+	n -= int64(encryptHeaderSize)
+	if n <= 0 {
+		return 0
+	}
+	full := int64(encryptChunkSize + encryptChunkOverhead)
+	chunks := (n + full - 1) / full
+	n -= chunks * encryptChunkOverhead
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+type encryptedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi *encryptedFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *encryptedFileInfo) Size() int64 {
+	if !fi.FileInfo.Mode().IsRegular() {
+		return fi.FileInfo.Size()
+	}
+	return encryptedToPlainSize(fi.FileInfo.Size())
+}
+
+func (e *EncryptVFS) wrapFileInfo(fi os.FileInfo, name string) os.FileInfo {
+	return &encryptedFileInfo{FileInfo: fi, name: name}
+}
+
+func (e *EncryptVFS) Chmod(name string, mode os.FileMode) error {
+	if e.keyFile(name) {
+		return os.ErrNotExist
+	}
+	return e.Fs.Chmod(e.realPath(name), mode)
+}
+
+func (e *EncryptVFS) Open(p string) (File, error) {
+	return e.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (e *EncryptVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if e.keyFile(name) {
+		return nil, os.ErrNotExist
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	innerFlag := flag &^ os.O_APPEND
+	// Existing contents are needed to update chunks.
+	if writable && flag&os.O_TRUNC == 0 {
+		innerFlag = innerFlag&^os.O_WRONLY | os.O_RDWR
+	}
+
+	f, err := e.Fs.OpenFile(e.realPath(name), innerFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	ef := &EncryptedFile{
+		File:     f,
+		e:        e,
+		name:     path.Clean("/" + name),
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+		cur:      -1,
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		ef.isDir = true
+		return ef, nil
+	}
+
+	if flag&os.O_TRUNC != 0 || fi.Size() == 0 {
+		ef.fileID = make([]byte, encryptFileIDSize)
+		_, err = rand.Read(ef.fileID)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		// The header and a final chunk must be written,
+		// even if the file is left empty.
+		ef.cur = 0
+		ef.dirty = writable
+		return ef, nil
+	}
+
+	hdr := make([]byte, encryptHeaderSize)
+	_, err = io.ReadFull(&offsetReader{f: f}, hdr)
+	if err != nil || string(hdr[:len(encryptFileMagic)]) != encryptFileMagic {
+		_ = f.Close()
+		return nil, ErrCorrupt
+	}
+	ef.fileID = hdr[len(encryptFileMagic):]
+	ef.headerWritten = true
+	ef.size = encryptedToPlainSize(fi.Size())
+	ef.stored = encryptChunkCount(ef.size)
+	ef.storedLastFinal = true
+	return ef, nil
+}
+
+func (e *EncryptVFS) Mkdir(p string, perm os.FileMode) error {
+	if e.keyFile(p) {
+		return os.ErrExist
+	}
+	return e.Fs.Mkdir(e.realPath(p), perm)
+}
+
+func (e *EncryptVFS) Stat(p string) (os.FileInfo, error) {
+	if e.keyFile(p) {
+		return nil, os.ErrNotExist
+	}
+	fi, err := e.Fs.Stat(e.realPath(p))
+	if err != nil {
+		return nil, err
+	}
+	return e.wrapFileInfo(fi, path.Base(path.Clean("/"+p))), nil
+}
+
+func (e *EncryptVFS) Rename(from, to string) error {
+	if e.keyFile(from) || e.keyFile(to) {
+		return os.ErrPermission
+	}
+	return e.Fs.Rename(e.realPath(from), e.realPath(to))
+}
+
+func (e *EncryptVFS) Remove(p string) error {
+	if e.keyFile(p) {
+		return os.ErrNotExist
+	}
+	return e.Fs.Remove(e.realPath(p))
+}
+
+func (e *EncryptVFS) Link(oldname, newname string) error {
+	if e.keyFile(oldname) || e.keyFile(newname) {
+		return os.ErrPermission
+	}
+	return e.Fs.Link(e.realPath(oldname), e.realPath(newname))
+}
+
+func (e *EncryptVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	// Backend checksums are of the encrypted contents.
+	return nil, ErrUnsupported
+}
+
+func (e *EncryptVFS) ChecksumAlgorithms() []string {
+	return nil
+}
+
+func (e *EncryptVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	if e.keyFile(path) {
+		return os.ErrNotExist
+	}
+	ct, ok := e.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	return ct.Chtimes(e.realPath(path), atime, mtime)
+}
+
+func (e *EncryptVFS) RemoveBatch(paths []string) error {
+	real := make([]string, len(paths))
+	for i, p := range paths {
+		if e.keyFile(p) {
+			return os.ErrNotExist
+		}
+		real[i] = e.realPath(p)
+	}
+	return RemoveBatch(e.Fs, real)
+}
+
+func (e *EncryptVFS) RenameBatch(renames []Rename) error {
+	real := make([]Rename, len(renames))
+	for i, r := range renames {
+		if e.keyFile(r.From) || e.keyFile(r.To) {
+			return os.ErrPermission
+		}
+		real[i] = Rename{From: e.realPath(r.From), To: e.realPath(r.To)}
+	}
+	return RenameBatch(e.Fs, real)
+}
+
+func (e *EncryptVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := e.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	switch efi := fi.(type) {
+	case *encryptedFileInfo:
+		fi = efi.FileInfo
+	case *encryptedOpenFileInfo:
+		fi = efi.FileInfo
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (e *EncryptVFS) WithContext(ctx context.Context) VFS {
+	copy := *e
+	copy.Fs = WithContext(e.Fs, ctx)
+	return &copy
+}
+
+func (e *EncryptVFS) Close() error {
+	return e.Fs.Close()
+}
+
+// The number of chunks in a file of size plaintext bytes,
+// there is always at least one so empty files can be verified.
+func encryptChunkCount(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + encryptChunkSize - 1) / encryptChunkSize
+}
+
+// EncryptedFile encrypts and decrypts one chunk at a time. Sequential
+// writes become sequential writes of whole chunks to the backend.
+type EncryptedFile struct {
+	File
+	e     *EncryptVFS
+	name  string
+	isDir bool
+
+	writable bool
+	append   bool
+	offset   int64
+
+	fileID        []byte
+	headerWritten bool
+	// Plaintext size of the file.
+	size int64
+	// Number of chunks written to the backend, and
+	// whether the last of them is marked final.
+	stored          int64
+	storedLastFinal bool
+
+	// The chunk being read or written.
+	cur   int64
+	data  []byte
+	dirty bool
+}
+
+func (f *EncryptedFile) chunkOffset(idx int64) int64 {
+	return int64(encryptHeaderSize) + idx*(encryptChunkSize+encryptChunkOverhead)
+}
+
+func (f *EncryptedFile) chunkAAD(idx int64, final bool) []byte {
+	aad := make([]byte, 0, encryptFileIDSize+9)
+	aad = append(aad, f.fileID...)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(idx))
+	aad = append(aad, b[:]...)
+	if final {
+		aad = append(aad, 1)
+	} else {
+		aad = append(aad, 0)
+	}
+	return aad
+}
+
+// Read and decrypt chunk idx as stored on the backend.
+func (f *EncryptedFile) readChunk(idx int64, final bool) ([]byte, error) {
+	sealed := make([]byte, encryptChunkSize+encryptChunkOverhead)
+	n, err := f.File.ReadAt(sealed, f.chunkOffset(idx))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	sealed = sealed[:n]
+	nonceSize := f.e.content.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, ErrCorrupt
+	}
+	plain, err := f.e.content.Open(nil, sealed[:nonceSize], sealed[nonceSize:], f.chunkAAD(idx, final))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plain, nil
+}
+
+func (f *EncryptedFile) writeChunk(idx int64, plain []byte, final bool) error {
+	if !f.headerWritten {
+		_, err := f.File.WriteAt(append([]byte(encryptFileMagic), f.fileID...), 0)
+		if err != nil {
+			return err
+		}
+		f.headerWritten = true
+	}
+	nonce := make([]byte, f.e.content.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	sealed := f.e.content.Seal(nonce, nonce, plain, f.chunkAAD(idx, final))
+	_, err = f.File.WriteAt(sealed, f.chunkOffset(idx))
+	if err != nil {
+		return err
+	}
+	if idx >= f.stored {
+		f.stored = idx + 1
+	}
+	if idx == f.stored-1 {
+		f.storedLastFinal = final
+	}
+	return nil
+}
+
+// Make chunk idx the current chunk.
+func (f *EncryptedFile) load(idx int64) error {
+	if f.cur == idx {
+		return nil
+	}
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+	f.cur = idx
+	f.data = nil
+	if idx < f.stored {
+		f.data, err = f.readChunk(idx, idx == f.stored-1 && f.storedLastFinal)
+		if err != nil {
+			f.cur = -1
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the current chunk to the backend if it was modified.
+func (f *EncryptedFile) flush() error {
+	if !f.dirty {
+		return nil
+	}
+	idx := f.cur
+	last := encryptChunkCount(f.size) - 1
+
+	// Chunks before this one must exist, be full, and not be final.
+	if idx >= f.stored {
+		if f.stored > 0 && f.storedLastFinal {
+			prev := f.stored - 1
+			data, err := f.readChunk(prev, true)
+			if err != nil {
+				return err
+			}
+			data = append(data, make([]byte, encryptChunkSize-len(data))...)
+			err = f.writeChunk(prev, data, false)
+			if err != nil {
+				return err
+			}
+		}
+		for i := f.stored; i < idx; i++ {
+			err := f.writeChunk(i, make([]byte, encryptChunkSize), false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data := f.data
+	if idx != last && len(data) < encryptChunkSize {
+		data = append(data, make([]byte, encryptChunkSize-len(data))...)
+		f.data = data
+	}
+	err := f.writeChunk(idx, data, idx == last)
+	if err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *EncryptedFile) Readdir(n int) ([]os.FileInfo, error) {
+	for {
+		fis, err := f.File.Readdir(n)
+		kept := fis[:0]
+		for _, fi := range fis {
+			if f.name == "/" && fi.Name() == EncryptKeyFile {
+				continue
+			}
+			name, derr := f.e.decryptName(fi.Name())
+			if derr != nil {
+				// Files not created through the wrapper are skipped.
+				continue
+			}
+			kept = append(kept, f.e.wrapFileInfo(fi, name))
+		}
+		// Don't return an empty batch unless the directory is done.
+		if len(kept) != 0 || len(fis) == 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
+
+func (f *EncryptedFile) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *EncryptedFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if f.isDir {
+		return f.e.wrapFileInfo(fi, path.Base(f.name)), nil
+	}
+	return &encryptedOpenFileInfo{encryptedFileInfo{FileInfo: fi, name: path.Base(f.name)}, f.size}, nil
+}
+
+// Info of an open file, whose size may not be written yet.
+type encryptedOpenFileInfo struct {
+	encryptedFileInfo
+	size int64
+}
+
+func (fi *encryptedOpenFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (f *EncryptedFile) ReadAt(buf []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrUnsupported
+	}
+	nread := 0
+	for nread < len(buf) {
+		pos := off + int64(nread)
+		if pos >= f.size {
+			return nread, io.EOF
+		}
+		err := f.load(pos / encryptChunkSize)
+		if err != nil {
+			return nread, err
+		}
+		chunkOff := int(pos % encryptChunkSize)
+		end := f.size - f.cur*encryptChunkSize
+		if end > encryptChunkSize {
+			end = encryptChunkSize
+		}
+		avail := f.data
+		if int64(len(avail)) > end {
+			avail = avail[:end]
+		}
+		if chunkOff < len(avail) {
+			nread += copy(buf[nread:], avail[chunkOff:])
+			continue
+		}
+		// A hole not yet written to the backend reads as zeros.
+		hole := buf[nread:]
+		if int64(len(hole)) > end-int64(chunkOff) {
+			hole = hole[:end-int64(chunkOff)]
+		}
+		for i := range hole {
+			hole[i] = 0
+		}
+		nread += len(hole)
+	}
+	return nread, nil
+}
+
+func (f *EncryptedFile) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *EncryptedFile) WriteAt(buf []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrUnsupported
+	}
+	if !f.writable {
+		return 0, os.ErrPermission
+	}
+	if f.append {
+		off = f.size
+	}
+	if end := off + int64(len(buf)); end > f.size {
+		f.size = end
+	}
+	nwritten := 0
+	for nwritten < len(buf) {
+		pos := off + int64(nwritten)
+		err := f.load(pos / encryptChunkSize)
+		if err != nil {
+			return nwritten, err
+		}
+		chunkOff := int(pos % encryptChunkSize)
+		n := encryptChunkSize - chunkOff
+		if n > len(buf)-nwritten {
+			n = len(buf) - nwritten
+		}
+		if len(f.data) < chunkOff+n {
+			f.data = append(f.data, make([]byte, chunkOff+n-len(f.data))...)
+		}
+		copy(f.data[chunkOff:], buf[nwritten:nwritten+n])
+		f.dirty = true
+		nwritten += n
+	}
+	return nwritten, nil
+}
+
+func (f *EncryptedFile) Write(buf []byte) (int, error) {
+	n, err := f.WriteAt(buf, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Write the final chunk, padding out the file if the
+// last write left a gap.
+func (f *EncryptedFile) finish() error {
+	last := encryptChunkCount(f.size) - 1
+	if f.dirty && f.cur == last {
+		return f.flush()
+	}
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+	if f.stored == last+1 && f.storedLastFinal {
+		return nil
+	}
+	err = f.load(last)
+	if err != nil {
+		return err
+	}
+	want := int(f.size - last*encryptChunkSize)
+	if len(f.data) < want {
+		f.data = append(f.data, make([]byte, want-len(f.data))...)
+	}
+	f.dirty = true
+	return f.flush()
+}
+
+func (f *EncryptedFile) Sync() error {
+	if f.writable && !f.isDir {
+		err := f.finish()
+		if err != nil {
+			return err
+		}
+	}
+	return f.File.Sync()
+}
+
+func (f *EncryptedFile) Close() error {
+	var err error
+	if f.writable && !f.isDir {
+		err = f.finish()
+	}
+	cerr := f.File.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package vfs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func writeAll(t *testing.T, fs vfs.VFS, p string, data []byte) {
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd sized writes cross chunk boundaries.
+	for len(data) > 0 {
+		n := 10000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err = f.Write(data[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(t *testing.T, fs vfs.VFS, p string) []byte {
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptVFS(t *testing.T) {
+	backend := mem.New()
+	fs, err := vfs.NewEncryptVFS(backend, []byte("secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{0, 1, 65535, 65536, 65537, 200000} {
+		data := make([]byte, size)
+		rng.Read(data)
+		writeAll(t, fs, "/plaintext-name", data)
+		if got := readAll(t, fs, "/plaintext-name"); !bytes.Equal(got, data) {
+			t.Fatalf("size %d: contents differ after round trip", size)
+		}
+		fi, err := fs.Stat("/plaintext-name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(size) {
+			t.Fatalf("size %d: stat size %d", size, fi.Size())
+		}
+	}
+
+	// Update the middle of a file and extend it past a hole.
+	data := readAll(t, fs, "/plaintext-name")
+	f, err := fs.OpenFile("/plaintext-name", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := bytes.Repeat([]byte("x"), 70000)
+	_, err = f.WriteAt(patch, 60000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("end"), 400000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[60000:], patch)
+	data = append(data, make([]byte, 400000-len(data))...)
+	data = append(data, "end"...)
+	if got := readAll(t, fs, "/plaintext-name"); !bytes.Equal(got, data) {
+		t.Fatal("contents differ after update")
+	}
+
+	err = fs.Mkdir("/dir", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, fs, "/dir/hello", []byte("hello world"))
+	err = fs.Rename("/dir/hello", "/dir/bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "dir,plaintext-name" && strings.Join(names, ",") != "plaintext-name,dir" {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	// Nothing stored in the backend should be readable.
+	d, err = backend.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err = d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if strings.Contains(name, "plaintext") || name == "dir" {
+			t.Fatalf("backend name %q is not encrypted", name)
+		}
+	}
+
+	// The key file stores the name choice and checks the passphrase.
+	fs2, err := vfs.NewEncryptVFS(backend, []byte("secret"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fs2, "/dir/bye"); string(got) != "hello world" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	_, err = vfs.NewEncryptVFS(backend, []byte("wrong"), true)
+	if err != vfs.ErrBadPassphrase {
+		t.Fatalf("expected ErrBadPassphrase, got %v", err)
+	}
+}
+
+func TestEncryptVFSTamper(t *testing.T) {
+	backend := mem.New()
+	fs, err := vfs.NewEncryptVFS(backend, []byte("secret"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, fs, "/f", bytes.Repeat([]byte("a"), 100000))
+
+	f, err := backend.OpenFile("/f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0}, 70000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	f, err = fs.Open("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = ioutil.ReadAll(f)
+	if err != vfs.ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestEncryptVFSKeyFileTamper(t *testing.T) {
+	keyFile := "/" + vfs.EncryptKeyFile
+	flagsOffset := int64(len("SPENCKEY"))
+
+	backend := mem.New()
+	_, err := vfs.NewEncryptVFS(backend, []byte("secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := readAll(t, backend, keyFile)
+
+	// Clearing the flags would store new names in cleartext.
+	tampered := append([]byte{}, orig...)
+	tampered[flagsOffset] = 0
+	writeAll(t, backend, keyFile, tampered)
+	_, err = vfs.NewEncryptVFS(backend, []byte("secret"), true)
+	if err != vfs.ErrBadPassphrase {
+		t.Fatalf("expected ErrBadPassphrase, got %v", err)
+	}
+
+	tampered = append([]byte{}, orig...)
+	copy(tampered[flagsOffset+1:], []byte{0xff, 0xff, 0xff, 0xff})
+	writeAll(t, backend, keyFile, tampered)
+	_, err = vfs.NewEncryptVFS(backend, []byte("secret"), true)
+	if err == nil || !strings.Contains(err.Error(), "iterations") {
+		t.Fatalf("expected an iterations error, got %v", err)
+	}
+
+	writeAll(t, backend, keyFile, orig)
+	_, err = vfs.NewEncryptVFS(backend, []byte("secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,250 @@
+// Package faultfs wraps a file system to inject faults into its calls,
+// failing, hanging or shortening them, so tests can exercise error
+// paths deterministically. It is not registered as an engine.
+package faultfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// A Fault is injected into the calls it matches.
+type Fault struct {
+	// The call to fault, named as in vfs.HookOp such as "open",
+	// "read", "write" or "close", empty for every call.
+	Op string
+	// A path.Match pattern for the path called with, empty for
+	// every path. Calls on open files match the path they were
+	// opened with.
+	Path string
+	// Matching calls to let through before faulting any.
+	Skip int
+	// Matching calls to fault after those skipped, 0 for all of them.
+	Count int
+	// If set, faulted calls wait until it is closed.
+	Hang <-chan struct{}
+	// If non zero, faulted reads and writes transfer at most this
+	// many bytes, then return Err. Without Err short writes return
+	// io.ErrShortWrite and short ReadAt calls io.EOF, as if the file
+	// ended early.
+	Short int
+	// The error faulted calls fail with, not made if set. Close is
+	// always made, so files are still released, before failing.
+	Err error
+}
+
+type fault struct {
+	Fault
+	matched int
+}
+
+// Whether the call op on p is faulted, counting it if it matches.
+func (f *fault) apply(op string, p string) bool {
+	if f.Op != "" && f.Op != op {
+		return false
+	}
+	if f.Path != "" {
+		if ok, _ := path.Match(f.Path, p); !ok {
+			return false
+		}
+	}
+	f.matched++
+	if f.matched <= f.Skip {
+		return false
+	}
+	return f.Count == 0 || f.matched-f.Skip <= f.Count
+}
+
+type state struct {
+	lock   sync.Mutex
+	faults []*fault
+	calls  map[string]int
+}
+
+// The first fault applying to op on p with short set or not.
+func (s *state) match(op string, p string, short bool) (Fault, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, f := range s.faults {
+		if (f.Short != 0) != short {
+			continue
+		}
+		if f.apply(op, p) {
+			return f.Fault, true
+		}
+	}
+	return Fault{}, false
+}
+
+func (s *state) before(op *vfs.HookOp) error {
+	s.lock.Lock()
+	s.calls[op.Op]++
+	s.lock.Unlock()
+	if op.Op == "close" {
+		// Close can't be refused, the file faults it once closed.
+		return nil
+	}
+	return s.fault(op.Op, op.Path)
+}
+
+// Hang and fail the call op on p if a fault applies to it.
+func (s *state) fault(op string, p string) error {
+	f, ok := s.match(op, p, false)
+	if !ok {
+		return nil
+	}
+	if f.Hang != nil {
+		<-f.Hang
+	}
+	return f.Err
+}
+
+// Fs passes calls to the file system it wraps, faulting those
+// matching the faults injected.
+type Fs struct {
+	vfs.VFS
+	s *state
+}
+
+func New(fs vfs.VFS) *Fs {
+	s := &state{calls: make(map[string]int)}
+	return &Fs{
+		VFS: &vfs.HookVFS{Fs: fs, Before: s.before},
+		s:   s,
+	}
+}
+
+// Fault the calls f matches, before any faults already injected.
+func (fs *Fs) Inject(f Fault) {
+	fs.s.lock.Lock()
+	defer fs.s.lock.Unlock()
+	fs.s.faults = append([]*fault{{Fault: f}}, fs.s.faults...)
+}
+
+// Remove every fault injected.
+func (fs *Fs) Reset() {
+	fs.s.lock.Lock()
+	defer fs.s.lock.Unlock()
+	fs.s.faults = nil
+}
+
+// The number of calls made to op, faulted or not.
+func (fs *Fs) Calls(op string) int {
+	fs.s.lock.Lock()
+	defer fs.s.lock.Unlock()
+	return fs.s.calls[op]
+}
+
+func (fs *Fs) Open(p string) (vfs.File, error) {
+	return fs.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(p string, flag int, perm os.FileMode) (vfs.File, error) {
+	f, err := fs.VFS.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, s: fs.s, path: p}, nil
+}
+
+func (fs *Fs) Checksum(p string, algorithm string) ([]byte, error) {
+	return fs.VFS.(vfs.Checksummer).Checksum(p, algorithm)
+}
+
+func (fs *Fs) ChecksumAlgorithms() []string {
+	return vfs.ChecksumAlgorithms(fs.VFS)
+}
+
+func (fs *Fs) RealPath(p string) (string, error) {
+	return vfs.RealPath(fs.VFS, p)
+}
+
+func (fs *Fs) AppendSupported() bool {
+	return vfs.AppendSupported(fs.VFS)
+}
+
+func (fs *Fs) Chtimes(p string, atime time.Time, mtime time.Time) error {
+	return fs.VFS.(vfs.Chtimeser).Chtimes(p, atime, mtime)
+}
+
+// Faults injected into fs are also injected into the file system returned.
+func (fs *Fs) WithContext(ctx context.Context) vfs.VFS {
+	return &Fs{VFS: vfs.WithContext(fs.VFS, ctx), s: fs.s}
+}
+
+type file struct {
+	vfs.File
+	s    *state
+	path string
+}
+
+// Shorten buf if a short fault applies to op.
+func (f *file) short(op string, buf []byte) ([]byte, Fault, bool) {
+	ft, ok := f.s.match(op, f.path, true)
+	if ok && ft.Short < len(buf) {
+		buf = buf[:ft.Short]
+	}
+	return buf, ft, ok
+}
+
+func (f *file) Read(buf []byte) (int, error) {
+	buf, ft, ok := f.short("read", buf)
+	n, err := f.File.Read(buf)
+	if ok && err == nil {
+		err = ft.Err
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(buf []byte, off int64) (int, error) {
+	full := len(buf)
+	buf, ft, ok := f.short("read", buf)
+	n, err := f.File.ReadAt(buf, off)
+	if ok && err == nil {
+		err = ft.Err
+		if err == nil && n < full {
+			err = io.EOF
+		}
+	}
+	return n, err
+}
+
+func (f *file) Write(buf []byte) (int, error) {
+	full := len(buf)
+	buf, ft, ok := f.short("write", buf)
+	n, err := f.File.Write(buf)
+	if ok && err == nil {
+		err = ft.Err
+		if err == nil && n < full {
+			err = io.ErrShortWrite
+		}
+	}
+	return n, err
+}
+
+func (f *file) WriteAt(buf []byte, off int64) (int, error) {
+	full := len(buf)
+	buf, ft, ok := f.short("write", buf)
+	n, err := f.File.WriteAt(buf, off)
+	if ok && err == nil {
+		err = ft.Err
+		if err == nil && n < full {
+			err = io.ErrShortWrite
+		}
+	}
+	return n, err
+}
+
+func (f *file) Close() error {
+	err := f.File.Close()
+	if ferr := f.s.fault("close", f.path); ferr != nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package faultfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestFaults(t *testing.T) {
+	fs := New(mem.New())
+	errFault := errors.New("fault")
+
+	fs.Inject(Fault{Op: "mkdir", Path: "/a*", Skip: 1, Count: 1, Err: errFault})
+	for i, expected := range []error{nil, errFault, nil} {
+		err := fs.Mkdir("/a"+string(rune('0'+i)), 0755)
+		if err != expected {
+			t.Fatalf("mkdir %d: expected %v, got %v", i, expected, err)
+		}
+	}
+	err := fs.Mkdir("/b", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.Calls("mkdir") != 4 {
+		t.Fatalf("expected 4 mkdir calls, got %d", fs.Calls("mkdir"))
+	}
+	if _, err := fs.Stat("/a1"); !os.IsNotExist(err) {
+		t.Fatal("expected the failed mkdir not to be made")
+	}
+
+	f, err := fs.OpenFile("/f", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Inject(Fault{Op: "write", Short: 2, Count: 1})
+	n, err := f.WriteAt([]byte("hello"), 0)
+	if n != 2 || err != io.ErrShortWrite {
+		t.Fatalf("expected a short write, got %d %v", n, err)
+	}
+	n, err = f.WriteAt([]byte("hello"), 0)
+	if n != 5 || err != nil {
+		t.Fatalf("expected a full write, got %d %v", n, err)
+	}
+	fs.Inject(Fault{Op: "read", Short: 3})
+	buf := make([]byte, 5)
+	n, err = f.ReadAt(buf, 0)
+	if n != 3 || err != io.EOF || string(buf[:n]) != "hel" {
+		t.Fatalf("expected a short read, got %d %v", n, err)
+	}
+
+	fs.Reset()
+	release := make(chan struct{})
+	fs.Inject(Fault{Op: "stat", Hang: release})
+	done := make(chan error, 1)
+	go func() {
+		_, err := fs.Stat("/f")
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected stat to hang")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing fails once the file is closed.
+	fs.Inject(Fault{Op: "close", Err: errFault})
+	err = f.Close()
+	if err != errFault {
+		t.Fatalf("expected close to fail, got %v", err)
+	}
+	if _, err := f.Stat(); err == nil {
+		t.Fatal("expected the file to be closed")
+	}
+}
@@ -0,0 +1,295 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A NamePattern matches paths. Patterns starting with "re:" are regular
+// expressions matched against the whole path, other patterns are globs
+// as in path.Match, matched against the whole path if they contain a
+// '/' and against the last path element otherwise.
+type NamePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func ParseNamePattern(pattern string) (*NamePattern, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(pattern[3:])
+		if err != nil {
+			return nil, fmt.Errorf("bad name pattern '%s': %s", pattern, err)
+		}
+		return &NamePattern{re: re}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad name pattern '%s': %s", pattern, err)
+	}
+	return &NamePattern{glob: pattern}, nil
+}
+
+func (np *NamePattern) Match(p string) bool {
+	p = path.Clean("/" + p)
+	if np.re != nil {
+		return np.re.MatchString(p)
+	}
+	if !strings.Contains(np.glob, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(np.glob, p)
+	return ok
+}
+
+func ParseNamePatterns(patterns []string) ([]*NamePattern, error) {
+	var parsed []*NamePattern
+	for _, pattern := range patterns {
+		np, err := ParseNamePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, np)
+	}
+	return parsed, nil
+}
+
+func matchAny(patterns []*NamePattern, p string) bool {
+	for _, np := range patterns {
+		if np.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterVFS restricts the names files can be written to. Opening a
+// file for writing, creating a directory, or renaming or linking to
+// a path fails with a permission error unless the path matches one
+// of the Allow patterns, if there are any, and none of the Deny patterns.
+//
+// Reading existing files is only restricted if Reads is set. Then
+// opening, stat, checksums and renaming or linking from files that
+// don't match fail the same way, and they are left out of directory
+// listings. Directories are only checked against the Deny patterns,
+// so clients can still find their way to allowed files inside them,
+// and nothing inside a denied directory can be read.
+type FilterVFS struct {
+	Fs    VFS
+	Allow []*NamePattern
+	Deny  []*NamePattern
+	Reads bool
+}
+
+func (f *FilterVFS) allowed(op, p string) error {
+	if len(f.Allow) != 0 && !matchAny(f.Allow, p) {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+	}
+	if matchAny(f.Deny, p) {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *FilterVFS) readAllowed(op, p string, isDir bool) error {
+	if isDir {
+		if matchAny(f.Deny, p) {
+			return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+		}
+		return nil
+	}
+	return f.allowed(op, p)
+}
+
+// Check p may be read if Reads is set, only looking up
+// whether it is a directory if the Deny patterns allow it.
+func (f *FilterVFS) checkRead(op, p string) error {
+	if !f.Reads {
+		return nil
+	}
+	for dir := path.Clean("/" + p); dir != "/"; dir = path.Dir(dir) {
+		if matchAny(f.Deny, dir) {
+			return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+		}
+	}
+	if len(f.Allow) == 0 || matchAny(f.Allow, p) {
+		return nil
+	}
+	fi, err := f.Fs.Stat(p)
+	if err != nil {
+		return err
+	}
+	return f.readAllowed(op, p, fi.IsDir())
+}
+
+func (f *FilterVFS) wrapFile(dir string, file File, err error) (File, error) {
+	if err != nil || !f.Reads {
+		return file, err
+	}
+	return &FilterFile{File: file, dir: dir, f: f}, nil
+}
+
+func (f *FilterVFS) Chmod(name string, mode os.FileMode) error {
+	return f.Fs.Chmod(name, mode)
+}
+
+func (f *FilterVFS) Open(path string) (File, error) {
+	if err := f.checkRead("open", path); err != nil {
+		return nil, err
+	}
+	file, err := f.Fs.Open(path)
+	return f.wrapFile(path, file, err)
+}
+
+func (f *FilterVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := f.allowed("open", name); err != nil {
+			return nil, err
+		}
+	} else if err := f.checkRead("open", name); err != nil {
+		return nil, err
+	}
+	file, err := f.Fs.OpenFile(name, flag, perm)
+	return f.wrapFile(name, file, err)
+}
+
+func (f *FilterVFS) Mkdir(path string, perm os.FileMode) error {
+	if err := f.allowed("mkdir", path); err != nil {
+		return err
+	}
+	return f.Fs.Mkdir(path, perm)
+}
+
+func (f *FilterVFS) Stat(path string) (os.FileInfo, error) {
+	if err := f.checkRead("stat", path); err != nil {
+		return nil, err
+	}
+	return f.Fs.Stat(path)
+}
+
+func (f *FilterVFS) Rename(from, to string) error {
+	if err := f.allowed("rename", to); err != nil {
+		return err
+	}
+	if err := f.checkRead("rename", from); err != nil {
+		return err
+	}
+	return f.Fs.Rename(from, to)
+}
+
+func (f *FilterVFS) Remove(path string) error {
+	return f.Fs.Remove(path)
+}
+
+func (f *FilterVFS) Link(oldname, newname string) error {
+	if err := f.allowed("link", newname); err != nil {
+		return err
+	}
+	if err := f.checkRead("link", oldname); err != nil {
+		return err
+	}
+	return f.Fs.Link(oldname, newname)
+}
+
+func (f *FilterVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	if err := f.checkRead("checksum", path); err != nil {
+		return nil, err
+	}
+	cs, ok := f.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return cs.Checksum(path, algorithm)
+}
+
+func (f *FilterVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(f.Fs)
+}
+
+func (f *FilterVFS) RealPath(p string) (string, error) {
+	return RealPath(f.Fs, p)
+}
+
+func (f *FilterVFS) AppendSupported() bool {
+	return AppendSupported(f.Fs)
+}
+
+func (f *FilterVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	ct, ok := f.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	return ct.Chtimes(path, atime, mtime)
+}
+
+func (f *FilterVFS) RemoveBatch(paths []string) error {
+	return RemoveBatch(f.Fs, paths)
+}
+
+func (f *FilterVFS) RenameBatch(renames []Rename) error {
+	for _, r := range renames {
+		if err := f.allowed("rename", r.To); err != nil {
+			return err
+		}
+		if err := f.checkRead("rename", r.From); err != nil {
+			return err
+		}
+	}
+	return RenameBatch(f.Fs, renames)
+}
+
+func (f *FilterVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := f.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (f *FilterVFS) WithContext(ctx context.Context) VFS {
+	copy := *f
+	copy.Fs = WithContext(f.Fs, ctx)
+	return &copy
+}
+
+func (f *FilterVFS) Close() error {
+	return f.Fs.Close()
+}
+
+// FilterFile leaves entries that may not be read out of
+// directory listings.
+type FilterFile struct {
+	File
+	dir string
+	f   *FilterVFS
+}
+
+func (ff *FilterFile) Readdir(n int) ([]os.FileInfo, error) {
+	for {
+		fis, err := ff.File.Readdir(n)
+		kept := fis[:0]
+		for _, fi := range fis {
+			if ff.f.readAllowed("readdir", path.Join("/", ff.dir, fi.Name()), fi.IsDir()) == nil {
+				kept = append(kept, fi)
+			}
+		}
+		// Don't return an empty batch unless the directory is done.
+		if len(kept) != 0 || len(fis) == 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
+
+// Names alone don't say which entries are directories,
+// so they are read with Readdir.
+func (ff *FilterFile) Readdirnames(n int) ([]string, error) {
+	fis, err := ff.Readdir(n)
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names, err
+}
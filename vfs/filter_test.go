@@ -0,0 +1,102 @@
+package vfs_test
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestNamePatternMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"*.exe", "/foo.exe", true},
+		{"*.exe", "/dir/foo.exe", true},
+		{"*.exe", "/foo.exe.txt", false},
+		{"/uploads/*", "/uploads/foo", true},
+		{"/uploads/*", "/uploads/dir/foo", false},
+		{"/uploads/*", "uploads/foo", true},
+		{"re:^/uploads/", "/uploads/dir/foo", true},
+		{"re:^/uploads/", "/other/uploads/foo", false},
+		{"re:(?i)\\.EXE$", "/foo.exe", true},
+	} {
+		np, err := vfs.ParseNamePattern(tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if np.Match(tc.path) != tc.match {
+			t.Errorf("%q matching %q = %v, want %v", tc.pattern, tc.path, !tc.match, tc.match)
+		}
+	}
+
+	for _, bad := range []string{"[", "re:("} {
+		if _, err := vfs.ParseNamePattern(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestFilterReads(t *testing.T) {
+	m := mem.New()
+	for _, dir := range []string{"/docs", "/bin"} {
+		if err := m.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"/docs/a.txt", "/docs/b.exe", "/bin/c.txt", "/docs/d.dat"} {
+		writeAll(t, m, p, []byte("data"))
+	}
+	allow, _ := vfs.ParseNamePatterns([]string{"*.txt", "*.exe"})
+	deny, _ := vfs.ParseNamePatterns([]string{"*.exe", "/bin"})
+
+	// Without Reads, only writes are restricted.
+	fs := &vfs.FilterVFS{Fs: m, Allow: allow, Deny: deny}
+	if _, err := fs.Stat("/docs/b.exe"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Reads = true
+	for _, p := range []string{"/docs/b.exe", "/docs/d.dat", "/bin", "/bin/c.txt"} {
+		if _, err := fs.Open(p); !os.IsPermission(err) {
+			t.Fatalf("open %s: expected a permission error, got %v", p, err)
+		}
+		if _, err := fs.OpenFile(p, os.O_RDONLY, 0); !os.IsPermission(err) {
+			t.Fatalf("open %s read only: expected a permission error, got %v", p, err)
+		}
+		if _, err := fs.Stat(p); !os.IsPermission(err) {
+			t.Fatalf("stat %s: expected a permission error, got %v", p, err)
+		}
+	}
+	// Renaming is a way to read files too.
+	if err := fs.Rename("/docs/d.dat", "/docs/d.txt"); !os.IsPermission(err) {
+		t.Fatalf("expected renaming a denied file to fail, got %v", err)
+	}
+	if string(readAll(t, fs, "/docs/a.txt")) != "data" {
+		t.Fatal("unexpected contents")
+	}
+	if _, err := fs.Stat("/docs/missing.dat"); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing file not to exist, got %v", err)
+	}
+
+	for _, dir := range []string{"/", "/docs"} {
+		d, err := fs.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := d.Readdirnames(-1)
+		_ = d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		expect := map[string]string{"/": "docs", "/docs": "a.txt"}[dir]
+		if strings.Join(names, " ") != expect {
+			t.Fatalf("%s: expected only %q to be listed, got %q", dir, expect, names)
+		}
+	}
+}
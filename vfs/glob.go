@@ -0,0 +1,81 @@
+package vfs
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Whether p has any of the special characters of path.Match.
+func HasGlobMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// Glob returns the paths in fs matching pattern, in the syntax of
+// path.Match, sorted like filepath.Glob sorts them. As in a shell,
+// names starting with a dot only match patterns starting with one.
+// A pattern without special characters matches itself if it exists.
+func Glob(fs VFS, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !HasGlobMeta(pattern) {
+		if _, err := fs.Stat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, file := path.Split(pattern)
+	if len(dir) > 1 {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	if !HasGlobMeta(dir) {
+		return glob(fs, dir, file, nil)
+	}
+
+	dirs, err := Glob(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		matches, err = glob(fs, d, file, matches)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// Append the names in dir matching pattern to matches. Relative
+// patterns are listed from the root and matched without a prefix.
+func glob(fs VFS, dir, pattern string, matches []string) ([]string, error) {
+	listDir := dir
+	if listDir == "" {
+		listDir = "/"
+	}
+	st, err := fs.Stat(listDir)
+	if err != nil || !st.IsDir() {
+		return matches, nil
+	}
+	f, err := fs.Open(listDir)
+	if err != nil {
+		return matches, nil
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return matches, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(pattern, ".") {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			matches = append(matches, path.Join(dir, name))
+		}
+	}
+	return matches, nil
+}
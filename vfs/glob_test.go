@@ -0,0 +1,52 @@
+package vfs_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestGlob(t *testing.T) {
+	fs := mem.New()
+	for _, dir := range []string{"/logs", "/logs/old", "/other"} {
+		err := fs.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"/logs/a.log", "/logs/b.log", "/logs/.hidden.log", "/logs/c.txt", "/logs/old/d.log", "/other/e.log", "/top.log"} {
+		writeAll(t, fs, p, []byte("x"))
+	}
+
+	for _, tc := range []struct {
+		pattern  string
+		expected string
+	}{
+		{"/logs/*.log", "[/logs/a.log /logs/b.log]"},
+		{"/logs/.*.log", "[/logs/.hidden.log]"},
+		{"/*/*.log", "[/logs/a.log /logs/b.log /other/e.log]"},
+		{"/logs/?.txt", "[/logs/c.txt]"},
+		{"/logs/[ab].log", "[/logs/a.log /logs/b.log]"},
+		{"*.log", "[top.log]"},
+		{"/logs/*/d.log", "[/logs/old/d.log]"},
+		{"/top.log", "[/top.log]"},
+		{"/missing", "[]"},
+		{"/missing/*", "[]"},
+		{"/top.log/*", "[]"},
+	} {
+		matches, err := vfs.Glob(fs, tc.pattern)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.pattern, err)
+		}
+		if got := fmt.Sprint(matches); got != tc.expected {
+			t.Fatalf("%s matched %s, expected %s", tc.pattern, got, tc.expected)
+		}
+	}
+
+	_, err := vfs.Glob(fs, "/logs/[")
+	if err == nil {
+		t.Fatal("expected bad pattern error")
+	}
+}
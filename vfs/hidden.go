@@ -0,0 +1,209 @@
+package vfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+)
+
+// HiddenVFS hides paths matching any of Patterns, or inside a matching
+// directory. Hidden entries are left out of directory listings and
+// any direct access fails with os.ErrNotExist.
+type HiddenVFS struct {
+	Fs       VFS
+	Patterns []*NamePattern
+}
+
+func (h *HiddenVFS) hidden(p string) bool {
+	for p = path.Clean("/" + p); p != "/"; p = path.Dir(p) {
+		if matchAny(h.Patterns, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HiddenVFS) wrapFile(dir string, f File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &HiddenFile{File: f, dir: dir, h: h}, nil
+}
+
+func (h *HiddenVFS) Chmod(name string, mode os.FileMode) error {
+	if h.hidden(name) {
+		return os.ErrNotExist
+	}
+	return h.Fs.Chmod(name, mode)
+}
+
+func (h *HiddenVFS) Open(path string) (File, error) {
+	if h.hidden(path) {
+		return nil, os.ErrNotExist
+	}
+	f, err := h.Fs.Open(path)
+	return h.wrapFile(path, f, err)
+}
+
+func (h *HiddenVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if h.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := h.Fs.OpenFile(name, flag, perm)
+	return h.wrapFile(name, f, err)
+}
+
+func (h *HiddenVFS) Mkdir(path string, perm os.FileMode) error {
+	if h.hidden(path) {
+		return os.ErrNotExist
+	}
+	return h.Fs.Mkdir(path, perm)
+}
+
+func (h *HiddenVFS) Stat(path string) (os.FileInfo, error) {
+	if h.hidden(path) {
+		return nil, os.ErrNotExist
+	}
+	return h.Fs.Stat(path)
+}
+
+func (h *HiddenVFS) Rename(from, to string) error {
+	if h.hidden(from) || h.hidden(to) {
+		return os.ErrNotExist
+	}
+	return h.Fs.Rename(from, to)
+}
+
+func (h *HiddenVFS) Remove(path string) error {
+	if h.hidden(path) {
+		return os.ErrNotExist
+	}
+	return h.Fs.Remove(path)
+}
+
+func (h *HiddenVFS) Link(oldname, newname string) error {
+	if h.hidden(oldname) || h.hidden(newname) {
+		return os.ErrNotExist
+	}
+	return h.Fs.Link(oldname, newname)
+}
+
+func (h *HiddenVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	if h.hidden(path) {
+		return nil, os.ErrNotExist
+	}
+	cs, ok := h.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return cs.Checksum(path, algorithm)
+}
+
+func (h *HiddenVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(h.Fs)
+}
+
+// Links to hidden paths resolve to their own path.
+func (h *HiddenVFS) RealPath(p string) (string, error) {
+	if h.hidden(p) {
+		return "", os.ErrNotExist
+	}
+	real, err := RealPath(h.Fs, p)
+	if err != nil {
+		return "", err
+	}
+	if h.hidden(real) {
+		return path.Clean(p), nil
+	}
+	return real, nil
+}
+
+func (h *HiddenVFS) AppendSupported() bool {
+	return AppendSupported(h.Fs)
+}
+
+func (h *HiddenVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	if h.hidden(path) {
+		return os.ErrNotExist
+	}
+	ct, ok := h.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	return ct.Chtimes(path, atime, mtime)
+}
+
+func (h *HiddenVFS) RemoveBatch(paths []string) error {
+	for _, p := range paths {
+		if h.hidden(p) {
+			return os.ErrNotExist
+		}
+	}
+	return RemoveBatch(h.Fs, paths)
+}
+
+func (h *HiddenVFS) RenameBatch(renames []Rename) error {
+	for _, r := range renames {
+		if h.hidden(r.From) || h.hidden(r.To) {
+			return os.ErrNotExist
+		}
+	}
+	return RenameBatch(h.Fs, renames)
+}
+
+func (h *HiddenVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := h.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (h *HiddenVFS) WithContext(ctx context.Context) VFS {
+	copy := *h
+	copy.Fs = WithContext(h.Fs, ctx)
+	return &copy
+}
+
+func (h *HiddenVFS) Close() error {
+	return h.Fs.Close()
+}
+
+// HiddenFile leaves hidden entries out of directory listings.
+type HiddenFile struct {
+	File
+	dir string
+	h   *HiddenVFS
+}
+
+func (hf *HiddenFile) Readdir(n int) ([]os.FileInfo, error) {
+	for {
+		fis, err := hf.File.Readdir(n)
+		kept := fis[:0]
+		for _, fi := range fis {
+			if !hf.h.hidden(path.Join("/", hf.dir, fi.Name())) {
+				kept = append(kept, fi)
+			}
+		}
+		// Don't return an empty batch unless the directory is done.
+		if len(kept) != 0 || len(fis) == 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
+
+func (hf *HiddenFile) Readdirnames(n int) ([]string, error) {
+	for {
+		names, err := hf.File.Readdirnames(n)
+		kept := names[:0]
+		for _, name := range names {
+			if !hf.h.hidden(path.Join("/", hf.dir, name)) {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) != 0 || len(names) == 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package vfs
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// A HookOp describes a call made through a HookVFS.
+type HookOp struct {
+	// One of "chmod", "open", "mkdir", "stat", "rename", "remove",
+	// "link", "checksum", "chtimes", "realpath", or for open files "read", "write", "readdir",
+	// "fchmod", "fstat", "sync" and "close".
+	Op string
+	// The path operated on, the path the file was opened with for
+	// calls on open files.
+	Path string
+	// The destination of "rename" and "link".
+	NewPath string
+	// Flags of "open".
+	Flags int
+	// Mode of "open", "mkdir", "chmod" and "fchmod".
+	Mode os.FileMode
+	// Offset of "read" and "write", sequential calls are
+	// reported at the offset they happened at.
+	Offset int64
+	// Bytes requested by "read" and "write", or
+	// entries requested by "readdir".
+	Length int
+
+	// Set before After is called. N is the number of bytes
+	// or entries read or written.
+	N        int
+	Err      error
+	Duration time.Duration
+}
+
+// HookVFS calls Before and After around every call to Fs, either may be
+// nil. An error from Before fails the call without making it, After sees
+// the result and how long the call took.
+//
+// Hooks may be called from many goroutines at once and must not
+// modify op.
+type HookVFS struct {
+	Fs     VFS
+	Before func(op *HookOp) error
+	After  func(op *HookOp)
+}
+
+func (h *HookVFS) run(op *HookOp, fn func() error) error {
+	if h.Before != nil {
+		err := h.Before(op)
+		if err != nil {
+			return err
+		}
+	}
+	return h.call(op, fn)
+}
+
+// Call fn and report the result to After.
+func (h *HookVFS) call(op *HookOp, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	if h.After != nil {
+		op.Err = err
+		op.Duration = time.Since(start)
+		h.After(op)
+	}
+	return err
+}
+
+func (h *HookVFS) Chmod(name string, mode os.FileMode) error {
+	return h.run(&HookOp{Op: "chmod", Path: name, Mode: mode}, func() error {
+		return h.Fs.Chmod(name, mode)
+	})
+}
+
+func (h *HookVFS) Open(path string) (File, error) {
+	return h.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (h *HookVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	var f File
+	err := h.run(&HookOp{Op: "open", Path: name, Flags: flag, Mode: perm}, func() error {
+		var err error
+		f, err = h.Fs.OpenFile(name, flag, perm)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &HookFile{File: f, h: h, path: name}, nil
+}
+
+func (h *HookVFS) Mkdir(path string, perm os.FileMode) error {
+	return h.run(&HookOp{Op: "mkdir", Path: path, Mode: perm}, func() error {
+		return h.Fs.Mkdir(path, perm)
+	})
+}
+
+func (h *HookVFS) Stat(path string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := h.run(&HookOp{Op: "stat", Path: path}, func() error {
+		var err error
+		fi, err = h.Fs.Stat(path)
+		return err
+	})
+	return fi, err
+}
+
+func (h *HookVFS) Rename(from, to string) error {
+	return h.run(&HookOp{Op: "rename", Path: from, NewPath: to}, func() error {
+		return h.Fs.Rename(from, to)
+	})
+}
+
+func (h *HookVFS) Remove(path string) error {
+	return h.run(&HookOp{Op: "remove", Path: path}, func() error {
+		return h.Fs.Remove(path)
+	})
+}
+
+func (h *HookVFS) Link(oldname, newname string) error {
+	return h.run(&HookOp{Op: "link", Path: oldname, NewPath: newname}, func() error {
+		return h.Fs.Link(oldname, newname)
+	})
+}
+
+func (h *HookVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := h.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	var sum []byte
+	err := h.run(&HookOp{Op: "checksum", Path: path}, func() error {
+		var err error
+		sum, err = cs.Checksum(path, algorithm)
+		return err
+	})
+	return sum, err
+}
+
+func (h *HookVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(h.Fs)
+}
+
+func (h *HookVFS) RealPath(p string) (string, error) {
+	var real string
+	err := h.run(&HookOp{Op: "realpath", Path: p}, func() error {
+		var err error
+		real, err = RealPath(h.Fs, p)
+		return err
+	})
+	return real, err
+}
+
+func (h *HookVFS) AppendSupported() bool {
+	return AppendSupported(h.Fs)
+}
+
+func (h *HookVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	ct, ok := h.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	return h.run(&HookOp{Op: "chtimes", Path: path}, func() error {
+		return ct.Chtimes(path, atime, mtime)
+	})
+}
+
+func (h *HookVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := h.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (h *HookVFS) WithContext(ctx context.Context) VFS {
+	copy := *h
+	copy.Fs = WithContext(h.Fs, ctx)
+	return &copy
+}
+
+func (h *HookVFS) Close() error {
+	return h.Fs.Close()
+}
+
+// HookFile calls the hooks of its HookVFS around calls on an open file.
+type HookFile struct {
+	File
+	h    *HookVFS
+	path string
+	// Offset of sequential reads and writes.
+	offset int64
+}
+
+func (hf *HookFile) Chmod(mode os.FileMode) error {
+	return hf.h.run(&HookOp{Op: "fchmod", Path: hf.path, Mode: mode}, func() error {
+		return hf.File.Chmod(mode)
+	})
+}
+
+func (hf *HookFile) Read(buf []byte) (int, error) {
+	op := &HookOp{Op: "read", Path: hf.path, Offset: hf.offset, Length: len(buf)}
+	err := hf.h.run(op, func() error {
+		var err error
+		op.N, err = hf.File.Read(buf)
+		return err
+	})
+	hf.offset += int64(op.N)
+	return op.N, err
+}
+
+func (hf *HookFile) ReadAt(buf []byte, off int64) (int, error) {
+	op := &HookOp{Op: "read", Path: hf.path, Offset: off, Length: len(buf)}
+	err := hf.h.run(op, func() error {
+		var err error
+		op.N, err = hf.File.ReadAt(buf, off)
+		return err
+	})
+	return op.N, err
+}
+
+func (hf *HookFile) Readdir(n int) ([]os.FileInfo, error) {
+	var fis []os.FileInfo
+	op := &HookOp{Op: "readdir", Path: hf.path, Length: n}
+	err := hf.h.run(op, func() error {
+		var err error
+		fis, err = hf.File.Readdir(n)
+		op.N = len(fis)
+		return err
+	})
+	return fis, err
+}
+
+func (hf *HookFile) Readdirnames(n int) ([]string, error) {
+	var names []string
+	op := &HookOp{Op: "readdir", Path: hf.path, Length: n}
+	err := hf.h.run(op, func() error {
+		var err error
+		names, err = hf.File.Readdirnames(n)
+		op.N = len(names)
+		return err
+	})
+	return names, err
+}
+
+func (hf *HookFile) Write(buf []byte) (int, error) {
+	op := &HookOp{Op: "write", Path: hf.path, Offset: hf.offset, Length: len(buf)}
+	err := hf.h.run(op, func() error {
+		var err error
+		op.N, err = hf.File.Write(buf)
+		return err
+	})
+	hf.offset += int64(op.N)
+	return op.N, err
+}
+
+func (hf *HookFile) WriteAt(buf []byte, off int64) (int, error) {
+	op := &HookOp{Op: "write", Path: hf.path, Offset: off, Length: len(buf)}
+	err := hf.h.run(op, func() error {
+		var err error
+		op.N, err = hf.File.WriteAt(buf, off)
+		return err
+	})
+	return op.N, err
+}
+
+func (hf *HookFile) Stat() (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := hf.h.run(&HookOp{Op: "fstat", Path: hf.path}, func() error {
+		var err error
+		fi, err = hf.File.Stat()
+		return err
+	})
+	return fi, err
+}
+
+func (hf *HookFile) Sync() error {
+	return hf.h.run(&HookOp{Op: "sync", Path: hf.path}, func() error {
+		return hf.File.Sync()
+	})
+}
+
+// Close can't be refused by Before, open files must always be released.
+func (hf *HookFile) Close() error {
+	op := &HookOp{Op: "close", Path: hf.path}
+	if hf.h.Before != nil {
+		_ = hf.h.Before(op)
+	}
+	return hf.h.call(op, func() error {
+		return hf.File.Close()
+	})
+}
@@ -0,0 +1,52 @@
+package vfs_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestHookVFS(t *testing.T) {
+	var ops []string
+	denied := errors.New("denied")
+	fs := &vfs.HookVFS{
+		Fs: mem.New(),
+		Before: func(op *vfs.HookOp) error {
+			if op.Op == "remove" {
+				return denied
+			}
+			return nil
+		},
+		After: func(op *vfs.HookOp) {
+			ops = append(ops, op.Op+":"+op.Path)
+			if op.Op == "write" && op.N != 5 {
+				t.Errorf("write of %d bytes reported", op.N)
+			}
+		},
+	}
+
+	writeAll(t, fs, "/a", []byte("hello"))
+	err := fs.Rename("/a", "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Remove("/b")
+	if err != denied {
+		t.Fatalf("expected denied, got %v", err)
+	}
+	if _, err := fs.Stat("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a"); err == nil {
+		t.Fatal("expected renamed file to be gone")
+	}
+
+	got := strings.Join(ops, " ")
+	want := "open:/a write:/a close:/a rename:/a stat:/b stat:/a"
+	if got != want {
+		t.Fatalf("got hooks %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+//go:build go1.16
+// +build go1.16
+
+// Package iofs serves any io/fs file system, such as an embed.FS or
+// fstest.MapFS, as a read only vfs.VFS.
+package iofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+var (
+	ErrNotDir = errors.New("not a directory")
+)
+
+type Fs struct {
+	fsys fs.FS
+}
+
+func New(fsys fs.FS) *Fs {
+	return &Fs{fsys: fsys}
+}
+
+// io/fs names are unrooted, with "." as the root.
+func fsName(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// Unwrap *fs.PathError so sentinel errors can be compared.
+func fixErr(err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		switch {
+		case errors.Is(pe.Err, fs.ErrNotExist):
+			return os.ErrNotExist
+		case errors.Is(pe.Err, fs.ErrExist):
+			return os.ErrExist
+		case errors.Is(pe.Err, fs.ErrPermission):
+			return os.ErrPermission
+		}
+	}
+	return err
+}
+
+func (ifs *Fs) Chmod(p string, mode os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (ifs *Fs) Open(p string) (vfs.File, error) {
+	name := fsName(p)
+	f, err := ifs.fsys.Open(name)
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return &File{fs: ifs, f: f, name: name, fpath: path.Clean("/" + p)}, nil
+}
+
+func (ifs *Fs) OpenFile(p string, flags int, perm os.FileMode) (vfs.File, error) {
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+	return ifs.Open(p)
+}
+
+func (ifs *Fs) Mkdir(p string, mode os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (ifs *Fs) Stat(p string) (os.FileInfo, error) {
+	fi, err := fs.Stat(ifs.fsys, fsName(p))
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return fi, nil
+}
+
+func (ifs *Fs) Rename(from, to string) error {
+	return os.ErrPermission
+}
+
+func (ifs *Fs) Remove(p string) error {
+	return os.ErrPermission
+}
+
+func (ifs *Fs) Link(oldname, newname string) error {
+	return os.ErrPermission
+}
+
+func (ifs *Fs) Close() error {
+	return nil
+}
+
+type File struct {
+	fs    *Fs
+	name  string
+	fpath string
+
+	// Reads of files that are not an io.ReaderAt or io.Seeker
+	// are emulated, reopening the file to read backwards.
+	lock   sync.Mutex
+	f      fs.File
+	offset int64
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return fi, nil
+}
+
+func (f *File) ReadAt(buf []byte, off int64) (int, error) {
+	if ra, ok := f.f.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(buf, off)
+		return n, fixErr(err)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if s, ok := f.f.(io.Seeker); ok {
+		_, err := s.Seek(off, io.SeekStart)
+		if err != nil {
+			return 0, fixErr(err)
+		}
+	} else {
+		if off < f.offset {
+			nf, err := f.fs.fsys.Open(f.name)
+			if err != nil {
+				return 0, fixErr(err)
+			}
+			_ = f.f.Close()
+			f.f = nf
+			f.offset = 0
+		}
+		if off > f.offset {
+			n, err := io.CopyN(io.Discard, f.f, off-f.offset)
+			f.offset += n
+			if err != nil {
+				return 0, fixErr(err)
+			}
+		}
+	}
+
+	n, err := io.ReadFull(f.f, buf)
+	f.offset = off + int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, fixErr(err)
+}
+
+func (f *File) Read(buf []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.f.Read(buf)
+	f.offset += int64(n)
+	return n, fixErr(err)
+}
+
+func (f *File) Write(buf []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *File) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	d, ok := f.f.(fs.ReadDirFile)
+	if !ok {
+		return nil, ErrNotDir
+	}
+	entries, err := d.ReadDir(n)
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return fis, fixErr(err)
+		}
+		fis = append(fis, fi)
+	}
+	return fis, fixErr(err)
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *File) Sync() error {
+	return nil
+}
+
+func (f *File) Close() error {
+	return fixErr(f.f.Close())
+}
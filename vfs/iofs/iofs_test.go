@@ -0,0 +1,94 @@
+//go:build go1.16
+// +build go1.16
+
+package iofs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+// Hides io.ReaderAt and io.Seeker to test emulated reads.
+type streamFS struct {
+	fs.FS
+}
+
+type streamFile struct {
+	fs.File
+}
+
+func (s streamFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(fs.ReadDirFile); ok {
+		return f, nil
+	}
+	return streamFile{f}, nil
+}
+
+func TestIOFS(t *testing.T) {
+	mfs := fstest.MapFS{
+		"hello.txt":     {Data: []byte("hello world"), Mode: 0644},
+		"dir/other.txt": {Data: []byte("other"), Mode: 0644},
+	}
+
+	for _, fsys := range []fs.FS{mfs, streamFS{mfs}} {
+		ifs := New(fsys)
+
+		fi, err := ifs.Stat("/hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 11 {
+			t.Fatalf("unexpected size %d", fi.Size())
+		}
+		if _, err := ifs.Stat("/missing"); err != os.ErrNotExist {
+			t.Fatalf("expected os.ErrNotExist, got %v", err)
+		}
+
+		f, err := ifs.Open("/hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		for _, tc := range []struct {
+			off  int64
+			want string
+		}{{6, "world"}, {0, "hello"}, {3, "lo wo"}} {
+			n, err := f.ReadAt(buf, tc.off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != tc.want {
+				t.Fatalf("read %q at %d, want %q", buf[:n], tc.off, tc.want)
+			}
+		}
+		n, err := f.ReadAt(buf, 9)
+		if n != 2 || err != io.EOF {
+			t.Fatalf("unexpected read at end %d %v", n, err)
+		}
+		_ = f.Close()
+
+		d, err := ifs.Open("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := d.Readdirnames(-1)
+		_ = d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 2 || names[0] != "dir" || names[1] != "hello.txt" {
+			t.Fatalf("unexpected names %v", names)
+		}
+
+		if _, err := ifs.OpenFile("/new", os.O_WRONLY|os.O_CREATE, 0644); err != os.ErrPermission {
+			t.Fatalf("expected os.ErrPermission, got %v", err)
+		}
+	}
+}
@@ -2,6 +2,11 @@ package local
 
 import (
 	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/andrewchambers/sftpplease/vfs"
 )
@@ -10,11 +15,20 @@ func init() {
 	vfs.RegisterEngine("local", vfsFactory)
 }
 
-func vfsFactory(token string) (vfs.VFS, error) {
+// The optional parameter is a directory to confine the file system to,
+// for example 'local:/srv/sftp'.
+func vfsFactory(root string) (vfs.VFS, error) {
+	if root != "" {
+		return &vfs.ChrootVFS{Fs: &Fs{}, Root: root}, nil
+	}
 	return &Fs{}, nil
 }
 
 type Fs struct {
+	// Cache of uid and gid names, lookups can be slow.
+	namesLock  sync.Mutex
+	userNames  map[uint32]string
+	groupNames map[uint32]string
 }
 
 func (fs *Fs) Chmod(fpath string, mode os.FileMode) error {
@@ -45,6 +59,64 @@ func (fs *Fs) Remove(fpath string) error {
 	return os.Remove(fpath)
 }
 
+func (fs *Fs) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (fs *Fs) RealPath(fpath string) (string, error) {
+	return vfs.ResolveSymlinks(fpath, func(p string) (string, bool, error) {
+		st, err := os.Lstat(p)
+		if err != nil || st.Mode()&os.ModeSymlink == 0 {
+			return "", false, err
+		}
+		target, err := os.Readlink(p)
+		return target, err == nil, err
+	})
+}
+
+func (fs *Fs) AppendSupported() bool {
+	return true
+}
+
 func (fs *Fs) Close() error {
 	return nil
 }
+
+func (fs *Fs) Chtimes(fpath string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(fpath, atime, mtime)
+}
+
+func (fs *Fs) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", "", false
+	}
+
+	fs.namesLock.Lock()
+	defer fs.namesLock.Unlock()
+
+	if fs.userNames == nil {
+		fs.userNames = make(map[uint32]string)
+		fs.groupNames = make(map[uint32]string)
+	}
+
+	owner, ok := fs.userNames[st.Uid]
+	if !ok {
+		owner = strconv.FormatUint(uint64(st.Uid), 10)
+		if u, err := user.LookupId(owner); err == nil {
+			owner = u.Username
+		}
+		fs.userNames[st.Uid] = owner
+	}
+
+	group, ok := fs.groupNames[st.Gid]
+	if !ok {
+		group = strconv.FormatUint(uint64(st.Gid), 10)
+		if g, err := user.LookupGroupId(group); err == nil {
+			group = g.Name
+		}
+		fs.groupNames[st.Gid] = group
+	}
+
+	return owner, group, true
+}
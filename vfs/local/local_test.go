@@ -0,0 +1,74 @@
+package local_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/local"
+)
+
+func TestChrootSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside, filepath.Join(root, "sub")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"escape":       outside,
+		"escape-file":  "../outside/secret",
+		"sub/relative": "../../outside",
+		"inside":       "sub",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Root may itself be reached through a link.
+	rootLink := filepath.Join(dir, "root-link")
+	if err := os.Symlink(root, rootLink); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &vfs.ChrootVFS{Fs: &local.Fs{}, Root: rootLink}
+	for _, p := range []string{"/escape/secret", "/escape-file", "/sub/relative/secret", "/inside/relative/secret"} {
+		if _, err := fs.Open(p); !os.IsPermission(err) {
+			t.Fatalf("open %s: expected a permission error, got %v", p, err)
+		}
+		if _, err := fs.Stat(p); !os.IsPermission(err) {
+			t.Fatalf("stat %s: expected a permission error, got %v", p, err)
+		}
+	}
+	_, err := fs.OpenFile("/escape/new", os.O_WRONLY|os.O_CREATE, 0644)
+	if !os.IsPermission(err) {
+		t.Fatalf("expected creating a file through a link to fail, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Fatal("expected no file to be created outside of the root")
+	}
+	if err := fs.Mkdir("/escape/dir", 0755); !os.IsPermission(err) {
+		t.Fatalf("expected mkdir through a link to fail, got %v", err)
+	}
+
+	// Links inside the root still work, and links themselves
+	// can be removed.
+	if _, err := fs.Stat("/inside"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := fs.RealPath("/inside"); err != nil || p != "/sub" {
+		t.Fatalf("expected /inside to resolve to /sub, got %q %v", p, err)
+	}
+	if err := fs.Remove("/escape"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Fatal("expected removing the link to leave its target")
+	}
+}
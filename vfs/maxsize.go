@@ -0,0 +1,142 @@
+package vfs
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// MaxFileSizeVFS fails any write that would make a file
+// larger than MaxSize bytes with ErrQuotaExceeded.
+type MaxFileSizeVFS struct {
+	Fs      VFS
+	MaxSize int64
+}
+
+func (m *MaxFileSizeVFS) Chmod(name string, mode os.FileMode) error {
+	return m.Fs.Chmod(name, mode)
+}
+
+func (m *MaxFileSizeVFS) Open(path string) (File, error) {
+	return m.Fs.Open(path)
+}
+
+func (m *MaxFileSizeVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := m.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, nil
+	}
+
+	mf := &MaxFileSizeFile{File: f, MaxSize: m.MaxSize}
+	if flag&os.O_APPEND != 0 {
+		st, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		mf.offset = st.Size()
+	}
+	return mf, nil
+}
+
+func (m *MaxFileSizeVFS) Mkdir(path string, perm os.FileMode) error {
+	return m.Fs.Mkdir(path, perm)
+}
+
+func (m *MaxFileSizeVFS) Stat(path string) (os.FileInfo, error) {
+	return m.Fs.Stat(path)
+}
+
+func (m *MaxFileSizeVFS) Rename(from, to string) error {
+	return m.Fs.Rename(from, to)
+}
+
+func (m *MaxFileSizeVFS) Remove(path string) error {
+	return m.Fs.Remove(path)
+}
+
+func (m *MaxFileSizeVFS) Link(oldname, newname string) error {
+	return m.Fs.Link(oldname, newname)
+}
+
+func (m *MaxFileSizeVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := m.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return cs.Checksum(path, algorithm)
+}
+
+func (m *MaxFileSizeVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(m.Fs)
+}
+
+func (m *MaxFileSizeVFS) RealPath(p string) (string, error) {
+	return RealPath(m.Fs, p)
+}
+
+func (m *MaxFileSizeVFS) AppendSupported() bool {
+	return AppendSupported(m.Fs)
+}
+
+func (m *MaxFileSizeVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	ct, ok := m.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	return ct.Chtimes(path, atime, mtime)
+}
+
+func (m *MaxFileSizeVFS) RemoveBatch(paths []string) error {
+	return RemoveBatch(m.Fs, paths)
+}
+
+func (m *MaxFileSizeVFS) RenameBatch(renames []Rename) error {
+	return RenameBatch(m.Fs, renames)
+}
+
+func (m *MaxFileSizeVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := m.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (m *MaxFileSizeVFS) WithContext(ctx context.Context) VFS {
+	copy := *m
+	copy.Fs = WithContext(m.Fs, ctx)
+	return &copy
+}
+
+func (m *MaxFileSizeVFS) Close() error {
+	return m.Fs.Close()
+}
+
+// MaxFileSizeFile fails writes that end past MaxSize bytes.
+type MaxFileSizeFile struct {
+	File
+	MaxSize int64
+
+	// Offset of sequential writes.
+	offset int64
+}
+
+func (mf *MaxFileSizeFile) Write(buf []byte) (int, error) {
+	if mf.offset+int64(len(buf)) > mf.MaxSize {
+		return 0, ErrQuotaExceeded
+	}
+	n, err := mf.File.Write(buf)
+	mf.offset += int64(n)
+	return n, err
+}
+
+func (mf *MaxFileSizeFile) WriteAt(buf []byte, off int64) (int, error) {
+	if off+int64(len(buf)) > mf.MaxSize {
+		return 0, ErrQuotaExceeded
+	}
+	return mf.File.WriteAt(buf, off)
+}
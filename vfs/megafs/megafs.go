@@ -0,0 +1,688 @@
+// Package megafs is a vfs engine backed by a MEGA account, 'mega:EMAIL',
+// with the password taken from the SFTPPLEASE_MEGA_PASSWORD environment
+// variable.
+//
+// MEGA encrypts everything on the client and refers to files by node
+// rather than by path. The node tree is fetched and decrypted on login
+// and kept up to date by the mega library, paths are resolved by walking
+// it from the root of the cloud drive.
+//
+// Uploads are encrypted with a key derived from the file size, so written
+// files are spooled to a temporary file and uploaded on Close. Reads
+// download and decrypt the chunk containing the offset being read.
+package megafs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/t3rm1n4l/go-mega"
+)
+
+var (
+	ErrNotFile            = errors.New("not a file")
+	ErrNotDir             = errors.New("not a directory")
+	ErrNotOpen            = errors.New("file not open")
+	ErrNotEmpty           = errors.New("directory not empty")
+	ErrBadReadWriteOffset = errors.New("bad read/write offset")
+)
+
+func init() {
+	vfs.RegisterEngine("mega", vfsFactory)
+}
+
+func vfsFactory(email string) (vfs.VFS, error) {
+	if email == "" {
+		return nil, errors.New("mega vfs expects an account email, 'mega:EMAIL'")
+	}
+	return Login(email, os.Getenv("SFTPPLEASE_MEGA_PASSWORD"))
+}
+
+type Fs struct {
+	c client
+}
+
+// Log in to the account, fetching and decrypting its node tree.
+func Login(email, password string) (*Fs, error) {
+	m := mega.New()
+	err := m.Login(email, password)
+	if err != nil {
+		return nil, err
+	}
+	return &Fs{c: megaClient{m: m}}, nil
+}
+
+// A file or directory in the node tree, a *mega.Node outside of tests.
+type node interface {
+	GetName() string
+	GetSize() int64
+	GetTimeStamp() time.Time
+	GetType() int
+	GetHash() string
+}
+
+type download interface {
+	Chunks() int
+	ChunkLocation(id int) (int64, int, error)
+	DownloadChunk(id int) ([]byte, error)
+	Finish() error
+}
+
+type upload interface {
+	Chunks() int
+	ChunkLocation(id int) (int64, int, error)
+	UploadChunk(id int, chunk []byte) error
+	Finish() (node, error)
+}
+
+// The calls made to MEGA, those of the same names on mega.Mega
+// and its node tree, so tests can stub them.
+type client interface {
+	GetRoot() node
+	PathLookup(root node, ns []string) ([]node, error)
+	GetChildren(n node) ([]node, error)
+	CreateDir(name string, parent node) (node, error)
+	Delete(n node, destroy bool) error
+	Move(src node, parent node) error
+	Rename(src node, name string) error
+	NewDownload(n node) (download, error)
+	NewUpload(parent node, name string, fileSize int64) (upload, error)
+}
+
+type megaClient struct {
+	m *mega.Mega
+}
+
+func toNodes(megaNodes []*mega.Node) []node {
+	nodes := make([]node, len(megaNodes))
+	for i, n := range megaNodes {
+		nodes[i] = n
+	}
+	return nodes
+}
+
+func (c megaClient) GetRoot() node {
+	return c.m.FS.GetRoot()
+}
+
+func (c megaClient) PathLookup(root node, ns []string) ([]node, error) {
+	nodes, err := c.m.FS.PathLookup(root.(*mega.Node), ns)
+	return toNodes(nodes), err
+}
+
+func (c megaClient) GetChildren(n node) ([]node, error) {
+	nodes, err := c.m.FS.GetChildren(n.(*mega.Node))
+	return toNodes(nodes), err
+}
+
+func (c megaClient) CreateDir(name string, parent node) (node, error) {
+	n, err := c.m.CreateDir(name, parent.(*mega.Node))
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (c megaClient) Delete(n node, destroy bool) error {
+	return c.m.Delete(n.(*mega.Node), destroy)
+}
+
+func (c megaClient) Move(src node, parent node) error {
+	return c.m.Move(src.(*mega.Node), parent.(*mega.Node))
+}
+
+func (c megaClient) Rename(src node, name string) error {
+	return c.m.Rename(src.(*mega.Node), name)
+}
+
+func (c megaClient) NewDownload(n node) (download, error) {
+	d, err := c.m.NewDownload(n.(*mega.Node))
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (c megaClient) NewUpload(parent node, name string, fileSize int64) (upload, error) {
+	u, err := c.m.NewUpload(parent.(*mega.Node), name, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	return megaUpload{u}, nil
+}
+
+type megaUpload struct {
+	*mega.Upload
+}
+
+func (u megaUpload) Finish() (node, error) {
+	n, err := u.Upload.Finish()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func fixErr(err error) error {
+	switch err {
+	case mega.ENOENT:
+		return os.ErrNotExist
+	case mega.EEXIST:
+		return os.ErrExist
+	case mega.EACCESS:
+		return os.ErrPermission
+	}
+	return err
+}
+
+// Find the node at p by walking the tree from the root.
+func (fs *Fs) lookup(p string) (node, error) {
+	p = path.Clean("/" + p)
+	root := fs.c.GetRoot()
+	if p == "/" {
+		return root, nil
+	}
+	nodes, err := fs.c.PathLookup(root, strings.Split(p[1:], "/"))
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	if len(nodes) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return nodes[len(nodes)-1], nil
+}
+
+// Find the directory that will contain p.
+func (fs *Fs) lookupParent(p string) (node, error) {
+	parent, err := fs.lookup(path.Dir(path.Clean("/" + p)))
+	if err != nil {
+		return nil, err
+	}
+	if parent.GetType() == mega.FILE {
+		return nil, ErrNotDir
+	}
+	return parent, nil
+}
+
+type FileInfo struct {
+	name string
+	node node
+}
+
+func (fi *FileInfo) Name() string       { return fi.name }
+func (fi *FileInfo) Size() int64        { return fi.node.GetSize() }
+func (fi *FileInfo) ModTime() time.Time { return fi.node.GetTimeStamp() }
+func (fi *FileInfo) IsDir() bool        { return fi.node.GetType() != mega.FILE }
+func (fi *FileInfo) Sys() interface{}   { return fi.node }
+
+func (fi *FileInfo) Mode() os.FileMode {
+	if fi.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fs *Fs) Stat(p string) (os.FileInfo, error) {
+	n, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{name: path.Base(path.Clean("/" + p)), node: n}, nil
+}
+
+func (fs *Fs) Chmod(p string, mode os.FileMode) error {
+	// MEGA has no permissions.
+	return nil
+}
+
+func (fs *Fs) Open(p string) (vfs.File, error) {
+	n, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		fs:             fs,
+		fpath:          p,
+		node:           n,
+		isDir:          n.GetType() != mega.FILE,
+		openForReading: true,
+	}, nil
+}
+
+func (fs *Fs) OpenFile(p string, flags int, perm os.FileMode) (vfs.File, error) {
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.Open(p)
+	}
+
+	n, err := fs.lookup(p)
+	exists := err == nil
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	if exists && n.GetType() != mega.FILE {
+		return nil, ErrNotFile
+	}
+	if !exists && flags&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if exists && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+	if !exists {
+		_, err = fs.lookupParent(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	spool, err := ioutil.TempFile("", "sftpplease-mega")
+	if err != nil {
+		return nil, err
+	}
+	// The spool file is only reachable through the handle.
+	_ = os.Remove(spool.Name())
+
+	f := &File{
+		fs:             fs,
+		fpath:          p,
+		node:           n,
+		openForWriting: true,
+		spool:          spool,
+		dirty:          !exists || flags&os.O_TRUNC != 0,
+	}
+
+	// Existing contents must be kept for partial updates.
+	if exists && flags&os.O_TRUNC == 0 {
+		err = f.downloadTo(spool)
+		if err != nil {
+			_ = spool.Close()
+			return nil, err
+		}
+	}
+	if flags&os.O_APPEND != 0 {
+		f.writeOffset, err = spool.Seek(0, io.SeekEnd)
+		if err != nil {
+			_ = spool.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (fs *Fs) Mkdir(p string, mode os.FileMode) error {
+	// MEGA allows several nodes with the same name.
+	_, err := fs.lookup(p)
+	if err == nil {
+		return os.ErrExist
+	}
+	if err != os.ErrNotExist {
+		return err
+	}
+	parent, err := fs.lookupParent(p)
+	if err != nil {
+		return err
+	}
+	_, err = fs.c.CreateDir(path.Base(path.Clean("/"+p)), parent)
+	return fixErr(err)
+}
+
+func (fs *Fs) Rename(from, to string) error {
+	n, err := fs.lookup(from)
+	if err != nil {
+		return err
+	}
+	if n.GetType() != mega.FILE && n.GetType() != mega.FOLDER {
+		return os.ErrPermission
+	}
+	to = path.Clean("/" + to)
+	parent, err := fs.lookupParent(to)
+	if err != nil {
+		return err
+	}
+	// An existing target file is replaced, like a local rename.
+	old, err := fs.lookup(to)
+	if err == nil {
+		if old.GetHash() == n.GetHash() {
+			return nil
+		}
+		if old.GetType() != mega.FILE {
+			return os.ErrExist
+		}
+		err = fs.c.Delete(old, true)
+		if err != nil {
+			return fixErr(err)
+		}
+	} else if err != os.ErrNotExist {
+		return err
+	}
+
+	if path.Dir(to) != path.Dir(path.Clean("/"+from)) {
+		err = fs.c.Move(n, parent)
+		if err != nil {
+			return fixErr(err)
+		}
+	}
+	if path.Base(to) != n.GetName() {
+		err = fs.c.Rename(n, path.Base(to))
+		if err != nil {
+			return fixErr(err)
+		}
+	}
+	return nil
+}
+
+// Files are destroyed rather than moved to the rubbish
+// bin, use -trash-dir to keep removed files.
+func (fs *Fs) Remove(p string) error {
+	n, err := fs.lookup(p)
+	if err != nil {
+		return err
+	}
+	switch n.GetType() {
+	case mega.FILE:
+	case mega.FOLDER:
+		children, err := fs.c.GetChildren(n)
+		if err != nil {
+			return fixErr(err)
+		}
+		if len(children) != 0 {
+			return ErrNotEmpty
+		}
+	default:
+		return os.ErrPermission
+	}
+	return fixErr(fs.c.Delete(n, true))
+}
+
+func (fs *Fs) Link(oldname, newname string) error {
+	return vfs.ErrUnsupported
+}
+
+func (fs *Fs) Close() error {
+	return nil
+}
+
+type File struct {
+	fs *Fs
+
+	fpath string
+	node  node
+	isDir bool
+
+	dirEnts []os.FileInfo
+	listed  bool
+
+	openForReading bool
+	openForWriting bool
+
+	readOffset int64
+	download   download
+	// Chunks that have been downloaded, the MAC
+	// of the file is checked if all of them were.
+	fetched  []bool
+	chunk    []byte
+	chunkPos int64
+
+	writeOffset int64
+	spool       *os.File
+	dirty       bool
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return nil
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.fs.Stat(f.fpath)
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.isDir {
+		return nil, ErrNotDir
+	}
+	if !f.openForReading {
+		return nil, ErrNotOpen
+	}
+
+	// The node tree is in memory, so the
+	// whole directory is listed at once.
+	if !f.listed {
+		children, err := f.fs.c.GetChildren(f.node)
+		if err != nil {
+			return nil, fixErr(err)
+		}
+		for _, child := range children {
+			f.dirEnts = append(f.dirEnts, &FileInfo{name: child.GetName(), node: child})
+		}
+		f.listed = true
+	}
+
+	if n <= 0 {
+		fis := f.dirEnts
+		f.dirEnts = nil
+		return fis, nil
+	}
+	if len(f.dirEnts) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirEnts) {
+		n = len(f.dirEnts)
+	}
+	fis := f.dirEnts[:n]
+	f.dirEnts = f.dirEnts[n:]
+	return fis, nil
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+// The decrypted chunk containing off and its position, the
+// last chunk is kept as reads are usually sequential.
+func (f *File) chunkAt(off int64) ([]byte, int64, error) {
+	if f.chunk != nil && off >= f.chunkPos && off < f.chunkPos+int64(len(f.chunk)) {
+		return f.chunk, f.chunkPos, nil
+	}
+	if f.download == nil {
+		d, err := f.fs.c.NewDownload(f.node)
+		if err != nil {
+			return nil, 0, fixErr(err)
+		}
+		f.download = d
+		f.fetched = make([]bool, d.Chunks())
+	}
+
+	// Chunks are in order, find the last one starting at or before off.
+	id := sort.Search(f.download.Chunks(), func(i int) bool {
+		pos, _, _ := f.download.ChunkLocation(i)
+		return pos > off
+	}) - 1
+	if id < 0 {
+		return nil, 0, ErrBadReadWriteOffset
+	}
+	pos, _, err := f.download.ChunkLocation(id)
+	if err != nil {
+		return nil, 0, fixErr(err)
+	}
+	chunk, err := f.download.DownloadChunk(id)
+	if err != nil {
+		return nil, 0, fixErr(err)
+	}
+	f.fetched[id] = true
+	f.chunk = chunk
+	f.chunkPos = pos
+	return chunk, pos, nil
+}
+
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrNotFile
+	}
+	if f.spool != nil {
+		return f.spool.ReadAt(b, off)
+	}
+	if !f.openForReading {
+		return 0, ErrNotOpen
+	}
+	if off < 0 {
+		return 0, ErrBadReadWriteOffset
+	}
+
+	size := f.node.GetSize()
+	nread := 0
+	for nread < len(b) && off+int64(nread) < size {
+		chunk, pos, err := f.chunkAt(off + int64(nread))
+		if err != nil {
+			return nread, err
+		}
+		nread += copy(b[nread:], chunk[off+int64(nread)-pos:])
+	}
+	if nread < len(b) {
+		return nread, io.EOF
+	}
+	return nread, nil
+}
+
+func (f *File) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.readOffset)
+	f.readOffset += int64(n)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Download the whole file to w.
+func (f *File) downloadTo(w io.Writer) error {
+	d, err := f.fs.c.NewDownload(f.node)
+	if err != nil {
+		return fixErr(err)
+	}
+	for id := 0; id < d.Chunks(); id++ {
+		chunk, err := d.DownloadChunk(id)
+		if err != nil {
+			return fixErr(err)
+		}
+		_, err = w.Write(chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return d.Finish()
+}
+
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrNotFile
+	}
+	if !f.openForWriting {
+		return 0, ErrNotOpen
+	}
+	if off < 0 {
+		return 0, ErrBadReadWriteOffset
+	}
+	f.dirty = true
+	return f.spool.WriteAt(b, off)
+}
+
+func (f *File) Write(b []byte) (int, error) {
+	n, err := f.WriteAt(b, f.writeOffset)
+	f.writeOffset += int64(n)
+	return n, err
+}
+
+func (f *File) Sync() error {
+	if f.openForWriting && f.dirty {
+		err := f.upload()
+		if err != nil {
+			return err
+		}
+		f.dirty = false
+	}
+	return nil
+}
+
+// Encrypt and upload the spooled file contents.
+func (f *File) upload() error {
+	size, err := f.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	parent, err := f.fs.lookupParent(f.fpath)
+	if err != nil {
+		return err
+	}
+	old, err := f.fs.lookup(f.fpath)
+	if err != nil && err != os.ErrNotExist {
+		return err
+	}
+
+	u, err := f.fs.c.NewUpload(parent, path.Base(path.Clean("/"+f.fpath)), size)
+	if err != nil {
+		return fixErr(err)
+	}
+	for id := 0; id < u.Chunks(); id++ {
+		pos, sz, err := u.ChunkLocation(id)
+		if err != nil {
+			return fixErr(err)
+		}
+		chunk := make([]byte, sz)
+		_, err = f.spool.ReadAt(chunk, pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		err = u.UploadChunk(id, chunk)
+		if err != nil {
+			return fixErr(err)
+		}
+	}
+	n, err := u.Finish()
+	if err != nil {
+		return fixErr(err)
+	}
+	f.node = n
+
+	// MEGA allows several files with the same name, the
+	// old file is removed once the new one is complete.
+	if old != nil {
+		return fixErr(f.fs.c.Delete(old, true))
+	}
+	return nil
+}
+
+func (f *File) Close() error {
+	if f.download != nil {
+		download := f.download
+		f.download = nil
+		f.chunk = nil
+		for _, fetched := range f.fetched {
+			if !fetched {
+				return nil
+			}
+		}
+		return download.Finish()
+	}
+	if f.spool != nil {
+		err := f.Sync()
+		_ = f.spool.Close()
+		f.spool = nil
+		return err
+	}
+	return nil
+}
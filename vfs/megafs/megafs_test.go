@@ -0,0 +1,363 @@
+package megafs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/t3rm1n4l/go-mega"
+)
+
+type fakeNode struct {
+	name     string
+	hash     string
+	ntype    int
+	data     []byte
+	parent   *fakeNode
+	children []*fakeNode
+}
+
+func (n *fakeNode) GetName() string         { return n.name }
+func (n *fakeNode) GetSize() int64          { return int64(len(n.data)) }
+func (n *fakeNode) GetTimeStamp() time.Time { return time.Time{} }
+func (n *fakeNode) GetType() int            { return n.ntype }
+func (n *fakeNode) GetHash() string         { return n.hash }
+
+// A node tree in memory, looked up the way the mega library does.
+// Files are transferred in chunks of 4 bytes.
+type fakeClient struct {
+	root *fakeNode
+	next int
+	// If set, Delete fails with it.
+	deleteErr error
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{root: &fakeNode{hash: "root", ntype: mega.ROOT}}
+}
+
+func (c *fakeClient) add(parent *fakeNode, name string, ntype int, data []byte) *fakeNode {
+	c.next++
+	n := &fakeNode{name: name, hash: string(rune('a' + c.next)), ntype: ntype, data: data, parent: parent}
+	parent.children = append(parent.children, n)
+	return n
+}
+
+func (c *fakeClient) unlink(n *fakeNode) {
+	siblings := n.parent.children
+	for i, sibling := range siblings {
+		if sibling == n {
+			n.parent.children = append(siblings[:i:i], siblings[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *fakeClient) GetRoot() node {
+	return c.root
+}
+
+func (c *fakeClient) PathLookup(root node, ns []string) ([]node, error) {
+	var nodes []node
+	children := root.(*fakeNode).children
+	for _, name := range ns {
+		found := false
+		for _, n := range children {
+			if n.name == name {
+				nodes = append(nodes, n)
+				children = n.children
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nodes, mega.ENOENT
+		}
+	}
+	return nodes, nil
+}
+
+func (c *fakeClient) GetChildren(n node) ([]node, error) {
+	var nodes []node
+	for _, child := range n.(*fakeNode).children {
+		nodes = append(nodes, child)
+	}
+	return nodes, nil
+}
+
+func (c *fakeClient) CreateDir(name string, parent node) (node, error) {
+	return c.add(parent.(*fakeNode), name, mega.FOLDER, nil), nil
+}
+
+func (c *fakeClient) Delete(n node, destroy bool) error {
+	if c.deleteErr != nil {
+		return c.deleteErr
+	}
+	c.unlink(n.(*fakeNode))
+	return nil
+}
+
+func (c *fakeClient) Move(src node, parent node) error {
+	n := src.(*fakeNode)
+	c.unlink(n)
+	n.parent = parent.(*fakeNode)
+	n.parent.children = append(n.parent.children, n)
+	return nil
+}
+
+func (c *fakeClient) Rename(src node, name string) error {
+	src.(*fakeNode).name = name
+	return nil
+}
+
+func chunkLocation(size int, id int) (int64, int, error) {
+	pos := id * 4
+	if pos >= size && size != 0 {
+		return 0, 0, errors.New("bad chunk")
+	}
+	n := size - pos
+	if n > 4 {
+		n = 4
+	}
+	return int64(pos), n, nil
+}
+
+type fakeDownload struct {
+	n *fakeNode
+}
+
+func (d *fakeDownload) Chunks() int {
+	return (len(d.n.data) + 3) / 4
+}
+
+func (d *fakeDownload) ChunkLocation(id int) (int64, int, error) {
+	return chunkLocation(len(d.n.data), id)
+}
+
+func (d *fakeDownload) DownloadChunk(id int) ([]byte, error) {
+	pos, size, err := d.ChunkLocation(id)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, d.n.data[pos:pos+int64(size)]...), nil
+}
+
+func (d *fakeDownload) Finish() error {
+	return nil
+}
+
+func (c *fakeClient) NewDownload(n node) (download, error) {
+	return &fakeDownload{n: n.(*fakeNode)}, nil
+}
+
+type fakeUpload struct {
+	c      *fakeClient
+	parent *fakeNode
+	name   string
+	data   []byte
+}
+
+func (u *fakeUpload) Chunks() int {
+	return (len(u.data) + 3) / 4
+}
+
+func (u *fakeUpload) ChunkLocation(id int) (int64, int, error) {
+	return chunkLocation(len(u.data), id)
+}
+
+func (u *fakeUpload) UploadChunk(id int, chunk []byte) error {
+	pos, _, err := u.ChunkLocation(id)
+	if err != nil {
+		return err
+	}
+	copy(u.data[pos:], chunk)
+	return nil
+}
+
+func (u *fakeUpload) Finish() (node, error) {
+	return u.c.add(u.parent, u.name, mega.FILE, u.data), nil
+}
+
+func (c *fakeClient) NewUpload(parent node, name string, fileSize int64) (upload, error) {
+	return &fakeUpload{c: c, parent: parent.(*fakeNode), name: name, data: make([]byte, fileSize)}, nil
+}
+
+func TestLookup(t *testing.T) {
+	c := newFakeClient()
+	dir := c.add(c.root, "dir", mega.FOLDER, nil)
+	file := c.add(dir, "file", mega.FILE, []byte("hello"))
+	fs := &Fs{c: c}
+
+	for _, tc := range []struct {
+		path   string
+		expect *fakeNode
+		err    error
+	}{
+		{"/", c.root, nil},
+		{"", c.root, nil},
+		{"/dir", dir, nil},
+		{"dir/", dir, nil},
+		{"/dir/file", file, nil},
+		{"/dir/../dir/./file", file, nil},
+		{"/missing", nil, os.ErrNotExist},
+		{"/dir/missing", nil, os.ErrNotExist},
+		{"/dir/file/below", nil, os.ErrNotExist},
+	} {
+		n, err := fs.lookup(tc.path)
+		if err != tc.err {
+			t.Fatalf("%q: expected error %v, got %v", tc.path, tc.err, err)
+		}
+		if err == nil && n != node(tc.expect) {
+			t.Fatalf("%q: found the wrong node %q", tc.path, n.GetName())
+		}
+	}
+
+	parent, err := fs.lookupParent("/dir/new")
+	if err != nil || parent != node(dir) {
+		t.Fatalf("unexpected parent %v %v", parent, err)
+	}
+	_, err = fs.lookupParent("/dir/file/new")
+	if err != ErrNotDir {
+		t.Fatalf("expected ErrNotDir, got %v", err)
+	}
+	_, err = fs.lookupParent("/missing/new")
+	if err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestFixErr(t *testing.T) {
+	other := errors.New("other")
+	for _, tc := range []struct {
+		err    error
+		expect error
+	}{
+		{nil, nil},
+		{mega.ENOENT, os.ErrNotExist},
+		{mega.EEXIST, os.ErrExist},
+		{mega.EACCESS, os.ErrPermission},
+		{other, other},
+	} {
+		if got := fixErr(tc.err); got != tc.expect {
+			t.Fatalf("%v: expected %v, got %v", tc.err, tc.expect, got)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := newFakeClient()
+	dir := c.add(c.root, "dir", mega.FOLDER, nil)
+	c.add(dir, "file", mega.FILE, []byte("hello"))
+	c.add(c.root, "empty", mega.FOLDER, nil)
+	c.add(c.root, "other", mega.FILE, []byte("other"))
+	fs := &Fs{c: c}
+
+	for _, tc := range []struct {
+		op  string
+		fn  func() error
+		err error
+	}{
+		{"stat missing", func() error { _, err := fs.Stat("/missing"); return err }, os.ErrNotExist},
+		{"mkdir existing", func() error { return fs.Mkdir("/dir", 0755) }, os.ErrExist},
+		{"mkdir in file", func() error { return fs.Mkdir("/other/d", 0755) }, ErrNotDir},
+		{"remove non empty", func() error { return fs.Remove("/dir") }, ErrNotEmpty},
+		{"remove root", func() error { return fs.Remove("/") }, os.ErrPermission},
+		{"rename root", func() error { return fs.Rename("/", "/x") }, os.ErrPermission},
+		{"rename over dir", func() error { return fs.Rename("/other", "/empty") }, os.ErrExist},
+		{"rename missing", func() error { return fs.Rename("/missing", "/x") }, os.ErrNotExist},
+		{"open dir for writing", func() error {
+			_, err := fs.OpenFile("/dir", os.O_WRONLY, 0)
+			return err
+		}, ErrNotFile},
+		{"open missing for writing", func() error {
+			_, err := fs.OpenFile("/missing", os.O_WRONLY, 0)
+			return err
+		}, os.ErrNotExist},
+		{"create existing exclusively", func() error {
+			_, err := fs.OpenFile("/other", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			return err
+		}, os.ErrExist},
+		{"create in missing dir", func() error {
+			_, err := fs.OpenFile("/missing/f", os.O_WRONLY|os.O_CREATE, 0644)
+			return err
+		}, os.ErrNotExist},
+	} {
+		if err := tc.fn(); err != tc.err {
+			t.Fatalf("%s: expected %v, got %v", tc.op, tc.err, err)
+		}
+	}
+
+	// Errors from the client are mapped.
+	c.deleteErr = mega.EACCESS
+	err := fs.Remove("/empty")
+	if err != os.ErrPermission {
+		t.Fatalf("expected os.ErrPermission, got %v", err)
+	}
+}
+
+func TestReadWriteRename(t *testing.T) {
+	c := newFakeClient()
+	c.add(c.root, "dir", mega.FOLDER, nil)
+	fs := &Fs{c: c}
+
+	f, err := fs.OpenFile("/dir/a", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the file leaves one node of that name.
+	f, err = fs.OpenFile("/dir/a", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := fs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+	if len(names) != 1 || names[0] != "a" {
+		t.Fatalf("unexpected directory contents %v", names)
+	}
+
+	err = fs.Rename("/dir/a", "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/dir/a"); err != os.ErrNotExist {
+		t.Fatalf("expected the old name to be gone, got %v", err)
+	}
+	f, err = fs.Open("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if string(got) != "hello world!" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+}
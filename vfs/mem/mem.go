@@ -0,0 +1,520 @@
+// Package mem is a vfs engine keeping files in memory, mostly
+// useful for tests. Each file system opened with 'mem' starts empty
+// and its contents are lost when it is closed.
+package mem
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+func init() {
+	vfs.RegisterEngine("mem", vfsFactory)
+}
+
+func vfsFactory(params string) (vfs.VFS, error) {
+	return New(), nil
+}
+
+type node struct {
+	mode     os.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*node
+}
+
+func (n *node) isDir() bool {
+	return n.mode.IsDir()
+}
+
+type Fs struct {
+	// Protects the whole tree, including file contents.
+	lock sync.Mutex
+	root *node
+}
+
+// An empty in memory file system.
+func New() *Fs {
+	return &Fs{
+		root: &node{
+			mode:     os.ModeDir | 0755,
+			modTime:  time.Now(),
+			children: make(map[string]*node),
+		},
+	}
+}
+
+func splitPath(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// Find the node at p, fs.lock must be held.
+func (fs *Fs) lookup(op, p string) (*node, error) {
+	n := fs.root
+	for _, name := range splitPath(p) {
+		if !n.isDir() {
+			return nil, &os.PathError{Op: op, Path: p, Err: syscall.ENOTDIR}
+		}
+		child, ok := n.children[name]
+		if !ok {
+			return nil, &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// Find the directory containing p and the last element of p,
+// fs.lock must be held.
+func (fs *Fs) lookupParent(op, p string) (*node, string, error) {
+	elems := splitPath(p)
+	if len(elems) == 0 {
+		return nil, "", &os.PathError{Op: op, Path: p, Err: syscall.EINVAL}
+	}
+	dir, err := fs.lookup(op, path.Dir(path.Clean("/"+p)))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.isDir() {
+		return nil, "", &os.PathError{Op: op, Path: p, Err: syscall.ENOTDIR}
+	}
+	return dir, elems[len(elems)-1], nil
+}
+
+func (fs *Fs) Chmod(p string, mode os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, err := fs.lookup("chmod", p)
+	if err != nil {
+		return err
+	}
+	n.mode = (n.mode &^ os.ModePerm) | (mode & os.ModePerm)
+	return nil
+}
+
+// Files only have a modification time, atime is ignored.
+func (fs *Fs) Chtimes(p string, atime time.Time, mtime time.Time) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, err := fs.lookup("chtimes", p)
+	if err != nil {
+		return err
+	}
+	n.modTime = mtime
+	return nil
+}
+
+func (fs *Fs) AppendSupported() bool {
+	return true
+}
+
+func (fs *Fs) Open(p string) (vfs.File, error) {
+	return fs.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(p string, flag int, perm os.FileMode) (vfs.File, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	n, err := fs.lookup("open", p)
+	if err == nil {
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+		}
+		if n.isDir() && writable {
+			return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EISDIR}
+		}
+		if flag&os.O_TRUNC != 0 && writable {
+			n.data = nil
+			n.modTime = time.Now()
+		}
+	} else if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		dir, name, err := fs.lookupParent("open", p)
+		if err != nil {
+			return nil, err
+		}
+		n = &node{
+			mode:    perm & os.ModePerm,
+			modTime: time.Now(),
+		}
+		dir.children[name] = n
+		dir.modTime = n.modTime
+	} else {
+		return nil, err
+	}
+
+	return &File{
+		fs:       fs,
+		n:        n,
+		name:     path.Clean("/" + p),
+		readable: flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (fs *Fs) Mkdir(p string, perm os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	dir, name, err := fs.lookupParent("mkdir", p)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+	now := time.Now()
+	dir.children[name] = &node{
+		mode:     os.ModeDir | (perm & os.ModePerm),
+		modTime:  now,
+		children: make(map[string]*node),
+	}
+	dir.modTime = now
+	return nil
+}
+
+func (fs *Fs) Stat(p string) (os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, err := fs.lookup("stat", p)
+	if err != nil {
+		return nil, err
+	}
+	return n.stat(path.Base(path.Clean("/" + p))), nil
+}
+
+func (fs *Fs) Rename(from, to string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fromDir, fromName, err := fs.lookupParent("rename", from)
+	if err != nil {
+		return err
+	}
+	n, ok := fromDir.children[fromName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	toDir, toName, err := fs.lookupParent("rename", to)
+	if err != nil {
+		return err
+	}
+
+	// A directory can't be moved inside itself.
+	cleanFrom, cleanTo := path.Clean("/"+from), path.Clean("/"+to)
+	if n.isDir() && strings.HasPrefix(cleanTo+"/", cleanFrom+"/") && cleanTo != cleanFrom {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EINVAL}
+	}
+
+	if existing, ok := toDir.children[toName]; ok {
+		if existing == n {
+			return nil
+		}
+		switch {
+		case n.isDir() && !existing.isDir():
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.ENOTDIR}
+		case !n.isDir() && existing.isDir():
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EISDIR}
+		case existing.isDir() && len(existing.children) != 0:
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	delete(fromDir.children, fromName)
+	toDir.children[toName] = n
+	now := time.Now()
+	fromDir.modTime = now
+	toDir.modTime = now
+	return nil
+}
+
+func (fs *Fs) Remove(p string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	dir, name, err := fs.lookupParent("remove", p)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.children[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	if n.isDir() && len(n.children) != 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+	}
+	delete(dir.children, name)
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (fs *Fs) Link(oldname, newname string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, err := fs.lookup("link", oldname)
+	if err != nil {
+		return err
+	}
+	if n.isDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrPermission}
+	}
+	dir, name, err := fs.lookupParent("link", newname)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[name]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	dir.children[name] = n
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (fs *Fs) Close() error {
+	return nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// A snapshot of n's metadata, fs.lock must be held.
+func (n *node) stat(name string) os.FileInfo {
+	return &fileInfo{
+		name:    name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+type File struct {
+	fs       *Fs
+	n        *node
+	name     string
+	readable bool
+	writable bool
+	append   bool
+
+	offset int64
+	// Remaining directory entries, listed on the first Readdir.
+	dirents []os.FileInfo
+	listed  bool
+	closed  bool
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if write && !f.writable || !write && !f.readable {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	if f.n.isDir() && op != "readdir" {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	return nil
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "chmod", Path: f.name, Err: os.ErrClosed}
+	}
+	f.n.mode = (f.n.mode &^ os.ModePerm) | (mode & os.ModePerm)
+	return nil
+}
+
+func (f *File) Read(buf []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(buf, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *File) ReadAt(buf []byte, offset int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	return f.readAt(buf, offset)
+}
+
+func (f *File) readAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset >= int64(len(f.n.data)) {
+		if len(buf) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(buf, f.n.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *File) Write(buf []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.append {
+		f.offset = int64(len(f.n.data))
+	}
+	n, err := f.writeAt(buf, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *File) WriteAt(buf []byte, offset int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.append {
+		// Like os.File, positioned writes don't mix with O_APPEND.
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EINVAL}
+	}
+	return f.writeAt(buf, offset)
+}
+
+func (f *File) writeAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EINVAL}
+	}
+	end := offset + int64(len(buf))
+	if end > int64(len(f.n.data)) {
+		if end > int64(cap(f.n.data)) {
+			grown := make([]byte, end, end+end/4)
+			copy(grown, f.n.data)
+			f.n.data = grown
+		}
+		f.n.data = f.n.data[:end]
+	}
+	copy(f.n.data[offset:], buf)
+	f.n.modTime = time.Now()
+	return len(buf), nil
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.n.isDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	if !f.listed {
+		names := make([]string, 0, len(f.n.children))
+		for name := range f.n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f.dirents = append(f.dirents, f.n.children[name].stat(name))
+		}
+		f.listed = true
+	}
+
+	if count <= 0 {
+		fis := f.dirents
+		f.dirents = nil
+		return fis, nil
+	}
+	if len(f.dirents) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.dirents) {
+		count = len(f.dirents)
+	}
+	fis := f.dirents[:count]
+	f.dirents = f.dirents[count:]
+	return fis, nil
+}
+
+func (f *File) Readdirnames(count int) ([]string, error) {
+	fis, err := f.Readdir(count)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.n.stat(path.Base(f.name)), nil
+}
+
+func (f *File) Sync() error {
+	return nil
+}
+
+func (f *File) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
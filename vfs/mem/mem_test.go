@@ -0,0 +1,189 @@
+package mem
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func writeFile(t *testing.T, fs *Fs, p, data string) {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs *Fs, p string) string {
+	t.Helper()
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReadWrite(t *testing.T) {
+	fs := New()
+
+	writeFile(t, fs, "/foo", "hello")
+	if data := readFile(t, fs, "/foo"); data != "hello" {
+		t.Fatalf("got %q", data)
+	}
+
+	f, err := fs.OpenFile("/foo", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("XY"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if data := readFile(t, fs, "/foo"); data != "hello\x00\x00XY" {
+		t.Fatalf("got %q", data)
+	}
+
+	f, err = fs.OpenFile("/foo", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("!"))
+	_ = f.Close()
+	if data := readFile(t, fs, "/foo"); data != "hello\x00\x00XY!" {
+		t.Fatalf("got %q", data)
+	}
+
+	f, err = fs.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Fatal("expected write to read only file to fail")
+	}
+	buf := make([]byte, 4)
+	n, err := f.ReadAt(buf, 8)
+	if n != 2 || err != io.EOF || string(buf[:n]) != "Y!" {
+		t.Fatalf("got %d %v %q", n, err, buf[:n])
+	}
+	_ = f.Close()
+
+	_, err = fs.OpenFile("/foo", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if !os.IsExist(err) {
+		t.Fatalf("expected exists error, got %v", err)
+	}
+	_, err = fs.Open("/missing")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	fs := New()
+
+	if err := fs.Mkdir("/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/a/b", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/a", 0755); !os.IsExist(err) {
+		t.Fatalf("expected exists error, got %v", err)
+	}
+	if err := fs.Mkdir("/x/y", 0755); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+	writeFile(t, fs, "/a/c", "c")
+	writeFile(t, fs, "/a/a", "a")
+
+	st, err := fs.Stat("/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.IsDir() || st.Mode().Perm() != 0700 || st.Name() != "b" {
+		t.Fatalf("bad stat: %v %v %v", st.IsDir(), st.Mode(), st.Name())
+	}
+
+	d, err := fs.Open("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		fis, err := d.Readdir(2)
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = d.Close()
+	if !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+		t.Fatalf("got %v", names)
+	}
+
+	if err := fs.Remove("/a"); err == nil {
+		t.Fatal("expected removing a non empty directory to fail")
+	}
+	if err := fs.Remove("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenFile("/a", os.O_WRONLY, 0); err == nil {
+		t.Fatal("expected opening a directory for writing to fail")
+	}
+}
+
+func TestRenameAndLink(t *testing.T) {
+	fs := New()
+
+	_ = fs.Mkdir("/d", 0755)
+	writeFile(t, fs, "/d/f", "data")
+	writeFile(t, fs, "/g", "old")
+
+	if err := fs.Rename("/d/f", "/g"); err != nil {
+		t.Fatal(err)
+	}
+	if data := readFile(t, fs, "/g"); data != "data" {
+		t.Fatalf("got %q", data)
+	}
+	if _, err := fs.Stat("/d/f"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+
+	if err := fs.Rename("/d", "/d/e"); err == nil {
+		t.Fatal("expected moving a directory inside itself to fail")
+	}
+	if err := fs.Rename("/d", "/e"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Link("/g", "/e/h"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("/g", "/e/h"); !os.IsExist(err) {
+		t.Fatalf("expected exists error, got %v", err)
+	}
+	writeFile(t, fs, "/g", "new")
+	if data := readFile(t, fs, "/e/h"); data != "new" {
+		t.Fatalf("got %q", data)
+	}
+}
@@ -0,0 +1,669 @@
+// Package onedrive is a vfs engine backed by a OneDrive drive using the
+// Microsoft Graph API. The engine parameter is an OAuth access token with
+// the Files.ReadWrite scope, 'onedrive:TOKEN'. If the token is empty it is
+// taken from the SFTPPLEASE_ONEDRIVE_TOKEN environment variable.
+//
+// Written files are spooled to a temporary file and uploaded on Close,
+// large files are uploaded in chunks using an upload session.
+package onedrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+var (
+	ErrNotFile            = errors.New("not a file")
+	ErrNotDir             = errors.New("not a directory")
+	ErrNotOpen            = errors.New("file not open")
+	ErrNotEmpty           = errors.New("directory not empty")
+	ErrBadReadWriteOffset = errors.New("bad read/write offset")
+)
+
+const DefaultDriveURL = "https://graph.microsoft.com/v1.0/me/drive"
+
+const (
+	// Files up to this size are uploaded with a single request,
+	// the graph api limit is 4MiB.
+	simpleUploadLimit = 4 * 1024 * 1024
+	// Upload session chunks must be a multiple of 320KiB.
+	uploadChunkSize = 32 * 320 * 1024
+	// Number of entries requested per directory listing page.
+	listPageSize = 1000
+)
+
+func init() {
+	vfs.RegisterEngine("onedrive", vfsFactory)
+}
+
+func vfsFactory(token string) (vfs.VFS, error) {
+	if token == "" {
+		token = os.Getenv("SFTPPLEASE_ONEDRIVE_TOKEN")
+	}
+	if token == "" {
+		return nil, errors.New("onedrive requires an access token")
+	}
+	return &Fs{
+		DriveURL: DefaultDriveURL,
+		Token:    token,
+		Client:   http.DefaultClient,
+	}, nil
+}
+
+type Fs struct {
+	// The graph api url of the drive, e.g. DefaultDriveURL.
+	DriveURL string
+	Token    string
+	Client   *http.Client
+}
+
+// The url of the drive item at p, with suffix
+// appended, e.g. "/children" or "/content".
+func (fs *Fs) itemURL(p string, suffix string) string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return fs.DriveURL + "/root" + suffix
+	}
+	parts := strings.Split(p[1:], "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	u := fs.DriveURL + "/root:/" + strings.Join(parts, "/")
+	if suffix != "" {
+		u += ":" + suffix
+	}
+	return u
+}
+
+// The graph api error response.
+type graphError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Convert unsuccessful responses to errors, consuming the body.
+func statusError(method, u string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return os.ErrPermission
+	case http.StatusConflict:
+		return os.ErrExist
+	}
+	gerr := graphError{}
+	if json.Unmarshal(body, &gerr) == nil && gerr.Error.Message != "" {
+		return fmt.Errorf("onedrive %s %s: %s: %s", method, u, gerr.Error.Code, gerr.Error.Message)
+	}
+	return fmt.Errorf("onedrive %s %s: %s", method, u, resp.Status)
+}
+
+// Perform a request, retrying when the api asks
+// us to back off. body must be nil or seekable.
+func (fs *Fs) do(method, u string, header http.Header, body io.ReadSeeker) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var reqBody io.Reader
+		if body != nil {
+			_, err := body.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			reqBody = body
+		}
+		req, err := http.NewRequest(method, u, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			// Seekable bodies are not sized automatically.
+			req.ContentLength, err = body.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+			_, err = body.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if fs.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+fs.Token)
+		}
+		resp, err := fs.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if attempt < 5 && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+			delay := time.Duration(1<<uint(attempt)) * time.Second
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				delay = time.Duration(secs) * time.Second
+			}
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+			time.Sleep(delay)
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// Perform a request with a json body, decoding a json response into out.
+func (fs *Fs) doJSON(method, u string, in interface{}, out interface{}, okStatus ...int) error {
+	var body io.ReadSeeker
+	header := http.Header{}
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+		header.Set("Content-Type", "application/json")
+	}
+	resp, err := fs.do(method, u, header, body)
+	if err != nil {
+		return err
+	}
+	ok := false
+	for _, status := range okStatus {
+		if resp.StatusCode == status {
+			ok = true
+		}
+	}
+	if !ok {
+		return statusError(method, u, resp)
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// The subset of the graph driveItem resource we use.
+type driveItem struct {
+	Name                 string     `json:"name"`
+	Size                 int64      `json:"size"`
+	LastModifiedDateTime time.Time  `json:"lastModifiedDateTime"`
+	Folder               *folder    `json:"folder,omitempty"`
+	File                 *struct{}  `json:"file,omitempty"`
+	ParentReference      *parentRef `json:"parentReference,omitempty"`
+}
+
+type folder struct {
+	ChildCount int64 `json:"childCount"`
+}
+
+type parentRef struct {
+	Path string `json:"path"`
+}
+
+const itemSelect = "name,size,lastModifiedDateTime,folder,file"
+
+type FileInfo struct {
+	item driveItem
+}
+
+func (fi *FileInfo) Name() string       { return fi.item.Name }
+func (fi *FileInfo) Size() int64        { return fi.item.Size }
+func (fi *FileInfo) ModTime() time.Time { return fi.item.LastModifiedDateTime }
+func (fi *FileInfo) IsDir() bool        { return fi.item.Folder != nil }
+func (fi *FileInfo) Sys() interface{}   { return nil }
+
+func (fi *FileInfo) Mode() os.FileMode {
+	if fi.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fs *Fs) Stat(p string) (os.FileInfo, error) {
+	return fs.stat(p)
+}
+
+func (fs *Fs) stat(p string) (*FileInfo, error) {
+	fi := &FileInfo{}
+	err := fs.doJSON("GET", fs.itemURL(p, "")+"?$select="+itemSelect, nil, &fi.item, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	if path.Clean("/"+p) == "/" {
+		fi.item.Name = "/"
+	}
+	return fi, nil
+}
+
+func (fs *Fs) Chmod(p string, mode os.FileMode) error {
+	// OneDrive has no permissions.
+	return nil
+}
+
+func (fs *Fs) Open(p string) (vfs.File, error) {
+	fi, err := fs.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		fs:             fs,
+		fpath:          p,
+		isDir:          fi.IsDir(),
+		openForReading: true,
+	}, nil
+}
+
+func (fs *Fs) OpenFile(p string, flags int, perm os.FileMode) (vfs.File, error) {
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.Open(p)
+	}
+
+	fi, err := fs.stat(p)
+	exists := err == nil
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	if exists && fi.IsDir() {
+		return nil, ErrNotFile
+	}
+	if !exists && flags&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if exists && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+
+	spool, err := ioutil.TempFile("", "sftpplease-onedrive")
+	if err != nil {
+		return nil, err
+	}
+	// The spool file is only reachable through the handle.
+	_ = os.Remove(spool.Name())
+
+	f := &File{
+		fs:             fs,
+		fpath:          p,
+		openForWriting: true,
+		spool:          spool,
+		dirty:          !exists || flags&os.O_TRUNC != 0,
+	}
+
+	// Existing contents must be kept for partial updates.
+	if exists && flags&os.O_TRUNC == 0 {
+		err = f.download(spool)
+		if err != nil {
+			_ = spool.Close()
+			return nil, err
+		}
+	}
+	if flags&os.O_APPEND != 0 {
+		f.writeOffset, err = spool.Seek(0, io.SeekEnd)
+		if err != nil {
+			_ = spool.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (fs *Fs) Mkdir(p string, mode os.FileMode) error {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return os.ErrExist
+	}
+	req := map[string]interface{}{
+		"name":                              path.Base(p),
+		"folder":                            map[string]interface{}{},
+		"@microsoft.graph.conflictBehavior": "fail",
+	}
+	return fs.doJSON("POST", fs.itemURL(path.Dir(p), "/children"), req, nil, http.StatusCreated, http.StatusOK)
+}
+
+func (fs *Fs) Rename(from, to string) error {
+	to = path.Clean("/" + to)
+	// An existing target is replaced, like a local rename.
+	fi, err := fs.stat(to)
+	if err == nil {
+		if fi.IsDir() {
+			return os.ErrExist
+		}
+		err = fs.Remove(to)
+		if err != nil {
+			return err
+		}
+	} else if err != os.ErrNotExist {
+		return err
+	}
+	parent := "/drive/root:"
+	if path.Dir(to) != "/" {
+		parent += path.Dir(to)
+	}
+	req := map[string]interface{}{
+		"name":            path.Base(to),
+		"parentReference": parentRef{Path: parent},
+	}
+	return fs.doJSON("PATCH", fs.itemURL(from, ""), req, nil, http.StatusOK)
+}
+
+func (fs *Fs) Remove(p string) error {
+	fi, err := fs.stat(p)
+	if err != nil {
+		return err
+	}
+	// OneDrive deletes folders recursively, only
+	// delete empty folders like a local file system.
+	if fi.IsDir() && fi.item.Folder.ChildCount != 0 {
+		return ErrNotEmpty
+	}
+	return fs.doJSON("DELETE", fs.itemURL(p, ""), nil, nil, http.StatusNoContent, http.StatusOK)
+}
+
+func (fs *Fs) Link(oldname, newname string) error {
+	return vfs.ErrUnsupported
+}
+
+func (fs *Fs) Close() error {
+	return nil
+}
+
+type File struct {
+	fs *Fs
+
+	fpath string
+	isDir bool
+
+	// The next page of directory entries, and the
+	// buffered entries of the current page.
+	nextLink string
+	listed   bool
+	dirEnts  []os.FileInfo
+
+	openForReading bool
+	openForWriting bool
+
+	readOffset int64
+	reader     io.ReadCloser
+
+	writeOffset int64
+	spool       *os.File
+	dirty       bool
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return nil
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.fs.Stat(f.fpath)
+}
+
+type childrenPage struct {
+	Value    []driveItem `json:"value"`
+	NextLink string      `json:"@odata.nextLink"`
+}
+
+// Fetch the next page of the listing, pages are fetched
+// as the client reads so huge folders are never held in memory.
+func (f *File) fetchPage() error {
+	u := f.nextLink
+	if !f.listed {
+		u = f.fs.itemURL(f.fpath, "/children") + fmt.Sprintf("?$top=%d&$select=%s", listPageSize, itemSelect)
+		f.listed = true
+	}
+	page := childrenPage{}
+	err := f.fs.doJSON("GET", u, nil, &page, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	for i := range page.Value {
+		f.dirEnts = append(f.dirEnts, &FileInfo{item: page.Value[i]})
+	}
+	f.nextLink = page.NextLink
+	return nil
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.isDir {
+		return nil, ErrNotDir
+	}
+	if !f.openForReading {
+		return nil, ErrNotOpen
+	}
+
+	for (!f.listed || f.nextLink != "") && (n <= 0 || len(f.dirEnts) < n) {
+		err := f.fetchPage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if n <= 0 {
+		fis := f.dirEnts
+		f.dirEnts = nil
+		return fis, nil
+	}
+	if len(f.dirEnts) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirEnts) {
+		n = len(f.dirEnts)
+	}
+	fis := f.dirEnts[:n]
+	f.dirEnts = f.dirEnts[n:]
+	return fis, nil
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+// Start a download from off.
+func (f *File) openReader(off int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if off != 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	u := f.fs.itemURL(f.fpath, "/content")
+	resp, err := f.fs.do("GET", u, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The server ignored the range.
+		if off != 0 {
+			_, err := io.CopyN(ioutil.Discard, resp.Body, off)
+			if err != nil {
+				_ = resp.Body.Close()
+				return nil, err
+			}
+		}
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		_ = resp.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	default:
+		return nil, statusError("GET", u, resp)
+	}
+	return resp.Body, nil
+}
+
+func (f *File) download(w io.Writer) error {
+	r, err := f.openReader(0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrNotFile
+	}
+	if f.spool != nil {
+		return f.spool.ReadAt(b, off)
+	}
+	if !f.openForReading {
+		return 0, ErrNotOpen
+	}
+
+	// Reuse the current download for sequential reads.
+	if f.reader == nil || off != f.readOffset {
+		if f.reader != nil {
+			_ = f.reader.Close()
+			f.reader = nil
+		}
+		r, err := f.openReader(off)
+		if err != nil {
+			return 0, err
+		}
+		f.reader = r
+		f.readOffset = off
+	}
+
+	n, err := io.ReadFull(f.reader, b)
+	f.readOffset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *File) Read(b []byte) (int, error) {
+	return f.ReadAt(b, f.readOffset)
+}
+
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrNotFile
+	}
+	if !f.openForWriting {
+		return 0, ErrNotOpen
+	}
+	if off < 0 {
+		return 0, ErrBadReadWriteOffset
+	}
+	f.dirty = true
+	return f.spool.WriteAt(b, off)
+}
+
+func (f *File) Write(b []byte) (int, error) {
+	n, err := f.WriteAt(b, f.writeOffset)
+	f.writeOffset += int64(n)
+	return n, err
+}
+
+func (f *File) Sync() error {
+	if f.openForWriting && f.dirty {
+		err := f.upload()
+		if err != nil {
+			return err
+		}
+		f.dirty = false
+	}
+	return nil
+}
+
+// Upload the spooled file contents.
+func (f *File) upload() error {
+	size, err := f.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size <= simpleUploadLimit {
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+		u := f.fs.itemURL(f.fpath, "/content")
+		resp, err := f.fs.do("PUT", u, header, io.NewSectionReader(f.spool, 0, size))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			return statusError("PUT", u, resp)
+		}
+		_ = resp.Body.Close()
+		return nil
+	}
+
+	session := struct {
+		UploadURL string `json:"uploadUrl"`
+	}{}
+	req := map[string]interface{}{
+		"item": map[string]interface{}{
+			"@microsoft.graph.conflictBehavior": "replace",
+		},
+	}
+	err = f.fs.doJSON("POST", f.fs.itemURL(f.fpath, "/createUploadSession"), req, &session, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	for off := int64(0); off < size; off += uploadChunkSize {
+		end := off + uploadChunkSize
+		if end > size {
+			end = size
+		}
+		header := http.Header{}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, end-1, size))
+		// The upload url is pre-authenticated and must not be sent the token.
+		uploadFs := &Fs{Client: f.fs.Client}
+		resp, err := uploadFs.do("PUT", session.UploadURL, header, io.NewSectionReader(f.spool, off, end-off))
+		if err != nil {
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusAccepted, http.StatusOK, http.StatusCreated:
+			_ = resp.Body.Close()
+		default:
+			err = statusError("PUT", f.fpath, resp)
+			cancel, _ := http.NewRequest("DELETE", session.UploadURL, nil)
+			if resp, cerr := f.fs.Client.Do(cancel); cerr == nil {
+				_ = resp.Body.Close()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) Close() error {
+	if f.reader != nil {
+		_ = f.reader.Close()
+		f.reader = nil
+	}
+	if f.spool != nil {
+		err := f.Sync()
+		_ = f.spool.Close()
+		f.spool = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package onedrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal in memory imitation of the graph drive api.
+type fakeDrive struct {
+	lock  sync.Mutex
+	srv   *httptest.Server
+	items map[string]*fakeItem
+	// Number of upload session chunks received.
+	chunks int
+}
+
+type fakeItem struct {
+	dir  bool
+	data []byte
+}
+
+func (d *fakeDrive) itemJSON(p string) driveItem {
+	it := d.items[p]
+	di := driveItem{Name: path.Base(p), Size: int64(len(it.data)), LastModifiedDateTime: time.Unix(1000, 0).UTC()}
+	if it.dir {
+		di.Folder = &folder{ChildCount: int64(len(d.children(p)))}
+	}
+	return di
+}
+
+func (d *fakeDrive) children(p string) []string {
+	var names []string
+	for k := range d.items {
+		if k != "/" && path.Dir(k) == p {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	writeJSON := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	if r.URL.Path == "/upload" {
+		p := r.URL.Query().Get("path")
+		var start, end, total int
+		fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		buf, _ := ioutil.ReadAll(r.Body)
+		if len(buf) != end-start+1 || start != len(d.items[p].data) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d.chunks++
+		d.items[p].data = append(d.items[p].data, buf...)
+		writeJSON(http.StatusAccepted, map[string]string{})
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/drive/root")
+	p, suffix := "/", rest
+	if strings.HasPrefix(rest, ":") {
+		parts := strings.SplitN(rest[1:], ":", 2)
+		p = parts[0]
+		suffix = ""
+		if len(parts) == 2 {
+			suffix = parts[1]
+		}
+	}
+
+	it, exists := d.items[p]
+	if !exists && !(r.Method == "PUT" && suffix == "/content") && suffix != "/createUploadSession" {
+		writeJSON(http.StatusNotFound, map[string]interface{}{"error": map[string]string{"code": "itemNotFound", "message": "not found"}})
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && suffix == "":
+		writeJSON(http.StatusOK, d.itemJSON(p))
+	case r.Method == "GET" && suffix == "/children":
+		// Small pages to exercise paging.
+		names := d.children(p)
+		skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+		page := childrenPage{}
+		for i := skip; i < len(names) && i < skip+2; i++ {
+			page.Value = append(page.Value, d.itemJSON(names[i]))
+		}
+		if skip+2 < len(names) {
+			page.NextLink = fmt.Sprintf("%s%s?skip=%d", d.srv.URL, r.URL.Path, skip+2)
+		}
+		writeJSON(http.StatusOK, page)
+	case r.Method == "GET" && suffix == "/content":
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(it.data))
+	case r.Method == "PUT" && suffix == "/content":
+		buf, _ := ioutil.ReadAll(r.Body)
+		d.items[p] = &fakeItem{data: buf}
+		writeJSON(http.StatusCreated, d.itemJSON(p))
+	case r.Method == "POST" && suffix == "/createUploadSession":
+		d.items[p] = &fakeItem{}
+		writeJSON(http.StatusOK, map[string]string{"uploadUrl": d.srv.URL + "/upload?path=" + p})
+	case r.Method == "POST" && suffix == "/children":
+		req := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		np := path.Join(p, req["name"].(string))
+		if _, ok := d.items[np]; ok {
+			writeJSON(http.StatusConflict, map[string]interface{}{"error": map[string]string{"code": "nameAlreadyExists"}})
+			return
+		}
+		d.items[np] = &fakeItem{dir: true}
+		writeJSON(http.StatusCreated, d.itemJSON(np))
+	case r.Method == "PATCH" && suffix == "":
+		req := struct {
+			Name            string    `json:"name"`
+			ParentReference parentRef `json:"parentReference"`
+		}{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		np := path.Join("/", strings.TrimPrefix(req.ParentReference.Path, "/drive/root:"), req.Name)
+		d.items[np] = it
+		delete(d.items, p)
+		writeJSON(http.StatusOK, d.itemJSON(np))
+	case r.Method == "DELETE" && suffix == "":
+		delete(d.items, p)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func testFs(t *testing.T) (*Fs, *fakeDrive) {
+	t.Helper()
+	d := &fakeDrive{items: map[string]*fakeItem{"/": {dir: true}}}
+	d.srv = httptest.NewServer(d)
+	return &Fs{DriveURL: d.srv.URL + "/drive", Token: "token", Client: d.srv.Client()}, d
+}
+
+func writeFile(t *testing.T, fs *Fs, p string, data []byte) {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs *Fs, p string) []byte {
+	t.Helper()
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReadWrite(t *testing.T) {
+	fs, d := testFs(t)
+	defer d.srv.Close()
+
+	writeFile(t, fs, "/a b.txt", []byte("hello world"))
+	if got := readFile(t, fs, "/a b.txt"); string(got) != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+
+	fi, err := fs.Stat("/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 11 || fi.IsDir() || fi.Name() != "a b.txt" {
+		t.Fatalf("bad stat %s %d %v", fi.Name(), fi.Size(), fi.IsDir())
+	}
+
+	f, err := fs.Open("/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	n, err := f.ReadAt(buf, 6)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("ReadAt: %q %v", buf[:n], err)
+	}
+
+	// Partial updates keep the existing contents.
+	f, err = fs.OpenFile("/a b.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("W"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/a b.txt"); string(got) != "hello World" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestLargeUpload(t *testing.T) {
+	fs, d := testFs(t)
+	defer d.srv.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), (uploadChunkSize+simpleUploadLimit)/10)
+	writeFile(t, fs, "/big", data)
+	if d.chunks != 2 {
+		t.Fatalf("expected 2 upload chunks, got %d", d.chunks)
+	}
+	if !bytes.Equal(d.items["/big"].data, data) {
+		t.Fatal("upload corrupted")
+	}
+}
+
+func TestDirs(t *testing.T) {
+	fs, d := testFs(t)
+	defer d.srv.Close()
+
+	err := fs.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Mkdir("/d", 0755)
+	if err != os.ErrExist {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+	for _, name := range []string{"a", "b", "c", "e", "f"} {
+		writeFile(t, fs, "/d/"+name, []byte(name))
+	}
+
+	f, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	for {
+		batch, err := f.Readdirnames(3)
+		names = append(names, batch...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(names, ",") != "a,b,c,e,f" {
+		t.Fatalf("bad listing %v", names)
+	}
+
+	err = fs.Remove("/d")
+	if err != ErrNotEmpty {
+		t.Fatalf("expected ErrNotEmpty, got %v", err)
+	}
+}
+
+func TestRenameRemove(t *testing.T) {
+	fs, d := testFs(t)
+	defer d.srv.Close()
+
+	err := fs.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/a", []byte("a"))
+	writeFile(t, fs, "/d/b", []byte("b"))
+	err = fs.Rename("/a", "/d/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/d/b"); string(got) != "a" {
+		t.Fatalf("got %q", got)
+	}
+	_, err = fs.Stat("/a")
+	if err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	err = fs.Remove("/d/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Remove("/d/b")
+	if err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	fs, d := testFs(t)
+	defer d.srv.Close()
+
+	fs.Token = "bad"
+	_, err := fs.Stat("/")
+	if err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+}
@@ -0,0 +1,399 @@
+// Package pluginfs is a vfs engine that forwards every call to an
+// external program, 'plugin:/path/to/program [args...]', so backends
+// can be written in any language.
+//
+// The program receives requests on stdin and sends responses on stdout,
+// each message is a JSON object prefixed by its length as a 4 byte big
+// endian integer. Requests carry an "id" copied into their response and
+// may be answered in any order. The first request is
+// {"op": "init", "version": 1}, answered with the version the program
+// speaks. Requests and responses are described by Request and Response,
+// []byte fields are base64 encoded. Failed requests set "error" to one
+// of the ErrCode constants, with an optional "message".
+//
+// Serve implements the program side for plugins written in Go.
+package pluginfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/anmitsu/go-shlex"
+)
+
+var ErrClientClosed = errors.New("plugin client closed")
+
+func init() {
+	vfs.RegisterEngine("plugin", vfsFactory)
+}
+
+func vfsFactory(param string) (vfs.VFS, error) {
+	args, err := shlex.Split(param, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("plugin vfs expects /path/to/program [args...]")
+	}
+	return DialCommand(args)
+}
+
+// The stdin and stdout of a plugin process.
+type pluginConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *pluginConn) Close() error {
+	_ = c.WriteCloser.Close()
+	return c.cmd.Wait()
+}
+
+// Run the command args and forward calls over its stdin and stdout.
+func DialCommand(args []string) (*Client, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &pluginConn{Reader: stdout, WriteCloser: stdin, cmd: cmd}
+	c, err := NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Client forwards vfs calls to a plugin.
+type Client struct {
+	rw io.ReadWriteCloser
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *Response
+	err     error
+}
+
+// Perform the protocol handshake over rw and start the client.
+func NewClient(rw io.ReadWriteCloser) (*Client, error) {
+	err := writeMessage(rw, &Request{Op: "init", Version: ProtocolVersion})
+	if err != nil {
+		return nil, err
+	}
+	var resp Response
+	err = readMessage(rw, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, toError(resp.Error, resp.Message)
+	}
+	if resp.Version != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported plugin protocol version %d", resp.Version)
+	}
+
+	c := &Client{
+		rw:      rw,
+		nextID:  1,
+		pending: make(map[uint64]chan *Response),
+	}
+	go c.readResponses()
+	return c, nil
+}
+
+func (c *Client) readResponses() {
+	var err error
+	for {
+		resp := &Response{}
+		err = readMessage(c.rw, resp)
+		if err != nil {
+			break
+		}
+		c.lock.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.lock.Unlock()
+		if !ok {
+			err = fmt.Errorf("plugin response with unexpected id %d", resp.ID)
+			break
+		}
+		ch <- resp
+	}
+	c.fail(err)
+}
+
+// Fail all pending and future requests with err.
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	if err == io.EOF {
+		err = ErrClientClosed
+	}
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	_ = c.rw.Close()
+}
+
+// Send req and wait for its response, returning
+// the error it reports if it failed.
+func (c *Client) request(req *Request) (*Response, error) {
+	ch := make(chan *Response, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	req.ID = c.nextID
+	c.nextID++
+	c.pending[req.ID] = ch
+	c.lock.Unlock()
+
+	c.writeLock.Lock()
+	err := writeMessage(c.rw, req)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+
+	resp, ok := <-ch
+	if !ok {
+		c.lock.Lock()
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	if resp.Error != "" {
+		return resp, toError(resp.Error, resp.Message)
+	}
+	return resp, nil
+}
+
+func (c *Client) Chmod(p string, mode os.FileMode) error {
+	_, err := c.request(&Request{Op: "chmod", Path: p, Mode: uint32(mode.Perm())})
+	return err
+}
+
+func (c *Client) Open(p string) (vfs.File, error) {
+	return c.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (c *Client) OpenFile(p string, flags int, perm os.FileMode) (vfs.File, error) {
+	resp, err := c.request(&Request{Op: "open", Path: p, Flags: toFlags(flags), Mode: uint32(perm.Perm())})
+	if err != nil {
+		return nil, err
+	}
+	return &ClientFile{c: c, name: p, handle: resp.Handle}, nil
+}
+
+func (c *Client) Mkdir(p string, perm os.FileMode) error {
+	_, err := c.request(&Request{Op: "mkdir", Path: p, Mode: uint32(perm.Perm())})
+	return err
+}
+
+func (c *Client) Stat(p string) (os.FileInfo, error) {
+	resp, err := c.request(&Request{Op: "stat", Path: p})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Info == nil {
+		return nil, errors.New("plugin stat response without info")
+	}
+	return &pluginFileInfo{fi: *resp.Info}, nil
+}
+
+func (c *Client) Rename(from, to string) error {
+	_, err := c.request(&Request{Op: "rename", Path: from, NewPath: to})
+	return err
+}
+
+func (c *Client) Remove(p string) error {
+	_, err := c.request(&Request{Op: "remove", Path: p})
+	return err
+}
+
+func (c *Client) Link(oldname, newname string) error {
+	_, err := c.request(&Request{Op: "link", Path: oldname, NewPath: newname})
+	return err
+}
+
+func (c *Client) Close() error {
+	c.fail(ErrClientClosed)
+	return nil
+}
+
+// A file or directory open in the plugin.
+type ClientFile struct {
+	c      *Client
+	name   string
+	handle uint64
+	offset int64
+
+	// Entries returned by the plugin not yet consumed by Readdir.
+	dirEnts []os.FileInfo
+	dirEOF  bool
+}
+
+func (f *ClientFile) Name() string {
+	return f.name
+}
+
+func (f *ClientFile) Chmod(mode os.FileMode) error {
+	_, err := f.c.request(&Request{Op: "fchmod", Handle: f.handle, Mode: uint32(mode.Perm())})
+	return err
+}
+
+func (f *ClientFile) Stat() (os.FileInfo, error) {
+	resp, err := f.c.request(&Request{Op: "fstat", Handle: f.handle})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Info == nil {
+		return nil, errors.New("plugin fstat response without info")
+	}
+	fi := *resp.Info
+	fi.Name = path.Base(f.name)
+	return &pluginFileInfo{fi: fi}, nil
+}
+
+func (f *ClientFile) ReadAt(buf []byte, offset int64) (int, error) {
+	nread := 0
+	for nread < len(buf) {
+		chunk := len(buf) - nread
+		if chunk > maxData {
+			chunk = maxData
+		}
+		resp, err := f.c.request(&Request{Op: "read", Handle: f.handle, Offset: offset + int64(nread), Length: chunk})
+		if err != nil {
+			return nread, err
+		}
+		if len(resp.Data) > chunk {
+			return nread, fmt.Errorf("plugin sent %d bytes, expected at most %d", len(resp.Data), chunk)
+		}
+		if len(resp.Data) == 0 {
+			return nread, io.EOF
+		}
+		nread += copy(buf[nread:], resp.Data)
+	}
+	return nread, nil
+}
+
+func (f *ClientFile) Read(buf []byte) (int, error) {
+	// Short reads are fine for Read, only send one request.
+	if len(buf) > maxData {
+		buf = buf[:maxData]
+	}
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *ClientFile) WriteAt(buf []byte, offset int64) (int, error) {
+	nwritten := 0
+	for nwritten < len(buf) {
+		chunk := buf[nwritten:]
+		if len(chunk) > maxData {
+			chunk = chunk[:maxData]
+		}
+		resp, err := f.c.request(&Request{Op: "write", Handle: f.handle, Offset: offset + int64(nwritten), Data: chunk})
+		if err != nil {
+			// Failed writes report how much was written.
+			if resp != nil {
+				nwritten += resp.N
+			}
+			return nwritten, err
+		}
+		nwritten += len(chunk)
+	}
+	return nwritten, nil
+}
+
+func (f *ClientFile) Write(buf []byte) (int, error) {
+	n, err := f.WriteAt(buf, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *ClientFile) Readdir(n int) ([]os.FileInfo, error) {
+	for !f.dirEOF && (n <= 0 || len(f.dirEnts) < n) {
+		resp, err := f.c.request(&Request{Op: "readdir", Handle: f.handle})
+		if err == io.EOF {
+			f.dirEOF = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Entries) == 0 {
+			f.dirEOF = true
+			break
+		}
+		for _, ent := range resp.Entries {
+			f.dirEnts = append(f.dirEnts, &pluginFileInfo{fi: ent})
+		}
+	}
+
+	if n <= 0 {
+		fis := f.dirEnts
+		f.dirEnts = nil
+		return fis, nil
+	}
+	if len(f.dirEnts) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirEnts) {
+		n = len(f.dirEnts)
+	}
+	fis := f.dirEnts[:n]
+	f.dirEnts = f.dirEnts[n:]
+	return fis, nil
+}
+
+func (f *ClientFile) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *ClientFile) Sync() error {
+	_, err := f.c.request(&Request{Op: "sync", Handle: f.handle})
+	return err
+}
+
+func (f *ClientFile) Close() error {
+	_, err := f.c.request(&Request{Op: "close", Handle: f.handle})
+	return err
+}
@@ -0,0 +1,133 @@
+package pluginfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func testClient(t *testing.T) *Client {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	go func() {
+		err := Serve(mem.New(), reqR, respW)
+		_ = respW.CloseWithError(err)
+	}()
+	c, err := NewClient(&pipeConn{Reader: respR, WriteCloser: reqW})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPlugin(t *testing.T) {
+	c := testClient(t)
+	defer c.Close()
+
+	err := c.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mkdir("/d", 0755); err != os.ErrExist {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 300000)
+	f, err := c.OpenFile("/d/f", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = c.Open("/d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, expected %d", len(got), len(data))
+	}
+	buf := make([]byte, 10)
+	n, err := f.ReadAt(buf, int64(len(data)-5))
+	if n != 5 || err != io.EOF {
+		t.Fatalf("unexpected read at end %d %v", n, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "f" || fi.Size() != int64(len(data)) || fi.Mode() != 0644 {
+		t.Fatalf("unexpected stat %s %d %s", fi.Name(), fi.Size(), fi.Mode())
+	}
+	_ = f.Close()
+
+	d, err := c.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+	if !reflect.DeepEqual(names, []string{"f"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	fi, err = c.Stat("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() {
+		t.Fatal("expected directory")
+	}
+
+	err = c.Rename("/d/f", "/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat("/d/f"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	err = c.Remove("/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	for _, flag := range []int{
+		os.O_RDONLY,
+		os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+		os.O_RDWR | os.O_APPEND,
+		os.O_WRONLY | os.O_CREATE | os.O_EXCL,
+	} {
+		got, err := fromFlags(toFlags(flag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != flag {
+			t.Fatalf("flags %x became %x", flag, got)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package pluginfs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+const ProtocolVersion = 1
+
+// The largest message either side will accept.
+const maxMessageSize = 16 * 1024 * 1024
+
+// The largest read or write sent in one request.
+const maxData = 1024 * 1024
+
+// Error codes sent in Response.Error, any other
+// code is reported using Response.Message.
+const (
+	ErrCodeNotExist    = "ENOENT"
+	ErrCodeExist       = "EEXIST"
+	ErrCodePermission  = "EACCES"
+	ErrCodeUnsupported = "ENOTSUP"
+	ErrCodeEOF         = "EOF"
+	ErrCodeOther       = "EIO"
+)
+
+// Flags of an "open" request.
+const (
+	FlagRead      = "read"
+	FlagWrite     = "write"
+	FlagAppend    = "append"
+	FlagCreate    = "create"
+	FlagTruncate  = "truncate"
+	FlagExclusive = "exclusive"
+)
+
+type Request struct {
+	ID uint64 `json:"id"`
+	// One of "init", "chmod", "open", "mkdir", "stat", "rename",
+	// "remove", "link", or for open files "fchmod", "fstat",
+	// "read", "write", "readdir", "sync" and "close".
+	Op      string   `json:"op"`
+	Version int      `json:"version,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	NewPath string   `json:"newPath,omitempty"`
+	Flags   []string `json:"flags,omitempty"`
+	Mode    uint32   `json:"mode,omitempty"`
+	Handle  uint64   `json:"handle"`
+	Offset  int64    `json:"offset,omitempty"`
+	Length  int      `json:"length,omitempty"`
+	Data    []byte   `json:"data,omitempty"`
+}
+
+type Response struct {
+	ID      uint64     `json:"id"`
+	Error   string     `json:"error,omitempty"`
+	Message string     `json:"message,omitempty"`
+	Version int        `json:"version,omitempty"`
+	Handle  uint64     `json:"handle"`
+	Info    *FileInfo  `json:"info,omitempty"`
+	Entries []FileInfo `json:"entries,omitempty"`
+	Data    []byte     `json:"data,omitempty"`
+	N       int        `json:"n,omitempty"`
+}
+
+type FileInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Permission bits.
+	Mode uint32 `json:"mode"`
+	Dir  bool   `json:"dir,omitempty"`
+	// Seconds since the unix epoch.
+	Mtime int64 `json:"mtime"`
+}
+
+func toFileInfo(fi os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:  fi.Name(),
+		Size:  fi.Size(),
+		Mode:  uint32(fi.Mode().Perm()),
+		Dir:   fi.IsDir(),
+		Mtime: fi.ModTime().Unix(),
+	}
+}
+
+type pluginFileInfo struct {
+	fi FileInfo
+}
+
+func (fi *pluginFileInfo) Name() string       { return fi.fi.Name }
+func (fi *pluginFileInfo) Size() int64        { return fi.fi.Size }
+func (fi *pluginFileInfo) ModTime() time.Time { return time.Unix(fi.fi.Mtime, 0) }
+func (fi *pluginFileInfo) IsDir() bool        { return fi.fi.Dir }
+func (fi *pluginFileInfo) Sys() interface{}   { return &fi.fi }
+
+func (fi *pluginFileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.fi.Mode).Perm()
+	if fi.fi.Dir {
+		mode |= os.ModeDir
+	}
+	return mode
+}
+
+func toFlags(flag int) []string {
+	var flags []string
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		flags = append(flags, FlagRead)
+	case os.O_WRONLY:
+		flags = append(flags, FlagWrite)
+	case os.O_RDWR:
+		flags = append(flags, FlagRead, FlagWrite)
+	}
+	if flag&os.O_APPEND != 0 {
+		flags = append(flags, FlagAppend)
+	}
+	if flag&os.O_CREATE != 0 {
+		flags = append(flags, FlagCreate)
+	}
+	if flag&os.O_TRUNC != 0 {
+		flags = append(flags, FlagTruncate)
+	}
+	if flag&os.O_EXCL != 0 {
+		flags = append(flags, FlagExclusive)
+	}
+	return flags
+}
+
+func fromFlags(flags []string) (int, error) {
+	var read, write bool
+	flag := 0
+	for _, f := range flags {
+		switch f {
+		case FlagRead:
+			read = true
+		case FlagWrite:
+			write = true
+		case FlagAppend:
+			flag |= os.O_APPEND
+		case FlagCreate:
+			flag |= os.O_CREATE
+		case FlagTruncate:
+			flag |= os.O_TRUNC
+		case FlagExclusive:
+			flag |= os.O_EXCL
+		default:
+			return 0, fmt.Errorf("unknown open flag %q", f)
+		}
+	}
+	switch {
+	case read && write:
+		flag |= os.O_RDWR
+	case write:
+		flag |= os.O_WRONLY
+	default:
+		flag |= os.O_RDONLY
+	}
+	return flag, nil
+}
+
+func toError(code, message string) error {
+	switch code {
+	case "":
+		return nil
+	case ErrCodeNotExist:
+		return os.ErrNotExist
+	case ErrCodeExist:
+		return os.ErrExist
+	case ErrCodePermission:
+		return os.ErrPermission
+	case ErrCodeUnsupported:
+		return vfs.ErrUnsupported
+	case ErrCodeEOF:
+		return io.EOF
+	}
+	if message == "" {
+		message = code
+	}
+	return errors.New(message)
+}
+
+func fromError(err error) (string, string) {
+	switch {
+	case err == nil:
+		return "", ""
+	case err == io.EOF:
+		return ErrCodeEOF, ""
+	case err == vfs.ErrUnsupported:
+		return ErrCodeUnsupported, err.Error()
+	case os.IsNotExist(err) || err == os.ErrNotExist:
+		return ErrCodeNotExist, err.Error()
+	case os.IsExist(err) || err == os.ErrExist:
+		return ErrCodeExist, err.Error()
+	case os.IsPermission(err) || err == os.ErrPermission:
+		return ErrCodePermission, err.Error()
+	}
+	return ErrCodeOther, err.Error()
+}
+
+// Messages are JSON objects prefixed by their
+// length as a 4 byte big endian integer.
+func writeMessage(w io.Writer, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(buf) > maxMessageSize {
+		return fmt.Errorf("plugin message of %d bytes is too large", len(buf))
+	}
+	msg := make([]byte, 4+len(buf))
+	binary.BigEndian.PutUint32(msg, uint32(len(buf)))
+	copy(msg[4:], buf)
+	_, err = w.Write(msg)
+	return err
+}
+
+func readMessage(r io.Reader, v interface{}) error {
+	var hdr [4]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return err
+	}
+	sz := binary.BigEndian.Uint32(hdr[:])
+	if sz > maxMessageSize {
+		return fmt.Errorf("plugin message of %d bytes is too large", sz)
+	}
+	buf := make([]byte, sz)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
@@ -0,0 +1,195 @@
+package pluginfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+type serverFile struct {
+	f      vfs.File
+	append bool
+}
+
+type server struct {
+	fs vfs.VFS
+
+	writeLock sync.Mutex
+	w         io.Writer
+
+	lock       sync.Mutex
+	nextHandle uint64
+	files      map[uint64]*serverFile
+}
+
+// Serve answers requests for fs read from r, writing responses to w,
+// until r is closed. It is the program side of the plugin protocol,
+// e.g. Serve(fs, os.Stdin, os.Stdout). Open files are closed on return.
+func Serve(fs vfs.VFS, r io.Reader, w io.Writer) error {
+	s := &server{
+		fs:         fs,
+		w:          w,
+		nextHandle: 1,
+		files:      make(map[uint64]*serverFile),
+	}
+	defer s.closeAll()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		req := &Request{}
+		err := readMessage(r, req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Op == "init" {
+			resp := &Response{ID: req.ID, Version: ProtocolVersion}
+			if req.Version != ProtocolVersion {
+				resp.Error = ErrCodeUnsupported
+				resp.Message = fmt.Sprintf("unsupported plugin protocol version %d", req.Version)
+			}
+			err = s.respond(resp)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = s.respond(s.handle(req))
+		}()
+	}
+}
+
+func (s *server) respond(resp *Response) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return writeMessage(s.w, resp)
+}
+
+func (s *server) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for h, sf := range s.files {
+		_ = sf.f.Close()
+		delete(s.files, h)
+	}
+}
+
+func (s *server) getFile(h uint64) (*serverFile, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sf, ok := s.files[h]
+	return sf, ok
+}
+
+func (s *server) handle(req *Request) *Response {
+	resp := &Response{ID: req.ID}
+	var err error
+	switch req.Op {
+	case "chmod":
+		err = s.fs.Chmod(req.Path, os.FileMode(req.Mode).Perm())
+	case "open":
+		var flag int
+		flag, err = fromFlags(req.Flags)
+		if err != nil {
+			break
+		}
+		var f vfs.File
+		f, err = s.fs.OpenFile(req.Path, flag, os.FileMode(req.Mode).Perm())
+		if err != nil {
+			break
+		}
+		s.lock.Lock()
+		resp.Handle = s.nextHandle
+		s.nextHandle++
+		s.files[resp.Handle] = &serverFile{f: f, append: flag&os.O_APPEND != 0}
+		s.lock.Unlock()
+	case "mkdir":
+		err = s.fs.Mkdir(req.Path, os.FileMode(req.Mode).Perm())
+	case "stat":
+		var fi os.FileInfo
+		fi, err = s.fs.Stat(req.Path)
+		if err == nil {
+			info := toFileInfo(fi)
+			resp.Info = &info
+		}
+	case "rename":
+		err = s.fs.Rename(req.Path, req.NewPath)
+	case "remove":
+		err = s.fs.Remove(req.Path)
+	case "link":
+		err = s.fs.Link(req.Path, req.NewPath)
+	case "fchmod", "fstat", "read", "write", "readdir", "sync", "close":
+		sf, ok := s.getFile(req.Handle)
+		if !ok {
+			err = fmt.Errorf("invalid handle %d", req.Handle)
+			break
+		}
+		err = s.handleFile(req, resp, sf)
+	default:
+		err = vfs.ErrUnsupported
+	}
+	resp.Error, resp.Message = fromError(err)
+	return resp
+}
+
+func (s *server) handleFile(req *Request, resp *Response, sf *serverFile) error {
+	switch req.Op {
+	case "fchmod":
+		return sf.f.Chmod(os.FileMode(req.Mode).Perm())
+	case "fstat":
+		fi, err := sf.f.Stat()
+		if err != nil {
+			return err
+		}
+		info := toFileInfo(fi)
+		resp.Info = &info
+	case "read":
+		if req.Length < 0 || req.Length > maxData {
+			return fmt.Errorf("invalid read length %d", req.Length)
+		}
+		buf := make([]byte, req.Length)
+		n, err := sf.f.ReadAt(buf, req.Offset)
+		if n != 0 && err == io.EOF {
+			err = nil
+		}
+		resp.Data = buf[:n]
+		return err
+	case "write":
+		var n int
+		var err error
+		if sf.append {
+			n, err = sf.f.Write(req.Data)
+		} else {
+			n, err = sf.f.WriteAt(req.Data, req.Offset)
+		}
+		resp.N = n
+		return err
+	case "readdir":
+		fis, err := sf.f.Readdir(100)
+		for _, fi := range fis {
+			resp.Entries = append(resp.Entries, toFileInfo(fi))
+		}
+		if len(fis) != 0 && err == io.EOF {
+			err = nil
+		}
+		return err
+	case "sync":
+		return sf.f.Sync()
+	case "close":
+		s.lock.Lock()
+		delete(s.files, req.Handle)
+		s.lock.Unlock()
+		return sf.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+// Package rclonefs is a vfs engine reaching any storage provider
+// supported by rclone, 'rclone:remote:path'. Remotes are configured
+// with 'rclone config' as usual. The engine runs
+// 'rclone serve sftp --stdio remote:path' and talks sftp to it.
+package rclonefs
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/sftpfs"
+)
+
+// The rclone command serving sftp on stdin and
+// stdout, the remote is appended.
+var RcloneCommand = []string{"rclone", "serve", "sftp", "--stdio"}
+
+func init() {
+	vfs.RegisterEngine("rclone", vfsFactory)
+}
+
+func vfsFactory(remote string) (vfs.VFS, error) {
+	if remote == "" || strings.HasPrefix(remote, "-") {
+		return nil, errors.New("rclone vfs expects remote:path")
+	}
+	return sftpfs.DialCommand(append(append([]string{}, RcloneCommand...), remote))
+}
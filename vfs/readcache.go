@@ -0,0 +1,333 @@
+package vfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadCacheVFS keeps copies of files read from Fs in the local directory
+// Dir, so files read again are served from local disk. A copy is only
+// used while the size and modification time reported by Fs match those
+// of the file it was copied from, and copies of files written, removed
+// or renamed through the cache are dropped.
+//
+// A file is copied as it is read, so only files read from start to end
+// are cached. The least recently used copies are removed when the cache
+// grows beyond MaxSize bytes, 0 means no limit. The directory may be
+// shared by any number of processes.
+type ReadCacheVFS struct {
+	Fs      VFS
+	Dir     string
+	MaxSize int64
+
+	parent    *ReadCacheVFS
+	evictLock sync.Mutex
+}
+
+// The wrapper a view made by WithContext came from, whose state
+// the view shares.
+func (c *ReadCacheVFS) root() *ReadCacheVFS {
+	if c.parent != nil {
+		return c.parent
+	}
+	return c
+}
+
+const readCacheTempPrefix = "tmp-"
+
+// Cache entries are named by a hash of the path followed by the size
+// and modification time they are valid for.
+func (c *ReadCacheVFS) entryPrefix(p string) string {
+	sum := sha256.Sum256([]byte(path.Clean("/" + p)))
+	return hex.EncodeToString(sum[:16]) + "-"
+}
+
+func (c *ReadCacheVFS) entryPath(p string, fi os.FileInfo) string {
+	name := fmt.Sprintf("%s%d-%d", c.entryPrefix(p), fi.Size(), fi.ModTime().UnixNano())
+	return filepath.Join(c.Dir, name)
+}
+
+func (c *ReadCacheVFS) cacheable(fi os.FileInfo) bool {
+	return fi.Mode().IsRegular() && fi.Size() > 0 && (c.MaxSize <= 0 || fi.Size() <= c.MaxSize)
+}
+
+// Drop every cached copy of p.
+func (c *ReadCacheVFS) invalidate(p string) {
+	matches, _ := filepath.Glob(filepath.Join(c.Dir, c.entryPrefix(p)+"*"))
+	for _, m := range matches {
+		_ = os.Remove(m)
+	}
+}
+
+// Remove the least recently used entries until the cache fits in MaxSize.
+func (c *ReadCacheVFS) evict() {
+	c = c.root()
+	if c.MaxSize <= 0 {
+		return
+	}
+	c.evictLock.Lock()
+	defer c.evictLock.Unlock()
+
+	fis, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return
+	}
+	entries := fis[:0]
+	total := int64(0)
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), readCacheTempPrefix) {
+			// Left behind by a process that exited while copying.
+			if time.Since(fi.ModTime()) > 24*time.Hour {
+				_ = os.Remove(filepath.Join(c.Dir, fi.Name()))
+			}
+			continue
+		}
+		entries = append(entries, fi)
+		total += fi.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, fi := range entries {
+		if total <= c.MaxSize {
+			break
+		}
+		_ = os.Remove(filepath.Join(c.Dir, fi.Name()))
+		total -= fi.Size()
+	}
+}
+
+func (c *ReadCacheVFS) Chmod(name string, mode os.FileMode) error {
+	return c.Fs.Chmod(name, mode)
+}
+
+func (c *ReadCacheVFS) Open(path string) (File, error) {
+	return c.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (c *ReadCacheVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		c.invalidate(name)
+		return c.Fs.OpenFile(name, flag, perm)
+	}
+
+	fi, err := c.Fs.Stat(name)
+	if err == nil && c.cacheable(fi) {
+		entry := c.entryPath(name, fi)
+		local, err := os.Open(entry)
+		if err == nil {
+			// The modification time orders entries for eviction.
+			now := time.Now()
+			_ = os.Chtimes(entry, now, now)
+			return &CachedFile{File: local, c: c, name: name, fi: fi}, nil
+		}
+	}
+
+	f, err := c.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err = f.Stat()
+	if err != nil || !c.cacheable(fi) {
+		return f, nil
+	}
+	return &ReadCacheFile{File: f, c: c, name: name, fi: fi}, nil
+}
+
+func (c *ReadCacheVFS) Mkdir(path string, perm os.FileMode) error {
+	return c.Fs.Mkdir(path, perm)
+}
+
+func (c *ReadCacheVFS) Stat(path string) (os.FileInfo, error) {
+	return c.Fs.Stat(path)
+}
+
+func (c *ReadCacheVFS) Rename(from, to string) error {
+	c.invalidate(from)
+	c.invalidate(to)
+	return c.Fs.Rename(from, to)
+}
+
+func (c *ReadCacheVFS) Remove(path string) error {
+	c.invalidate(path)
+	return c.Fs.Remove(path)
+}
+
+func (c *ReadCacheVFS) Link(oldname, newname string) error {
+	c.invalidate(newname)
+	return c.Fs.Link(oldname, newname)
+}
+
+func (c *ReadCacheVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := c.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return cs.Checksum(path, algorithm)
+}
+
+func (c *ReadCacheVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(c.Fs)
+}
+
+func (c *ReadCacheVFS) RealPath(p string) (string, error) {
+	return RealPath(c.Fs, p)
+}
+
+func (c *ReadCacheVFS) AppendSupported() bool {
+	return AppendSupported(c.Fs)
+}
+
+func (c *ReadCacheVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	ct, ok := c.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	return ct.Chtimes(path, atime, mtime)
+}
+
+func (c *ReadCacheVFS) RemoveBatch(paths []string) error {
+	for _, p := range paths {
+		c.invalidate(p)
+	}
+	return RemoveBatch(c.Fs, paths)
+}
+
+func (c *ReadCacheVFS) RenameBatch(renames []Rename) error {
+	for _, r := range renames {
+		c.invalidate(r.From)
+		c.invalidate(r.To)
+	}
+	return RenameBatch(c.Fs, renames)
+}
+
+func (c *ReadCacheVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := c.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (c *ReadCacheVFS) WithContext(ctx context.Context) VFS {
+	return &ReadCacheVFS{
+		Fs:      WithContext(c.Fs, ctx),
+		Dir:     c.Dir,
+		MaxSize: c.MaxSize,
+		parent:  c.root(),
+	}
+}
+
+func (c *ReadCacheVFS) Close() error {
+	return c.Fs.Close()
+}
+
+// CachedFile is a file served from a cached copy.
+type CachedFile struct {
+	*os.File
+	c    *ReadCacheVFS
+	name string
+	fi   os.FileInfo
+}
+
+func (cf *CachedFile) Name() string {
+	return cf.name
+}
+
+func (cf *CachedFile) Chmod(mode os.FileMode) error {
+	return cf.c.Fs.Chmod(cf.name, mode)
+}
+
+func (cf *CachedFile) Stat() (os.FileInfo, error) {
+	return cf.fi, nil
+}
+
+func (cf *CachedFile) Write(buf []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (cf *CachedFile) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// ReadCacheFile copies data read from the start of a file
+// into the cache, and adds the copy once it is complete.
+type ReadCacheFile struct {
+	File
+	c    *ReadCacheVFS
+	name string
+	fi   os.FileInfo
+
+	// Offset of sequential reads.
+	offset int64
+	copy   *os.File
+	copied int64
+	failed bool
+}
+
+func (rf *ReadCacheFile) save(buf []byte, off int64) {
+	if rf.failed || off > rf.copied || off+int64(len(buf)) <= rf.copied {
+		return
+	}
+	if rf.copy == nil {
+		var err error
+		rf.copy, err = ioutil.TempFile(rf.c.Dir, readCacheTempPrefix)
+		if err != nil {
+			rf.failed = true
+			return
+		}
+	}
+	n, err := rf.copy.Write(buf[rf.copied-off:])
+	rf.copied += int64(n)
+	if err != nil {
+		rf.failed = true
+	}
+}
+
+func (rf *ReadCacheFile) Read(buf []byte) (int, error) {
+	n, err := rf.File.Read(buf)
+	rf.save(buf[:n], rf.offset)
+	rf.offset += int64(n)
+	return n, err
+}
+
+func (rf *ReadCacheFile) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := rf.File.ReadAt(buf, off)
+	rf.save(buf[:n], off)
+	return n, err
+}
+
+func (rf *ReadCacheFile) Close() error {
+	err := rf.File.Close()
+	if rf.copy == nil {
+		return err
+	}
+	complete := !rf.failed && rf.copied == rf.fi.Size()
+	if complete {
+		// Only whole copies may be seen by other readers.
+		complete = rf.copy.Sync() == nil
+	}
+	_ = rf.copy.Close()
+	if complete {
+		complete = os.Rename(rf.copy.Name(), rf.c.entryPath(rf.name, rf.fi)) == nil
+	}
+	if !complete {
+		_ = os.Remove(rf.copy.Name())
+		return err
+	}
+	rf.c.evict()
+	return err
+}
@@ -0,0 +1,64 @@
+package vfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// Counts files opened on the wrapped file system.
+type countingVFS struct {
+	vfs.VFS
+	opens int
+}
+
+func (c *countingVFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	c.opens++
+	return c.VFS.OpenFile(name, flag, perm)
+}
+
+func TestReadCacheVFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftpplease-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &countingVFS{VFS: mem.New()}
+	fs := &vfs.ReadCacheVFS{Fs: backend, Dir: dir, MaxSize: 10}
+
+	writeAll(t, fs, "/a", []byte("hello"))
+	writeAll(t, fs, "/b", []byte("goodbye"))
+
+	for i := 0; i < 2; i++ {
+		if got := readAll(t, fs, "/a"); string(got) != "hello" {
+			t.Fatalf("unexpected contents %q", got)
+		}
+	}
+	backend.opens = 0
+	if got := readAll(t, fs, "/a"); string(got) != "hello" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if backend.opens != 0 {
+		t.Fatal("cached file was read from the backend")
+	}
+
+	// Writing through the cache drops the old copy.
+	writeAll(t, fs, "/a", []byte("hullo"))
+	if got := readAll(t, fs, "/a"); string(got) != "hullo" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+
+	// Caching b goes over MaxSize, evicting a.
+	readAll(t, fs, "/b")
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Size() != 7 {
+		t.Fatalf("unexpected cache contents %v", fis)
+	}
+}
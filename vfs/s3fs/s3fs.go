@@ -0,0 +1,889 @@
+// Package s3fs is a vfs engine backed by an Amazon S3 bucket, or any
+// object store speaking the S3 API such as MinIO, Ceph RGW, DigitalOcean
+// Spaces or Wasabi. The engine parameter is the bucket, an optional
+// prefix of the keys files are stored under, and options in URL query
+// syntax, 's3:BUCKET[/PREFIX][?OPTIONS]', for example
+// 's3:backups/sftp?endpoint=https://minio.example.com&path-style=true'.
+//
+// The 'region' option is the region requests are signed for, by default
+// $AWS_REGION or us-east-1. The 'endpoint' option is the URL of a store
+// other than AWS. With 'path-style=true' the bucket is addressed in the
+// path of requests rather than as a subdomain of the endpoint, which
+// most stores other than AWS need. New objects are encrypted by the
+// store with 'sse=AES256', or with 'sse=aws:kms' and optionally the key
+// 'sse-kms-key-id=KEY'. The 'storage-class' option sets the storage
+// class of new objects, for example 'STANDARD_IA'.
+//
+// Credentials are taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and, for temporary credentials, AWS_SESSION_TOKEN environment variables.
+//
+// S3 has no directories, so directories are the prefixes of object keys,
+// Mkdir creates an empty "dir/" marker object so empty directories can
+// exist. Objects cannot be modified, so files are written sequentially
+// from the start and replace any existing object when they are closed.
+// Files larger than PartSize are uploaded as a multipart upload, one
+// part at a time, so at most one part of each file is buffered. Renames
+// copy every object moved, which S3 only allows for objects up to 5GiB.
+package s3fs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+var (
+	ErrNotFile            = errors.New("not a file")
+	ErrNotDir             = errors.New("not a directory")
+	ErrNotOpen            = errors.New("file not open")
+	ErrNotEmpty           = errors.New("directory not empty")
+	ErrBadReadWriteOffset = errors.New("bad read/write offset")
+)
+
+// The size of upload parts unless PartSize is set. S3 parts other
+// than the last must be at least 5MiB.
+const defaultPartSize = 8 * 1024 * 1024
+
+func init() {
+	vfs.RegisterEngine("s3", vfsFactory)
+}
+
+func vfsFactory(param string) (vfs.VFS, error) {
+	fs, err := parseParam(param)
+	if err != nil {
+		return nil, err
+	}
+	fs.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	fs.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	fs.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if fs.AccessKeyID == "" || fs.SecretAccessKey == "" {
+		return nil, errors.New("s3 requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return fs, nil
+}
+
+// Parse 'BUCKET[/PREFIX][?OPTIONS]', without credentials.
+func parseParam(param string) (*Fs, error) {
+	location, rawOpts := param, ""
+	if i := strings.IndexByte(param, '?'); i != -1 {
+		location, rawOpts = param[:i], param[i+1:]
+	}
+	opts, err := url.ParseQuery(rawOpts)
+	if err != nil {
+		return nil, fmt.Errorf("bad s3 options '%s': %s", rawOpts, err)
+	}
+
+	fs := &Fs{Client: http.DefaultClient}
+	parts := strings.SplitN(strings.Trim(location, "/"), "/", 2)
+	fs.Bucket = parts[0]
+	if fs.Bucket == "" {
+		return nil, fmt.Errorf("bad s3 parameter '%s', expected 'BUCKET[/PREFIX][?OPTIONS]'", param)
+	}
+	if len(parts) == 2 {
+		fs.Prefix = strings.Trim(parts[1], "/") + "/"
+	}
+
+	fs.Region = os.Getenv("AWS_REGION")
+	if fs.Region == "" {
+		fs.Region = "us-east-1"
+	}
+	endpoint := ""
+	for name, values := range opts {
+		value := values[len(values)-1]
+		switch name {
+		case "region":
+			fs.Region = value
+		case "endpoint":
+			endpoint = value
+		case "path-style":
+			fs.PathStyle, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad s3 path-style '%s', expected true or false", value)
+			}
+		case "sse":
+			if value != "AES256" && value != "aws:kms" {
+				return nil, fmt.Errorf("bad s3 sse '%s', expected 'AES256' or 'aws:kms'", value)
+			}
+			fs.SSE = value
+		case "sse-kms-key-id":
+			fs.SSEKMSKeyID = value
+		case "storage-class":
+			fs.StorageClass = value
+		default:
+			return nil, fmt.Errorf("unknown s3 option '%s'", name)
+		}
+	}
+	if fs.SSEKMSKeyID != "" && fs.SSE != "aws:kms" {
+		return nil, errors.New("s3 sse-kms-key-id needs sse=aws:kms")
+	}
+
+	if endpoint == "" {
+		endpoint = "https://s3." + fs.Region + ".amazonaws.com"
+	}
+	fs.Endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad s3 endpoint: %s", err)
+	}
+	if (fs.Endpoint.Scheme != "http" && fs.Endpoint.Scheme != "https") || fs.Endpoint.Host == "" {
+		return nil, fmt.Errorf("bad s3 endpoint '%s', expected an http or https url", endpoint)
+	}
+	return fs, nil
+}
+
+type Fs struct {
+	// The URL of the store, such as https://s3.us-east-1.amazonaws.com.
+	Endpoint *url.URL
+	Region   string
+	Bucket   string
+	// Prepended to the key of every object, empty or ending in "/".
+	Prefix string
+	// Address the bucket in the path of requests, not the host.
+	PathStyle bool
+
+	// Server side encryption of new objects, "", "AES256" or "aws:kms".
+	SSE         string
+	SSEKMSKeyID string
+	// The storage class of new objects, empty for the default.
+	StorageClass string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Files are uploaded in parts of this size, 0 for 8MiB.
+	PartSize int64
+	Client   *http.Client
+}
+
+// The key of the object at p.
+func (fs *Fs) key(p string) string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return strings.TrimSuffix(fs.Prefix, "/")
+	}
+	return fs.Prefix + p[1:]
+}
+
+// The prefix of the keys of objects in directory p.
+func (fs *Fs) dirPrefix(p string) string {
+	if path.Clean("/"+p) == "/" {
+		return fs.Prefix
+	}
+	return fs.key(p) + "/"
+}
+
+// The URL of the object key, or the bucket if key is empty.
+func (fs *Fs) url(key string, query url.Values) *url.URL {
+	u := *fs.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if fs.PathStyle {
+		u.Path += "/" + fs.Bucket
+	} else {
+		u.Host = fs.Bucket + "." + u.Host
+	}
+	u.Path += "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (fs *Fs) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, fs.url(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := emptyPayloadHash
+	if len(body) != 0 {
+		payloadHash = sha256Hex(body)
+	}
+	fs.sign(req, payloadHash, time.Now())
+	return fs.Client.Do(req)
+}
+
+// Headers for requests creating objects.
+func (fs *Fs) createHeader() http.Header {
+	header := http.Header{}
+	if fs.SSE != "" {
+		header.Set("X-Amz-Server-Side-Encryption", fs.SSE)
+	}
+	if fs.SSEKMSKeyID != "" {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", fs.SSEKMSKeyID)
+	}
+	if fs.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", fs.StorageClass)
+	}
+	return header
+}
+
+type s3Error struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Convert an S3 error to a vfs error.
+func fixErr(method, key string, status int, e *s3Error) error {
+	switch {
+	case status == http.StatusNotFound, e.Code == "NoSuchKey", e.Code == "NoSuchBucket", e.Code == "NoSuchUpload":
+		return os.ErrNotExist
+	case status == http.StatusForbidden, e.Code == "AccessDenied":
+		return os.ErrPermission
+	}
+	msg := e.Code
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	return fmt.Errorf("s3 %s %s: %s", method, key, msg)
+}
+
+// Convert unsuccessful responses to errors, consuming the body.
+func statusError(method, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	e := &s3Error{}
+	_ = xml.Unmarshal(data, e)
+	return fixErr(method, key, resp.StatusCode, e)
+}
+
+// Make a request, decoding its XML response into v if it is not nil.
+// Some requests fail after the response status is sent, with an error
+// document in place of the response.
+func (fs *Fs) doXML(method, key string, query url.Values, header http.Header, body []byte, v interface{}) (*http.Response, error) {
+	resp, err := fs.do(method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, statusError(method, key, resp)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	e := &s3Error{}
+	if xml.Unmarshal(data, e) == nil && e.XMLName.Local == "Error" {
+		return nil, fixErr(method, key, resp.StatusCode, e)
+	}
+	if v != nil {
+		err = xml.Unmarshal(data, v)
+		if err != nil {
+			return nil, fmt.Errorf("s3 %s %s: bad response: %s", method, key, err)
+		}
+	}
+	return resp, nil
+}
+
+type listResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// List up to maxKeys keys starting with prefix from token, those
+// under a further "/" grouped as common prefixes unless recursive.
+func (fs *Fs) list(prefix string, recursive bool, maxKeys int, token string) (*listResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if !recursive {
+		query.Set("delimiter", "/")
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	result := &listResult{}
+	_, err := fs.doXML("GET", "", query, nil, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *FileInfo) Name() string       { return fi.name }
+func (fi *FileInfo) Size() int64        { return fi.size }
+func (fi *FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *FileInfo) IsDir() bool        { return fi.isDir }
+func (fi *FileInfo) Sys() interface{}   { return nil }
+
+func (fi *FileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fs *Fs) Stat(p string) (os.FileInfo, error) {
+	return fs.stat(p)
+}
+
+func (fs *Fs) stat(p string) (*FileInfo, error) {
+	name := path.Base(path.Clean("/" + p))
+	if path.Clean("/"+p) == "/" {
+		return &FileInfo{name: name, isDir: true}, nil
+	}
+
+	key := fs.key(p)
+	resp, err := fs.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		_ = resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &FileInfo{name: name, size: resp.ContentLength, modTime: modTime}, nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return nil, statusError("HEAD", key, resp)
+	}
+	_ = resp.Body.Close()
+	// A directory exists while any object, including
+	// its marker, has it as a prefix.
+	result, err := fs.list(key+"/", true, 1, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Contents) != 0 {
+		return &FileInfo{name: name, isDir: true}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Check the parent of p is a directory we can create entries in.
+func (fs *Fs) checkParent(p string) error {
+	fi, err := fs.stat(path.Dir(path.Clean("/" + p)))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return ErrNotDir
+	}
+	return nil
+}
+
+func (fs *Fs) Chmod(p string, mode os.FileMode) error {
+	// S3 has no permissions.
+	return nil
+}
+
+func (fs *Fs) Open(p string) (vfs.File, error) {
+	fi, err := fs.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		fs:             fs,
+		fpath:          p,
+		key:            fs.key(p),
+		isDir:          fi.IsDir(),
+		size:           fi.Size(),
+		openForReading: true,
+	}, nil
+}
+
+func (fs *Fs) OpenFile(p string, flags int, perm os.FileMode) (vfs.File, error) {
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.Open(p)
+	}
+	if flags&os.O_APPEND != 0 {
+		return nil, vfs.ErrUnsupported
+	}
+	if path.Clean("/"+p) == "/" {
+		return nil, ErrNotFile
+	}
+
+	fi, err := fs.stat(p)
+	exists := err == nil
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	if exists && fi.IsDir() {
+		return nil, ErrNotFile
+	}
+	if !exists && flags&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if exists && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+	// Objects can only be replaced, not updated.
+	if exists && flags&os.O_TRUNC == 0 {
+		return nil, vfs.ErrUnsupported
+	}
+	if !exists {
+		err = fs.checkParent(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &File{
+		fs:             fs,
+		fpath:          p,
+		key:            fs.key(p),
+		openForWriting: true,
+	}, nil
+}
+
+func (fs *Fs) Mkdir(p string, mode os.FileMode) error {
+	if path.Clean("/"+p) == "/" {
+		return os.ErrExist
+	}
+	_, err := fs.stat(p)
+	if err == nil {
+		return os.ErrExist
+	}
+	if err != os.ErrNotExist {
+		return err
+	}
+	err = fs.checkParent(p)
+	if err != nil {
+		return err
+	}
+	key := fs.key(p) + "/"
+	_, err = fs.doXML("PUT", key, nil, fs.createHeader(), nil, nil)
+	return err
+}
+
+// Copy the object from to the key to, then delete it.
+func (fs *Fs) move(from, to string) error {
+	header := fs.createHeader()
+	header.Set("X-Amz-Copy-Source", uriEncode("/"+fs.Bucket+"/"+from, false))
+	_, err := fs.doXML("PUT", to, nil, header, nil, nil)
+	if err != nil {
+		return err
+	}
+	return fs.deleteObject(from)
+}
+
+func (fs *Fs) deleteObject(key string) error {
+	resp, err := fs.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return statusError("DELETE", key, resp)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (fs *Fs) Rename(from, to string) error {
+	if path.Clean("/"+from) == "/" || path.Clean("/"+to) == "/" {
+		return vfs.ErrUnsupported
+	}
+	fi, err := fs.stat(from)
+	if err != nil {
+		return err
+	}
+	// An existing target file is replaced, like a local rename.
+	toFi, err := fs.stat(to)
+	if err == nil {
+		if toFi.IsDir() {
+			return os.ErrExist
+		}
+	} else if err != os.ErrNotExist {
+		return err
+	} else {
+		err = fs.checkParent(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	fromKey, toKey := fs.key(from), fs.key(to)
+	if !fi.IsDir() {
+		return fs.move(fromKey, toKey)
+	}
+	// Directories are moved one object at a time.
+	token := ""
+	for {
+		result, err := fs.list(fromKey+"/", true, 0, token)
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			err = fs.move(obj.Key, toKey+obj.Key[len(fromKey):])
+			if err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (fs *Fs) Remove(p string) error {
+	if path.Clean("/"+p) == "/" {
+		return os.ErrPermission
+	}
+	fi, err := fs.stat(p)
+	if err != nil {
+		return err
+	}
+	key := fs.key(p)
+	if !fi.IsDir() {
+		return fs.deleteObject(key)
+	}
+	// Only the marker of an empty directory may remain.
+	result, err := fs.list(key+"/", false, 2, "")
+	if err != nil {
+		return err
+	}
+	if len(result.CommonPrefixes) != 0 {
+		return ErrNotEmpty
+	}
+	for _, obj := range result.Contents {
+		if obj.Key != key+"/" {
+			return ErrNotEmpty
+		}
+	}
+	return fs.deleteObject(key + "/")
+}
+
+func (fs *Fs) Link(oldname, newname string) error {
+	return vfs.ErrUnsupported
+}
+
+func (fs *Fs) Close() error {
+	return nil
+}
+
+type File struct {
+	fs *Fs
+
+	fpath string
+	key   string
+	isDir bool
+	size  int64
+
+	// Listings are read a page at a time as the client
+	// reads, entries not yet consumed are buffered.
+	dirEnts   []os.FileInfo
+	dirToken  string
+	dirListed bool
+	dirEOF    bool
+
+	openForReading bool
+	openForWriting bool
+
+	readOffset int64
+	reader     io.ReadCloser
+
+	writeOffset int64
+	writeErr    error
+	part        []byte
+	uploadID    string
+	parts       []completedPart
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return nil
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.fs.Stat(f.fpath)
+}
+
+// Buffer the next page of the listing.
+func (f *File) listPage() error {
+	prefix := f.fs.dirPrefix(f.fpath)
+	result, err := f.fs.list(prefix, false, 0, f.dirToken)
+	if err != nil {
+		return err
+	}
+	for _, cp := range result.CommonPrefixes {
+		name := strings.TrimSuffix(cp.Prefix[len(prefix):], "/")
+		if name != "" {
+			f.dirEnts = append(f.dirEnts, &FileInfo{name: name, isDir: true})
+		}
+	}
+	for _, obj := range result.Contents {
+		name := obj.Key[len(prefix):]
+		// The marker of the directory being listed.
+		if name == "" {
+			continue
+		}
+		f.dirEnts = append(f.dirEnts, &FileInfo{name: name, size: obj.Size, modTime: obj.LastModified})
+	}
+	f.dirListed = true
+	f.dirToken = result.NextContinuationToken
+	f.dirEOF = !result.IsTruncated
+	return nil
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.isDir {
+		return nil, ErrNotDir
+	}
+	if !f.openForReading {
+		return nil, ErrNotOpen
+	}
+
+	for !f.dirListed || (!f.dirEOF && (n <= 0 || len(f.dirEnts) < n)) {
+		err := f.listPage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if n <= 0 {
+		fis := f.dirEnts
+		f.dirEnts = nil
+		return fis, nil
+	}
+	if len(f.dirEnts) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirEnts) {
+		n = len(f.dirEnts)
+	}
+	fis := f.dirEnts[:n]
+	f.dirEnts = f.dirEnts[n:]
+	return fis, nil
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrNotFile
+	}
+	if !f.openForReading {
+		return 0, ErrNotOpen
+	}
+	if off < 0 {
+		return 0, ErrBadReadWriteOffset
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	// Reuse the current download for sequential reads.
+	if f.reader == nil || off != f.readOffset {
+		if f.reader != nil {
+			_ = f.reader.Close()
+			f.reader = nil
+		}
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+		resp, err := f.fs.do("GET", f.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			return 0, statusError("GET", f.key, resp)
+		}
+		f.reader = resp.Body
+		f.readOffset = off
+		// The store ignored the range.
+		if resp.StatusCode == http.StatusOK && off != 0 {
+			_, err := io.CopyN(ioutil.Discard, f.reader, off)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := io.ReadFull(f.reader, b)
+	f.readOffset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *File) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.readOffset)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) partSize() int64 {
+	if f.fs.PartSize > 0 {
+		return f.fs.PartSize
+	}
+	return defaultPartSize
+}
+
+// Upload the buffered part, starting the upload if needed.
+func (f *File) uploadPart() error {
+	if f.uploadID == "" {
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		_, err := f.fs.doXML("POST", f.key, url.Values{"uploads": {""}}, f.fs.createHeader(), nil, &result)
+		if err != nil {
+			return err
+		}
+		f.uploadID = result.UploadID
+	}
+	number := len(f.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {f.uploadID}}
+	resp, err := f.fs.doXML("PUT", f.key, query, nil, f.part, nil)
+	if err != nil {
+		return err
+	}
+	f.parts = append(f.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	f.part = f.part[:0]
+	return nil
+}
+
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrNotFile
+	}
+	if !f.openForWriting {
+		return 0, ErrNotOpen
+	}
+	if f.writeErr != nil {
+		return 0, f.writeErr
+	}
+	if off != f.writeOffset {
+		return 0, ErrBadReadWriteOffset
+	}
+
+	nwritten := 0
+	for len(b) != 0 {
+		// Full parts are uploaded once more is written, the
+		// last part is uploaded on Close.
+		if int64(len(f.part)) == f.partSize() {
+			err := f.uploadPart()
+			if err != nil {
+				f.writeErr = err
+				return nwritten, err
+			}
+		}
+		chunk := b
+		if remaining := f.partSize() - int64(len(f.part)); int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		f.part = append(f.part, chunk...)
+		nwritten += len(chunk)
+		f.writeOffset += int64(len(chunk))
+		b = b[len(chunk):]
+	}
+	return nwritten, nil
+}
+
+func (f *File) Write(b []byte) (int, error) {
+	return f.WriteAt(b, f.writeOffset)
+}
+
+func (f *File) Sync() error {
+	// Objects are only stored once they are closed.
+	if f.openForWriting && f.writeOffset != 0 {
+		return vfs.ErrUnsupported
+	}
+	return nil
+}
+
+// Store the written data, replacing any existing object.
+func (f *File) commit() error {
+	if f.writeErr != nil {
+		f.abort()
+		return f.writeErr
+	}
+	if f.uploadID == "" {
+		_, err := f.fs.doXML("PUT", f.key, nil, f.fs.createHeader(), f.part, nil)
+		return err
+	}
+	if len(f.part) != 0 {
+		err := f.uploadPart()
+		if err != nil {
+			f.abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: f.parts})
+	if err != nil {
+		return err
+	}
+	_, err = f.fs.doXML("POST", f.key, url.Values{"uploadId": {f.uploadID}}, nil, body, nil)
+	if err != nil {
+		f.abort()
+	}
+	return err
+}
+
+// Abort a failed multipart upload, so its parts are not kept.
+func (f *File) abort() {
+	if f.uploadID == "" {
+		return
+	}
+	resp, err := f.fs.do("DELETE", f.key, url.Values{"uploadId": {f.uploadID}}, nil, nil)
+	if err == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	f.uploadID = ""
+}
+
+func (f *File) Close() error {
+	if f.reader != nil {
+		_ = f.reader.Close()
+		f.reader = nil
+	}
+	if !f.openForWriting {
+		return nil
+	}
+	f.openForWriting = false
+	return f.commit()
+}
@@ -0,0 +1,562 @@
+package s3fs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeObject struct {
+	data   []byte
+	header http.Header
+}
+
+// An S3 store holding one bucket in memory, addressed path style.
+type fakeS3 struct {
+	lock    sync.Mutex
+	bucket  string
+	objects map[string]fakeObject
+	uploads map[string]map[int][]byte
+	// The headers each upload was started with.
+	uploadHeaders map[string]http.Header
+	nextUpload    int
+	completed     int
+	// The most keys listed at once.
+	pageSize int
+	// If set, completing uploads fails after the status is sent.
+	failComplete bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		bucket:        "bucket",
+		objects:       make(map[string]fakeObject),
+		uploads:       make(map[string]map[int][]byte),
+		uploadHeaders: make(map[string]http.Header),
+		pageSize:      1000,
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		writeS3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+	if r.URL.Path != "/"+s.bucket && !strings.HasPrefix(r.URL.Path, "/"+s.bucket+"/") {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+s.bucket), "/")
+	query := r.URL.Query()
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == "GET" && key == "":
+		s.list(w, query)
+	case r.Method == "HEAD" || r.Method == "GET":
+		obj, ok := s.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", "Fri, 24 May 2013 00:00:00 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == "HEAD" {
+			return
+		}
+		off := 0
+		if rng := r.Header.Get("Range"); rng != "" {
+			off, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)-off))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		_, _ = w.Write(obj.data[off:])
+	case r.Method == "PUT" && uploadID != "":
+		parts, ok := s.uploads[uploadID]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, n))
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		obj, ok := s.objects[strings.TrimPrefix(src, "/"+s.bucket+"/")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		s.objects[key] = fakeObject{data: obj.data, header: r.Header}
+		fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+	case r.Method == "PUT":
+		s.objects[key] = fakeObject{data: body, header: r.Header}
+	case r.Method == "POST" && uploads:
+		s.nextUpload++
+		id := strconv.Itoa(s.nextUpload)
+		s.uploads[id] = make(map[int][]byte)
+		s.uploadHeaders[id] = r.Header
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "POST" && uploadID != "":
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		if s.failComplete {
+			writeS3Error(w, http.StatusOK, "InternalError")
+			return
+		}
+		var data []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"part%d"`, i+1) {
+				writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, s.uploads[uploadID][part.PartNumber]...)
+		}
+		s.objects[key] = fakeObject{data: data, header: s.uploadHeaders[uploadID]}
+		delete(s.uploads, uploadID)
+		s.completed++
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "DELETE" && uploadID != "":
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token")
+	maxKeys := s.pageSize
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n < maxKeys {
+		maxKeys = n
+	}
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := &listResult{}
+	seen := make(map[string]bool)
+	count := 0
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) || k <= token || (strings.HasSuffix(token, "/") && strings.HasPrefix(k, token)) {
+			continue
+		}
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		rest := k[len(prefix):]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i != -1 {
+			cp := prefix + rest[:i+1]
+			if !seen[cp] {
+				seen[cp] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct {
+					Prefix string `xml:"Prefix"`
+				}{cp})
+				result.NextContinuationToken = cp
+				count++
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			LastModified time.Time `xml:"LastModified"`
+			Size         int64     `xml:"Size"`
+		}{k, time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC), int64(len(s.objects[k].data))})
+		result.NextContinuationToken = k
+		count++
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		*listResult
+	}{listResult: result})
+	_, _ = w.Write(data)
+}
+
+func testFs(t *testing.T, options string) (*Fs, *fakeS3, func()) {
+	t.Helper()
+	s3 := newFakeS3()
+	srv := httptest.NewServer(s3)
+	fs, err := parseParam("bucket?path-style=true&endpoint=" + url.QueryEscape(srv.URL) + options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.AccessKeyID = "AKID"
+	fs.SecretAccessKey = "SECRET"
+	fs.Client = srv.Client()
+	return fs, s3, srv.Close
+}
+
+func writeFile(t *testing.T, fs *Fs, p, data string) {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs *Fs, p string) string {
+	t.Helper()
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseParam(t *testing.T) {
+	os.Unsetenv("AWS_REGION")
+	fs, err := parseParam("bucket/some/prefix/?region=eu-west-1&sse=aws:kms&sse-kms-key-id=key&storage-class=STANDARD_IA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.Bucket != "bucket" || fs.Prefix != "some/prefix/" || fs.Region != "eu-west-1" ||
+		fs.SSE != "aws:kms" || fs.SSEKMSKeyID != "key" || fs.StorageClass != "STANDARD_IA" || fs.PathStyle {
+		t.Fatalf("unexpected %+v", fs)
+	}
+	if fs.Endpoint.String() != "https://s3.eu-west-1.amazonaws.com" {
+		t.Fatalf("unexpected endpoint %s", fs.Endpoint)
+	}
+
+	fs, err = parseParam("bucket?endpoint=https://minio.example.com:9000&path-style=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.Prefix != "" || fs.Region != "us-east-1" || !fs.PathStyle || fs.Endpoint.Host != "minio.example.com:9000" {
+		t.Fatalf("unexpected %+v", fs)
+	}
+
+	for _, bad := range []string{
+		"",
+		"bucket?sse=rot13",
+		"bucket?sse-kms-key-id=key",
+		"bucket?sse=AES256&sse-kms-key-id=key",
+		"bucket?path-style=maybe",
+		"bucket?endpoint=ftp://host",
+		"bucket?endpoint=minio.example.com",
+		"bucket?acl=public-read",
+	} {
+		if _, err := parseParam(bad); err == nil {
+			t.Fatalf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	endpoint, _ := url.Parse("https://s3.example.com")
+	fs := &Fs{Endpoint: endpoint, Bucket: "bucket"}
+	if u := fs.url("a b/c+d", nil).String(); u != "https://bucket.s3.example.com/a%20b/c%2Bd" {
+		t.Fatalf("unexpected url %s", u)
+	}
+	fs.PathStyle = true
+	u := fs.url("a b/c+d", url.Values{"partNumber": {"1"}, "uploadId": {"a/b"}}).String()
+	if u != "https://s3.example.com/bucket/a%20b/c%2Bd?partNumber=1&uploadId=a%2Fb" {
+		t.Fatalf("unexpected url %s", u)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	fs, _, done := testFs(t, "")
+	defer done()
+
+	writeFile(t, fs, "/a b.txt", "hello world")
+	if got := readFile(t, fs, "/a b.txt"); got != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+	fi, err := fs.Stat("/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 11 || fi.IsDir() || fi.Name() != "a b.txt" {
+		t.Fatalf("bad stat %s %d %v", fi.Name(), fi.Size(), fi.IsDir())
+	}
+
+	f, err := fs.Open("/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	n, err := f.ReadAt(buf, 6)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("ReadAt: %q %v", buf[:n], err)
+	}
+	_, err = f.ReadAt(buf, 20)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// Objects can only be replaced.
+	_, err = fs.OpenFile("/a b.txt", os.O_WRONLY, 0)
+	if err == nil {
+		t.Fatal("expected updating an object to fail")
+	}
+	w, err := fs.OpenFile("/new", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.WriteAt([]byte("x"), 1)
+	if err != ErrBadReadWriteOffset {
+		t.Fatalf("expected a bad offset, got %v", err)
+	}
+	_ = w.Close()
+	if got := readFile(t, fs, "/new"); got != "" {
+		t.Fatalf("expected an empty file, got %q", got)
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	fs, s3, done := testFs(t, "")
+	defer done()
+	fs.PartSize = 4
+
+	f, err := fs.OpenFile("/big", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []string{"abc", "defghi", "j", "kl"} {
+		if _, err := f.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/big"); got != "abcdefghijkl" {
+		t.Fatalf("got %q", got)
+	}
+	if s3.completed != 1 {
+		t.Fatalf("expected one multipart upload, got %d", s3.completed)
+	}
+
+	// Writes within a part are a single put.
+	writeFile(t, fs, "/small", "abcd")
+	if s3.completed != 1 {
+		t.Fatal("expected a single put")
+	}
+
+	// Failed uploads are aborted.
+	s3.failComplete = true
+	f, err = fs.OpenFile("/failed", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("abcdefgh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Fatalf("expected the upload to fail, got %v", err)
+	}
+	if len(s3.uploads) != 0 {
+		t.Fatal("expected the upload to be aborted")
+	}
+	if _, err := fs.Stat("/failed"); err != os.ErrNotExist {
+		t.Fatalf("expected no file, got %v", err)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	fs, s3, done := testFs(t, "")
+	defer done()
+	s3.pageSize = 2
+
+	if err := fs.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/d", 0755); err != os.ErrExist {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+	if err := fs.Mkdir("/missing/d", 0755); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if err := fs.Mkdir("/d/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		writeFile(t, fs, "/d/"+name, name)
+	}
+
+	d, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a,b,c,sub" {
+		t.Fatalf("unexpected listing %v", names)
+	}
+
+	if err := fs.Remove("/d"); err != ErrNotEmpty {
+		t.Fatalf("expected ErrNotEmpty, got %v", err)
+	}
+	if err := fs.Rename("/d", "/e"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/d"); err != os.ErrNotExist {
+		t.Fatalf("expected /d to be moved, got %v", err)
+	}
+	if got := readFile(t, fs, "/e/b"); got != "b" {
+		t.Fatalf("got %q", got)
+	}
+	fi, err := fs.Stat("/e/sub")
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("expected /e/sub to be a directory, got %v", err)
+	}
+
+	// Renames replace files but not directories.
+	if err := fs.Rename("/e/a", "/e/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/e/b"); got != "a" {
+		t.Fatalf("got %q", got)
+	}
+	if err := fs.Rename("/e/b", "/e/sub"); err != os.ErrExist {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+
+	if err := fs.Remove("/e/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/e/sub"); err != os.ErrNotExist {
+		t.Fatalf("expected /e/sub to be removed, got %v", err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	fs, s3, done := testFs(t, "")
+	defer done()
+	fs.Prefix = "pre/"
+
+	writeFile(t, fs, "/a", "a")
+	s3.objects["other"] = fakeObject{data: []byte("other")}
+	if _, ok := s3.objects["pre/a"]; !ok {
+		t.Fatal("expected the object under the prefix")
+	}
+	d, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "a" {
+		t.Fatalf("unexpected listing %v", names)
+	}
+}
+
+func TestCreateHeaders(t *testing.T) {
+	fs, s3, done := testFs(t, "&sse=aws:kms&sse-kms-key-id=key&storage-class=STANDARD_IA")
+	defer done()
+
+	check := func(key string) {
+		t.Helper()
+		h := s3.objects[key].header
+		if h.Get("X-Amz-Server-Side-Encryption") != "aws:kms" ||
+			h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "key" ||
+			h.Get("X-Amz-Storage-Class") != "STANDARD_IA" {
+			t.Fatalf("%s created without the headers, got %v", key, h)
+		}
+	}
+	writeFile(t, fs, "/a", "a")
+	check("a")
+	if err := fs.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	check("d/")
+	if err := fs.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	check("b")
+	fs.PartSize = 1
+	writeFile(t, fs, "/c", "abc")
+	check("c")
+}
+
+func TestErrors(t *testing.T) {
+	fs, _, done := testFs(t, "")
+	defer done()
+
+	if _, err := fs.Stat("/missing"); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if _, err := fs.Open("/missing"); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if _, err := fs.OpenFile("/missing", os.O_WRONLY, 0); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if err := fs.Remove("/"); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+
+	fs.AccessKeyID = "WRONG"
+	if _, err := fs.Stat("/a"); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	if err := fs.Mkdir("/a", 0755); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+
+	fs.AccessKeyID = "AKID"
+	fs.Bucket = "other"
+	if _, err := fs.Stat("/a"); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
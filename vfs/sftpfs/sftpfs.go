@@ -0,0 +1,87 @@
+// Package sftpfs is a vfs engine that serves files from an upstream
+// SFTP server, 'sftp:[user@]host[:path]'. The connection is made by
+// running 'ssh -s host sftp', so host keys, ports and credentials are
+// configured as for any other ssh connection, e.g. in ~/.ssh/config.
+// Paths are relative to path, or the remote home directory.
+package sftpfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/andrewchambers/sftpplease/sftp"
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+// The ssh command used to reach the upstream server, the destination
+// and "sftp" subsystem arguments are appended.
+var SSHCommand = []string{"ssh", "-oBatchMode=yes", "-s"}
+
+func init() {
+	vfs.RegisterEngine("sftp", vfsFactory)
+}
+
+func vfsFactory(param string) (vfs.VFS, error) {
+	dest, root := param, "."
+	if idx := strings.Index(param, ":"); idx != -1 {
+		dest, root = param[:idx], param[idx+1:]
+		if root == "" {
+			root = "."
+		}
+	}
+	if dest == "" || strings.HasPrefix(dest, "-") {
+		return nil, errors.New("sftp vfs expects [user@]host[:path]")
+	}
+
+	c, err := Dial(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &vfs.ChrootVFS{Fs: c, Root: root}, nil
+}
+
+// The stdin and stdout of an ssh process.
+type sshConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *sshConn) Close() error {
+	_ = c.WriteCloser.Close()
+	return c.cmd.Wait()
+}
+
+// Connect to the sftp server of dest using ssh.
+func Dial(dest string) (*sftp.Client, error) {
+	return DialCommand(append(append([]string{}, SSHCommand...), dest, "sftp"))
+}
+
+// Run the command args and speak sftp over its stdin and stdout.
+func DialCommand(args []string) (*sftp.Client, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &sshConn{Reader: stdout, WriteCloser: stdin, cmd: cmd}
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,246 @@
+// Package smbfs is a vfs engine serving files from a Windows or Samba
+// share over SMB2/3, 'smb://[DOMAIN;]user@server[:port]/share[/path]'.
+// The password is taken from the url or SFTPPLEASE_SMB_PASSWORD.
+// Paths are relative to path, or the root of the share.
+package smbfs
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/hirochachacha/go-smb2"
+)
+
+func init() {
+	vfs.RegisterEngine("smb", vfsFactory)
+}
+
+func vfsFactory(param string) (vfs.VFS, error) {
+	u, err := url.Parse("smb:" + param)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if u.Host == "" || parts[0] == "" {
+		return nil, errors.New("smb vfs expects smb://[DOMAIN;]user@server[:port]/share[/path]")
+	}
+
+	opts := &Options{
+		Address:  u.Host,
+		Share:    parts[0],
+		Password: os.Getenv("SFTPPLEASE_SMB_PASSWORD"),
+	}
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		opts.Address = net.JoinHostPort(opts.Address, "445")
+	}
+	if u.User != nil {
+		opts.User = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			opts.Password = password
+		}
+	}
+	if idx := strings.Index(opts.User, ";"); idx != -1 {
+		opts.Domain, opts.User = opts.User[:idx], opts.User[idx+1:]
+	}
+	if opts.User == "" {
+		opts.User = "guest"
+	}
+
+	fs, err := Dial(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		return &vfs.ChrootVFS{Fs: fs, Root: "/" + parts[1]}, nil
+	}
+	return fs, nil
+}
+
+type Options struct {
+	// host:port of the server.
+	Address  string
+	Share    string
+	User     string
+	Password string
+	Domain   string
+}
+
+type Fs struct {
+	conn    net.Conn
+	session *smb2.Session
+	share   *smb2.Share
+}
+
+// Connect and mount the share described by opts.
+func Dial(opts *Options) (*Fs, error) {
+	conn, err := net.Dial("tcp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	d := &smb2.Dialer{
+		Initiator: &smb2.NTLMInitiator{
+			User:     opts.User,
+			Password: opts.Password,
+			Domain:   opts.Domain,
+		},
+	}
+	session, err := d.Dial(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	share, err := session.Mount(opts.Share)
+	if err != nil {
+		_ = session.Logoff()
+		_ = conn.Close()
+		return nil, err
+	}
+	return &Fs{conn: conn, session: session, share: share}, nil
+}
+
+// Share paths are relative with '\' separators, the
+// root of the share is the empty path.
+func sharePath(p string) string {
+	p = path.Clean("/" + p)
+	return strings.Replace(p[1:], "/", `\`, -1)
+}
+
+// Unwrap the errors of the smb2 package, which wraps
+// os.ErrNotExist and friends in *os.PathError.
+func fixErr(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		switch e.Err {
+		case os.ErrNotExist, os.ErrExist, os.ErrPermission:
+			return e.Err
+		}
+	case *os.LinkError:
+		switch e.Err {
+		case os.ErrNotExist, os.ErrExist, os.ErrPermission:
+			return e.Err
+		}
+	}
+	return err
+}
+
+func (fs *Fs) Chmod(p string, mode os.FileMode) error {
+	return fixErr(fs.share.Chmod(sharePath(p), mode))
+}
+
+func (fs *Fs) Chtimes(p string, atime time.Time, mtime time.Time) error {
+	return fixErr(fs.share.Chtimes(sharePath(p), atime, mtime))
+}
+
+func (fs *Fs) Open(p string) (vfs.File, error) {
+	return fs.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (fs *Fs) OpenFile(p string, flag int, perm os.FileMode) (vfs.File, error) {
+	f, err := fs.share.OpenFile(sharePath(p), flag, perm)
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return &File{f: f, fpath: path.Clean("/" + p)}, nil
+}
+
+func (fs *Fs) Mkdir(p string, perm os.FileMode) error {
+	return fixErr(fs.share.Mkdir(sharePath(p), perm))
+}
+
+func (fs *Fs) Stat(p string) (os.FileInfo, error) {
+	fi, err := fs.share.Stat(sharePath(p))
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return fi, nil
+}
+
+func (fs *Fs) Rename(from, to string) error {
+	// SMB does not replace existing files when renaming.
+	if fi, err := fs.share.Stat(sharePath(to)); err == nil && !fi.IsDir() {
+		err = fs.share.Remove(sharePath(to))
+		if err != nil {
+			return fixErr(err)
+		}
+	}
+	return fixErr(fs.share.Rename(sharePath(from), sharePath(to)))
+}
+
+func (fs *Fs) Remove(p string) error {
+	return fixErr(fs.share.Remove(sharePath(p)))
+}
+
+func (fs *Fs) Link(oldname, newname string) error {
+	return vfs.ErrUnsupported
+}
+
+func (fs *Fs) Close() error {
+	_ = fs.share.Umount()
+	_ = fs.session.Logoff()
+	return fs.conn.Close()
+}
+
+type File struct {
+	f     *smb2.File
+	fpath string
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return fixErr(f.f.Chmod(mode))
+}
+
+func (f *File) Read(buf []byte) (int, error) {
+	n, err := f.f.Read(buf)
+	return n, fixErr(err)
+}
+
+func (f *File) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := f.f.ReadAt(buf, off)
+	return n, fixErr(err)
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	fis, err := f.f.Readdir(n)
+	return fis, fixErr(err)
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	names, err := f.f.Readdirnames(n)
+	return names, fixErr(err)
+}
+
+func (f *File) Write(buf []byte) (int, error) {
+	n, err := f.f.Write(buf)
+	return n, fixErr(err)
+}
+
+func (f *File) WriteAt(buf []byte, off int64) (int, error) {
+	n, err := f.f.WriteAt(buf, off)
+	return n, fixErr(err)
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return nil, fixErr(err)
+	}
+	return fi, nil
+}
+
+func (f *File) Sync() error {
+	return fixErr(f.f.Sync())
+}
+
+func (f *File) Close() error {
+	return fixErr(f.f.Close())
+}
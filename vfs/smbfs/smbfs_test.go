@@ -0,0 +1,33 @@
+package smbfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSharePath(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"/", ""},
+		{"", ""},
+		{"/foo", "foo"},
+		{"/foo/bar", `foo\bar`},
+		{"../../foo/./bar/", `foo\bar`},
+	} {
+		if got := sharePath(tc.in); got != tc.out {
+			t.Errorf("sharePath(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+func TestFixErr(t *testing.T) {
+	err := fixErr(&os.PathError{Op: "open", Path: `foo\bar`, Err: os.ErrNotExist})
+	if err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	err = fixErr(&os.LinkError{Op: "rename", Old: "a", New: "b", Err: os.ErrExist})
+	if err != os.ErrExist {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testFs(t *testing.T) (*Fs, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "files.db")
+	fs, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, dbPath, func() {
+		fs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func writeFile(t *testing.T, fs *Fs, p string, data []byte) {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs *Fs, p string) []byte {
+	t.Helper()
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReadWrite(t *testing.T) {
+	fs, dbPath, done := testFs(t)
+	defer done()
+
+	data := make([]byte, 2*ChunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	writeFile(t, fs, "/a", data)
+	if got := readFile(t, fs, "/a"); !bytes.Equal(got, data) {
+		t.Fatal("read data differs from written data")
+	}
+
+	f, err := fs.OpenFile("/a", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("xyz"), ChunkSize-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	n, err := f.ReadAt(buf, ChunkSize-2)
+	if err != nil || n != 5 {
+		t.Fatal(n, err)
+	}
+	expected := append([]byte{data[ChunkSize-2]}, 'x', 'y', 'z', data[ChunkSize+2])
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("got %v, expected %v", buf, expected)
+	}
+	_, err = f.ReadAt(buf, int64(len(data))-2)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	f.Close()
+
+	// Writes past the end leave a hole of zeros.
+	writeFile(t, fs, "/sparse", nil)
+	f, err = fs.OpenFile("/sparse", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("end"), 3*ChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	got := readFile(t, fs, "/sparse")
+	if len(got) != 3*ChunkSize+3 || got[ChunkSize] != 0 || string(got[3*ChunkSize:]) != "end" {
+		t.Fatal("bad sparse file")
+	}
+
+	f, err = fs.OpenFile("/sparse", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Contents persist across opens.
+	fs.Close()
+	fs, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat("/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3*ChunkSize+4 || fi.Mode() != 0644 {
+		t.Fatalf("bad stat %d %s", fi.Size(), fi.Mode())
+	}
+	writeFile(t, fs, "/a", []byte("short"))
+	if got := readFile(t, fs, "/a"); string(got) != "short" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestDirs(t *testing.T) {
+	fs, _, done := testFs(t)
+	defer done()
+
+	err := fs.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Mkdir("/d", 0755)
+	if err != os.ErrExist {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+	err = fs.Mkdir("/missing/d", 0755)
+	if err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	for _, name := range []string{"c", "a", "e", "b", "d"} {
+		writeFile(t, fs, "/d/"+name, []byte(name))
+	}
+
+	d, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		batch, err := d.Readdirnames(2)
+		names = append(names, batch...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatalf("bad listing %v", names)
+	}
+
+	err = fs.Remove("/d")
+	if err != ErrNotEmpty {
+		t.Fatalf("expected ErrNotEmpty, got %v", err)
+	}
+	err = fs.Rename("/d", "/d/sub")
+	if err != ErrBadPath {
+		t.Fatalf("expected ErrBadPath, got %v", err)
+	}
+}
+
+func TestRenameLinkRemove(t *testing.T) {
+	fs, _, done := testFs(t)
+	defer done()
+
+	err := fs.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/a", []byte("a"))
+	writeFile(t, fs, "/d/b", []byte("b"))
+
+	err = fs.Rename("/a", "/d/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/d/b"); string(got) != "a" {
+		t.Fatalf("got %q", got)
+	}
+	_, err = fs.Stat("/a")
+	if err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	err = fs.Link("/d/b", "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Remove("/d/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/c"); string(got) != "a" {
+		t.Fatalf("got %q", got)
+	}
+
+	err = fs.Rename("/d", "/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Remove("/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Remove("/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inodes, chunks int
+	err = fs.db.QueryRow("SELECT count(*) FROM inodes").Scan(&inodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.db.QueryRow("SELECT count(*) FROM chunks").Scan(&chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodes != 1 || chunks != 0 {
+		t.Fatalf("leaked %d inodes and %d chunks", inodes-1, chunks)
+	}
+}
@@ -0,0 +1,266 @@
+package vfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatCacheVFS remembers the results of Stat for TTL, and the entries
+// of directory listings as if they were results of Stat. Changes made
+// through the cache drop affected entries, changes made by others may be
+// missed for up to TTL.
+type StatCacheVFS struct {
+	Fs  VFS
+	TTL time.Duration
+
+	parent  *StatCacheVFS
+	lock    sync.Mutex
+	entries map[string]statCacheEntry
+}
+
+// The wrapper a view made by WithContext came from, whose state
+// the view shares.
+func (c *StatCacheVFS) root() *StatCacheVFS {
+	if c.parent != nil {
+		return c.parent
+	}
+	return c
+}
+
+type statCacheEntry struct {
+	fi      os.FileInfo
+	expires time.Time
+}
+
+// Entries are pruned once there are this many.
+const statCacheMaxEntries = 10000
+
+func (c *StatCacheVFS) get(p string) (os.FileInfo, bool) {
+	c = c.root()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[p]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, p)
+		return nil, false
+	}
+	return e.fi, true
+}
+
+func (c *StatCacheVFS) put(p string, fi os.FileInfo) {
+	c = c.root()
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]statCacheEntry)
+	}
+	if len(c.entries) >= statCacheMaxEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= statCacheMaxEntries {
+			c.entries = make(map[string]statCacheEntry)
+		}
+	}
+	c.entries[p] = statCacheEntry{fi: fi, expires: now.Add(c.TTL)}
+}
+
+// Drop p and its parent directory, whose modification
+// time changes with its entries.
+func (c *StatCacheVFS) invalidate(p string) {
+	c = c.root()
+	p = path.Clean("/" + p)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, p)
+	delete(c.entries, path.Dir(p))
+}
+
+// Drop p, its parent and everything inside it.
+func (c *StatCacheVFS) invalidateTree(p string) {
+	c = c.root()
+	p = path.Clean("/" + p)
+	c.invalidate(p)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k := range c.entries {
+		if strings.HasPrefix(k, p+"/") {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *StatCacheVFS) Chmod(name string, mode os.FileMode) error {
+	defer c.invalidate(name)
+	return c.Fs.Chmod(name, mode)
+}
+
+func (c *StatCacheVFS) Open(path string) (File, error) {
+	return c.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (c *StatCacheVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+	if writable {
+		c.invalidate(name)
+	}
+	f, err := c.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &StatCacheFile{File: f, c: c, name: path.Clean("/" + name), writable: writable}, nil
+}
+
+func (c *StatCacheVFS) Mkdir(path string, perm os.FileMode) error {
+	defer c.invalidate(path)
+	return c.Fs.Mkdir(path, perm)
+}
+
+func (c *StatCacheVFS) Stat(p string) (os.FileInfo, error) {
+	p = path.Clean("/" + p)
+	if fi, ok := c.get(p); ok {
+		return fi, nil
+	}
+	fi, err := c.Fs.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	c.put(p, fi)
+	return fi, nil
+}
+
+func (c *StatCacheVFS) Rename(from, to string) error {
+	defer c.invalidateTree(to)
+	defer c.invalidateTree(from)
+	return c.Fs.Rename(from, to)
+}
+
+func (c *StatCacheVFS) Remove(path string) error {
+	defer c.invalidateTree(path)
+	return c.Fs.Remove(path)
+}
+
+func (c *StatCacheVFS) Link(oldname, newname string) error {
+	// Link counts are part of the cached information.
+	defer c.invalidate(oldname)
+	defer c.invalidate(newname)
+	return c.Fs.Link(oldname, newname)
+}
+
+func (c *StatCacheVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := c.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return cs.Checksum(path, algorithm)
+}
+
+func (c *StatCacheVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(c.Fs)
+}
+
+func (c *StatCacheVFS) RealPath(p string) (string, error) {
+	return RealPath(c.Fs, p)
+}
+
+func (c *StatCacheVFS) AppendSupported() bool {
+	return AppendSupported(c.Fs)
+}
+
+func (c *StatCacheVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	ct, ok := c.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	defer c.invalidate(path)
+	return ct.Chtimes(path, atime, mtime)
+}
+
+func (c *StatCacheVFS) RemoveBatch(paths []string) error {
+	defer func() {
+		for _, p := range paths {
+			c.invalidateTree(p)
+		}
+	}()
+	return RemoveBatch(c.Fs, paths)
+}
+
+func (c *StatCacheVFS) RenameBatch(renames []Rename) error {
+	defer func() {
+		for _, r := range renames {
+			c.invalidateTree(r.From)
+			c.invalidateTree(r.To)
+		}
+	}()
+	return RenameBatch(c.Fs, renames)
+}
+
+func (c *StatCacheVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := c.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (c *StatCacheVFS) WithContext(ctx context.Context) VFS {
+	return &StatCacheVFS{
+		Fs:     WithContext(c.Fs, ctx),
+		TTL:    c.TTL,
+		parent: c.root(),
+	}
+}
+
+func (c *StatCacheVFS) Close() error {
+	return c.Fs.Close()
+}
+
+// StatCacheFile caches the entries of directory listings, and
+// drops the cached information of files written through it.
+type StatCacheFile struct {
+	File
+	c        *StatCacheVFS
+	name     string
+	writable bool
+}
+
+func (sf *StatCacheFile) Readdir(n int) ([]os.FileInfo, error) {
+	fis, err := sf.File.Readdir(n)
+	for _, fi := range fis {
+		sf.c.put(path.Join(sf.name, fi.Name()), fi)
+	}
+	return fis, err
+}
+
+func (sf *StatCacheFile) Write(buf []byte) (int, error) {
+	defer sf.c.invalidate(sf.name)
+	return sf.File.Write(buf)
+}
+
+func (sf *StatCacheFile) WriteAt(buf []byte, off int64) (int, error) {
+	defer sf.c.invalidate(sf.name)
+	return sf.File.WriteAt(buf, off)
+}
+
+func (sf *StatCacheFile) Chmod(mode os.FileMode) error {
+	defer sf.c.invalidate(sf.name)
+	return sf.File.Chmod(mode)
+}
+
+func (sf *StatCacheFile) Close() error {
+	if sf.writable {
+		// Some backends only update files when they are closed.
+		defer sf.c.invalidate(sf.name)
+	}
+	return sf.File.Close()
+}
@@ -0,0 +1,85 @@
+package vfs_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// Counts calls to Stat on the wrapped file system.
+type statCountingVFS struct {
+	vfs.VFS
+	stats int
+}
+
+func (c *statCountingVFS) Stat(p string) (os.FileInfo, error) {
+	c.stats++
+	return c.VFS.Stat(p)
+}
+
+func TestStatCacheVFS(t *testing.T) {
+	backend := &statCountingVFS{VFS: mem.New()}
+	fs := &vfs.StatCacheVFS{Fs: backend, TTL: time.Hour}
+
+	writeAll(t, fs, "/a", []byte("hello"))
+	for i := 0; i < 3; i++ {
+		fi, err := fs.Stat("/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 5 {
+			t.Fatalf("unexpected size %d", fi.Size())
+		}
+	}
+	if backend.stats != 1 {
+		t.Fatalf("expected 1 backend stat, got %d", backend.stats)
+	}
+
+	// Writes drop the cached result.
+	writeAll(t, fs, "/a", []byte("hello world"))
+	fi, err := fs.Stat("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 11 {
+		t.Fatalf("unexpected size %d", fi.Size())
+	}
+
+	err = fs.Rename("/a", "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a"); err == nil {
+		t.Fatal("renamed file still cached")
+	}
+
+	// Listings fill the cache.
+	d, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Readdir(-1)
+	_ = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.stats = 0
+	if _, err := fs.Stat("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.stats != 0 {
+		t.Fatal("listed file was not cached")
+	}
+
+	short := &vfs.StatCacheVFS{Fs: backend, TTL: time.Millisecond}
+	_, _ = short.Stat("/b")
+	time.Sleep(5 * time.Millisecond)
+	backend.stats = 0
+	_, _ = short.Stat("/b")
+	if backend.stats != 1 {
+		t.Fatal("expired entry was used")
+	}
+}
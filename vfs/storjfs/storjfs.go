@@ -0,0 +1,637 @@
+// Package storjfs is a vfs engine backed by Storj decentralized cloud
+// storage using the uplink library. The engine parameter is a serialized
+// access grant, 'storj:ACCESS'. If it is empty it is taken from the
+// SFTPPLEASE_STORJ_ACCESS environment variable.
+//
+// Buckets are the top level directories. Storj has no directories, so
+// directories are the prefixes of object keys, Mkdir creates an empty
+// "dir/" marker object so empty directories can exist.
+//
+// Objects cannot be modified, so files are written sequentially from
+// the start and replace any existing object when they are closed.
+// Writes are streamed to storj as a multipart upload, so large files
+// are never buffered.
+package storjfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"storj.io/uplink"
+)
+
+var (
+	ErrNotFile            = errors.New("not a file")
+	ErrNotDir             = errors.New("not a directory")
+	ErrNotOpen            = errors.New("file not open")
+	ErrNotEmpty           = errors.New("directory not empty")
+	ErrBadReadWriteOffset = errors.New("bad read/write offset")
+)
+
+// Uploads are split into parts of this size, the size of a storj
+// segment, each committed as soon as it has been written.
+const partSize = 64 * 1024 * 1024
+
+func init() {
+	vfs.RegisterEngine("storj", vfsFactory)
+}
+
+func vfsFactory(access string) (vfs.VFS, error) {
+	if access == "" {
+		access = os.Getenv("SFTPPLEASE_STORJ_ACCESS")
+	}
+	if access == "" {
+		return nil, errors.New("storj requires an access grant")
+	}
+	return Dial(access)
+}
+
+type Fs struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	project *uplink.Project
+}
+
+// Open the project of the serialized access grant.
+func Dial(access string) (*Fs, error) {
+	grant, err := uplink.ParseAccess(access)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	project, err := uplink.OpenProject(ctx, grant)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Fs{ctx: ctx, cancel: cancel, project: project}, nil
+}
+
+func fixErr(err error) error {
+	switch {
+	case errors.Is(err, uplink.ErrObjectNotFound), errors.Is(err, uplink.ErrBucketNotFound):
+		return os.ErrNotExist
+	case errors.Is(err, uplink.ErrBucketAlreadyExists):
+		return os.ErrExist
+	case errors.Is(err, uplink.ErrPermissionDenied):
+		return os.ErrPermission
+	case errors.Is(err, uplink.ErrBucketNotEmpty):
+		return ErrNotEmpty
+	}
+	return err
+}
+
+// Split p into a bucket and an object key, "/" has
+// no bucket and the root of a bucket has no key.
+func splitPath(p string) (string, string) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "", ""
+	}
+	parts := strings.SplitN(p[1:], "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+type FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *FileInfo) Name() string       { return fi.name }
+func (fi *FileInfo) Size() int64        { return fi.size }
+func (fi *FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *FileInfo) IsDir() bool        { return fi.isDir }
+func (fi *FileInfo) Sys() interface{}   { return nil }
+
+func (fi *FileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fs *Fs) Stat(p string) (os.FileInfo, error) {
+	return fs.stat(p)
+}
+
+func (fs *Fs) stat(p string) (*FileInfo, error) {
+	bucket, key := splitPath(p)
+	name := path.Base(path.Clean("/" + p))
+	if bucket == "" {
+		return &FileInfo{name: name, isDir: true}, nil
+	}
+	if key == "" {
+		b, err := fs.project.StatBucket(fs.ctx, bucket)
+		if err != nil {
+			return nil, fixErr(err)
+		}
+		return &FileInfo{name: name, isDir: true, modTime: b.Created}, nil
+	}
+
+	obj, err := fs.project.StatObject(fs.ctx, bucket, key)
+	if err == nil {
+		return &FileInfo{name: name, size: obj.System.ContentLength, modTime: obj.System.Created}, nil
+	}
+	if !errors.Is(err, uplink.ErrObjectNotFound) {
+		return nil, fixErr(err)
+	}
+	// A directory exists while any object, including
+	// its marker, has it as a prefix.
+	it := fs.project.ListObjects(fs.ctx, bucket, &uplink.ListObjectsOptions{Prefix: key + "/"})
+	if it.Next() {
+		return &FileInfo{name: name, isDir: true}, nil
+	}
+	if it.Err() != nil {
+		return nil, fixErr(it.Err())
+	}
+	return nil, os.ErrNotExist
+}
+
+// Check the parent of p is a directory we can create entries in.
+func (fs *Fs) checkParent(p string) error {
+	fi, err := fs.stat(path.Dir(path.Clean("/" + p)))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return ErrNotDir
+	}
+	return nil
+}
+
+func (fs *Fs) Chmod(p string, mode os.FileMode) error {
+	// Storj has no permissions.
+	return nil
+}
+
+func (fs *Fs) Open(p string) (vfs.File, error) {
+	fi, err := fs.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := splitPath(p)
+	return &File{
+		fs:             fs,
+		fpath:          p,
+		bucket:         bucket,
+		key:            key,
+		isDir:          fi.IsDir(),
+		size:           fi.Size(),
+		openForReading: true,
+	}, nil
+}
+
+func (fs *Fs) OpenFile(p string, flags int, perm os.FileMode) (vfs.File, error) {
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.Open(p)
+	}
+
+	bucket, key := splitPath(p)
+	if key == "" {
+		return nil, ErrNotFile
+	}
+	fi, err := fs.stat(p)
+	exists := err == nil
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	if exists && fi.IsDir() {
+		return nil, ErrNotFile
+	}
+	if !exists && flags&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if exists && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+	// Objects can only be replaced, not updated.
+	if exists && flags&os.O_TRUNC == 0 {
+		return nil, vfs.ErrUnsupported
+	}
+	if !exists {
+		err = fs.checkParent(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &File{
+		fs:             fs,
+		fpath:          p,
+		bucket:         bucket,
+		key:            key,
+		openForWriting: true,
+	}, nil
+}
+
+func (fs *Fs) Mkdir(p string, mode os.FileMode) error {
+	bucket, key := splitPath(p)
+	if bucket == "" {
+		return os.ErrExist
+	}
+	if key == "" {
+		_, err := fs.project.CreateBucket(fs.ctx, bucket)
+		return fixErr(err)
+	}
+	_, err := fs.stat(p)
+	if err == nil {
+		return os.ErrExist
+	}
+	if err != os.ErrNotExist {
+		return err
+	}
+	err = fs.checkParent(p)
+	if err != nil {
+		return err
+	}
+	upload, err := fs.project.UploadObject(fs.ctx, bucket, key+"/", nil)
+	if err != nil {
+		return fixErr(err)
+	}
+	return fixErr(upload.Commit())
+}
+
+func (fs *Fs) Rename(from, to string) error {
+	fromBucket, fromKey := splitPath(from)
+	toBucket, toKey := splitPath(to)
+	if fromKey == "" || toKey == "" {
+		// Buckets cannot be renamed.
+		return vfs.ErrUnsupported
+	}
+	fi, err := fs.stat(from)
+	if err != nil {
+		return err
+	}
+	// An existing target file is replaced, like a local rename.
+	toFi, err := fs.stat(to)
+	if err == nil {
+		if toFi.IsDir() {
+			return os.ErrExist
+		}
+		_, err = fs.project.DeleteObject(fs.ctx, toBucket, toKey)
+		if err != nil {
+			return fixErr(err)
+		}
+	} else if err != os.ErrNotExist {
+		return err
+	} else {
+		err = fs.checkParent(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !fi.IsDir() {
+		return fixErr(fs.project.MoveObject(fs.ctx, fromBucket, fromKey, toBucket, toKey, nil))
+	}
+	// Directories are moved one object at a time.
+	it := fs.project.ListObjects(fs.ctx, fromBucket, &uplink.ListObjectsOptions{Prefix: fromKey + "/", Recursive: true})
+	for it.Next() {
+		key := it.Item().Key
+		err = fs.project.MoveObject(fs.ctx, fromBucket, key, toBucket, toKey+key[len(fromKey):], nil)
+		if err != nil {
+			return fixErr(err)
+		}
+	}
+	return fixErr(it.Err())
+}
+
+func (fs *Fs) Remove(p string) error {
+	bucket, key := splitPath(p)
+	if bucket == "" {
+		return os.ErrPermission
+	}
+	if key == "" {
+		_, err := fs.project.DeleteBucket(fs.ctx, bucket)
+		return fixErr(err)
+	}
+	fi, err := fs.stat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		_, err = fs.project.DeleteObject(fs.ctx, bucket, key)
+		return fixErr(err)
+	}
+	// Only the marker of an empty directory may remain.
+	it := fs.project.ListObjects(fs.ctx, bucket, &uplink.ListObjectsOptions{Prefix: key + "/"})
+	for it.Next() {
+		if it.Item().Key != key+"/" {
+			return ErrNotEmpty
+		}
+	}
+	if it.Err() != nil {
+		return fixErr(it.Err())
+	}
+	_, err = fs.project.DeleteObject(fs.ctx, bucket, key+"/")
+	return fixErr(err)
+}
+
+func (fs *Fs) Link(oldname, newname string) error {
+	return vfs.ErrUnsupported
+}
+
+func (fs *Fs) Close() error {
+	err := fs.project.Close()
+	fs.cancel()
+	return err
+}
+
+type File struct {
+	fs *Fs
+
+	fpath  string
+	bucket string
+	key    string
+	isDir  bool
+	size   int64
+
+	// Listings are read from the iterators as the
+	// client reads, entries not yet consumed are buffered.
+	buckets *uplink.BucketIterator
+	objects *uplink.ObjectIterator
+	dirEnts []os.FileInfo
+	dirEOF  bool
+
+	openForReading bool
+	openForWriting bool
+
+	readOffset int64
+	download   *uplink.Download
+
+	writeOffset int64
+	writeErr    error
+	uploadID    string
+	partNumber  uint32
+	part        *uplink.PartUpload
+	partWritten int64
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return nil
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.fs.Stat(f.fpath)
+}
+
+// The next entry of the listing, or nil at the end.
+func (f *File) nextDirEnt() (os.FileInfo, error) {
+	if f.bucket == "" {
+		if f.buckets == nil {
+			f.buckets = f.fs.project.ListBuckets(f.fs.ctx, nil)
+		}
+		if !f.buckets.Next() {
+			return nil, fixErr(f.buckets.Err())
+		}
+		b := f.buckets.Item()
+		return &FileInfo{name: b.Name, isDir: true, modTime: b.Created}, nil
+	}
+
+	prefix := ""
+	if f.key != "" {
+		prefix = f.key + "/"
+	}
+	if f.objects == nil {
+		f.objects = f.fs.project.ListObjects(f.fs.ctx, f.bucket, &uplink.ListObjectsOptions{Prefix: prefix, System: true})
+	}
+	for f.objects.Next() {
+		obj := f.objects.Item()
+		name := strings.TrimSuffix(obj.Key[len(prefix):], "/")
+		// The marker of the directory being listed.
+		if name == "" {
+			continue
+		}
+		if obj.IsPrefix {
+			return &FileInfo{name: name, isDir: true}, nil
+		}
+		return &FileInfo{name: name, size: obj.System.ContentLength, modTime: obj.System.Created}, nil
+	}
+	return nil, fixErr(f.objects.Err())
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.isDir {
+		return nil, ErrNotDir
+	}
+	if !f.openForReading {
+		return nil, ErrNotOpen
+	}
+
+	for !f.dirEOF && (n <= 0 || len(f.dirEnts) < n) {
+		fi, err := f.nextDirEnt()
+		if err != nil {
+			return nil, err
+		}
+		if fi == nil {
+			f.dirEOF = true
+			break
+		}
+		f.dirEnts = append(f.dirEnts, fi)
+	}
+
+	if n <= 0 {
+		fis := f.dirEnts
+		f.dirEnts = nil
+		return fis, nil
+	}
+	if len(f.dirEnts) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirEnts) {
+		n = len(f.dirEnts)
+	}
+	fis := f.dirEnts[:n]
+	f.dirEnts = f.dirEnts[n:]
+	return fis, nil
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrNotFile
+	}
+	if !f.openForReading {
+		return 0, ErrNotOpen
+	}
+	if off < 0 {
+		return 0, ErrBadReadWriteOffset
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	// Reuse the current download for sequential reads.
+	if f.download == nil || off != f.readOffset {
+		if f.download != nil {
+			_ = f.download.Close()
+			f.download = nil
+		}
+		d, err := f.fs.project.DownloadObject(f.fs.ctx, f.bucket, f.key, &uplink.DownloadOptions{Offset: off, Length: -1})
+		if err != nil {
+			return 0, fixErr(err)
+		}
+		f.download = d
+		f.readOffset = off
+	}
+
+	n, err := io.ReadFull(f.download, b)
+	f.readOffset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, fixErr(err)
+}
+
+func (f *File) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.readOffset)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Start the next part of the upload, starting the upload if needed.
+func (f *File) nextPart() error {
+	if f.uploadID == "" {
+		info, err := f.fs.project.BeginUpload(f.fs.ctx, f.bucket, f.key, nil)
+		if err != nil {
+			return fixErr(err)
+		}
+		f.uploadID = info.UploadID
+	}
+	f.partNumber++
+	part, err := f.fs.project.UploadPart(f.fs.ctx, f.bucket, f.key, f.uploadID, f.partNumber)
+	if err != nil {
+		return fixErr(err)
+	}
+	f.part = part
+	f.partWritten = 0
+	return nil
+}
+
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, ErrNotFile
+	}
+	if !f.openForWriting {
+		return 0, ErrNotOpen
+	}
+	if f.writeErr != nil {
+		return 0, f.writeErr
+	}
+	if off != f.writeOffset {
+		return 0, ErrBadReadWriteOffset
+	}
+
+	nwritten := 0
+	for len(b) != 0 {
+		if f.part == nil {
+			err := f.nextPart()
+			if err != nil {
+				f.writeErr = err
+				return nwritten, err
+			}
+		}
+		chunk := b
+		if remaining := partSize - f.partWritten; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := f.part.Write(chunk)
+		nwritten += n
+		f.writeOffset += int64(n)
+		f.partWritten += int64(n)
+		b = b[n:]
+		if err == nil && f.partWritten == partSize {
+			err = f.part.Commit()
+			f.part = nil
+		}
+		if err != nil {
+			f.writeErr = fixErr(err)
+			return nwritten, f.writeErr
+		}
+	}
+	return nwritten, nil
+}
+
+func (f *File) Write(b []byte) (int, error) {
+	return f.WriteAt(b, f.writeOffset)
+}
+
+func (f *File) Sync() error {
+	// Uploads are only committed to storj when
+	// the multipart upload is finished on Close.
+	if f.uploadID != "" {
+		return vfs.ErrUnsupported
+	}
+	return nil
+}
+
+// Commit the written data, replacing any existing object.
+func (f *File) commit() error {
+	if f.writeErr != nil {
+		return f.writeErr
+	}
+	if f.uploadID == "" {
+		// Nothing was written, upload an empty object.
+		upload, err := f.fs.project.UploadObject(f.fs.ctx, f.bucket, f.key, nil)
+		if err != nil {
+			return fixErr(err)
+		}
+		return fixErr(upload.Commit())
+	}
+	if f.part != nil {
+		err := f.part.Commit()
+		f.part = nil
+		if err != nil {
+			return fixErr(err)
+		}
+	}
+	_, err := f.fs.project.CommitUpload(f.fs.ctx, f.bucket, f.key, f.uploadID, nil)
+	return fixErr(err)
+}
+
+func (f *File) Close() error {
+	if f.download != nil {
+		_ = f.download.Close()
+		f.download = nil
+	}
+	if !f.openForWriting {
+		f.openForReading = false
+		return nil
+	}
+	f.openForWriting = false
+
+	err := f.commit()
+	if err != nil && f.uploadID != "" {
+		if f.part != nil {
+			_ = f.part.Abort()
+			f.part = nil
+		}
+		_ = f.fs.project.AbortUpload(f.fs.ctx, f.bucket, f.key, f.uploadID)
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package storjfs
+
+import (
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	for _, tc := range []struct {
+		p      string
+		bucket string
+		key    string
+	}{
+		{"/", "", ""},
+		{"", "", ""},
+		{"/b", "b", ""},
+		{"/b/", "b", ""},
+		{"/b/k", "b", "k"},
+		{"b/d/k", "b", "d/k"},
+		{"/b/d/../k", "b", "k"},
+	} {
+		bucket, key := splitPath(tc.p)
+		if bucket != tc.bucket || key != tc.key {
+			t.Fatalf("%q split into %q %q, expected %q %q", tc.p, bucket, key, tc.bucket, tc.key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// The most symbolic links followed resolving one path, as on Linux.
+const MaxSymlinks = 40
+
+// Resolve the symbolic links in p for a RealPath method, as if it were
+// absolute. Like realpath(3) links are followed before "..", not after
+// cleaning p. readlink returns the target of the link at a path, false
+// if it is not a link. Once a path does not exist the rest of p is joined
+// to it as it is. Following more than MaxSymlinks links fails with an
+// error wrapping syscall.ELOOP.
+func ResolveSymlinks(p string, readlink func(p string) (string, bool, error)) (string, error) {
+	resolved := "/"
+	rest := p
+	links := 0
+	for rest != "" {
+		var name string
+		if i := strings.IndexByte(rest, '/'); i != -1 {
+			name, rest = rest[:i], rest[i+1:]
+		} else {
+			name, rest = rest, ""
+		}
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, name)
+		target, ok, err := readlink(next)
+		if errors.Is(err, os.ErrNotExist) {
+			return path.Join(next, rest), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			resolved = next
+			continue
+		}
+		links++
+		if links > MaxSymlinks {
+			return "", &os.PathError{Op: "realpath", Path: p, Err: syscall.ELOOP}
+		}
+		// Targets are relative to the directory of the link, and
+		// not cleaned before they are walked, ".." follows links.
+		if strings.HasPrefix(target, "/") {
+			resolved = "/"
+		}
+		rest = strings.TrimPrefix(target, "/") + "/" + rest
+	}
+	return resolved, nil
+}
@@ -0,0 +1,70 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestResolveSymlinks(t *testing.T) {
+	links := map[string]string{
+		"/a/link":     "../b",
+		"/abs":        "/a/link/c",
+		"/b/up":       "..",
+		"/loop1":      "loop2",
+		"/loop2":      "/loop1",
+		"/a/dotdot":   "link/..",
+		"/b/selfloop": "./selfloop/x",
+	}
+	exists := map[string]bool{"/a": true, "/b": true, "/b/c": true}
+	readlink := func(p string) (string, bool, error) {
+		if target, ok := links[p]; ok {
+			return target, true, nil
+		}
+		if !exists[p] {
+			return "", false, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+		}
+		return "", false, nil
+	}
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/", "/"},
+		{"a", "/a"},
+		{"/a/link", "/b"},
+		{"/a/link/c", "/b/c"},
+		{"/abs", "/b/c"},
+		{"/abs/new/file", "/b/c/new/file"},
+		{"/b/up/a/link", "/b"},
+		// Links are followed before "..".
+		{"/a/dotdot", "/"},
+		{"/a/link/../a", "/a"},
+		{"/missing/x/../y", "/missing/y"},
+	} {
+		real, err := ResolveSymlinks(tc.path, readlink)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if real != tc.expected {
+			t.Fatalf("%s: expected %s, got %s", tc.path, tc.expected, real)
+		}
+	}
+
+	for _, p := range []string{"/loop1", "/loop1/x", "/b/selfloop"} {
+		_, err := ResolveSymlinks(p, readlink)
+		if !errors.Is(err, syscall.ELOOP) {
+			t.Fatalf("%s: expected a link loop, got %v", p, err)
+		}
+	}
+
+	errFailed := errors.New("failed")
+	_, err := ResolveSymlinks("/a/b", func(p string) (string, bool, error) {
+		return "", false, errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("expected the readlink error, got %v", err)
+	}
+}
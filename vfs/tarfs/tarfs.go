@@ -0,0 +1,389 @@
+// Package tarfs is a read only vfs engine exposing the contents of a tar
+// archive, 'tar:/path/to/archive.tar.gz'. Archives may be uncompressed,
+// gzip or zstd compressed, zstd needs the zstd command to be installed.
+//
+// Compressed archives are decompressed to a temporary file when the file
+// system is opened, then every archive is indexed so reads do not need
+// to scan the archive.
+package tarfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+)
+
+var (
+	ErrNotFile = errors.New("not a file")
+	ErrNotDir  = errors.New("not a directory")
+)
+
+func init() {
+	vfs.RegisterEngine("tar", vfsFactory)
+}
+
+func vfsFactory(archive string) (vfs.VFS, error) {
+	if archive == "" {
+		return nil, errors.New("tar vfs expects the path of an archive")
+	}
+	return Open(archive)
+}
+
+type entry struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	size    int64
+	// Offset of the contents in the uncompressed archive.
+	offset   int64
+	children []string
+}
+
+func (e *entry) Name() string       { return e.name }
+func (e *entry) Size() int64        { return e.size }
+func (e *entry) Mode() os.FileMode  { return e.mode }
+func (e *entry) ModTime() time.Time { return e.modTime }
+func (e *entry) IsDir() bool        { return e.mode.IsDir() }
+func (e *entry) Sys() interface{}   { return nil }
+
+type Fs struct {
+	// The uncompressed archive.
+	archive *os.File
+	entries map[string]*entry
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Open and index the archive at archivePath.
+func Open(archivePath string) (*Fs, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		_ = f.Close()
+		return nil, err
+	}
+	magic = magic[:n]
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	archive := f
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		archive, err = decompressGzip(f)
+		_ = f.Close()
+	case bytes.HasPrefix(magic, zstdMagic):
+		archive, err = decompressZstd(f)
+		_ = f.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress %s: %s", archivePath, err)
+	}
+
+	fs := &Fs{
+		archive: archive,
+		entries: make(map[string]*entry),
+	}
+	err = fs.index()
+	if err != nil {
+		_ = archive.Close()
+		return nil, fmt.Errorf("unable to index %s: %s", archivePath, err)
+	}
+	return fs, nil
+}
+
+// A temporary file only reachable through the returned handle.
+func tempFile() (*os.File, error) {
+	f, err := ioutil.TempFile("", "sftpplease-tar")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(f.Name())
+	return f, nil
+}
+
+func decompressGzip(r io.Reader) (*os.File, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	out, err := tempFile()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(out, gz)
+	if err != nil {
+		_ = out.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+func decompressZstd(r io.Reader) (*os.File, error) {
+	out, err := tempFile()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("zstd", "-d", "-c", "-q")
+	cmd.Stdin = r
+	cmd.Stdout = out
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		_ = out.Close()
+		return nil, fmt.Errorf("zstd: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (fs *Fs) dir(p string) *entry {
+	if e, ok := fs.entries[p]; ok {
+		return e
+	}
+	e := &entry{name: path.Base(p), mode: os.ModeDir | 0755}
+	fs.entries[p] = e
+	if p != "/" {
+		parent := fs.dir(path.Dir(p))
+		parent.children = append(parent.children, e.name)
+	}
+	return e
+}
+
+func (fs *Fs) index() error {
+	_, err := fs.archive.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	fs.dir("/")
+	links := make(map[string]string)
+
+	tr := tar.NewReader(fs.archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		p := path.Clean("/" + hdr.Name)
+		if p == "/" {
+			continue
+		}
+
+		var e *entry
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e = fs.dir(p)
+		case tar.TypeReg, tar.TypeRegA, tar.TypeSymlink, tar.TypeLink:
+			// Entries appearing again replace earlier ones.
+			e = fs.entries[p]
+			if e == nil || e.IsDir() {
+				parent := fs.dir(path.Dir(p))
+				if e == nil {
+					parent.children = append(parent.children, path.Base(p))
+				}
+				e = &entry{name: path.Base(p)}
+				fs.entries[p] = e
+			}
+		default:
+			// Devices, fifos and sparse files are not exposed.
+			continue
+		}
+
+		info := hdr.FileInfo()
+		e.mode = info.Mode()
+		e.modTime = hdr.ModTime
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// tar.Reader seeks past file contents, so
+			// the contents start at the current offset.
+			e.offset, err = fs.archive.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			e.size = hdr.Size
+		case tar.TypeSymlink:
+			e.size = int64(len(hdr.Linkname))
+		case tar.TypeLink:
+			links[p] = path.Clean("/" + hdr.Linkname)
+		}
+	}
+
+	for p, target := range links {
+		t, ok := fs.entries[target]
+		if !ok || !t.mode.IsRegular() {
+			continue
+		}
+		e := fs.entries[p]
+		e.mode = t.mode
+		e.offset = t.offset
+		e.size = t.size
+	}
+
+	for _, e := range fs.entries {
+		sort.Strings(e.children)
+	}
+	return nil
+}
+
+func (fs *Fs) lookup(p string) (*entry, error) {
+	e, ok := fs.entries[path.Clean("/"+p)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return e, nil
+}
+
+func (fs *Fs) Chmod(p string, mode os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *Fs) Open(p string) (vfs.File, error) {
+	p = path.Clean("/" + p)
+	e, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return &File{fs: fs, fpath: p, e: e}, nil
+}
+
+func (fs *Fs) OpenFile(p string, flags int, perm os.FileMode) (vfs.File, error) {
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+	return fs.Open(p)
+}
+
+func (fs *Fs) Mkdir(p string, mode os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *Fs) Stat(p string) (os.FileInfo, error) {
+	return fs.lookup(p)
+}
+
+func (fs *Fs) Rename(from, to string) error {
+	return os.ErrPermission
+}
+
+func (fs *Fs) Remove(p string) error {
+	return os.ErrPermission
+}
+
+func (fs *Fs) Link(oldname, newname string) error {
+	return os.ErrPermission
+}
+
+func (fs *Fs) Close() error {
+	return fs.archive.Close()
+}
+
+type File struct {
+	fs     *Fs
+	fpath  string
+	e      *entry
+	offset int64
+	// Index of the next directory entry returned by Readdir.
+	dirOffset int
+}
+
+func (f *File) Name() string {
+	return f.fpath
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.e, nil
+}
+
+func (f *File) ReadAt(buf []byte, offset int64) (int, error) {
+	if !f.e.mode.IsRegular() {
+		return 0, ErrNotFile
+	}
+	return io.NewSectionReader(f.fs.archive, f.e.offset, f.e.size).ReadAt(buf, offset)
+}
+
+func (f *File) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) Write(buf []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *File) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.e.IsDir() {
+		return nil, ErrNotDir
+	}
+	names := f.e.children[f.dirOffset:]
+	if n > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(names) {
+			names = names[:n]
+		}
+	}
+	f.dirOffset += len(names)
+	fis := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		fis = append(fis, f.fs.entries[path.Join(f.fpath, name)])
+	}
+	return fis, nil
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *File) Sync() error {
+	return nil
+}
+
+func (f *File) Close() error {
+	return nil
+}
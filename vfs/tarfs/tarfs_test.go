@@ -0,0 +1,182 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func makeArchive(t *testing.T) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	add := func(hdr *tar.Header, data string) {
+		hdr.ModTime = time.Unix(1000, 0)
+		hdr.Size = int64(len(data))
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755}, "")
+	add(&tar.Header{Name: "d/b.txt", Typeflag: tar.TypeReg, Mode: 0644}, "bbbb")
+	add(&tar.Header{Name: "d/a.txt", Typeflag: tar.TypeReg, Mode: 0600}, "hello world")
+	// Parent directories may be implicit.
+	add(&tar.Header{Name: "x/y/z.txt", Typeflag: tar.TypeReg, Mode: 0644}, "zzz")
+	add(&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "d/a.txt"}, "")
+	// Later entries replace earlier ones.
+	add(&tar.Header{Name: "d/b.txt", Typeflag: tar.TypeReg, Mode: 0644}, "replaced")
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeTemp(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	err := ioutil.WriteFile(p, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func readFile(t *testing.T, fs *Fs, p string) string {
+	t.Helper()
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func checkArchive(t *testing.T, archivePath string) {
+	t.Helper()
+	fs, err := Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	if got := readFile(t, fs, "/d/a.txt"); got != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+	if got := readFile(t, fs, "/d/b.txt"); got != "replaced" {
+		t.Fatalf("got %q", got)
+	}
+	if got := readFile(t, fs, "/x/y/z.txt"); got != "zzz" {
+		t.Fatalf("got %q", got)
+	}
+	if got := readFile(t, fs, "/hard"); got != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+
+	fi, err := fs.Stat("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 11 || fi.Mode() != 0600 || !fi.ModTime().Equal(time.Unix(1000, 0)) {
+		t.Fatalf("bad stat %d %s %s", fi.Size(), fi.Mode(), fi.ModTime())
+	}
+
+	f, err := fs.Open("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	n, err := f.ReadAt(buf, 6)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("ReadAt: %q %v", buf[:n], err)
+	}
+
+	d, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"d", "hard", "x"}) {
+		t.Fatalf("bad listing %v", names)
+	}
+	_, err = d.Readdirnames(1)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	_, err = fs.Stat("/missing")
+	if err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	_, err = fs.OpenFile("/new", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+}
+
+func TestTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkArchive(t, writeTemp(t, dir, "a.tar", makeArchive(t)))
+}
+
+func TestTarGz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	_, err = gz.Write(makeArchive(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(t, writeTemp(t, dir, "a.tgz", buf.Bytes()))
+}
+
+func TestTarZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not installed")
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := writeTemp(t, dir, "a.tar", makeArchive(t))
+	err = exec.Command("zstd", "-q", p, "-o", p+".zst").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(t, p+".zst")
+}
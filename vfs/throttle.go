@@ -0,0 +1,261 @@
+package vfs
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// ThrottleVFS limits the calls made to Fs to an average of OpsPerSecond,
+// with bursts of up to a second of calls, and to at most MaxConcurrent
+// calls in progress at once. Calls on open files count too. A zero
+// limit disables that limit.
+type ThrottleVFS struct {
+	Fs            VFS
+	OpsPerSecond  float64
+	MaxConcurrent int
+
+	parent   *ThrottleVFS
+	initOnce sync.Once
+	inFlight chan struct{}
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// The wrapper a view made by WithContext came from, whose state
+// the view shares.
+func (t *ThrottleVFS) root() *ThrottleVFS {
+	if t.parent != nil {
+		return t.parent
+	}
+	return t
+}
+
+func (t *ThrottleVFS) init() {
+	if t.MaxConcurrent > 0 {
+		t.inFlight = make(chan struct{}, t.MaxConcurrent)
+	}
+	t.tokens = t.OpsPerSecond
+	t.last = time.Now()
+}
+
+// Wait until a call may be made, the returned
+// function must be called once it is done.
+func (t *ThrottleVFS) begin() func() {
+	t = t.root()
+	t.initOnce.Do(t.init)
+
+	if t.OpsPerSecond > 0 {
+		t.lock.Lock()
+		now := time.Now()
+		t.tokens += now.Sub(t.last).Seconds() * t.OpsPerSecond
+		if t.tokens > t.OpsPerSecond {
+			t.tokens = t.OpsPerSecond
+		}
+		t.last = now
+		// The tokens may go negative, reserving them
+		// for this caller while it sleeps.
+		t.tokens -= 1
+		deficit := -t.tokens
+		t.lock.Unlock()
+
+		if deficit > 0 {
+			time.Sleep(time.Duration(deficit / t.OpsPerSecond * float64(time.Second)))
+		}
+	}
+
+	if t.inFlight == nil {
+		return func() {}
+	}
+	t.inFlight <- struct{}{}
+	return func() { <-t.inFlight }
+}
+
+func (t *ThrottleVFS) wrapFile(f File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &ThrottleFile{File: f, t: t}, nil
+}
+
+func (t *ThrottleVFS) Chmod(name string, mode os.FileMode) error {
+	defer t.begin()()
+	return t.Fs.Chmod(name, mode)
+}
+
+func (t *ThrottleVFS) Open(path string) (File, error) {
+	defer t.begin()()
+	return t.wrapFile(t.Fs.Open(path))
+}
+
+func (t *ThrottleVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	defer t.begin()()
+	return t.wrapFile(t.Fs.OpenFile(name, flag, perm))
+}
+
+func (t *ThrottleVFS) Mkdir(path string, perm os.FileMode) error {
+	defer t.begin()()
+	return t.Fs.Mkdir(path, perm)
+}
+
+func (t *ThrottleVFS) Stat(path string) (os.FileInfo, error) {
+	defer t.begin()()
+	return t.Fs.Stat(path)
+}
+
+func (t *ThrottleVFS) Rename(from, to string) error {
+	defer t.begin()()
+	return t.Fs.Rename(from, to)
+}
+
+func (t *ThrottleVFS) Remove(path string) error {
+	defer t.begin()()
+	return t.Fs.Remove(path)
+}
+
+func (t *ThrottleVFS) Link(oldname, newname string) error {
+	defer t.begin()()
+	return t.Fs.Link(oldname, newname)
+}
+
+func (t *ThrottleVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := t.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	defer t.begin()()
+	return cs.Checksum(path, algorithm)
+}
+
+func (t *ThrottleVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(t.Fs)
+}
+
+func (t *ThrottleVFS) RealPath(p string) (string, error) {
+	defer t.begin()()
+	return RealPath(t.Fs, p)
+}
+
+func (t *ThrottleVFS) AppendSupported() bool {
+	return AppendSupported(t.Fs)
+}
+
+func (t *ThrottleVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	ct, ok := t.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	defer t.begin()()
+	return ct.Chtimes(path, atime, mtime)
+}
+
+// Batches count as one call, backends without
+// them are called once per path as usual.
+func (t *ThrottleVFS) RemoveBatch(paths []string) error {
+	if _, ok := t.Fs.(Batcher); !ok {
+		for _, p := range paths {
+			err := t.Remove(p)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer t.begin()()
+	return RemoveBatch(t.Fs, paths)
+}
+
+func (t *ThrottleVFS) RenameBatch(renames []Rename) error {
+	if _, ok := t.Fs.(Batcher); !ok {
+		for _, r := range renames {
+			err := t.Rename(r.From, r.To)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer t.begin()()
+	return RenameBatch(t.Fs, renames)
+}
+
+func (t *ThrottleVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := t.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (t *ThrottleVFS) WithContext(ctx context.Context) VFS {
+	return &ThrottleVFS{
+		Fs:            WithContext(t.Fs, ctx),
+		OpsPerSecond:  t.OpsPerSecond,
+		MaxConcurrent: t.MaxConcurrent,
+		parent:        t.root(),
+	}
+}
+
+func (t *ThrottleVFS) Close() error {
+	return t.Fs.Close()
+}
+
+// ThrottleFile applies the limits of its ThrottleVFS
+// to calls on an open file.
+type ThrottleFile struct {
+	File
+	t *ThrottleVFS
+}
+
+func (tf *ThrottleFile) Chmod(mode os.FileMode) error {
+	defer tf.t.begin()()
+	return tf.File.Chmod(mode)
+}
+
+func (tf *ThrottleFile) Read(buf []byte) (int, error) {
+	defer tf.t.begin()()
+	return tf.File.Read(buf)
+}
+
+func (tf *ThrottleFile) ReadAt(buf []byte, off int64) (int, error) {
+	defer tf.t.begin()()
+	return tf.File.ReadAt(buf, off)
+}
+
+func (tf *ThrottleFile) Readdir(n int) ([]os.FileInfo, error) {
+	defer tf.t.begin()()
+	return tf.File.Readdir(n)
+}
+
+func (tf *ThrottleFile) Readdirnames(n int) ([]string, error) {
+	defer tf.t.begin()()
+	return tf.File.Readdirnames(n)
+}
+
+func (tf *ThrottleFile) Write(buf []byte) (int, error) {
+	defer tf.t.begin()()
+	return tf.File.Write(buf)
+}
+
+func (tf *ThrottleFile) WriteAt(buf []byte, off int64) (int, error) {
+	defer tf.t.begin()()
+	return tf.File.WriteAt(buf, off)
+}
+
+func (tf *ThrottleFile) Stat() (os.FileInfo, error) {
+	defer tf.t.begin()()
+	return tf.File.Stat()
+}
+
+func (tf *ThrottleFile) Sync() error {
+	defer tf.t.begin()()
+	return tf.File.Sync()
+}
+
+func (tf *ThrottleFile) Close() error {
+	defer tf.t.begin()()
+	return tf.File.Close()
+}
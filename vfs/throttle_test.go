@@ -0,0 +1,62 @@
+package vfs_test
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestThrottleVFSRate(t *testing.T) {
+	fs := &vfs.ThrottleVFS{Fs: mem.New(), OpsPerSecond: 100}
+	start := time.Now()
+	// 100 calls are a burst, the next 10 must wait 100ms.
+	for i := 0; i < 110; i++ {
+		_, _ = fs.Stat("/")
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("110 calls took %s", elapsed)
+	}
+}
+
+// Tracks the most calls to Stat in progress at once.
+type concurrencyVFS struct {
+	vfs.VFS
+	lock     sync.Mutex
+	current  int
+	greatest int
+}
+
+func (c *concurrencyVFS) Stat(p string) (os.FileInfo, error) {
+	c.lock.Lock()
+	c.current++
+	if c.current > c.greatest {
+		c.greatest = c.current
+	}
+	c.lock.Unlock()
+	time.Sleep(time.Millisecond)
+	c.lock.Lock()
+	c.current--
+	c.lock.Unlock()
+	return c.VFS.Stat(p)
+}
+
+func TestThrottleVFSConcurrency(t *testing.T) {
+	backend := &concurrencyVFS{VFS: mem.New()}
+	fs := &vfs.ThrottleVFS{Fs: backend, MaxConcurrent: 2}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = fs.Stat("/")
+		}()
+	}
+	wg.Wait()
+	if backend.greatest > 2 {
+		t.Fatalf("%d calls were in progress at once", backend.greatest)
+	}
+}
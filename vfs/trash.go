@@ -0,0 +1,277 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrashVFS moves removed files into the directory Dir instead of deleting
+// them, as it does files replaced by renaming another file over them.
+// Files are renamed to their base name followed by the time they were
+// removed, with a counter added if that name is taken. Directories are
+// deleted, they can only be removed when empty.
+//
+// Clients can read Dir and rename files out of it to restore them, but
+// anything else changing or removing files inside it fails with
+// os.ErrPermission.
+//
+// If Retention is set, files that have been in Dir for longer are
+// deleted, checked at most once an hour when files are removed.
+type TrashVFS struct {
+	Fs        VFS
+	Dir       string
+	Retention time.Duration
+
+	parent     *TrashVFS
+	lock       sync.Mutex
+	lastPurged time.Time
+}
+
+// The wrapper a view made by WithContext came from, whose state
+// the view shares.
+func (t *TrashVFS) root() *TrashVFS {
+	if t.parent != nil {
+		return t.parent
+	}
+	return t
+}
+
+const trashTimeFormat = "20060102T150405Z"
+
+func (t *TrashVFS) inTrash(p string) bool {
+	dir := path.Clean("/" + t.Dir)
+	p = path.Clean("/" + p)
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+func (t *TrashVFS) Chmod(name string, mode os.FileMode) error {
+	if t.inTrash(name) {
+		return os.ErrPermission
+	}
+	return t.Fs.Chmod(name, mode)
+}
+
+func (t *TrashVFS) Open(path string) (File, error) {
+	return t.Fs.Open(path)
+}
+
+func (t *TrashVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC|os.O_CREATE) != 0 && t.inTrash(name) {
+		return nil, os.ErrPermission
+	}
+	return t.Fs.OpenFile(name, flag, perm)
+}
+
+func (t *TrashVFS) Mkdir(path string, perm os.FileMode) error {
+	if t.inTrash(path) {
+		return os.ErrPermission
+	}
+	return t.Fs.Mkdir(path, perm)
+}
+
+func (t *TrashVFS) Stat(path string) (os.FileInfo, error) {
+	return t.Fs.Stat(path)
+}
+
+func (t *TrashVFS) Rename(from, to string) error {
+	if t.inTrash(to) || path.Clean("/"+from) == path.Clean("/"+t.Dir) {
+		return os.ErrPermission
+	}
+	// Keep the file being replaced, backends may replace existing
+	// files when renaming.
+	fi, err := t.Fs.Stat(to)
+	if err == nil && !fi.IsDir() && path.Clean("/"+from) != path.Clean("/"+to) {
+		_, err = t.Fs.Stat(from)
+		if err != nil {
+			return err
+		}
+		err = t.moveToTrash(to)
+		if err != nil {
+			return err
+		}
+	}
+	return t.Fs.Rename(from, to)
+}
+
+func (t *TrashVFS) Remove(p string) error {
+	if t.inTrash(p) {
+		return os.ErrPermission
+	}
+	fi, err := t.Fs.Stat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return t.Fs.Remove(p)
+	}
+	return t.moveToTrash(p)
+}
+
+// Move the file p into Dir.
+func (t *TrashVFS) moveToTrash(p string) error {
+	dir := path.Clean("/" + t.Dir)
+	err := t.Fs.Mkdir(dir, 0700)
+	if err != nil {
+		if st, serr := t.Fs.Stat(dir); serr != nil || !st.IsDir() {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	base := path.Base(path.Clean("/"+p)) + "." + now.Format(trashTimeFormat)
+	for i := 0; ; i++ {
+		name := base
+		if i != 0 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		target := path.Join(dir, name)
+		// Backends may replace existing files when renaming.
+		_, err = t.Fs.Stat(target)
+		if err == nil {
+			continue
+		}
+		err = t.Fs.Rename(p, target)
+		break
+	}
+	if err != nil {
+		return err
+	}
+
+	t.purge(now)
+	return nil
+}
+
+// Parse the time a file was moved to the trash from its name.
+func trashedAt(name string) (time.Time, bool) {
+	if idx := strings.LastIndex(name, "-"); idx != -1 && idx > strings.LastIndex(name, ".") {
+		name = name[:idx]
+	}
+	idx := strings.LastIndex(name, ".")
+	if idx == -1 {
+		return time.Time{}, false
+	}
+	at, err := time.Parse(trashTimeFormat, name[idx+1:])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// Delete files kept longer than Retention.
+func (t *TrashVFS) purge(now time.Time) {
+	t = t.root()
+	if t.Retention <= 0 {
+		return
+	}
+	t.lock.Lock()
+	if now.Sub(t.lastPurged) < time.Hour {
+		t.lock.Unlock()
+		return
+	}
+	t.lastPurged = now
+	t.lock.Unlock()
+
+	dir := path.Clean("/" + t.Dir)
+	d, err := t.Fs.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		at, ok := trashedAt(name)
+		if ok && now.Sub(at) > t.Retention {
+			_ = t.Fs.Remove(path.Join(dir, name))
+		}
+	}
+}
+
+func (t *TrashVFS) Link(oldname, newname string) error {
+	if t.inTrash(newname) {
+		return os.ErrPermission
+	}
+	return t.Fs.Link(oldname, newname)
+}
+
+func (t *TrashVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := t.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return cs.Checksum(path, algorithm)
+}
+
+func (t *TrashVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(t.Fs)
+}
+
+func (t *TrashVFS) RealPath(p string) (string, error) {
+	return RealPath(t.Fs, p)
+}
+
+func (t *TrashVFS) AppendSupported() bool {
+	return AppendSupported(t.Fs)
+}
+
+func (t *TrashVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	if t.inTrash(path) {
+		return os.ErrPermission
+	}
+	ct, ok := t.Fs.(Chtimeser)
+	if !ok {
+		return ErrUnsupported
+	}
+	return ct.Chtimes(path, atime, mtime)
+}
+
+// Removed files are moved to the trash one at a time.
+func (t *TrashVFS) RemoveBatch(paths []string) error {
+	for _, p := range paths {
+		err := t.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaced files are moved to the trash, so renames are made one at
+// a time.
+func (t *TrashVFS) RenameBatch(renames []Rename) error {
+	for _, r := range renames {
+		err := t.Rename(r.From, r.To)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TrashVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := t.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (t *TrashVFS) WithContext(ctx context.Context) VFS {
+	return &TrashVFS{
+		Fs:        WithContext(t.Fs, ctx),
+		Dir:       t.Dir,
+		Retention: t.Retention,
+		parent:    t.root(),
+	}
+}
+
+func (t *TrashVFS) Close() error {
+	return t.Fs.Close()
+}
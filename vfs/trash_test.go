@@ -0,0 +1,157 @@
+package vfs_test
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func listDir(t *testing.T, fs vfs.VFS, p string) []string {
+	d, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestTrashVFS(t *testing.T) {
+	backend := mem.New()
+	fs := &vfs.TrashVFS{Fs: backend, Dir: "/.trash", Retention: time.Hour}
+
+	err := backend.Mkdir("/.trash", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Purged once past the retention period.
+	writeAll(t, backend, "/.trash/old.19990101T000000Z", []byte("old"))
+
+	for i := 0; i < 2; i++ {
+		writeAll(t, fs, "/a.txt", []byte("hello"))
+		err = fs.Remove("/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Stat("/a.txt"); err == nil {
+		t.Fatal("removed file still exists")
+	}
+
+	names := listDir(t, fs, "/.trash")
+	if len(names) != 2 {
+		t.Fatalf("unexpected trash contents %v", names)
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "a.txt.") {
+			t.Fatalf("unexpected trash contents %v", names)
+		}
+		if got := readAll(t, fs, "/.trash/"+name); string(got) != "hello" {
+			t.Fatalf("unexpected contents %q", got)
+		}
+	}
+
+	// Restoring a file renames it out of the trash.
+	err = fs.Rename("/.trash/"+names[0], "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fs, "/a.txt"); string(got) != "hello" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+}
+
+func TestTrashVFSRenameOver(t *testing.T) {
+	fs := &vfs.TrashVFS{Fs: mem.New(), Dir: "/.trash"}
+
+	writeAll(t, fs, "/a.txt", []byte("old"))
+	writeAll(t, fs, "/b.txt", []byte("new"))
+	err := fs.Rename("/b.txt", "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fs, "/a.txt"); string(got) != "new" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	names := listDir(t, fs, "/.trash")
+	if len(names) != 1 || !strings.HasPrefix(names[0], "a.txt.") {
+		t.Fatalf("unexpected trash contents %v", names)
+	}
+	if got := readAll(t, fs, "/.trash/"+names[0]); string(got) != "old" {
+		t.Fatalf("replaced file not kept, got %q", got)
+	}
+
+	writeAll(t, fs, "/c.txt", []byte("older"))
+	writeAll(t, fs, "/d.txt", []byte("newer"))
+	err = fs.RenameBatch([]vfs.Rename{{From: "/d.txt", To: "/c.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listDir(t, fs, "/.trash"); len(names) != 2 {
+		t.Fatalf("replaced file not kept by batch rename: %v", names)
+	}
+
+	// A failed rename does not trash its target.
+	err = fs.Rename("/missing", "/a.txt")
+	if err == nil {
+		t.Fatal("expected renaming a missing file to fail")
+	}
+	if got := readAll(t, fs, "/a.txt"); string(got) != "new" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+}
+
+func TestTrashVFSProtected(t *testing.T) {
+	fs := &vfs.TrashVFS{Fs: mem.New(), Dir: "/.trash"}
+
+	writeAll(t, fs, "/a.txt", []byte("hello"))
+	err := fs.Remove("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashed := "/.trash/" + listDir(t, fs, "/.trash")[0]
+	writeAll(t, fs, "/b.txt", []byte("other"))
+
+	for _, tc := range []struct {
+		op string
+		fn func() error
+	}{
+		{"remove", func() error { return fs.Remove(trashed) }},
+		{"remove dir", func() error { return fs.Remove("/.trash") }},
+		{"remove batch", func() error { return fs.RemoveBatch([]string{trashed}) }},
+		{"rename over", func() error { return fs.Rename("/b.txt", trashed) }},
+		{"rename dir", func() error { return fs.Rename("/.trash", "/t") }},
+		{"truncate", func() error {
+			f, err := fs.OpenFile(trashed, os.O_WRONLY|os.O_TRUNC, 0)
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}},
+		{"create", func() error {
+			f, err := fs.OpenFile("/.trash/new", os.O_WRONLY|os.O_CREATE, 0644)
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}},
+		{"mkdir", func() error { return fs.Mkdir("/.trash/d", 0755) }},
+		{"chmod", func() error { return fs.Chmod(trashed, 0644) }},
+	} {
+		if err := tc.fn(); err != os.ErrPermission {
+			t.Fatalf("%s: expected os.ErrPermission, got %v", tc.op, err)
+		}
+	}
+	if got := readAll(t, fs, trashed); string(got) != "hello" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+}
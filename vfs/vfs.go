@@ -1,10 +1,39 @@
 package vfs
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"time"
 )
 
+var (
+	ErrUnsupported   = errors.New("unsupported operation")
+	ErrQuotaExceeded = errors.New("file size limit exceeded")
+	ErrCorrupt       = errors.New("file data is corrupt or was tampered with")
+)
+
+// A StatusError lets a file system choose the sftp status code and
+// message clients are sent for an error, where the server would
+// otherwise guess from the os errors it recognises. Err is the error
+// it stands for, if any, so errors.Is still matches it.
+type StatusError struct {
+	// One of the FX_ codes of package sftp/protosftp.
+	Code uint32
+	Msg  string
+	Err  error
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
 type File interface {
 	Name() string
 	Chmod(mode os.FileMode) error
@@ -15,6 +44,7 @@ type File interface {
 	Write(buf []byte) (int, error)
 	WriteAt(buf []byte, off int64) (int, error)
 	Stat() (os.FileInfo, error)
+	Sync() error
 	Close() error
 }
 
@@ -26,9 +56,138 @@ type VFS interface {
 	Stat(path string) (os.FileInfo, error)
 	Rename(from, to string) error
 	Remove(path string) error
+	Link(oldname, newname string) error
 	Close() error
 }
 
+// Implemented by file systems that can checksum a whole file
+// without transferring its contents, e.g. using hashes stored
+// by the backend. ChecksumAlgorithms lists the algorithms that can be
+// computed natively, Checksum returns ErrUnsupported for any other.
+type Checksummer interface {
+	Checksum(path string, algorithm string) ([]byte, error)
+	ChecksumAlgorithms() []string
+}
+
+// The algorithms fs can checksum natively, none unless it is a Checksummer.
+func ChecksumAlgorithms(fs VFS) []string {
+	if cs, ok := fs.(Checksummer); ok {
+		return cs.ChecksumAlgorithms()
+	}
+	return nil
+}
+
+// Implemented by file systems that can set the access and
+// modification times of files, e.g. to preserve the times of
+// uploaded files. Backends that can only set them while a file
+// is being written return ErrUnsupported for other files.
+type Chtimeser interface {
+	Chtimes(path string, atime time.Time, mtime time.Time) error
+}
+
+// Implemented by file systems that can remove or rename many paths
+// with fewer calls than one per path, e.g. to remove directory trees
+// without being rate limited. Batches are not atomic, some of the
+// paths may have been changed when an error is returned.
+type Batcher interface {
+	RemoveBatch(paths []string) error
+	RenameBatch(renames []Rename) error
+}
+
+// A rename in a batch.
+type Rename struct {
+	From string
+	To   string
+}
+
+// Remove paths in one batch if fs is a Batcher,
+// or one at a time if it is not.
+func RemoveBatch(fs VFS, paths []string) error {
+	if b, ok := fs.(Batcher); ok {
+		return b.RemoveBatch(paths)
+	}
+	for _, p := range paths {
+		err := fs.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename paths in one batch if fs is a Batcher,
+// or one at a time if it is not.
+func RenameBatch(fs VFS, renames []Rename) error {
+	if b, ok := fs.(Batcher); ok {
+		return b.RenameBatch(renames)
+	}
+	for _, r := range renames {
+		err := fs.Rename(r.From, r.To)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Implemented by file systems that can name the owner
+// and group of files they return.
+type OwnerLookuper interface {
+	LookupOwner(fi os.FileInfo) (owner string, group string, ok bool)
+}
+
+// Implemented by file systems where paths other than the clean path
+// lead to a file, e.g. through symbolic links or names matched
+// ignoring case. RealPath returns the path of the file p leads to,
+// resolving what it can of a path that does not exist, and an error
+// wrapping syscall.ELOOP if symbolic links loop.
+type RealPather interface {
+	RealPath(p string) (string, error)
+}
+
+// The real path of p if fs is a RealPather,
+// or p cleaned if it is not.
+func RealPath(fs VFS, p string) (string, error) {
+	if rp, ok := fs.(RealPather); ok {
+		return rp.RealPath(p)
+	}
+	return path.Clean(p), nil
+}
+
+// Implemented by file systems that can append, where Write on a file
+// opened with os.O_APPEND writes at the end of the file, even once
+// others have written to it. Others may only write at the offsets
+// given, so appends are made at the end of the file as last seen.
+type Appender interface {
+	AppendSupported() bool
+}
+
+// Whether fs is an Appender that supports appending.
+func AppendSupported(fs VFS) bool {
+	if a, ok := fs.(Appender); ok {
+		return a.AppendSupported()
+	}
+	return false
+}
+
+// Implemented by file systems that can abort slow operations, e.g.
+// requests to a remote service. WithContext returns a view of the
+// file system whose operations, including those on files it opens,
+// are aborted once ctx is done. The view shares any state, such as
+// caches, with the file system it came from.
+type ContextVFS interface {
+	WithContext(ctx context.Context) VFS
+}
+
+// A view of fs bound to ctx if fs is a ContextVFS,
+// or fs itself if it is not.
+func WithContext(fs VFS, ctx context.Context) VFS {
+	if c, ok := fs.(ContextVFS); ok {
+		return c.WithContext(ctx)
+	}
+	return fs
+}
+
 type NewVFSFunc func(string) (VFS, error)
 
 func Open(engineName, params string) (VFS, error) {
@@ -103,6 +262,50 @@ func (rofs *ReadOnlyVFS) Remove(path string) error {
 	return os.ErrPermission
 }
 
+func (rofs *ReadOnlyVFS) Link(oldname, newname string) error {
+	return os.ErrPermission
+}
+
+func (rofs *ReadOnlyVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := rofs.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return cs.Checksum(path, algorithm)
+}
+
+func (rofs *ReadOnlyVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(rofs.Fs)
+}
+
+func (rofs *ReadOnlyVFS) RealPath(p string) (string, error) {
+	return RealPath(rofs.Fs, p)
+}
+
+func (rofs *ReadOnlyVFS) RemoveBatch(paths []string) error {
+	return os.ErrPermission
+}
+
+func (rofs *ReadOnlyVFS) RenameBatch(renames []Rename) error {
+	return os.ErrPermission
+}
+
+func (rofs *ReadOnlyVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return os.ErrPermission
+}
+
+func (rofs *ReadOnlyVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := rofs.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (rofs *ReadOnlyVFS) WithContext(ctx context.Context) VFS {
+	return &ReadOnlyVFS{Fs: WithContext(rofs.Fs, ctx)}
+}
+
 func (rofs *ReadOnlyVFS) Close() error {
 	return rofs.Fs.Close()
 }
@@ -147,6 +350,10 @@ func (rof *ReadOnlyFile) Stat() (os.FileInfo, error) {
 	return rof.F.Stat()
 }
 
+func (rof *ReadOnlyFile) Sync() error {
+	return rof.F.Sync()
+}
+
 func (rof *ReadOnlyFile) Close() error {
 	return rof.F.Close()
 }
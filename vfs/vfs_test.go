@@ -0,0 +1,96 @@
+package vfs_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+func TestBatchFallback(t *testing.T) {
+	base := mem.New()
+	err := base.Mkdir("/root", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wrappers batch through to backends without batches.
+	var fs vfs.VFS = &vfs.ChrootVFS{Fs: base, Root: "/root"}
+
+	writeAll(t, fs, "/a", []byte("a"))
+	writeAll(t, fs, "/b", []byte("b"))
+	err = vfs.RenameBatch(fs, []vfs.Rename{{From: "/a", To: "/c"}, {From: "/b", To: "/d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listDir(t, fs, "/"); fmt.Sprint(names) != "[c d]" {
+		t.Fatalf("unexpected names after renames %v", names)
+	}
+
+	err = vfs.RemoveBatch(fs, []string{"/c", "/d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listDir(t, fs, "/"); len(names) != 0 {
+		t.Fatalf("unexpected names after removes %v", names)
+	}
+
+	err = vfs.RemoveBatch(fs, []string{"/missing"})
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+}
+
+// A backend recording the context it was bound to.
+type contextFs struct {
+	*mem.Fs
+	ctx context.Context
+}
+
+func (c *contextFs) WithContext(ctx context.Context) vfs.VFS {
+	return &contextFs{Fs: c.Fs, ctx: ctx}
+}
+
+func TestWithContext(t *testing.T) {
+	base := mem.New()
+	if vfs.WithContext(base, context.Background()) != base {
+		t.Fatal("expected file systems without contexts to be returned as they are")
+	}
+
+	backend := &contextFs{Fs: base}
+	readOnly := &vfs.ReadOnlyVFS{Fs: backend}
+	chroot := &vfs.ChrootVFS{Fs: readOnly, Root: "/"}
+	throttle := &vfs.ThrottleVFS{Fs: chroot, MaxConcurrent: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	view := vfs.WithContext(&vfs.StatCacheVFS{Fs: throttle}, ctx)
+
+	// Wrappers pass the context through to the backend,
+	// leaving the file system they were made from as it was.
+	inner := view.(*vfs.StatCacheVFS).Fs.(*vfs.ThrottleVFS).Fs.(*vfs.ChrootVFS).Fs.(*vfs.ReadOnlyVFS).Fs
+	if inner.(*contextFs).ctx != ctx {
+		t.Fatal("expected the backend to be bound to the context")
+	}
+	if backend.ctx != nil || chroot.Fs != readOnly || throttle.Fs != chroot {
+		t.Fatal("expected the original file system to be unchanged")
+	}
+
+	// Views share the state of their wrapper, here the cache.
+	writeAll(t, base, "/a", []byte("a"))
+	cache := &vfs.StatCacheVFS{Fs: base, TTL: time.Hour}
+	_, err := vfs.WithContext(cache, ctx).Stat("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = base.Remove("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.Stat("/a")
+	if err != nil {
+		t.Fatal("expected the view and its wrapper to share the cache")
+	}
+}
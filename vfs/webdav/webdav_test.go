@@ -0,0 +1,222 @@
+package webdav
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+
+	xwebdav "golang.org/x/net/webdav"
+)
+
+func testFs(t *testing.T) (*Fs, func()) {
+	t.Helper()
+	srv := httptest.NewServer(&xwebdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: xwebdav.NewMemFS(),
+		LockSystem: xwebdav.NewMemLS(),
+	})
+	u, err := url.Parse(srv.URL + "/dav/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Fs{URL: u, Client: srv.Client()}, srv.Close
+}
+
+func writeFile(t *testing.T, fs *Fs, p, data string) {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs *Fs, p string) string {
+	t.Helper()
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReadWrite(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+
+	writeFile(t, fs, "/a.txt", "hello world")
+	if got := readFile(t, fs, "/a.txt"); got != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+
+	fi, err := fs.Stat("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 11 || fi.IsDir() || fi.Name() != "a.txt" {
+		t.Fatalf("bad stat %s %d %v", fi.Name(), fi.Size(), fi.IsDir())
+	}
+
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	n, err := f.ReadAt(buf, 6)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("ReadAt: %q %v", buf[:n], err)
+	}
+	_, err = f.ReadAt(buf, 20)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+
+	f, err := fs.OpenFile("/empty", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat("/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("expected empty file, got %d bytes", fi.Size())
+	}
+}
+
+func TestNonSequentialWrite(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+
+	f, err := fs.OpenFile("/f", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt([]byte("x"), 10)
+	if err != ErrBadReadWriteOffset {
+		t.Fatalf("expected ErrBadReadWriteOffset, got %v", err)
+	}
+}
+
+func TestDirs(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+
+	err := fs.Mkdir("/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Mkdir("/d", 0755)
+	if err != os.ErrExist {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+	err = fs.Mkdir("/missing/d", 0755)
+	if err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	writeFile(t, fs, "/d/b", "b")
+	writeFile(t, fs, "/d/a", "a")
+	err = fs.Mkdir("/d/sub", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	for {
+		batch, err := f.Readdirnames(2)
+		names = append(names, batch...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "sub" {
+		t.Fatalf("bad listing %v", names)
+	}
+
+	err = fs.Remove("/d")
+	if err != ErrNotEmpty {
+		t.Fatalf("expected ErrNotEmpty, got %v", err)
+	}
+}
+
+func TestRenameRemove(t *testing.T) {
+	fs, done := testFs(t)
+	defer done()
+
+	writeFile(t, fs, "/a", "a")
+	writeFile(t, fs, "/b", "b")
+	err := fs.Rename("/a", "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/b"); got != "a" {
+		t.Fatalf("got %q", got)
+	}
+	_, err = fs.Stat("/a")
+	if err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	err = fs.Remove("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Remove("/b")
+	if err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestFactory(t *testing.T) {
+	_, err := vfsFactory("ftp://example.com/")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	os.Setenv("SFTPPLEASE_WEBDAV_PASSWORD", "secret")
+	defer os.Unsetenv("SFTPPLEASE_WEBDAV_PASSWORD")
+	v, err := vfsFactory("https://bob@example.com/dav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := v.(*Fs)
+	if fs.Username != "bob" || fs.Password != "secret" || fs.URL.User != nil {
+		t.Fatalf("bad credentials %q %q", fs.Username, fs.Password)
+	}
+}
@@ -0,0 +1,220 @@
+package vfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// WriteOnceVFS allows new files to be created and written, but once a file
+// has been closed its contents can never change. Opening existing files
+// for writing, changing their permissions, removing them and renaming
+// over them all fail with os.ErrPermission. Renaming files would let new
+// content take their place, so only directories with no files below them
+// may be renamed. Empty directories may be removed, including on file
+// systems that would remove a directory with everything in it.
+type WriteOnceVFS struct {
+	Fs VFS
+}
+
+func (w *WriteOnceVFS) exists(p string) bool {
+	_, err := w.Fs.Stat(p)
+	return err == nil
+}
+
+// Report if p is a file, or a directory with files below it.
+func (w *WriteOnceVFS) containsFiles(p string) (bool, error) {
+	fi, err := w.Fs.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	if !fi.IsDir() {
+		return true, nil
+	}
+	d, err := w.Fs.Open(p)
+	if err != nil {
+		return false, err
+	}
+	names, err := d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		found, err := w.containsFiles(path.Join(p, name))
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (w *WriteOnceVFS) checkRename(from, to string) error {
+	if w.exists(to) {
+		return os.ErrPermission
+	}
+	found, err := w.containsFiles(from)
+	if err != nil {
+		return err
+	}
+	if found {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (w *WriteOnceVFS) checkRemove(p string) error {
+	fi, err := w.Fs.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return os.ErrPermission
+	}
+	d, err := w.Fs.Open(p)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(1)
+	_ = d.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(names) != 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+	}
+	return nil
+}
+
+func (w *WriteOnceVFS) Chmod(name string, mode os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (w *WriteOnceVFS) Open(path string) (File, error) {
+	return w.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (w *WriteOnceVFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC) == 0 {
+		f, err := w.Fs.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &WriteOnceFile{File: f}, nil
+	}
+	if flag&os.O_CREATE == 0 || w.exists(name) {
+		return nil, os.ErrPermission
+	}
+	// Fail rather than write to a file created since the check.
+	f, err := w.Fs.OpenFile(name, flag|os.O_EXCL, perm)
+	if os.IsExist(err) || err == os.ErrExist {
+		return nil, os.ErrPermission
+	}
+	return f, err
+}
+
+func (w *WriteOnceVFS) Mkdir(path string, perm os.FileMode) error {
+	return w.Fs.Mkdir(path, perm)
+}
+
+func (w *WriteOnceVFS) Stat(path string) (os.FileInfo, error) {
+	return w.Fs.Stat(path)
+}
+
+func (w *WriteOnceVFS) Rename(from, to string) error {
+	err := w.checkRename(from, to)
+	if err != nil {
+		return err
+	}
+	return w.Fs.Rename(from, to)
+}
+
+func (w *WriteOnceVFS) Remove(path string) error {
+	err := w.checkRemove(path)
+	if err != nil {
+		return err
+	}
+	return w.Fs.Remove(path)
+}
+
+func (w *WriteOnceVFS) Link(oldname, newname string) error {
+	if w.exists(newname) {
+		return os.ErrPermission
+	}
+	return w.Fs.Link(oldname, newname)
+}
+
+func (w *WriteOnceVFS) Checksum(path string, algorithm string) ([]byte, error) {
+	cs, ok := w.Fs.(Checksummer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return cs.Checksum(path, algorithm)
+}
+
+func (w *WriteOnceVFS) ChecksumAlgorithms() []string {
+	return ChecksumAlgorithms(w.Fs)
+}
+
+func (w *WriteOnceVFS) RealPath(p string) (string, error) {
+	return RealPath(w.Fs, p)
+}
+
+func (w *WriteOnceVFS) AppendSupported() bool {
+	return AppendSupported(w.Fs)
+}
+
+func (w *WriteOnceVFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return os.ErrPermission
+}
+
+func (w *WriteOnceVFS) RemoveBatch(paths []string) error {
+	for _, p := range paths {
+		err := w.checkRemove(p)
+		if err != nil {
+			return err
+		}
+	}
+	return RemoveBatch(w.Fs, paths)
+}
+
+func (w *WriteOnceVFS) RenameBatch(renames []Rename) error {
+	for _, r := range renames {
+		err := w.checkRename(r.From, r.To)
+		if err != nil {
+			return err
+		}
+	}
+	return RenameBatch(w.Fs, renames)
+}
+
+func (w *WriteOnceVFS) LookupOwner(fi os.FileInfo) (string, string, bool) {
+	ol, ok := w.Fs.(OwnerLookuper)
+	if !ok {
+		return "", "", false
+	}
+	return ol.LookupOwner(fi)
+}
+
+func (w *WriteOnceVFS) WithContext(ctx context.Context) VFS {
+	return &WriteOnceVFS{Fs: WithContext(w.Fs, ctx)}
+}
+
+func (w *WriteOnceVFS) Close() error {
+	return w.Fs.Close()
+}
+
+// WriteOnceFile is an existing file opened for reading.
+type WriteOnceFile struct {
+	File
+}
+
+func (wf *WriteOnceFile) Chmod(mode os.FileMode) error {
+	return os.ErrPermission
+}
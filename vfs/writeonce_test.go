@@ -0,0 +1,124 @@
+package vfs_test
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/andrewchambers/sftpplease/vfs"
+	"github.com/andrewchambers/sftpplease/vfs/mem"
+)
+
+// A file system removing directories with everything in them, like
+// dropbox does.
+type recursiveRemoveFs struct {
+	*mem.Fs
+}
+
+func (fs *recursiveRemoveFs) Remove(p string) error {
+	fi, err := fs.Stat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		d, err := fs.Open(p)
+		if err != nil {
+			return err
+		}
+		names, err := d.Readdirnames(-1)
+		_ = d.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = fs.Remove(path.Join(p, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Fs.Remove(p)
+}
+
+func TestWriteOnceVFS(t *testing.T) {
+	fs := &vfs.WriteOnceVFS{Fs: mem.New()}
+
+	writeAll(t, fs, "/a", []byte("hello"))
+	writeAll(t, fs, "/b", []byte("world"))
+	if got := readAll(t, fs, "/a"); string(got) != "hello" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+
+	for _, flag := range []int{
+		os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+		os.O_RDWR,
+		os.O_WRONLY | os.O_APPEND,
+	} {
+		if _, err := fs.OpenFile("/a", flag, 0644); err != os.ErrPermission {
+			t.Fatalf("open flags %x: expected ErrPermission, got %v", flag, err)
+		}
+	}
+	if err := fs.Remove("/a"); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	if err := fs.Chmod("/a", 0600); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	if err := fs.Rename("/b", "/a"); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+
+	if err := fs.Rename("/b", "/c"); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/dir"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteOnceVFSDirectories(t *testing.T) {
+	fs := &vfs.WriteOnceVFS{Fs: &recursiveRemoveFs{Fs: mem.New()}}
+	for _, dir := range []string{"/dir", "/dir/sub", "/empty", "/empty/sub"} {
+		if err := fs.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeAll(t, fs, "/dir/sub/a", []byte("hello"))
+
+	if err := fs.Remove("/dir"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("expected removing a non empty directory to fail, got %v", err)
+	}
+	if err := fs.RemoveBatch([]string{"/dir/sub"}); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("expected removing a non empty directory to fail, got %v", err)
+	}
+	if got := readAll(t, fs, "/dir/sub/a"); string(got) != "hello" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+
+	// Moving a file aside would let another take its place.
+	if err := fs.Rename("/dir/sub/a", "/dir/sub/b"); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	if err := fs.Rename("/dir", "/other"); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	if err := fs.RenameBatch([]vfs.Rename{{From: "/dir/sub", To: "/sub"}}); err != os.ErrPermission {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+
+	// Directories without files may be moved and removed.
+	if err := fs.Rename("/empty", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/moved/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/moved"); err != nil {
+		t.Fatal(err)
+	}
+}